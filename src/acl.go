@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+/*
+commandClass groups commands for access control
+*/
+type commandClass int
+
+const (
+	classNone commandClass = iota
+	classRead
+	classWrite
+	classAdmin
+)
+
+var commandClassNames = map[string]commandClass{
+	"read":  classRead,
+	"write": classWrite,
+	"admin": classAdmin,
+}
+
+/*
+commandClasses maps protocol commands to their class. Commands not listed
+(quit, version, verbosity, auth) are available to everyone
+*/
+var commandClasses = map[string]commandClass{
+	"get":        classRead,
+	"gets":       classRead,
+	"range":      classRead,
+	"watch":      classRead,
+	"subscribe":  classRead,
+	"psubscribe": classRead,
+	"hget":       classRead,
+	"hgetall":    classRead,
+	"hkeys":      classRead,
+	"set":        classWrite,
+	"add":        classWrite,
+	"replace":    classWrite,
+	"delete":     classWrite,
+	"publish":    classWrite,
+	"lock":       classWrite,
+	"renew":      classWrite,
+	"unlock":     classWrite,
+	"hset":       classWrite,
+	"hdel":       classWrite,
+	"hincrby":    classWrite,
+	"flush_all":  classAdmin,
+	"switchdb":   classAdmin,
+	"dbstats":    classAdmin,
+	"backup":     classAdmin,
+	"migrate":    classAdmin,
+	"replicate":  classAdmin,
+	"cluster":    classAdmin,
+}
+
+type aclContextKey struct{}
+
+/*
+aclUser is an authenticated principal: allowed command classes and key prefixes
+*/
+type aclUser struct {
+	name     string
+	token    string
+	classes  map[commandClass]bool
+	prefixes []string
+}
+
+/*
+ACL holds the users loaded from the acl file
+*/
+type ACL struct {
+	users map[string]*aclUser
+}
+
+/*
+loadACL reads an acl file. One user per line:
+
+	<user> <token> <read,write,admin> <prefix,prefix|*>
+
+a token of "-" disables token auth for the user (client certificate only).
+Empty lines and lines starting with # are ignored
+*/
+func loadACL(filename string) (*ACL, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	acl := ACL{users: make(map[string]*aclUser)}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("%s:%d: expected user, token, classes and prefixes", filename, n)
+		}
+		u := aclUser{name: fields[0], token: fields[1], classes: make(map[commandClass]bool)}
+		if u.token == "-" {
+			u.token = ""
+		}
+		for _, c := range strings.Split(fields[2], ",") {
+			class, ok := commandClassNames[c]
+			if !ok {
+				return nil, fmt.Errorf("%s:%d: unknown command class %s", filename, n, c)
+			}
+			u.classes[class] = true
+		}
+		if fields[3] != "*" {
+			u.prefixes = strings.Split(fields[3], ",")
+		}
+		acl.users[u.name] = &u
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &acl, nil
+}
+
+/*
+Authenticate checks user and token, returns nil if they don't match
+*/
+func (acl *ACL) Authenticate(name string, token string) *aclUser {
+	u, ok := acl.users[name]
+	if !ok || u.token == "" {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(u.token), []byte(token)) != 1 {
+		return nil
+	}
+	return u
+}
+
+/*
+UserByToken finds the user owning a bearer token
+*/
+func (acl *ACL) UserByToken(token string) *aclUser {
+	for _, u := range acl.users {
+		if u.token != "" && subtle.ConstantTimeCompare([]byte(u.token), []byte(token)) == 1 {
+			return u
+		}
+	}
+	return nil
+}
+
+/*
+UserByIdentity maps a client certificate CN to a user
+*/
+func (acl *ACL) UserByIdentity(identity string) *aclUser {
+	if identity == "" {
+		return nil
+	}
+	return acl.users[identity]
+}
+
+/*
+Allowed checks if the user may run a command of class on all keys
+*/
+func (u *aclUser) Allowed(class commandClass, keys []string) bool {
+	if class == classNone {
+		return true
+	}
+	if u == nil || !u.classes[class] {
+		return false
+	}
+	if u.prefixes == nil {
+		return true
+	}
+	for _, k := range keys {
+		if !u.allowedKey(k) {
+			return false
+		}
+	}
+	return true
+}
+
+func (u *aclUser) allowedKey(key string) bool {
+	for _, p := range u.prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+authorizeHTTP wraps an API handler with bearer token or client certificate authentication
+*/
+func authorizeHTTP(acl *ACL, class commandClass, handler http.HandlerFunc) http.HandlerFunc {
+	if acl == nil {
+		return handler
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		u := acl.UserByIdentity(requestIdentity(req))
+		if auth := req.Header.Get("Authorization"); u == nil && strings.HasPrefix(auth, "Bearer ") {
+			u = acl.UserByToken(strings.TrimPrefix(auth, "Bearer "))
+		}
+		if u == nil {
+			authFailures.Inc(1)
+			http.Error(w, "401 Unauthorized", 401)
+			return
+		}
+		if !u.Allowed(class, nil) {
+			aclDenials.Inc(1)
+			log.Error("ACL: user %s denied on %s", u.name, req.URL.Path)
+			http.Error(w, "403 Forbidden", 403)
+			return
+		}
+		handler(w, req.WithContext(context.WithValue(req.Context(), aclContextKey{}, u)))
+	}
+}
+
+/*
+requestUser returns the name of the user authorized by authorizeHTTP
+*/
+func requestUser(req *http.Request) string {
+	if u, ok := req.Context().Value(aclContextKey{}).(*aclUser); ok {
+		return u.name
+	}
+	return requestIdentity(req)
+}
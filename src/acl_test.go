@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func loadTestACL(t *testing.T) *ACL {
+	f, _ := ioutil.TempFile("", "beano_acl")
+	defer os.Remove(f.Name())
+	f.WriteString("# user token classes prefixes\n")
+	f.WriteString("app s3cret read,write app:,shared:\n")
+	f.WriteString("ops 0ps read,write,admin *\n")
+	f.WriteString("clapton - read *\n")
+	f.Close()
+	acl, err := loadACL(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return acl
+}
+
+func TestACLAuthenticate(t *testing.T) {
+	acl := loadTestACL(t)
+	if u := acl.Authenticate("app", "s3cret"); u == nil {
+		t.Error(errUnexpected(u))
+	}
+	if u := acl.Authenticate("app", "wrong"); u != nil {
+		t.Error(errUnexpected(u))
+	}
+	if u := acl.Authenticate("clapton", ""); u != nil {
+		t.Error(errUnexpected(u))
+	}
+	if u := acl.UserByToken("0ps"); u == nil || u.name != "ops" {
+		t.Error(errUnexpected(u))
+	}
+	if u := acl.UserByIdentity("clapton"); u == nil {
+		t.Error(errUnexpected(u))
+	}
+}
+
+func TestACLAllowed(t *testing.T) {
+	acl := loadTestACL(t)
+	app := acl.users["app"]
+	if !app.Allowed(classWrite, []string{"app:beano"}) {
+		t.Error(errUnexpected("app write on app:beano denied"))
+	}
+	if app.Allowed(classRead, []string{"app:beano", "other:beano"}) {
+		t.Error(errUnexpected("app read on other:beano allowed"))
+	}
+	if app.Allowed(classAdmin, nil) {
+		t.Error(errUnexpected("app admin allowed"))
+	}
+	if !acl.users["ops"].Allowed(classAdmin, nil) {
+		t.Error(errUnexpected("ops admin denied"))
+	}
+	// the limit of a range isn't a key
+	if !app.Allowed(classRead, commandKeys("gets", []string{"gets", "app:", "10"})) {
+		t.Error(errUnexpected("app gets on app: denied"))
+	}
+	var anonymous *aclUser
+	if anonymous.Allowed(classRead, []string{"app:beano"}) {
+		t.Error(errUnexpected("anonymous read allowed"))
+	}
+	if !anonymous.Allowed(classNone, nil) {
+		t.Error(errUnexpected("anonymous version denied"))
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+auditLog records admin commands with timestamp, client address and user
+*/
+type auditLog struct {
+	out       io.Writer
+	auditLock *sync.Mutex
+}
+
+/*
+newAuditLog appends to filename. An empty filename audits to stdout
+*/
+func newAuditLog(filename string) (*auditLog, error) {
+	var out io.Writer = os.Stdout
+	if filename != "" {
+		f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		out = f
+	}
+	return &auditLog{out: out, auditLock: &sync.Mutex{}}, nil
+}
+
+/*
+Record writes one audit line. A nil auditLog records nothing
+*/
+func (al *auditLog) Record(client string, user string, listener string, command ...string) {
+	if al == nil {
+		return
+	}
+	if user == "" {
+		user = "-"
+	}
+	al.auditLock.Lock()
+	defer al.auditLock.Unlock()
+	fmt.Fprintf(al.out, "%s AUDIT client=%s user=%s listener=%s command=%q\n",
+		time.Now().Format(time.RFC3339Nano), client, user, listener, strings.Join(command, " "))
+}
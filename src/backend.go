@@ -21,3 +21,53 @@ type BackendDatabase interface {
 	Flush() error
 	BucketStats() error
 }
+
+/*
+backendWrapper is implemented by layers stacked on top of another backend
+(cache, filters, ...) to reach the wrapped one
+*/
+type backendWrapper interface {
+	Unwrap() BackendDatabase
+}
+
+/*
+KeyScanner is implemented by backends able to walk all their keys, used to
+build key filters
+*/
+type KeyScanner interface {
+	ScanKeys(fn func(key []byte) error) error
+}
+
+/*
+findSyncer walks down the wrapper chain looking for a backend that can fsync
+*/
+func findSyncer(vdb BackendDatabase) (Syncer, bool) {
+	for vdb != nil {
+		if s, ok := vdb.(Syncer); ok {
+			return s, true
+		}
+		w, ok := vdb.(backendWrapper)
+		if !ok {
+			break
+		}
+		vdb = w.Unwrap()
+	}
+	return nil, false
+}
+
+/*
+findKeyScanner walks down the wrapper chain looking for a backend that can list its keys
+*/
+func findKeyScanner(vdb BackendDatabase) (KeyScanner, bool) {
+	for vdb != nil {
+		if s, ok := vdb.(KeyScanner); ok {
+			return s, true
+		}
+		w, ok := vdb.(backendWrapper)
+		if !ok {
+			break
+		}
+		vdb = w.Unwrap()
+	}
+	return nil, false
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// backupVersion is written in the backup header, bump it when a format changes
+const backupVersion = 1
+
+/*
+Backuper is implemented by backends able to write a consistent snapshot of
+themselves while serving requests
+*/
+type Backuper interface {
+	Backup(w io.Writer) error
+	BackendName() string
+}
+
+/*
+findBackuper walks down the wrapper chain looking for a backend that can back up.
+Wrappers don't change the stored data so the snapshot is the raw backend one
+*/
+func findBackuper(vdb BackendDatabase) (Backuper, bool) {
+	for vdb != nil {
+		if b, ok := vdb.(Backuper); ok {
+			return b, true
+		}
+		w, ok := vdb.(backendWrapper)
+		if !ok {
+			break
+		}
+		vdb = w.Unwrap()
+	}
+	return nil, false
+}
+
+/*
+writeBackup writes the header line followed by the backend native snapshot:
+
+	BEANO-BACKUP <version> <backend>\n
+*/
+func writeBackup(b Backuper, w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "BEANO-BACKUP %d %s\n", backupVersion, b.BackendName()); err != nil {
+		return err
+	}
+	return b.Backup(w)
+}
+
+/*
+backupToDir writes a snapshot of vdb to a new file in dir, one file per shard
+for sharded backends. Returns the files written
+*/
+func backupToDir(vdb BackendDatabase, dir string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	name := filepath.Join(dir, fmt.Sprintf("beano-%s.backup", time.Now().UTC().Format("20060102T150405.000Z")))
+
+	for w := vdb; w != nil; {
+		if sb, ok := w.(*shardedBackend); ok {
+			var files []string
+			for i, shard := range sb.shards {
+				file := shardPath(name, i)
+				if err := backupToFile(shard, file); err != nil {
+					return files, err
+				}
+				files = append(files, file)
+			}
+			return files, nil
+		}
+		u, ok := w.(backendWrapper)
+		if !ok {
+			break
+		}
+		w = u.Unwrap()
+	}
+	if err := backupToFile(vdb, name); err != nil {
+		return nil, err
+	}
+	return []string{name}, nil
+}
+
+/*
+backupToFile writes the snapshot to a temporary file renamed once complete
+*/
+func backupToFile(vdb BackendDatabase, filename string) error {
+	b, ok := findBackuper(vdb)
+	if !ok {
+		return fmt.Errorf("Backup not supported by %s", vdb.GetDbPath())
+	}
+	start := time.Now()
+	tmp := filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	err = writeBackup(b, bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	log.Info("Backup of %s to %s done in %s", vdb.GetDbPath(), filename, time.Since(start))
+	return os.Rename(tmp, filename)
+}
+
+/*
+restoreBackup loads the backup file into a new database at filename, before
+the server opens it. Sharded databases restore <file>.shardN into each shard
+*/
+func restoreBackup(backend string, file string, filename string, shards int) error {
+	if shards > 1 {
+		for i := 0; i < shards; i++ {
+			if err := restoreBackup(backend, shardPath(file, i), shardPath(filename, i), 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if _, err := os.Stat(filename); err == nil {
+		return fmt.Errorf("Restore target %s already exists", filename)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	header, err := r.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("%s: not a backup file", file)
+	}
+	var version int
+	var name string
+	if n, _ := fmt.Sscanf(header, "BEANO-BACKUP %d %s\n", &version, &name); n != 2 || version != backupVersion {
+		return fmt.Errorf("%s: unknown backup format %s", file, strings.TrimSpace(header))
+	}
+	if name != backend {
+		return fmt.Errorf("%s is a %s backup, not %s", file, name, backend)
+	}
+
+	switch backend {
+	case "boltdb":
+		err = restoreFile(r, filename)
+	case "badger":
+		var b *badgerBackend
+		b, err = NewBadgerBackend(filename, durabilitySync, 0)
+		if err == nil {
+			err = b.db.Load(r)
+			b.Close()
+		}
+	case "leveldb":
+		err = restoreLevelDB(r, filename)
+	default:
+		err = fmt.Errorf("Restore not supported by %s", backend)
+	}
+	if err != nil {
+		os.RemoveAll(filename)
+		return fmt.Errorf("Restoring %s: %s", file, err)
+	}
+	// a key filter saved by an older database at this path would hide restored keys
+	os.Remove(filename + ".keyfilter")
+	log.Info("Restored %s from %s", filename, file)
+	return nil
+}
+
+func restoreFile(r io.Reader, filename string) error {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+/*
+Backup writes the leveldb snapshot as a sequence of
+<uvarint key size> <key> <uvarint value size> <value>, ended by an empty key
+*/
+func (be LevelDBBackend) Backup(w io.Writer) error {
+	snap, err := be.db.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+	it := snap.NewIterator(nil, be.ro)
+	defer it.Release()
+	size := make([]byte, binary.MaxVarintLen64)
+	for it.Next() {
+		for _, b := range [][]byte{it.Key(), it.Value()} {
+			if _, err := w.Write(size[:binary.PutUvarint(size, uint64(len(b)))]); err != nil {
+				return err
+			}
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+		}
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	_, err = w.Write([]byte{0})
+	return err
+}
+
+/*
+BackendName names the backup format
+*/
+func (be LevelDBBackend) BackendName() string {
+	return "leveldb"
+}
+
+func restoreLevelDB(r *bufio.Reader, filename string) error {
+	l, err := NewLevelDBBackend(filename)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	readBytes := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, err
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(r, b)
+		return b, err
+	}
+	batch := new(leveldb.Batch)
+	for {
+		key, err := readBytes()
+		if err != nil {
+			return err
+		}
+		if len(key) == 0 {
+			break
+		}
+		value, err := readBytes()
+		if err != nil {
+			return err
+		}
+		batch.Put(key, value)
+		if batch.Len() >= 1000 {
+			if err := l.db.Write(batch, nil); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	return l.db.Write(batch, nil)
+}
+
+/*
+Backup writes a copy of the bolt file from a read transaction
+*/
+func (be KVBoltDBBackend) Backup(w io.Writer) error {
+	return be.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
+/*
+BackendName names the backup format
+*/
+func (be KVBoltDBBackend) BackendName() string {
+	return "boltdb"
+}
+
+/*
+Backup writes a full badger backup
+*/
+func (be badgerBackend) Backup(w io.Writer) error {
+	_, err := be.db.Backup(w, 0)
+	return err
+}
+
+/*
+BackendName names the backup format
+*/
+func (be badgerBackend) BackendName() string {
+	return "badger"
+}
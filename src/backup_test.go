@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testBackupRestore(t *testing.T, backend string, vdb BackendDatabase, dir string) {
+	for i := 0; i < 100; i++ {
+		vdb.Set([]byte(fmt.Sprintf("backup%d", i)), []byte("clapton"))
+	}
+	files, err := backupToDir(vdb, filepath.Join(dir, "backups"))
+	if err != nil || len(files) != 1 {
+		t.Fatal(errUnexpected(err))
+	}
+	restored := filepath.Join(dir, "restored-"+backend)
+	if err := restoreBackup(backend, files[0], restored, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreBackup(backend, files[0], restored, 1); err == nil {
+		t.Error(errUnexpected("restored over an existing database"))
+	}
+	rdb, err := openBackend(backend, restored, dbOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdb.Close()
+	for i := 0; i < 100; i++ {
+		if v, err := rdb.Get([]byte(fmt.Sprintf("backup%d", i))); err != nil || string(v) != "clapton" {
+			t.Fatal(errUnexpected(fmt.Sprintf("%s backup%d: %s", backend, i, v)))
+		}
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beano-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, backend := range []string{"leveldb", "boltdb", "badger"} {
+		vdb, err := openBackend(backend, filepath.Join(dir, backend), dbOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		testBackupRestore(t, backend, vdb, dir)
+		vdb.Close()
+	}
+}
+
+func TestRestoreWrongBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beano-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files, err := backupToDir(vleveldb, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreBackup("boltdb", files[0], filepath.Join(dir, "restored"), 1); err == nil {
+		t.Error(errUnexpected("restored a leveldb backup into boltdb"))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "restored")); !os.IsNotExist(err) {
+		t.Error(errUnexpected(err))
+	}
+}
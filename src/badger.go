@@ -2,34 +2,82 @@ package main
 
 import (
 	"fmt"
+	"path/filepath"
 	"strconv"
-	"sync"
+	"time"
 
 	"github.com/dgraph-io/badger"
 )
 
 /*
-KVDBBackend is the KeyValue DB abstraction. Contains a Mutex to coordinate
-file changes
+KVDBBackend is the KeyValue DB abstraction. Contains striped locks to coordinate
+read-modify-write operations on the same key
 */
 type badgerBackend struct {
-	dirname string
-	db      *badger.DB
-	dbMutex *sync.RWMutex
+	dirname    string
+	db         *badger.DB
+	keyLocks   *stripedLock
+	coalescer  *writeCoalescer
+	durability *durability
 }
 
 /*
-NewbadgerBackend receives a dirname with path and creates a new Backend instance
+NewbadgerBackend receives a dirname with path and creates a new Backend instance.
+Badger only takes SyncWrites at open time so durability is set here
 */
-func NewBadgerBackend(dirname string) (*badgerBackend, error) {
+func NewBadgerBackend(dirname string, mode durabilityMode, interval time.Duration) (*badgerBackend, error) {
+	d := newDurability(mode, durabilitySync, interval)
 	opt := badger.DefaultOptions
 	opt.Dir = dirname
 	opt.ValueDir = dirname
+	opt.SyncWrites = d.mode == durabilitySync
 	kv, _ := badger.Open(opt)
-	b := badgerBackend{db: kv, dirname: dirname, dbMutex: &sync.RWMutex{}}
+	b := badgerBackend{db: kv, dirname: dirname, keyLocks: newStripedLock(), durability: d}
+	d.start(b)
 	return &b, nil
 }
 
+/*
+Sync fsyncs the value log, badger's write ahead log
+*/
+func (be badgerBackend) Sync() error {
+	return syncFiles(filepath.Join(be.dirname, "*.vlog"))
+}
+
+/*
+EnableGroupCommit batches plain sets and deletes issued within window into
+a single badger transaction of up to maxBatch writes
+*/
+func (be *badgerBackend) EnableGroupCommit(window time.Duration, maxBatch int) {
+	be.coalescer = newWriteCoalescer(window, maxBatch, be.commitBatch)
+}
+
+func (be badgerBackend) commitBatch(ops []*writeOp) error {
+	txn := be.db.NewTransaction(true)
+	for i := 0; i < len(ops); i++ {
+		var err error
+		if ops[i].delete {
+			err = txn.Delete(ops[i].key)
+		} else {
+			err = txn.Set(ops[i].key, ops[i].value)
+		}
+		if err == badger.ErrTxnTooBig {
+			// commit what fits and retry the op on a fresh transaction
+			if err := txn.Commit(nil); err != nil {
+				return err
+			}
+			txn = be.db.NewTransaction(true)
+			i--
+			continue
+		}
+		if err != nil {
+			txn.Discard()
+			return err
+		}
+	}
+	return txn.Commit(nil)
+}
+
 func (be badgerBackend) NormalizedGet(key []byte) ([]byte, error) {
 	var item *badger.Item
 	err := be.db.View(func(txn *badger.Txn) error {
@@ -84,8 +132,8 @@ func (be badgerBackend) Decr(key []byte, value uint) (int, error) {
 Increment - Generic get and set for incr/decr tx
 */
 func (be badgerBackend) Increment(key []byte, value int, createIfNotExists bool) (int, error) {
-	be.dbMutex.Lock()
-	defer be.dbMutex.Unlock()
+	be.keyLocks.Lock(key)
+	defer be.keyLocks.Unlock(key)
 
 	txn := be.db.NewTransaction(true)
 	defer txn.Discard()
@@ -127,11 +175,20 @@ func (be badgerBackend) Increment(key []byte, value int, createIfNotExists bool)
 }
 
 /*
-Put data checking if it should be replaced or exists. Passthru enforces the replacement check
+Put data checking if it should be replaced or exists. Passthru skips the
+replacement check and the key lock
 */
 func (be badgerBackend) Put(key []byte, value []byte, replace bool, passthru bool) error {
-	be.dbMutex.Lock()
-	defer be.dbMutex.Unlock()
+	if passthru == true {
+		if be.coalescer != nil {
+			return be.coalescer.Put(key, value)
+		}
+		return be.db.Update(func(txn *badger.Txn) error {
+			return txn.Set(key, value)
+		})
+	}
+	be.keyLocks.Lock(key)
+	defer be.keyLocks.Unlock(key)
 
 	err := be.db.Update(func(txn *badger.Txn) error {
 		keyExists := true
@@ -145,15 +202,13 @@ func (be badgerBackend) Put(key []byte, value []byte, replace bool, passthru boo
 			}
 		}
 
-		if passthru == false {
-			if replace == true {
-				if !keyExists {
-					return fmt.Errorf("Key %s do not exists, replace set to true - %s", string(key), err)
-				}
-			} else {
-				if keyExists {
-					return fmt.Errorf("Key %s exists, replace set to false - %s", string(key), err)
-				}
+		if replace == true {
+			if !keyExists {
+				return fmt.Errorf("Key %s do not exists, replace set to true - %s", string(key), err)
+			}
+		} else {
+			if keyExists {
+				return fmt.Errorf("Key %s exists, replace set to false - %s", string(key), err)
 			}
 		}
 
@@ -168,8 +223,6 @@ func (be badgerBackend) Put(key []byte, value []byte, replace bool, passthru boo
 Get data for key
 */
 func (be badgerBackend) Get(key []byte) ([]byte, error) {
-	be.dbMutex.RLock()
-	defer be.dbMutex.RUnlock()
 	v, err := be.NormalizedGet(key)
 	return v, err
 }
@@ -178,19 +231,24 @@ func (be badgerBackend) Get(key []byte) ([]byte, error) {
 Range query by key prefix. If limit == -1 no limit is applyed. Take care
 */
 func (be badgerBackend) Range(keyPrefix []byte, limit int, from []byte, reverse bool) (map[string][]byte, error) {
-	be.dbMutex.RLock()
-	defer be.dbMutex.RUnlock()
-	var counter int
-
 	ret := make(map[string][]byte)
 	itrOpt := badger.DefaultIteratorOptions
 	itrOpt.PrefetchSize = 100
 	itrOpt.Reverse = reverse
 
+	// forward iteration seeks to the first key >= start, reverse to the last key <= start
+	start := from
+	if start == nil && reverse == true {
+		start = append(append([]byte{}, keyPrefix...), 0xff)
+	} else if start == nil {
+		start = keyPrefix
+	}
+
 	err := be.db.View(func(txn *badger.Txn) error {
 		itr := txn.NewIterator(itrOpt)
-		counter = 0
-		for itr.Rewind(); itr.ValidForPrefix(keyPrefix); itr.Next() {
+		defer itr.Close()
+		itr.Seek(start)
+		for l := 1; itr.ValidForPrefix(keyPrefix); itr.Next() {
 			item := itr.Item()
 			k := string(item.Key())
 			v, err := item.Value()
@@ -199,10 +257,10 @@ func (be badgerBackend) Range(keyPrefix []byte, limit int, from []byte, reverse
 			}
 			ret[k] = make([]byte, len(v))
 			copy(ret[k], v)
-			if limit >= 0 && counter == limit {
+			if limit >= 0 && limit == l {
 				break
 			}
-			counter++
+			l++
 		}
 
 		return nil
@@ -211,13 +269,36 @@ func (be badgerBackend) Range(keyPrefix []byte, limit int, from []byte, reverse
 	return ret, err
 }
 
+/*
+ScanKeys calls fn for every key in the database, stopping at the first error.
+Values are not fetched
+*/
+func (be badgerBackend) ScanKeys(fn func(key []byte) error) error {
+	itrOpt := badger.DefaultIteratorOptions
+	itrOpt.PrefetchValues = false
+	return be.db.View(func(txn *badger.Txn) error {
+		itr := txn.NewIterator(itrOpt)
+		defer itr.Close()
+		for itr.Rewind(); itr.Valid(); itr.Next() {
+			if err := fn(itr.Item().Key()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 /*
 Delete key, optional check to see if it exists.
 Returns deleted boolean and error
 */
 func (be badgerBackend) Delete(key []byte, onlyIfExists bool) (bool, error) {
-	be.dbMutex.Lock()
-	defer be.dbMutex.Unlock()
+	if onlyIfExists == true {
+		be.keyLocks.Lock(key)
+		defer be.keyLocks.Unlock(key)
+	} else if be.coalescer != nil {
+		return true, be.coalescer.Delete(key)
+	}
 
 	err := be.db.Update(func(txn *badger.Txn) error {
 		// enforces deletion only if the key exists
@@ -250,13 +331,17 @@ func (be badgerBackend) Delete(key []byte, onlyIfExists bool) (bool, error) {
 Close database
 */
 func (be badgerBackend) Close() {
+	be.durability.stop()
+	if be.coalescer != nil {
+		be.coalescer.Close()
+	}
 	be.db.Close()
 }
 
 /*
 Stats returns db statuses
 */
-func (be badgerBackend) Stats() string { return "" }
+func (be badgerBackend) Stats() string { return be.durability.String() }
 
 /*
 GetDbPath returns the filesystem path for the database
@@ -266,9 +351,34 @@ func (be badgerBackend) GetDbPath() string {
 }
 
 /*
-Flush flushes all data from the database, not implemented
+Flush deletes all keys, 1000 per transaction
 */
-func (be badgerBackend) Flush() error { return nil }
+func (be badgerBackend) Flush() error {
+	var keys [][]byte
+	deleteKeys := func() error {
+		err := be.db.Update(func(txn *badger.Txn) error {
+			for _, k := range keys {
+				if err := txn.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		keys = keys[:0]
+		return err
+	}
+	err := be.ScanKeys(func(key []byte) error {
+		keys = append(keys, append([]byte{}, key...))
+		if len(keys) >= 1000 {
+			return deleteKeys()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return deleteKeys()
+}
 
 /*
 BucketStats implement statuses for db that used the bucket idea (boltdb)
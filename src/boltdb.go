@@ -1,9 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/boltdb/bolt"
 	bloom "github.com/pmylund/go-bloom"
@@ -60,6 +62,7 @@ type KVBoltDBBackend struct {
 	expirationdb     *bolt.DB
 	keyCache         map[string]*BloomFilterKeys
 	maxKeysPerBucket int
+	durability       *durability
 }
 
 func NewKVBoltDBBackend(filename string, bucketName string, maxKeysPerBucket int) (*KVBoltDBBackend, error) {
@@ -70,6 +73,7 @@ func NewKVBoltDBBackend(filename string, bucketName string, maxKeysPerBucket int
 		return nil, err
 	}
 
+	b.durability = newDurability(durabilityDefault, durabilitySync, 0)
 	b.keyCache = make(map[string]*BloomFilterKeys)
 	b.keyCache[bucketName] = NewBloomFilterKeys(maxKeysPerBucket)
 
@@ -87,6 +91,25 @@ func NewKVBoltDBBackend(filename string, bucketName string, maxKeysPerBucket int
 	return &b, nil
 }
 
+/*
+SetDurability maps the durability mode onto bolt NoSync. interval mode fsyncs in the background.
+Without fsync on commit a crash can leave bolt meta pages pointing at pages never
+written: the file is corrupt, not just behind
+*/
+func (be *KVBoltDBBackend) SetDurability(mode durabilityMode, interval time.Duration) {
+	be.durability.stop()
+	be.durability = newDurability(mode, durabilitySync, interval)
+	be.db.NoSync = be.durability.mode != durabilitySync
+	be.durability.start(be)
+}
+
+/*
+Sync fsyncs the database file
+*/
+func (be KVBoltDBBackend) Sync() error {
+	return be.db.Sync()
+}
+
 func (be KVBoltDBBackend) Set(key []byte, value []byte) error {
 	return be.Put(key, value, false, true)
 }
@@ -126,7 +149,7 @@ func (be KVBoltDBBackend) Increment(key []byte, value int, create_if_not_exists
 			if create_if_not_exists == false {
 				return fmt.Errorf("Increment: Key %s exists", string(key))
 			}
-			i := string(0 + value)
+			i := strconv.Itoa(0 + value)
 			err := bucket.Put(key, []byte(i))
 			if err != nil {
 				return fmt.Errorf("Error storing incr/decr value for key %s - %s", string(key), i)
@@ -226,7 +249,12 @@ func (be KVBoltDBBackend) Delete(key []byte, only_if_exists bool) (bool, error)
 	}
 	err := be.db.Update(func(tx *bolt.Tx) error {
 		be.keyCache[be.bucketName].Remove(key)
-		return tx.Bucket([]byte(be.bucketName)).Delete(key)
+		// a new or flushed database has no bucket, nothing to delete
+		bucket := tx.Bucket([]byte(be.bucketName))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete(key)
 	})
 	return true, err
 }
@@ -241,6 +269,7 @@ func (be KVBoltDBBackend) Flush() error {
 
 func (be KVBoltDBBackend) BucketStats() error { return nil }
 func (be KVBoltDBBackend) Close() {
+	be.durability.stop()
 	be.db.Close()
 }
 func (be KVBoltDBBackend) GetDbPath() string {
@@ -255,10 +284,85 @@ func (be KVBoltDBBackend) SwitchBucket(bucket string) {
 	be.bucketName = bucket
 }
 
+/*
+Range query by key prefix. If limit == -1 no limit is applyed. Take care
+*/
 func (be KVBoltDBBackend) Range(key []byte, limit int, from []byte, reverse bool) (map[string][]byte, error) {
-	return nil, nil
+	ret := make(map[string][]byte)
+	err := be.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(be.bucketName))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		var k, v []byte
+		next := c.Next
+		if reverse == true {
+			next = c.Prev
+			// position on the last key <= from, or the last key of the prefix
+			seek := from
+			if seek == nil {
+				seek = prefixEnd(key)
+			}
+			if seek == nil {
+				k, v = c.Last()
+			} else if k, v = c.Seek(seek); k == nil {
+				k, v = c.Last()
+			} else if bytes.Compare(k, seek) > 0 || from == nil {
+				k, v = c.Prev()
+			}
+		} else if from != nil && bytes.Compare(from, key) > 0 {
+			k, v = c.Seek(from)
+		} else {
+			k, v = c.Seek(key)
+		}
+		for l := 1; k != nil && bytes.HasPrefix(k, key); l++ {
+			ret[string(k)] = append([]byte{}, v...)
+			if limit >= 0 && limit == l {
+				break
+			}
+			k, v = next()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+/*
+prefixEnd returns the first key after all keys starting with prefix, nil if there is none
+*/
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+/*
+ScanKeys calls fn for every key in the bucket, stopping at the first error
+*/
+func (be KVBoltDBBackend) ScanKeys(fn func(key []byte) error) error {
+	return be.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(be.bucketName))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			return fn(k)
+		})
+	})
 }
 
 func (be KVBoltDBBackend) Stats() string {
-	return ""
+	if be.db.NoSync {
+		return be.durability.String() + ", bolt NoSync: a crash can corrupt the database file"
+	}
+	return be.durability.String()
 }
@@ -1,6 +1,9 @@
 package main
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestBoltDBDelete(t *testing.T) {
 	key := []byte("beano")
@@ -108,7 +111,7 @@ func TestBoltDBDecr(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	} else if v != 9 {
-		t.Error(errUnexpected(string(v)))
+		t.Error(errUnexpected(v))
 	}
 
 	if v, err := vboltdb.Get(key); err != nil {
@@ -135,4 +138,51 @@ func TestBoltDBFlush(t *testing.T) {
 	} else if v != nil {
 		t.Error(errUnexpected(v))
 	}
+	// the flush dropped the bucket
+	if _, err := vboltdb.Delete(key, false); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBoltDBRange(t *testing.T) {
+	for _, k := range []string{"range1", "range2", "range3", "rangf"} {
+		vboltdb.Set([]byte(k), []byte("clapton"))
+	}
+	for _, c := range []struct {
+		limit    int
+		from     string
+		reverse  bool
+		expected string
+	}{
+		{-1, "", false, "range1 range2 range3"},
+		{2, "range2", false, "range2 range3"},
+		{2, "", true, "range3 range2"},
+		{-1, "range2", true, "range2 range1"},
+	} {
+		var from []byte
+		if c.from != "" {
+			from = []byte(c.from)
+		}
+		v, err := vboltdb.Range([]byte("range"), c.limit, from, c.reverse)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys := strings.Join(sortedKeys(v, c.reverse), " "); keys != c.expected {
+			t.Error(errUnexpected(keys))
+		}
+	}
+	for _, k := range []string{"range1", "range2", "range3", "rangf"} {
+		vboltdb.Delete([]byte(k), false)
+	}
+}
+
+func TestBoltDBDurability(t *testing.T) {
+	vboltdb.SetDurability(durabilityNone, 0)
+	if !strings.Contains(vboltdb.Stats(), "a crash can corrupt") {
+		t.Error(errUnexpected(vboltdb.Stats()))
+	}
+	vboltdb.SetDurability(durabilityDefault, 0)
+	if vboltdb.db.NoSync || !strings.HasSuffix(vboltdb.Stats(), "durability: sync") {
+		t.Error(errUnexpected(vboltdb.Stats()))
+	}
 }
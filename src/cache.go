@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/facebookgo/inmem"
+)
+
+// cached entries never expire, eviction is LRU only
+var cacheNeverExpires = time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+
+/*
+cachedBackend fronts a persistent backend with a bounded in memory LRU (the
+same cache used by the inmem backend). Writes go through to the backend and
+update the cache, deletes and flushes invalidate it. A switchdb loads a new
+backend with a new, empty cache. Every flush bumps generation, a value read
+from the backend before it isn't cached after it
+*/
+type cachedBackend struct {
+	BackendDatabase
+	size       int
+	cache      inmem.Cache
+	cacheLock  *sync.RWMutex
+	keyLocks   *stripedLock
+	generation uint64
+}
+
+/*
+NewCachedBackend wraps vdb with an LRU of size entries
+*/
+func NewCachedBackend(vdb BackendDatabase, size int) *cachedBackend {
+	return &cachedBackend{
+		BackendDatabase: vdb,
+		size:            size,
+		cache:           inmem.NewLocked(size),
+		cacheLock:       &sync.RWMutex{},
+		keyLocks:        newStripedLock(),
+	}
+}
+
+/*
+Unwrap returns the persistent backend
+*/
+func (cb *cachedBackend) Unwrap() BackendDatabase {
+	return cb.BackendDatabase
+}
+
+func (cb *cachedBackend) lru() inmem.Cache {
+	cb.cacheLock.RLock()
+	defer cb.cacheLock.RUnlock()
+	return cb.cache
+}
+
+func (cb *cachedBackend) currentGeneration() uint64 {
+	cb.cacheLock.RLock()
+	defer cb.cacheLock.RUnlock()
+	return cb.generation
+}
+
+/*
+store caches a copy of value, unless a flush happened since generation was read
+*/
+func (cb *cachedBackend) store(key []byte, value []byte, generation uint64) {
+	v := make([]byte, len(value))
+	copy(v, value)
+	cb.cacheLock.RLock()
+	defer cb.cacheLock.RUnlock()
+	if cb.generation == generation {
+		cb.cache.Add(string(key), v, cacheNeverExpires)
+	}
+}
+
+func (cb *cachedBackend) invalidate(key []byte) {
+	cb.lru().Remove(string(key))
+}
+
+/*
+Set the value for key
+*/
+func (cb *cachedBackend) Set(key []byte, value []byte) error {
+	return cb.Put(key, value, false, true)
+}
+
+/*
+Add value to key, store data only if the server doesnt holds it yet
+*/
+func (cb *cachedBackend) Add(key []byte, value []byte) error {
+	return cb.Put(key, value, false, false)
+}
+
+/*
+Replace value for key, store data only if the server already holds this key
+*/
+func (cb *cachedBackend) Replace(key []byte, value []byte) error {
+	return cb.Put(key, value, true, false)
+}
+
+/*
+Incr data, yields error if the represented value doesnt maps to int
+*/
+func (cb *cachedBackend) Incr(key []byte, value uint) (int, error) {
+	return cb.Increment(key, int(value), false)
+}
+
+/*
+Decr data, yields error if the represented value doesnt maps to int
+*/
+func (cb *cachedBackend) Decr(key []byte, value uint) (int, error) {
+	return cb.Increment(key, int(value)*-1, false)
+}
+
+/*
+Increment runs on the backend and invalidates the cached value
+*/
+func (cb *cachedBackend) Increment(key []byte, value int, createIfNotExists bool) (int, error) {
+	cb.keyLocks.Lock(key)
+	defer cb.keyLocks.Unlock(key)
+	i, err := cb.BackendDatabase.Increment(key, value, createIfNotExists)
+	cb.invalidate(key)
+	return i, err
+}
+
+/*
+Put writes through to the backend, caching the value once stored
+*/
+func (cb *cachedBackend) Put(key []byte, value []byte, replace bool, passthru bool) error {
+	cb.keyLocks.Lock(key)
+	defer cb.keyLocks.Unlock(key)
+	generation := cb.currentGeneration()
+	if err := cb.BackendDatabase.Put(key, value, replace, passthru); err != nil {
+		cb.invalidate(key)
+		return err
+	}
+	cb.store(key, value, generation)
+	return nil
+}
+
+/*
+Get serves a copy of the cached value, so callers can't change the cache, and
+loads misses from the backend
+*/
+func (cb *cachedBackend) Get(key []byte) ([]byte, error) {
+	if v, ok := cb.lru().Get(string(key)); ok {
+		cacheHits.Inc(1)
+		return append([]byte(nil), v.([]byte)...), nil
+	}
+	cacheMisses.Inc(1)
+	// the key lock keeps a concurrent write from being overwritten by a stale
+	// load, the generation a concurrent flush
+	cb.keyLocks.Lock(key)
+	defer cb.keyLocks.Unlock(key)
+	generation := cb.currentGeneration()
+	v, err := cb.BackendDatabase.Get(key)
+	if err == nil && v != nil {
+		cb.store(key, v, generation)
+	}
+	return v, err
+}
+
+/*
+Delete key from backend and cache
+*/
+func (cb *cachedBackend) Delete(key []byte, onlyIfExists bool) (bool, error) {
+	cb.keyLocks.Lock(key)
+	defer cb.keyLocks.Unlock(key)
+	deleted, err := cb.BackendDatabase.Delete(key, onlyIfExists)
+	cb.invalidate(key)
+	return deleted, err
+}
+
+/*
+Flush the backend and drop the whole cache
+*/
+func (cb *cachedBackend) Flush() error {
+	err := cb.BackendDatabase.Flush()
+	cb.cacheLock.Lock()
+	cb.cache = inmem.NewLocked(cb.size)
+	cb.generation++
+	cb.cacheLock.Unlock()
+	return err
+}
+
+/*
+Sync forwards to the backend when it supports it
+*/
+func (cb *cachedBackend) Sync() error {
+	if s, ok := findSyncer(cb.BackendDatabase); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+/*
+Stats adds cache usage to the backend stats
+*/
+func (cb *cachedBackend) Stats() string {
+	return fmt.Sprintf("%s\ncache: %d/%d entries, hit ratio %.3f",
+		cb.BackendDatabase.Stats(), cb.lru().Len(), cb.size, cacheHitRatio())
+}
+
+func cacheHitRatio() float64 {
+	hits, misses := cacheHits.Count(), cacheMisses.Count()
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCachedBackendWriteThrough(t *testing.T) {
+	cb := NewCachedBackend(vleveldb, 10)
+	key := []byte("beano")
+	cb.Delete(key, false)
+
+	cb.Set(key, []byte("clapton"))
+	if v, err := vleveldb.Get(key); err != nil {
+		t.Error(err)
+	} else if string(v) != "clapton" {
+		t.Error(errUnexpected(string(v)))
+	}
+	hits := cacheHits.Count()
+	if v, err := cb.Get(key); err != nil {
+		t.Error(err)
+	} else if string(v) != "clapton" || cacheHits.Count() != hits+1 {
+		t.Error(errUnexpected(string(v)))
+	}
+
+	if err := cb.Add(key, []byte("eric")); err == nil {
+		t.Error(errUnexpected("add on existing key"))
+	}
+	if v, _ := cb.Get(key); string(v) != "clapton" {
+		t.Error(errUnexpected(string(v)))
+	}
+	cb.Delete(key, false)
+}
+
+func TestCachedBackendInvalidation(t *testing.T) {
+	cb := NewCachedBackend(vleveldb, 10)
+	key := []byte("beano")
+	cb.Set(key, []byte("10"))
+	cb.Get(key)
+
+	if v, err := cb.Incr(key, 1); err != nil || v != 11 {
+		t.Error(errUnexpected(v))
+	}
+	if v, _ := cb.Get(key); string(v) != "11" {
+		t.Error(errUnexpected(string(v)))
+	}
+
+	cb.Delete(key, false)
+	if v, err := cb.Get(key); err != nil {
+		t.Error(err)
+	} else if v != nil {
+		t.Error(errUnexpected(v))
+	}
+}
+
+func TestCachedBackendEviction(t *testing.T) {
+	cb := NewCachedBackend(vleveldb, 2)
+	for _, k := range []string{"beano1", "beano2", "beano3"} {
+		cb.Set([]byte(k), []byte("clapton"))
+	}
+	if n := cb.lru().Len(); n != 2 {
+		t.Error(errUnexpected(n))
+	}
+	if v, _ := cb.Get([]byte("beano1")); string(v) != "clapton" {
+		t.Error(errUnexpected(string(v)))
+	}
+	for _, k := range []string{"beano1", "beano2", "beano3"} {
+		cb.Delete([]byte(k), false)
+	}
+}
+
+func TestCachedBackendGetCopy(t *testing.T) {
+	cb := NewCachedBackend(vleveldb, 10)
+	key := []byte("beano")
+	cb.Set(key, []byte("clapton"))
+	v, _ := cb.Get(key)
+	v[0] = 'C'
+	if v, _ := cb.Get(key); string(v) != "clapton" {
+		t.Error(errUnexpected(string(v)))
+	}
+	cb.Delete(key, false)
+}
+
+/*
+pausedGetBackend holds Get after reading the value until release is closed
+*/
+type pausedGetBackend struct {
+	BackendDatabase
+	loaded  chan struct{}
+	release chan struct{}
+}
+
+func (pb *pausedGetBackend) Get(key []byte) ([]byte, error) {
+	v, err := pb.BackendDatabase.Get(key)
+	close(pb.loaded)
+	<-pb.release
+	return v, err
+}
+
+func TestCachedBackendFlushDuringLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beano-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	vdb := loadDB("leveldb", filepath.Join(dir, "cache.db"), dbOptions{})
+	defer vdb.Close()
+	key := []byte("beano")
+	vdb.Set(key, []byte("clapton"))
+	pb := &pausedGetBackend{BackendDatabase: vdb, loaded: make(chan struct{}), release: make(chan struct{})}
+	cb := NewCachedBackend(pb, 10)
+
+	done := make(chan struct{})
+	go func() {
+		cb.Get(key)
+		close(done)
+	}()
+	<-pb.loaded
+	cb.Flush()
+	close(pb.release)
+	<-done
+	// the value read before the flush isn't cached
+	if v, ok := cb.lru().Get(string(key)); ok {
+		t.Error(errUnexpected(v))
+	}
+}
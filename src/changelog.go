@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	opSet    byte = 'S'
+	opDelete byte = 'D'
+	opFlush  byte = 'F'
+	// opPing is a heartbeat carrying the primary last sequence, sent to replicas and never stored
+	opPing byte = 'P'
+)
+
+var errChangeLogTruncated = errors.New("change log truncated")
+var errChangeRecordCorrupt = errors.New("change log record corrupt")
+
+// errUnchanged is returned by a logged write that changed nothing, it isn't recorded
+var errUnchanged = errors.New("nothing changed")
+
+/*
+changeRecord is a change log entry. Increments are logged as a set of the resulting value
+*/
+type changeRecord struct {
+	seq   uint64
+	op    byte
+	key   []byte
+	value []byte
+}
+
+/*
+appendChangeRecord encodes r as
+<op> <uvarint seq> <uvarint key size> <key> <uvarint value size> <value> <crc32>
+with the crc32 (IEEE, big endian) of the bytes before it
+*/
+func appendChangeRecord(b []byte, r changeRecord) []byte {
+	start := len(b)
+	b = append(b, r.op)
+	b = binary.AppendUvarint(b, r.seq)
+	b = binary.AppendUvarint(b, uint64(len(r.key)))
+	b = append(b, r.key...)
+	b = binary.AppendUvarint(b, uint64(len(r.value)))
+	b = append(b, r.value...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b[start:]))
+}
+
+/*
+recordReader decodes the crc32 framed records of the change and raft logs,
+keeping the bytes read for the checksum
+*/
+type recordReader struct {
+	r   *bufio.Reader
+	raw []byte
+}
+
+/*
+begin starts a record, io.EOF if r ended on a record boundary
+*/
+func (rr *recordReader) begin() error {
+	rr.raw = rr.raw[:0]
+	if _, err := rr.r.Peek(1); err != nil {
+		return io.EOF
+	}
+	return nil
+}
+
+func (rr *recordReader) ReadByte() (byte, error) {
+	c, err := rr.r.ReadByte()
+	if err != nil {
+		return 0, io.ErrUnexpectedEOF
+	}
+	rr.raw = append(rr.raw, c)
+	return c, nil
+}
+
+func (rr *recordReader) uvarint() (uint64, error) {
+	return binary.ReadUvarint(rr)
+}
+
+/*
+bytes reads a uvarint size prefixed byte string. Sizes come from disk or the
+network: one over exportMaxSize is corrupt, and the buffer grows with the
+data read so a torn record doesn't allocate the size it claims
+*/
+func (rr *recordReader) bytes() ([]byte, error) {
+	n, err := rr.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n > exportMaxSize {
+		return nil, errChangeRecordCorrupt
+	}
+	var b []byte
+	for left := int(n); left > 0; {
+		chunk := left
+		if chunk > exportChunkSize {
+			chunk = exportChunkSize
+		}
+		b = append(b, make([]byte, chunk)...)
+		if _, err := io.ReadFull(rr.r, b[len(b)-chunk:]); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		left -= chunk
+	}
+	rr.raw = append(rr.raw, b...)
+	return b, nil
+}
+
+/*
+checksum reads the crc32 ending the record and verifies it
+*/
+func (rr *recordReader) checksum() error {
+	var sum [4]byte
+	if _, err := io.ReadFull(rr.r, sum[:]); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if binary.BigEndian.Uint32(sum[:]) != crc32.ChecksumIEEE(rr.raw) {
+		return errChangeRecordCorrupt
+	}
+	return nil
+}
+
+/*
+readChangeRecord decodes a record. io.EOF means r ended on a record boundary,
+anything else a truncated or corrupt record
+*/
+func readChangeRecord(r *bufio.Reader) (changeRecord, error) {
+	var rec changeRecord
+	rr := recordReader{r: r}
+	if err := rr.begin(); err != nil {
+		return rec, err
+	}
+	op, err := rr.ReadByte()
+	if err != nil {
+		return rec, err
+	}
+	switch op {
+	case opSet, opDelete, opFlush, opPing:
+	default:
+		return rec, errChangeRecordCorrupt
+	}
+	rec.op = op
+	if rec.seq, err = rr.uvarint(); err != nil {
+		return rec, err
+	}
+	if rec.key, err = rr.bytes(); err != nil {
+		return rec, err
+	}
+	if rec.value, err = rr.bytes(); err != nil {
+		return rec, err
+	}
+	return rec, rr.checksum()
+}
+
+/*
+changeLog records the writes accepted by the backend, numbered by a sequence,
+in segment files named <prefix>.<first sequence>. A new segment is started
+when the current one reaches segmentSize, only the last keep segments are
+kept: replicas asking for older changes get a full snapshot instead.
+Writes are recorded once the backend accepted them, under a key lock so the
+log order is the order they were applied in. Segments are fsynced following
+the -durability mode, by default it's left to the OS
+*/
+type changeLog struct {
+	prefix      string
+	segmentSize int64
+	keep        int
+	lock        sync.Mutex
+	keyLocks    *stripedLock
+	flushLock   sync.RWMutex
+	file        *os.File
+	size        int64
+	segments    []uint64
+	last        uint64
+	notify      chan struct{}
+	buf         []byte
+	durability  *durability
+}
+
+func segmentName(prefix string, first uint64) string {
+	return fmt.Sprintf("%s.%020d", prefix, first)
+}
+
+/*
+openChangeLog opens the log at prefix, creating it if needed. A record torn
+by a crash at the end of the last segment is cut off
+*/
+func openChangeLog(prefix string, segmentSize int64, keep int) (*changeLog, error) {
+	if keep < 1 {
+		keep = 1
+	}
+	cl := changeLog{
+		prefix:      prefix,
+		segmentSize: segmentSize,
+		keep:        keep,
+		keyLocks:    newStripedLock(),
+		notify:      make(chan struct{}),
+		durability:  newDurability(durabilityNone, durabilityNone, 0),
+	}
+	names, err := filepath.Glob(prefix + ".*")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		suffix := strings.TrimPrefix(name, prefix+".")
+		if len(suffix) != 20 {
+			continue
+		}
+		if first, err := strconv.ParseUint(suffix, 10, 64); err == nil {
+			cl.segments = append(cl.segments, first)
+		}
+	}
+	sort.Slice(cl.segments, func(i, j int) bool { return cl.segments[i] < cl.segments[j] })
+
+	if len(cl.segments) == 0 {
+		return &cl, cl.startSegment(1)
+	}
+	first := cl.segments[len(cl.segments)-1]
+	cl.last = first - 1
+	f, err := os.OpenFile(segmentName(prefix, first), os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(f)
+	for {
+		rec, err := readChangeRecord(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Error("Change log %s: cutting a torn record after sequence %d", segmentName(prefix, first), cl.last)
+			break
+		}
+		cl.last = rec.seq
+		cl.size += int64(len(appendChangeRecord(cl.buf[:0], rec)))
+	}
+	if err := f.Truncate(cl.size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(cl.size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	cl.file = f
+	return &cl, nil
+}
+
+/*
+startSegment closes the current segment and starts one at first, dropping the
+oldest segments over keep. Caller holds lock
+*/
+func (cl *changeLog) startSegment(first uint64) error {
+	f, err := os.OpenFile(segmentName(cl.prefix, first), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if cl.file != nil {
+		if cl.durability.mode != durabilityNone {
+			if err := cl.file.Sync(); err != nil {
+				log.Error("Change log: %s", err)
+			}
+		}
+		cl.file.Close()
+	}
+	cl.file, cl.size = f, 0
+	if len(cl.segments) == 0 || cl.segments[len(cl.segments)-1] != first {
+		cl.segments = append(cl.segments, first)
+	}
+	for len(cl.segments) > cl.keep {
+		if err := os.Remove(segmentName(cl.prefix, cl.segments[0])); err != nil && !os.IsNotExist(err) {
+			log.Error("Change log: %s", err)
+		}
+		cl.segments = cl.segments[1:]
+	}
+	return nil
+}
+
+/*
+append writes a record with the next sequence and wakes up the readers
+*/
+func (cl *changeLog) append(op byte, key []byte, value []byte) (uint64, error) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	rec := changeRecord{seq: cl.last + 1, op: op, key: key, value: value}
+	cl.buf = appendChangeRecord(cl.buf[:0], rec)
+	if cl.size > 0 && cl.size+int64(len(cl.buf)) > cl.segmentSize {
+		if err := cl.startSegment(rec.seq); err != nil {
+			return 0, err
+		}
+	}
+	_, err := cl.file.Write(cl.buf)
+	if err == nil && cl.durability.mode == durabilitySync {
+		err = cl.file.Sync()
+	}
+	if err != nil {
+		// don't leave a partial record in front of the next one
+		cl.file.Truncate(cl.size)
+		cl.file.Seek(cl.size, io.SeekStart)
+		return 0, err
+	}
+	cl.size += int64(len(cl.buf))
+	cl.last = rec.seq
+	changeLogRecords.Inc(1)
+	close(cl.notify)
+	cl.notify = make(chan struct{})
+	return rec.seq, nil
+}
+
+/*
+logged runs write, which returns the value to record, and records it when the
+backend accepted it. A flush waits for the writes in flight. A nil log just writes
+*/
+func (cl *changeLog) logged(op byte, key []byte, write func() ([]byte, error)) error {
+	if cl == nil {
+		_, err := write()
+		return err
+	}
+	if op == opFlush {
+		cl.flushLock.Lock()
+		defer cl.flushLock.Unlock()
+	} else {
+		cl.flushLock.RLock()
+		defer cl.flushLock.RUnlock()
+		cl.keyLocks.Lock(key)
+		defer cl.keyLocks.Unlock(key)
+	}
+	value, err := write()
+	if err == errUnchanged {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if _, err := cl.append(op, key, value); err != nil {
+		changeLogErrors.Inc(1)
+		log.Error("Change log: %s", err)
+		return err
+	}
+	return nil
+}
+
+/*
+Last returns the sequence of the last record, 0 for an empty log
+*/
+func (cl *changeLog) Last() uint64 {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	return cl.last
+}
+
+/*
+SetDurability fsyncs every record in sync mode, or in the background in
+interval mode
+*/
+func (cl *changeLog) SetDurability(mode durabilityMode, interval time.Duration) {
+	cl.durability.stop()
+	cl.durability = newDurability(mode, durabilityNone, interval)
+	cl.durability.start(cl)
+}
+
+/*
+Sync flushes the current segment to stable storage
+*/
+func (cl *changeLog) Sync() error {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	return cl.file.Sync()
+}
+
+/*
+Close closes the current segment, synced unless durability is none
+*/
+func (cl *changeLog) Close() error {
+	cl.durability.stop()
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	if cl.durability.mode != durabilityNone {
+		if err := cl.file.Sync(); err != nil {
+			cl.file.Close()
+			return err
+		}
+	}
+	return cl.file.Close()
+}
+
+/*
+changeLogReader follows the log from a sequence, across segments, waiting for new records
+*/
+type changeLogReader struct {
+	cl    *changeLog
+	next  uint64
+	file  *os.File
+	r     *bufio.Reader
+	first uint64
+}
+
+/*
+NewReader returns a reader starting at sequence from, errChangeLogTruncated
+when the log doesn't hold it anymore (or never did). The segment is opened
+right away so it can't be dropped before the first Next
+*/
+func (cl *changeLog) NewReader(from uint64) (*changeLogReader, error) {
+	lr := changeLogReader{cl: cl, next: from}
+	if err := lr.open(); err != nil {
+		return nil, err
+	}
+	return &lr, nil
+}
+
+/*
+open opens the segment holding the next record
+*/
+func (lr *changeLogReader) open() error {
+	lr.cl.lock.Lock()
+	last := lr.cl.last
+	segments := append([]uint64{}, lr.cl.segments...)
+	lr.cl.lock.Unlock()
+	if lr.next < 1 || len(segments) == 0 || lr.next < segments[0] || lr.next > last+1 {
+		return errChangeLogTruncated
+	}
+	i := sort.Search(len(segments), func(i int) bool { return segments[i] > lr.next }) - 1
+	f, err := os.Open(segmentName(lr.cl.prefix, segments[i]))
+	if os.IsNotExist(err) {
+		return errChangeLogTruncated
+	} else if err != nil {
+		return err
+	}
+	lr.Close()
+	lr.file, lr.r, lr.first = f, bufio.NewReader(f), segments[i]
+	return nil
+}
+
+/*
+Next returns the next record, waiting up to wait for it. ok is false when
+nothing was written in the meantime
+*/
+func (lr *changeLogReader) Next(wait time.Duration) (rec changeRecord, ok bool, err error) {
+	var timeout <-chan time.Time
+	for {
+		lr.cl.lock.Lock()
+		last, notify := lr.cl.last, lr.cl.notify
+		lr.cl.lock.Unlock()
+		if lr.next > last {
+			if timeout == nil {
+				timeout = time.After(wait)
+			}
+			select {
+			case <-notify:
+				continue
+			case <-timeout:
+				return rec, false, nil
+			}
+		}
+		rec, err = readChangeRecord(lr.r)
+		if err == io.EOF {
+			// the record is in the next segment
+			if lr.next == lr.first {
+				return rec, false, errChangeRecordCorrupt
+			}
+			if err := lr.open(); err != nil {
+				return rec, false, err
+			}
+			if lr.first != lr.next {
+				return rec, false, errChangeLogTruncated
+			}
+			continue
+		} else if err != nil {
+			return rec, false, err
+		}
+		if rec.seq < lr.next {
+			continue
+		}
+		if rec.seq != lr.next {
+			return rec, false, errChangeRecordCorrupt
+		}
+		lr.next++
+		return rec, true, nil
+	}
+}
+
+/*
+Close releases the segment
+*/
+func (lr *changeLogReader) Close() {
+	if lr.file != nil {
+		lr.file.Close()
+		lr.file = nil
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestChangeLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beano-changelog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	prefix := filepath.Join(dir, "changes")
+	cl, err := openChangeLog(prefix, 64, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if _, err := cl.append(opSet, []byte(fmt.Sprintf("key%02d", i)), []byte("clapton")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cl.Last() != 20 || len(cl.segments) != 3 {
+		t.Fatal(errUnexpected(cl.segments))
+	}
+	if _, err := cl.NewReader(1); err != errChangeLogTruncated {
+		t.Error(errUnexpected(err))
+	}
+	if _, err := cl.NewReader(22); err != errChangeLogTruncated {
+		t.Error(errUnexpected(err))
+	}
+
+	// a reader follows across segments then waits for new records
+	from := cl.segments[0]
+	lr, err := cl.NewReader(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seq := from; seq <= 20; seq++ {
+		rec, ok, err := lr.Next(time.Second)
+		if err != nil || !ok || rec.seq != seq || string(rec.key) != fmt.Sprintf("key%02d", seq-1) {
+			t.Fatal(errUnexpected(fmt.Sprintf("%d: %v %v %+v", seq, ok, err, rec)))
+		}
+	}
+	if _, ok, err := lr.Next(10 * time.Millisecond); ok || err != nil {
+		t.Error(errUnexpected(err))
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cl.append(opDelete, []byte("key00"), nil)
+	}()
+	if rec, ok, _ := lr.Next(time.Second); !ok || rec.op != opDelete || rec.seq != 21 {
+		t.Error(errUnexpected(rec))
+	}
+	lr.Close()
+	cl.Close()
+
+	// a torn record at the end is cut off on open
+	last := segmentName(prefix, cl.segments[len(cl.segments)-1])
+	f, _ := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write(appendChangeRecord(nil, changeRecord{seq: 22, op: opSet, key: []byte("torn")})[:5])
+	f.Close()
+	cl, err = openChangeLog(prefix, 64, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cl.Last() != 21 {
+		t.Error(errUnexpected(cl.Last()))
+	}
+	if seq, _ := cl.append(opFlush, nil, nil); seq != 22 {
+		t.Error(errUnexpected(seq))
+	}
+	lr, err = cl.NewReader(21)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lr.Next(time.Second)
+	if rec, ok, err := lr.Next(time.Second); !ok || err != nil || rec.op != opFlush {
+		t.Error(errUnexpected(err))
+	}
+	lr.Close()
+	cl.Close()
+}
+
+func TestChangeRecordCorruptSize(t *testing.T) {
+	// a key size over the limit, and a value size past the end of the record
+	huge := append([]byte{opSet, 1}, binary.AppendUvarint(nil, 1<<62)...)
+	short := append([]byte{opSet, 1, 1, 'k'}, binary.AppendUvarint(nil, exportMaxSize)...)
+	for _, b := range [][]byte{huge, short} {
+		if _, err := readChangeRecord(bufio.NewReader(bytes.NewReader(b))); err != errChangeRecordCorrupt && err != io.ErrUnexpectedEOF {
+			t.Error(errUnexpected(err))
+		}
+	}
+}
+
+func TestChangeLogLogged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beano-changelog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	vdb := loadDB("leveldb", filepath.Join(dir, "db"), dbOptions{})
+	db := newCurrentDB(vdb, "leveldb")
+	defer db.Close()
+	db.changes, err = openChangeLog(filepath.Join(dir, "changes"), 1<<20, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.changes.SetDurability(durabilitySync, 0)
+	defer db.changes.Close()
+
+	db.Set([]byte("counter"), []byte("1"))
+	db.Incr([]byte("counter"), 41)
+	db.Add([]byte("counter"), []byte("0")) // refused, not logged
+	db.Delete([]byte("counter"), false)
+	db.Delete([]byte("counter"), true) // not found, not logged
+	db.Flush()
+
+	lr, err := db.changes.NewReader(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lr.Close()
+	expected := []string{"S counter 1", "S counter 42", "D counter ", "F  "}
+	for _, e := range expected {
+		rec, ok, err := lr.Next(time.Second)
+		if got := fmt.Sprintf("%c %s %s", rec.op, rec.key, rec.value); !ok || err != nil || got != e {
+			t.Error(errUnexpected(got))
+		}
+	}
+	if db.changes.Last() != 4 {
+		t.Error(errUnexpected(db.changes.Last()))
+	}
+}
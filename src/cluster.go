@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+/*
+clusterOptions makes this server a member of a raft cluster
+*/
+type clusterOptions struct {
+	addr            string
+	peers           []string
+	dir             string
+	snapshotEntries uint64
+	token           string
+	tls             *tls.Config
+}
+
+/*
+raftBackend replicates writes through the raft log of node before they reach
+the backend, forwarding them to the leader when node follows. Reads wait
+until they are linearizable
+*/
+type raftBackend struct {
+	BackendDatabase
+	node *raftNode
+}
+
+/*
+startCluster starts the raft node for vdb and wraps it
+*/
+func startCluster(opts clusterOptions, vdb BackendDatabase) (*raftBackend, error) {
+	peers := opts.peers
+	if len(peers) == 0 {
+		peers = []string{opts.addr}
+	}
+	listener, err := net.Listen("tcp", opts.addr)
+	if err != nil {
+		return nil, err
+	}
+	if opts.tls != nil {
+		listener = tls.NewListener(listener, opts.tls)
+	}
+	if opts.token == "" {
+		log.Warning("Cluster: no -clustertoken, any client reaching %s can write and change the membership, firewall it", opts.addr)
+	}
+	node, err := startRaftNode(raftOptions{
+		addr:            opts.addr,
+		peers:           peers,
+		dir:             opts.dir,
+		snapshotEntries: opts.snapshotEntries,
+		token:           opts.token,
+		tls:             clientTLSConfig(opts.tls),
+		heartbeat:       50 * time.Millisecond,
+		electionTimeout: 500 * time.Millisecond,
+	}, vdb, listener)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &raftBackend{BackendDatabase: vdb, node: node}, nil
+}
+
+/*
+Unwrap returns the replicated backend
+*/
+func (rb *raftBackend) Unwrap() BackendDatabase {
+	return rb.BackendDatabase
+}
+
+func (rb *raftBackend) do(args ForwardArgs) (ForwardReply, error) {
+	reply := rb.node.Do(args)
+	if reply.Err != "" {
+		return reply, errors.New(reply.Err)
+	}
+	return reply, nil
+}
+
+/*
+Set the value for key
+*/
+func (rb *raftBackend) Set(key []byte, value []byte) error {
+	_, err := rb.do(ForwardArgs{Op: opSet, Key: key, Value: value})
+	return err
+}
+
+/*
+Add value to key, store data only if the server doesnt holds it yet
+*/
+func (rb *raftBackend) Add(key []byte, value []byte) error {
+	_, err := rb.do(ForwardArgs{Op: opAdd, Key: key, Value: value})
+	return err
+}
+
+/*
+Replace value for key, store data only if the server already holds this key
+*/
+func (rb *raftBackend) Replace(key []byte, value []byte) error {
+	_, err := rb.do(ForwardArgs{Op: opReplace, Key: key, Value: value})
+	return err
+}
+
+/*
+Put data checking if it should be replaced or exists
+*/
+func (rb *raftBackend) Put(key []byte, value []byte, replace bool, passthru bool) error {
+	switch {
+	case passthru:
+		return rb.Set(key, value)
+	case replace:
+		return rb.Replace(key, value)
+	default:
+		return rb.Add(key, value)
+	}
+}
+
+/*
+Incr data, yields error if the represented value doesnt maps to int
+*/
+func (rb *raftBackend) Incr(key []byte, value uint) (int, error) {
+	return rb.Increment(key, int(value), false)
+}
+
+/*
+Decr data, yields error if the represented value doesnt maps to int
+*/
+func (rb *raftBackend) Decr(key []byte, value uint) (int, error) {
+	return rb.Increment(key, int(value)*-1, false)
+}
+
+/*
+Increment is resolved by the leader and replicated as a set of the result
+*/
+func (rb *raftBackend) Increment(key []byte, value int, createIfNotExists bool) (int, error) {
+	reply, err := rb.do(ForwardArgs{Op: opIncrement, Key: key, Delta: value, Create: createIfNotExists})
+	if err != nil {
+		return -1, err
+	}
+	return reply.Int, nil
+}
+
+/*
+Delete key, optional check to see if it exists
+*/
+func (rb *raftBackend) Delete(key []byte, onlyIfExists bool) (bool, error) {
+	reply, err := rb.do(ForwardArgs{Op: opDelete, Key: key, OnlyIfExists: onlyIfExists})
+	return reply.Deleted, err
+}
+
+/*
+Flush deletes all keys on every member
+*/
+func (rb *raftBackend) Flush() error {
+	_, err := rb.do(ForwardArgs{Op: opFlush})
+	return err
+}
+
+/*
+Get data for key, seeing every write acknowledged before the call
+*/
+func (rb *raftBackend) Get(key []byte) ([]byte, error) {
+	if err := rb.node.linearizableRead(); err != nil {
+		return nil, err
+	}
+	return rb.BackendDatabase.Get(key)
+}
+
+/*
+Range query by key prefix, seeing every write acknowledged before the call
+*/
+func (rb *raftBackend) Range(key []byte, limit int, from []byte, reverse bool) (map[string][]byte, error) {
+	if err := rb.node.linearizableRead(); err != nil {
+		return nil, err
+	}
+	return rb.BackendDatabase.Range(key, limit, from, reverse)
+}
+
+/*
+ChangeMembership adds or removes the member with raft address peer, action is add or remove
+*/
+func (rb *raftBackend) ChangeMembership(action string, peer string) error {
+	if action != "add" && action != "remove" {
+		return fmt.Errorf("unknown membership change %s", action)
+	}
+	_, err := rb.do(ForwardArgs{Op: opConfig, Key: []byte(action), Value: []byte(peer)})
+	return err
+}
+
+/*
+Status describes the raft node
+*/
+func (rb *raftBackend) Status() string {
+	return rb.node.Status()
+}
+
+/*
+Stats returns the backend statuses and the raft node state
+*/
+func (rb *raftBackend) Stats() string {
+	return fmt.Sprintf("%s\n%s", rb.BackendDatabase.Stats(), rb.node.Status())
+}
+
+/*
+Close stops the raft node, then the backend
+*/
+func (rb *raftBackend) Close() {
+	rb.node.Close()
+	rb.BackendDatabase.Close()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var errCoalescerClosed = errors.New("write coalescer closed")
+
+/*
+writeOp is a pending write. done receives the batch commit result
+*/
+type writeOp struct {
+	key    []byte
+	value  []byte
+	delete bool
+	done   chan error
+}
+
+/*
+writeCoalescer gathers concurrent writes into a single backend batch (group
+commit). Writers block until the batch holding their write is committed.
+closed is set under lock before Close drains ops, so no write is queued after
+the drain
+*/
+type writeCoalescer struct {
+	lock     sync.RWMutex
+	closed   bool
+	ops      chan *writeOp
+	quit     chan bool
+	stopped  chan bool
+	window   time.Duration
+	maxBatch int
+	commit   func([]*writeOp) error
+}
+
+/*
+newWriteCoalescer starts the batching loop. A batch is committed when it reaches
+maxBatch writes or window elapsed since its first write
+*/
+func newWriteCoalescer(window time.Duration, maxBatch int, commit func([]*writeOp) error) *writeCoalescer {
+	if maxBatch <= 0 {
+		maxBatch = 1
+	}
+	wc := writeCoalescer{
+		ops:      make(chan *writeOp, maxBatch),
+		quit:     make(chan bool),
+		stopped:  make(chan bool),
+		window:   window,
+		maxBatch: maxBatch,
+		commit:   commit,
+	}
+	go wc.run()
+	return &wc
+}
+
+/*
+Put queues a write and waits for its batch to commit
+*/
+func (wc *writeCoalescer) Put(key []byte, value []byte) error {
+	return wc.submit(&writeOp{key: key, value: value, done: make(chan error, 1)})
+}
+
+/*
+Delete queues a delete and waits for its batch to commit
+*/
+func (wc *writeCoalescer) Delete(key []byte) error {
+	return wc.submit(&writeOp{key: key, delete: true, done: make(chan error, 1)})
+}
+
+func (wc *writeCoalescer) submit(op *writeOp) error {
+	wc.lock.RLock()
+	if wc.closed {
+		wc.lock.RUnlock()
+		return errCoalescerClosed
+	}
+	// the loop keeps reading ops until closed is set, this send doesn't block Close for long
+	wc.ops <- op
+	wc.lock.RUnlock()
+	return <-op.done
+}
+
+func (wc *writeCoalescer) run() {
+	defer close(wc.stopped)
+	batch := make([]*writeOp, 0, wc.maxBatch)
+	timer := time.NewTimer(wc.window)
+	timer.Stop()
+	for {
+		select {
+		case op := <-wc.ops:
+			batch = append(batch[:0], op)
+		case <-wc.quit:
+			return
+		}
+		timer.Reset(wc.window)
+		quit := false
+	collect:
+		for len(batch) < wc.maxBatch {
+			select {
+			case op := <-wc.ops:
+				batch = append(batch, op)
+			case <-timer.C:
+				break collect
+			case <-wc.quit:
+				quit = true
+				break collect
+			}
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		wc.flush(batch)
+		if quit {
+			return
+		}
+	}
+}
+
+func (wc *writeCoalescer) flush(batch []*writeOp) {
+	start := time.Now()
+	err := wc.commit(batch)
+	batchLatency.UpdateSince(start)
+	batchSizes.Update(int64(len(batch)))
+	for _, op := range batch {
+		op.done <- err
+	}
+}
+
+/*
+Close stops the batching loop. Writes already queued are committed first
+*/
+func (wc *writeCoalescer) Close() {
+	wc.lock.Lock()
+	wc.closed = true
+	wc.lock.Unlock()
+	close(wc.quit)
+	<-wc.stopped
+	for {
+		select {
+		case op := <-wc.ops:
+			wc.flush([]*writeOp{op})
+		default:
+			return
+		}
+	}
+}
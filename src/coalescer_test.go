@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWriteCoalescerBatches(t *testing.T) {
+	var batches []int
+	lock := &sync.Mutex{}
+	wc := newWriteCoalescer(50*time.Millisecond, 100, func(ops []*writeOp) error {
+		lock.Lock()
+		batches = append(batches, len(ops))
+		lock.Unlock()
+		return nil
+	})
+	defer wc.Close()
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := wc.Put([]byte(fmt.Sprintf("beano%d", i)), []byte("clapton")); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	total := 0
+	for _, n := range batches {
+		total += n
+	}
+	if total != 20 || len(batches) >= 20 {
+		t.Error(errUnexpected(batches))
+	}
+}
+
+func TestWriteCoalescerClose(t *testing.T) {
+	wc := newWriteCoalescer(time.Millisecond, 10, func(ops []*writeOp) error { return nil })
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// writes racing Close are committed or refused, none waits forever
+			if err := wc.Put([]byte(fmt.Sprintf("beano%d", i)), []byte("clapton")); err != nil && err != errCoalescerClosed {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wc.Close()
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal(errUnexpected("writer stuck after Close"))
+	}
+	if err := wc.Delete([]byte("beano0")); err != errCoalescerClosed {
+		t.Error(errUnexpected(err))
+	}
+}
+
+func TestLevelDBGroupCommit(t *testing.T) {
+	be, err := NewLevelDBBackend("test_leveldb_batch.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("test_leveldb_batch.db")
+	be.EnableGroupCommit(5*time.Millisecond, 16)
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			be.Set([]byte(fmt.Sprintf("beano%d", i)), []byte("clapton"))
+		}(i)
+	}
+	wg.Wait()
+	be.Delete([]byte("beano0"), false)
+
+	for i := 0; i < 50; i++ {
+		v, err := be.Get([]byte(fmt.Sprintf("beano%d", i)))
+		if err != nil {
+			t.Error(err)
+		} else if i == 0 && v != nil {
+			t.Error(errUnexpected(v))
+		} else if i > 0 && string(v) != "clapton" {
+			t.Error(errUnexpected(v))
+		}
+	}
+	be.Close()
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/golang/snappy"
+)
+
+/*
+Compressed values are stored behind a 4 byte header: valueMagic and the
+encoding. Values written without a header (before compression was enabled)
+are returned as they are, so both kinds coexist in a database. Uncompressed
+values that happen to start with valueMagic get the raw header to stay readable
+*/
+var valueMagic = []byte{0x00, 0xbe, 0xa0}
+
+const (
+	encodingRaw    byte = 'r'
+	encodingSnappy byte = 's'
+)
+
+const valueHeaderSize = 4
+
+/*
+compressedBackend snappy compresses values of at least threshold bytes when
+it saves space
+*/
+type compressedBackend struct {
+	BackendDatabase
+	threshold int
+}
+
+/*
+NewCompressedBackend wraps vdb, compressing values of threshold bytes or more
+*/
+func NewCompressedBackend(vdb BackendDatabase, threshold int) *compressedBackend {
+	return &compressedBackend{BackendDatabase: vdb, threshold: threshold}
+}
+
+/*
+Unwrap returns the backend storing the compressed values
+*/
+func (cb *compressedBackend) Unwrap() BackendDatabase {
+	return cb.BackendDatabase
+}
+
+func withValueHeader(encoding byte, value []byte) []byte {
+	v := make([]byte, 0, valueHeaderSize+len(value))
+	v = append(v, valueMagic...)
+	v = append(v, encoding)
+	return append(v, value...)
+}
+
+/*
+encodeValue compresses value when it is over the threshold and gets smaller
+*/
+func (cb *compressedBackend) encodeValue(value []byte) []byte {
+	if len(value) >= cb.threshold {
+		compressed := snappy.Encode(nil, value)
+		if len(compressed)+valueHeaderSize < len(value) {
+			compressionBytesIn.Inc(int64(len(value)))
+			compressionBytesOut.Inc(int64(len(compressed) + valueHeaderSize))
+			return withValueHeader(encodingSnappy, compressed)
+		}
+	}
+	if bytes.HasPrefix(value, valueMagic) {
+		return withValueHeader(encodingRaw, value)
+	}
+	return value
+}
+
+/*
+decodeValue undoes encodeValue, values without header are returned unchanged
+*/
+func decodeValue(value []byte) ([]byte, error) {
+	if len(value) < valueHeaderSize || !bytes.HasPrefix(value, valueMagic) {
+		return value, nil
+	}
+	switch value[len(valueMagic)] {
+	case encodingRaw:
+		return value[valueHeaderSize:], nil
+	case encodingSnappy:
+		return snappy.Decode(nil, value[valueHeaderSize:])
+	}
+	return nil, fmt.Errorf("Unknown value encoding %q", value[len(valueMagic)])
+}
+
+/*
+Set the value for key
+*/
+func (cb *compressedBackend) Set(key []byte, value []byte) error {
+	return cb.BackendDatabase.Set(key, cb.encodeValue(value))
+}
+
+/*
+Add value to key, store data only if the server doesnt holds it yet
+*/
+func (cb *compressedBackend) Add(key []byte, value []byte) error {
+	return cb.BackendDatabase.Add(key, cb.encodeValue(value))
+}
+
+/*
+Replace value for key, store data only if the server already holds this key
+*/
+func (cb *compressedBackend) Replace(key []byte, value []byte) error {
+	return cb.BackendDatabase.Replace(key, cb.encodeValue(value))
+}
+
+/*
+Put compresses the value before storing it. Counters are below any sensible
+threshold so incr and decr keep working on the plain value
+*/
+func (cb *compressedBackend) Put(key []byte, value []byte, replace bool, passthru bool) error {
+	return cb.BackendDatabase.Put(key, cb.encodeValue(value), replace, passthru)
+}
+
+/*
+Get decompresses the stored value
+*/
+func (cb *compressedBackend) Get(key []byte) ([]byte, error) {
+	v, err := cb.BackendDatabase.Get(key)
+	if err != nil || v == nil {
+		return v, err
+	}
+	return decodeValue(v)
+}
+
+/*
+Range decompresses all values in the result
+*/
+func (cb *compressedBackend) Range(key []byte, limit int, from []byte, reverse bool) (map[string][]byte, error) {
+	ret, err := cb.BackendDatabase.Range(key, limit, from, reverse)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range ret {
+		if ret[k], err = decodeValue(v); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+/*
+Sync forwards to the backend when it supports it
+*/
+func (cb *compressedBackend) Sync() error {
+	if s, ok := findSyncer(cb.BackendDatabase); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+/*
+Stats adds the compression ratio to the backend stats
+*/
+func (cb *compressedBackend) Stats() string {
+	return fmt.Sprintf("%s\ncompression: snappy, threshold %d bytes, ratio %.2f",
+		cb.BackendDatabase.Stats(), cb.threshold, compressionRatio())
+}
+
+/*
+compressionRatio is original size / stored size of the compressed values
+*/
+func compressionRatio() float64 {
+	in, out := compressionBytesIn.Count(), compressionBytesOut.Count()
+	if out == 0 {
+		return 0
+	}
+	return float64(in) / float64(out)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCompressedBackend(t *testing.T) {
+	cb := NewCompressedBackend(vleveldb, 64)
+	large := []byte(strings.Repeat(`{"name": "eric", "surname": "clapton"}`, 100))
+	key := []byte("beano")
+
+	cb.Set(key, large)
+	if stored, _ := vleveldb.Get(key); len(stored) >= len(large) || !bytes.HasPrefix(stored, valueMagic) {
+		t.Error(errUnexpected(len(stored)))
+	}
+	if v, err := cb.Get(key); err != nil || !bytes.Equal(v, large) {
+		t.Error(errUnexpected(err))
+	}
+	if compressionRatio() <= 1 {
+		t.Error(errUnexpected(compressionRatio()))
+	}
+
+	// values written without the wrapper and small ones stay readable
+	vleveldb.Set([]byte("beano2"), []byte("clapton"))
+	cb.Set([]byte("beano3"), []byte("clapton"))
+	if stored, _ := vleveldb.Get([]byte("beano3")); string(stored) != "clapton" {
+		t.Error(errUnexpected(stored))
+	}
+	escaped := append(append([]byte{}, valueMagic...), 's', 'x')
+	cb.Set([]byte("beano4"), escaped)
+
+	v, err := cb.Range(key, -1, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(v["beano"], large) || string(v["beano2"]) != "clapton" || string(v["beano3"]) != "clapton" || !bytes.Equal(v["beano4"], escaped) {
+		t.Error(errUnexpected(v))
+	}
+	for _, k := range []string{"beano", "beano2", "beano3", "beano4"} {
+		vleveldb.Delete([]byte(k), false)
+	}
+}
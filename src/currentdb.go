@@ -0,0 +1,181 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+)
+
+/*
+currentDB guards the active backend, swapped by switchdb and migrations.
+Connections use it as their backend: every call runs on the backend active
+when it starts and Swap waits for the calls in flight, so the replaced
+backend can be closed once Swap returns. Writes are recorded in the change
+log, when enabled, whatever the active backend. When pinned is set switchdb
+and migrations are refused with it
+*/
+type currentDB struct {
+	vdb     BackendDatabase
+	backend string
+	dbLock  *sync.RWMutex
+	changes *changeLog
+	pinned  error
+}
+
+func newCurrentDB(vdb BackendDatabase, backend string) *currentDB {
+	return &currentDB{vdb: vdb, backend: backend, dbLock: &sync.RWMutex{}}
+}
+
+/*
+Active returns the active backend
+*/
+func (c *currentDB) Active() BackendDatabase {
+	c.dbLock.RLock()
+	defer c.dbLock.RUnlock()
+	return c.vdb
+}
+
+/*
+Swap replaces the active backend with vdb, of type backend
+*/
+func (c *currentDB) Swap(vdb BackendDatabase, backend string) {
+	c.dbLock.Lock()
+	c.vdb, c.backend = vdb, backend
+	c.dbLock.Unlock()
+}
+
+/*
+Backend returns the type of the active backend
+*/
+func (c *currentDB) Backend() string {
+	c.dbLock.RLock()
+	defer c.dbLock.RUnlock()
+	return c.backend
+}
+
+/*
+Unwrap returns the active backend
+*/
+func (c *currentDB) Unwrap() BackendDatabase {
+	return c.Active()
+}
+
+/*
+increment logs the resulting value as a set
+*/
+func (c *currentDB) increment(key []byte, fn func() (int, error)) (int, error) {
+	var i int
+	err := c.changes.logged(opSet, key, func() ([]byte, error) {
+		var err error
+		i, err = fn()
+		return []byte(strconv.Itoa(i)), err
+	})
+	return i, err
+}
+
+func (c *currentDB) Set(key []byte, value []byte) error {
+	c.dbLock.RLock()
+	defer c.dbLock.RUnlock()
+	return c.changes.logged(opSet, key, func() ([]byte, error) {
+		return value, c.vdb.Set(key, value)
+	})
+}
+
+func (c *currentDB) Add(key []byte, value []byte) error {
+	c.dbLock.RLock()
+	defer c.dbLock.RUnlock()
+	return c.changes.logged(opSet, key, func() ([]byte, error) {
+		return value, c.vdb.Add(key, value)
+	})
+}
+
+func (c *currentDB) Replace(key []byte, value []byte) error {
+	c.dbLock.RLock()
+	defer c.dbLock.RUnlock()
+	return c.changes.logged(opSet, key, func() ([]byte, error) {
+		return value, c.vdb.Replace(key, value)
+	})
+}
+
+func (c *currentDB) Incr(key []byte, value uint) (int, error) {
+	c.dbLock.RLock()
+	defer c.dbLock.RUnlock()
+	return c.increment(key, func() (int, error) { return c.vdb.Incr(key, value) })
+}
+
+func (c *currentDB) Decr(key []byte, value uint) (int, error) {
+	c.dbLock.RLock()
+	defer c.dbLock.RUnlock()
+	return c.increment(key, func() (int, error) { return c.vdb.Decr(key, value) })
+}
+
+func (c *currentDB) Increment(key []byte, value int, createIfNotExists bool) (int, error) {
+	c.dbLock.RLock()
+	defer c.dbLock.RUnlock()
+	return c.increment(key, func() (int, error) { return c.vdb.Increment(key, value, createIfNotExists) })
+}
+
+func (c *currentDB) Put(key []byte, value []byte, replace bool, passthru bool) error {
+	c.dbLock.RLock()
+	defer c.dbLock.RUnlock()
+	return c.changes.logged(opSet, key, func() ([]byte, error) {
+		return value, c.vdb.Put(key, value, replace, passthru)
+	})
+}
+
+func (c *currentDB) Get(key []byte) ([]byte, error) {
+	c.dbLock.RLock()
+	defer c.dbLock.RUnlock()
+	return c.vdb.Get(key)
+}
+
+func (c *currentDB) Range(key []byte, limit int, from []byte, reverse bool) (map[string][]byte, error) {
+	c.dbLock.RLock()
+	defer c.dbLock.RUnlock()
+	return c.vdb.Range(key, limit, from, reverse)
+}
+
+func (c *currentDB) Delete(key []byte, onlyIfExists bool) (bool, error) {
+	c.dbLock.RLock()
+	defer c.dbLock.RUnlock()
+	var deleted bool
+	err := c.changes.logged(opDelete, key, func() ([]byte, error) {
+		var err error
+		if deleted, err = c.vdb.Delete(key, onlyIfExists); err == nil && !deleted {
+			return nil, errUnchanged
+		}
+		return nil, err
+	})
+	return deleted, err
+}
+
+func (c *currentDB) Close() {
+	c.dbLock.RLock()
+	defer c.dbLock.RUnlock()
+	c.vdb.Close()
+}
+
+func (c *currentDB) Stats() string {
+	c.dbLock.RLock()
+	defer c.dbLock.RUnlock()
+	return c.vdb.Stats()
+}
+
+func (c *currentDB) GetDbPath() string {
+	c.dbLock.RLock()
+	defer c.dbLock.RUnlock()
+	return c.vdb.GetDbPath()
+}
+
+func (c *currentDB) Flush() error {
+	c.dbLock.RLock()
+	defer c.dbLock.RUnlock()
+	return c.changes.logged(opFlush, nil, func() ([]byte, error) {
+		return nil, c.vdb.Flush()
+	})
+}
+
+func (c *currentDB) BucketStats() error {
+	c.dbLock.RLock()
+	defer c.dbLock.RUnlock()
+	return c.vdb.BucketStats()
+}
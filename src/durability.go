@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+durabilityMode tells backends when writes reach stable storage
+*/
+type durabilityMode string
+
+const (
+	// durabilityDefault keeps the backend native behaviour
+	durabilityDefault durabilityMode = ""
+	// durabilitySync fsyncs every write before acknowledging it
+	durabilitySync durabilityMode = "sync"
+	// durabilityInterval fsyncs in the background every interval
+	durabilityInterval durabilityMode = "interval"
+	// durabilityNone leaves flushing to the OS
+	durabilityNone durabilityMode = "none"
+)
+
+/*
+parseDurability validates the -durability flag
+*/
+func parseDurability(mode string) (durabilityMode, error) {
+	switch m := durabilityMode(mode); m {
+	case durabilityDefault, durabilitySync, durabilityInterval, durabilityNone:
+		return m, nil
+	}
+	return durabilityDefault, fmt.Errorf("Unknown durability mode %s, use sync, interval or none", mode)
+}
+
+/*
+Syncer is implemented by backends able to flush pending writes to stable storage on demand
+*/
+type Syncer interface {
+	Sync() error
+}
+
+/*
+durability holds the mode of a backend and runs the periodic fsync for interval mode
+*/
+type durability struct {
+	mode     durabilityMode
+	interval time.Duration
+	quit     chan bool
+}
+
+/*
+newDurability resolves durabilityDefault to the backend native mode
+*/
+func newDurability(mode durabilityMode, native durabilityMode, interval time.Duration) *durability {
+	if mode == durabilityDefault {
+		mode = native
+	}
+	return &durability{mode: mode, interval: interval}
+}
+
+/*
+start launches the background fsync when running in interval mode
+*/
+func (d *durability) start(s Syncer) {
+	if d.mode != durabilityInterval || d.interval <= 0 {
+		return
+	}
+	d.quit = make(chan bool)
+	go func() {
+		ticker := time.NewTicker(d.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.Sync(); err != nil {
+					log.Error("Periodic fsync: %s", err)
+				}
+			case <-d.quit:
+				return
+			}
+		}
+	}()
+}
+
+/*
+stop ends the background fsync, called before the backend closes
+*/
+func (d *durability) stop() {
+	if d.quit != nil {
+		close(d.quit)
+		d.quit = nil
+	}
+}
+
+func (d *durability) String() string {
+	if d.mode == durabilityInterval {
+		return fmt.Sprintf("durability: %s (%s)", d.mode, d.interval)
+	}
+	return fmt.Sprintf("durability: %s", d.mode)
+}
+
+/*
+syncFiles fsyncs files matching pattern. Any descriptor flushes the whole
+file, so this works for stores that don't expose a sync call
+*/
+func syncFiles(pattern string) error {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	for _, name := range files {
+		f, err := os.OpenFile(name, os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		err = f.Sync()
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,605 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const encodingAESGCM byte = 'e'
+
+// keyMarker separates the cleartext namespace of a stored key from its encrypted part
+const keyMarker byte = 0x00
+
+var errRotationRunning = errors.New("key rotation already running")
+
+/*
+encryptionKey is one key of the key file. Values are sealed with AES-GCM and
+a random nonce. Keys are sealed deterministically, with a nonce derived from
+an HMAC of the key, so the same key always maps to the same stored key
+*/
+type encryptionKey struct {
+	id       byte
+	values   cipher.AEAD
+	keys     cipher.AEAD
+	nonceKey []byte
+}
+
+func newEncryptionKey(id byte, secret []byte) (*encryptionKey, error) {
+	derive := func(label string) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(label))
+		return mac.Sum(nil)
+	}
+	aeads := make([]cipher.AEAD, 2)
+	for i, s := range [][]byte{secret, derive("beano key encryption")} {
+		block, err := aes.NewCipher(s)
+		if err != nil {
+			return nil, err
+		}
+		if aeads[i], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return &encryptionKey{id: id, values: aeads[0], keys: aeads[1], nonceKey: derive("beano key nonce")}, nil
+}
+
+/*
+keyRing holds all keys of the key file, the last one encrypts new writes
+*/
+type keyRing struct {
+	keys   map[byte]*encryptionKey
+	active *encryptionKey
+	// older keys, newest first
+	previous []*encryptionKey
+}
+
+/*
+loadKeyRing reads a key file. One key per line:
+
+	<id 1-255> <hex encoded 16, 24 or 32 byte key>
+
+the last key is used for new writes, the others only to read data not yet
+rotated. Empty lines and lines starting with # are ignored
+*/
+func loadKeyRing(filename string) (*keyRing, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ring := keyRing{keys: make(map[byte]*encryptionKey)}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected key id and key", filename, n)
+		}
+		id, err := strconv.Atoi(fields[0])
+		if err != nil || id < 1 || id > 255 {
+			return nil, fmt.Errorf("%s:%d: key id must be between 1 and 255", filename, n)
+		}
+		if _, ok := ring.keys[byte(id)]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicated key id %d", filename, n, id)
+		}
+		secret, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", filename, n, err)
+		}
+		k, err := newEncryptionKey(byte(id), secret)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", filename, n, err)
+		}
+		if ring.active != nil {
+			ring.previous = append([]*encryptionKey{ring.active}, ring.previous...)
+		}
+		ring.keys[k.id], ring.active = k, k
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if ring.active == nil {
+		return nil, fmt.Errorf("%s: no keys", filename)
+	}
+	return &ring, nil
+}
+
+/*
+encryptedBackend seals values with AES-GCM, bound to their key. With
+encryptKeys set keys are sealed too, except for their namespace: the part up
+to and including the first separator stays in clear so ranges over a
+namespace still run on the backend. Data written before encryption was
+enabled is read as it is until the rotation job rewrites it
+*/
+type encryptedBackend struct {
+	BackendDatabase
+	ring        *keyRing
+	encryptKeys bool
+	separator   string
+	keyLocks    *stripedLock
+	rotating    int32
+	rotateDone  *sync.WaitGroup
+	quit        chan bool
+}
+
+/*
+NewEncryptedBackend wraps vdb with the keys of ring
+*/
+func NewEncryptedBackend(vdb BackendDatabase, ring *keyRing, encryptKeys bool, separator string) *encryptedBackend {
+	return &encryptedBackend{
+		BackendDatabase: vdb,
+		ring:            ring,
+		encryptKeys:     encryptKeys,
+		separator:       separator,
+		keyLocks:        newStripedLock(),
+		rotateDone:      &sync.WaitGroup{},
+		quit:            make(chan bool),
+	}
+}
+
+/*
+Unwrap returns the backend storing the encrypted data
+*/
+func (eb *encryptedBackend) Unwrap() BackendDatabase {
+	return eb.BackendDatabase
+}
+
+/*
+namespace is the cleartext part of a key
+*/
+func (eb *encryptedBackend) namespace(key []byte) []byte {
+	if i := bytes.Index(key, []byte(eb.separator)); i >= 0 && eb.separator != "" {
+		return key[:i+len(eb.separator)]
+	}
+	return nil
+}
+
+/*
+storedKey is <namespace> 0x00 <key id> <nonce> <sealed key>
+*/
+func (eb *encryptedBackend) storedKey(k *encryptionKey, key []byte) []byte {
+	ns := eb.namespace(key)
+	mac := hmac.New(sha256.New, k.nonceKey)
+	mac.Write(key)
+	nonce := mac.Sum(nil)[:k.keys.NonceSize()]
+	stored := make([]byte, 0, len(ns)+2+len(nonce)+len(key)+k.keys.Overhead())
+	stored = append(stored, ns...)
+	stored = append(stored, keyMarker, k.id)
+	stored = append(stored, nonce...)
+	return k.keys.Seal(stored, nonce, key[len(ns):], ns)
+}
+
+/*
+storedKeys lists where key may be stored: sealed with the active key, with
+older keys and in clear, in that order
+*/
+func (eb *encryptedBackend) storedKeys(key []byte) [][]byte {
+	if !eb.encryptKeys {
+		return [][]byte{key}
+	}
+	names := [][]byte{eb.storedKey(eb.ring.active, key)}
+	for _, k := range eb.ring.previous {
+		names = append(names, eb.storedKey(k, key))
+	}
+	return append(names, key)
+}
+
+/*
+plainKey opens a stored key. Keys that don't open are taken as stored in clear
+*/
+func (eb *encryptedBackend) plainKey(stored []byte) ([]byte, *encryptionKey) {
+	if !eb.encryptKeys {
+		return stored, nil
+	}
+	i := bytes.IndexByte(stored, keyMarker)
+	if i < 0 || len(stored) < i+2 {
+		return stored, nil
+	}
+	ns := stored[:i]
+	if len(ns) > 0 && !bytes.HasSuffix(ns, []byte(eb.separator)) {
+		return stored, nil
+	}
+	k, ok := eb.ring.keys[stored[i+1]]
+	if !ok || len(stored) < i+2+k.keys.NonceSize() {
+		return stored, nil
+	}
+	nonce := stored[i+2 : i+2+k.keys.NonceSize()]
+	plain, err := k.keys.Open(append([]byte{}, ns...), nonce, stored[i+2+len(nonce):], ns)
+	if err != nil {
+		return stored, nil
+	}
+	return plain, k
+}
+
+/*
+sealValue is valueMagic 'e' <key id> <nonce> <sealed value>, the key is the additional data
+*/
+func (eb *encryptedBackend) sealValue(key []byte, value []byte) ([]byte, error) {
+	k := eb.ring.active
+	nonce := make([]byte, k.values.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, 0, valueHeaderSize+1+len(nonce)+len(value)+k.values.Overhead())
+	sealed = append(sealed, valueMagic...)
+	sealed = append(sealed, encodingAESGCM, k.id)
+	sealed = append(sealed, nonce...)
+	return k.values.Seal(sealed, nonce, value, key), nil
+}
+
+/*
+openValue returns the value and the key that sealed it, nil for values stored in clear
+*/
+func (eb *encryptedBackend) openValue(key []byte, value []byte) ([]byte, *encryptionKey, error) {
+	if len(value) < valueHeaderSize+1 || !bytes.HasPrefix(value, valueMagic) || value[len(valueMagic)] != encodingAESGCM {
+		return value, nil, nil
+	}
+	k, ok := eb.ring.keys[value[valueHeaderSize]]
+	if !ok {
+		return nil, nil, fmt.Errorf("Value of %s sealed with unknown key %d", key, value[valueHeaderSize])
+	}
+	sealed := value[valueHeaderSize+1:]
+	if len(sealed) < k.values.NonceSize() {
+		return nil, nil, fmt.Errorf("Value of %s truncated", key)
+	}
+	plain, err := k.values.Open(nil, sealed[:k.values.NonceSize()], sealed[k.values.NonceSize():], key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Value of %s: %s", key, err)
+	}
+	return plain, k, nil
+}
+
+/*
+find returns the stored key and raw value for key, nil if not found
+*/
+func (eb *encryptedBackend) find(key []byte) ([]byte, []byte, error) {
+	for _, name := range eb.storedKeys(key) {
+		v, err := eb.BackendDatabase.Get(name)
+		if err != nil || v != nil {
+			return name, v, err
+		}
+	}
+	return nil, nil, nil
+}
+
+/*
+store writes value under the active stored key and drops the copies under
+older ones. Caller holds the key lock
+*/
+func (eb *encryptedBackend) store(key []byte, value []byte) error {
+	sealed, err := eb.sealValue(key, value)
+	if err != nil {
+		return err
+	}
+	names := eb.storedKeys(key)
+	if err := eb.BackendDatabase.Put(names[0], sealed, false, true); err != nil {
+		return err
+	}
+	for _, name := range names[1:] {
+		if _, err := eb.BackendDatabase.Delete(name, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Set the value for key
+*/
+func (eb *encryptedBackend) Set(key []byte, value []byte) error {
+	return eb.Put(key, value, false, true)
+}
+
+/*
+Add value to key, store data only if the server doesnt holds it yet
+*/
+func (eb *encryptedBackend) Add(key []byte, value []byte) error {
+	return eb.Put(key, value, false, false)
+}
+
+/*
+Replace value for key, store data only if the server already holds this key
+*/
+func (eb *encryptedBackend) Replace(key []byte, value []byte) error {
+	return eb.Put(key, value, true, false)
+}
+
+/*
+Incr data, yields error if the represented value doesnt maps to int
+*/
+func (eb *encryptedBackend) Incr(key []byte, value uint) (int, error) {
+	return eb.Increment(key, int(value), false)
+}
+
+/*
+Decr data, yields error if the represented value doesnt maps to int
+*/
+func (eb *encryptedBackend) Decr(key []byte, value uint) (int, error) {
+	return eb.Increment(key, int(value)*-1, false)
+}
+
+/*
+Increment opens the value, adds and seals it back. The backend can't do it, it
+only sees ciphertext
+*/
+func (eb *encryptedBackend) Increment(key []byte, value int, createIfNotExists bool) (int, error) {
+	eb.keyLocks.Lock(key)
+	defer eb.keyLocks.Unlock(key)
+	_, raw, err := eb.find(key)
+	if err != nil {
+		return -1, err
+	}
+	if raw == nil {
+		if createIfNotExists == false {
+			return -1, fmt.Errorf("Key %s do not exists, createIfNotExists set to false", string(key))
+		}
+		return 0, eb.store(key, []byte("0"))
+	}
+	v, _, err := eb.openValue(key, raw)
+	if err != nil {
+		return -1, err
+	}
+	i, err := strconv.Atoi(string(v))
+	if err != nil {
+		return -1, fmt.Errorf("Data cannot be incr/decr for key %s - %s", string(key), string(v))
+	}
+	i = i + value
+	if err := eb.store(key, []byte(strconv.Itoa(i))); err != nil {
+		return -1, fmt.Errorf("Error key %s - %s", string(key), err)
+	}
+	return i, nil
+}
+
+/*
+Put seals the value. Existence checks for add and replace look at every
+place the key may be stored
+*/
+func (eb *encryptedBackend) Put(key []byte, value []byte, replace bool, passthru bool) error {
+	eb.keyLocks.Lock(key)
+	defer eb.keyLocks.Unlock(key)
+	if passthru == false {
+		_, v, err := eb.find(key)
+		if err != nil {
+			return err
+		}
+		if replace == true && v == nil {
+			return fmt.Errorf("Key %s do not exists, replace set to true", string(key))
+		}
+		if replace == false && v != nil {
+			return fmt.Errorf("Key %s exists, replace set to false", string(key))
+		}
+	}
+	return eb.store(key, value)
+}
+
+/*
+Get opens the stored value
+*/
+func (eb *encryptedBackend) Get(key []byte) ([]byte, error) {
+	_, raw, err := eb.find(key)
+	if err != nil || raw == nil {
+		return nil, err
+	}
+	v, _, err := eb.openValue(key, raw)
+	return v, err
+}
+
+/*
+Range opens keys and values. Sealed keys don't sort like the plain ones, so
+with encrypted keys every call reads the whole namespace of the prefix from
+the backend and opens all its keys to apply the rest of the prefix, from and
+limit. Only the values returned are opened, but a scan paging through a
+large namespace still reads it once per page
+*/
+func (eb *encryptedBackend) Range(key []byte, limit int, from []byte, reverse bool) (map[string][]byte, error) {
+	if !eb.encryptKeys {
+		ret, err := eb.BackendDatabase.Range(key, limit, from, reverse)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range ret {
+			if ret[k], _, err = eb.openValue([]byte(k), v); err != nil {
+				return nil, err
+			}
+		}
+		return ret, nil
+	}
+
+	stored, err := eb.BackendDatabase.Range(eb.namespace(key), -1, nil, reverse)
+	if err != nil {
+		return nil, err
+	}
+	// plain key to the stored value, opened once the page is known
+	found := make(map[string][]byte)
+	for name, raw := range stored {
+		plain, _ := eb.plainKey([]byte(name))
+		if !bytes.HasPrefix(plain, key) {
+			continue
+		}
+		if from != nil && ((!reverse && bytes.Compare(plain, from) < 0) || (reverse && bytes.Compare(plain, from) > 0)) {
+			continue
+		}
+		found[string(plain)] = raw
+	}
+	page := sortedKeys(found, reverse)
+	if limit >= 0 && len(page) > limit {
+		page = page[:limit]
+	}
+	ret := make(map[string][]byte, len(page))
+	for _, k := range page {
+		if ret[k], _, err = eb.openValue([]byte(k), found[k]); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+/*
+Delete key from every place it may be stored
+*/
+func (eb *encryptedBackend) Delete(key []byte, onlyIfExists bool) (bool, error) {
+	if !eb.encryptKeys {
+		return eb.BackendDatabase.Delete(key, onlyIfExists)
+	}
+	eb.keyLocks.Lock(key)
+	defer eb.keyLocks.Unlock(key)
+	deleted := !onlyIfExists
+	for _, name := range eb.storedKeys(key) {
+		d, err := eb.BackendDatabase.Delete(name, true)
+		if err != nil {
+			return false, err
+		}
+		deleted = deleted || d
+	}
+	return deleted, nil
+}
+
+/*
+ScanKeys walks the opened keys
+*/
+func (eb *encryptedBackend) ScanKeys(fn func(key []byte) error) error {
+	scanner, ok := findKeyScanner(eb.BackendDatabase)
+	if !ok {
+		return fmt.Errorf("Encryption: backend can't scan its keys")
+	}
+	return scanner.ScanKeys(func(stored []byte) error {
+		plain, _ := eb.plainKey(stored)
+		return fn(plain)
+	})
+}
+
+/*
+Rotate starts the background job sealing everything with the active key:
+values and keys sealed with older keys and data stored in clear. Once it is
+done older keys can be removed from the key file
+*/
+func (eb *encryptedBackend) Rotate() error {
+	scanner, ok := findKeyScanner(eb.BackendDatabase)
+	if !ok {
+		return fmt.Errorf("Encryption: backend can't scan its keys")
+	}
+	if !atomic.CompareAndSwapInt32(&eb.rotating, 0, 1) {
+		return errRotationRunning
+	}
+	eb.rotateDone.Add(1)
+	go func() {
+		defer eb.rotateDone.Done()
+		defer atomic.StoreInt32(&eb.rotating, 0)
+		// collect first, rewriting while iterating would visit the new keys
+		var names [][]byte
+		err := scanner.ScanKeys(func(stored []byte) error {
+			names = append(names, append([]byte{}, stored...))
+			return nil
+		})
+		if err != nil {
+			log.Error("Key rotation: %s", err)
+			return
+		}
+		rotated := 0
+		for _, stored := range names {
+			select {
+			case <-eb.quit:
+				log.Info("Key rotation stopped, %d items rotated", rotated)
+				return
+			default:
+			}
+			done, err := eb.rotate(stored)
+			if err != nil {
+				log.Error("Key rotation: %s", err)
+				continue
+			}
+			if done {
+				rotated++
+				encryptionRotations.Inc(1)
+			}
+		}
+		log.Info("Key rotation done, %d items rotated", rotated)
+	}()
+	return nil
+}
+
+/*
+rotate reseals one stored item if it isn't sealed with the active key
+*/
+func (eb *encryptedBackend) rotate(stored []byte) (bool, error) {
+	key, keyKey := eb.plainKey(stored)
+	eb.keyLocks.Lock(key)
+	defer eb.keyLocks.Unlock(key)
+	raw, err := eb.BackendDatabase.Get(stored)
+	if err != nil || raw == nil {
+		return false, err
+	}
+	value, valueKey, err := eb.openValue(key, raw)
+	if err != nil {
+		return false, err
+	}
+	if valueKey == eb.ring.active && (!eb.encryptKeys || keyKey == eb.ring.active) {
+		return false, nil
+	}
+	return true, eb.store(key, value)
+}
+
+/*
+Sync forwards to the backend when it supports it
+*/
+func (eb *encryptedBackend) Sync() error {
+	if s, ok := findSyncer(eb.BackendDatabase); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+/*
+Close stops a running rotation and closes the backend
+*/
+func (eb *encryptedBackend) Close() {
+	close(eb.quit)
+	eb.rotateDone.Wait()
+	eb.BackendDatabase.Close()
+}
+
+/*
+Stats adds the active key and rotation state to the backend stats
+*/
+func (eb *encryptedBackend) Stats() string {
+	state := "idle"
+	if atomic.LoadInt32(&eb.rotating) == 1 {
+		state = "running"
+	}
+	return fmt.Sprintf("%s\nencryption: aes-gcm, active key %d, %d older keys, keys encrypted %t, rotation %s",
+		eb.BackendDatabase.Stats(), eb.ring.active.id, len(eb.ring.previous), eb.encryptKeys, state)
+}
+
+/*
+findEncryptedBackend walks down the wrapper chain looking for the encryption layer
+*/
+func findEncryptedBackend(vdb BackendDatabase) (*encryptedBackend, bool) {
+	for vdb != nil {
+		if eb, ok := vdb.(*encryptedBackend); ok {
+			return eb, true
+		}
+		w, ok := vdb.(backendWrapper)
+		if !ok {
+			break
+		}
+		vdb = w.Unwrap()
+	}
+	return nil, false
+}
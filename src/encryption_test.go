@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestKeyFile(t *testing.T, dir string, name string, lines ...string) *keyRing {
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ring, err := loadKeyRing(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ring
+}
+
+func TestEncryptedBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beano-encryption")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := NewLevelDBBackend(filepath.Join(dir, "encrypted.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring := writeTestKeyFile(t, dir, "keys", "1 "+strings.Repeat("ab", 32))
+	eb := NewEncryptedBackend(l, ring, true, ":")
+	defer eb.Close()
+
+	eb.Set([]byte("user:eric"), []byte("clapton"))
+	eb.Set([]byte("user:jimi"), []byte("hendrix"))
+	eb.Set([]byte("counter"), []byte("10"))
+	if v, err := eb.Get([]byte("user:eric")); err != nil || string(v) != "clapton" {
+		t.Error(errUnexpected(err))
+	}
+	if v, _ := l.Get([]byte("user:eric")); v != nil {
+		t.Error(errUnexpected("key stored in clear"))
+	}
+	stored, _ := l.Range([]byte("user:"), -1, nil, false)
+	if len(stored) != 2 {
+		t.Error(errUnexpected(len(stored)))
+	}
+	for k, v := range stored {
+		if strings.Contains(k, "eric") || bytes.Contains(v, []byte("clapton")) {
+			t.Error(errUnexpected(k))
+		}
+	}
+
+	v, err := eb.Range([]byte("user:e"), -1, nil, false)
+	if err != nil || len(v) != 1 || string(v["user:eric"]) != "clapton" {
+		t.Error(errUnexpected(v))
+	}
+
+	// pages follow the plain key order, not the sealed one
+	for i := 0; i < 10; i++ {
+		eb.Set([]byte(fmt.Sprintf("page:%02d", i)), []byte(fmt.Sprintf("v%d", i)))
+	}
+	var from []byte
+	for page := 0; page < 4; page++ {
+		v, err := eb.Range([]byte("page:"), 3, from, false)
+		keys := sortedKeys(v, false)
+		want := 3
+		if page == 3 {
+			want = 1
+		}
+		if err != nil || len(keys) != want {
+			t.Fatal(errUnexpected(keys))
+		}
+		for i, k := range keys {
+			if want := fmt.Sprintf("page:%02d", page*3+i); k != want || string(v[k]) != fmt.Sprintf("v%d", page*3+i) {
+				t.Error(errUnexpected(k + " want " + want))
+			}
+		}
+		if len(keys) > 0 {
+			from = []byte(keys[len(keys)-1] + "\x00")
+		}
+	}
+
+	if i, err := eb.Incr([]byte("counter"), 5); err != nil || i != 15 {
+		t.Error(errUnexpected(err))
+	}
+	if err := eb.Add([]byte("user:eric"), []byte("cream")); err == nil {
+		t.Error(errUnexpected("add on existing key"))
+	}
+	if deleted, _ := eb.Delete([]byte("user:jimi"), true); !deleted {
+		t.Error(errUnexpected(deleted))
+	}
+	if v, _ := eb.Get([]byte("user:jimi")); v != nil {
+		t.Error(errUnexpected(v))
+	}
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beano-encryption")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := NewLevelDBBackend(filepath.Join(dir, "encrypted.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	oldRing := writeTestKeyFile(t, dir, "old", "1 "+strings.Repeat("ab", 32))
+	newRing := writeTestKeyFile(t, dir, "new", "1 "+strings.Repeat("ab", 32), "2 "+strings.Repeat("cd", 32))
+
+	l.Set([]byte("user:legacy"), []byte("plain"))
+	NewEncryptedBackend(l, oldRing, true, ":").Set([]byte("user:eric"), []byte("clapton"))
+
+	eb := NewEncryptedBackend(l, newRing, true, ":")
+	if v, _ := eb.Get([]byte("user:eric")); string(v) != "clapton" {
+		t.Error(errUnexpected(v))
+	}
+	if v, _ := eb.Get([]byte("user:legacy")); string(v) != "plain" {
+		t.Error(errUnexpected(v))
+	}
+	if err := eb.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	eb.rotateDone.Wait()
+
+	stored, _ := l.Range([]byte("user:"), -1, nil, false)
+	if len(stored) != 2 {
+		t.Error(errUnexpected(len(stored)))
+	}
+	for k, v := range stored {
+		if _, key := eb.plainKey([]byte(k)); key != newRing.active || v[valueHeaderSize] != 2 {
+			t.Error(errUnexpected(k))
+		}
+	}
+	v, _ := eb.Range([]byte("user:"), -1, nil, false)
+	if string(v["user:eric"]) != "clapton" || string(v["user:legacy"]) != "plain" {
+		t.Error(errUnexpected(v))
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// exportVersion is written in the stream header, bump it when the record layout changes
+const exportVersion = 1
+
+// exportPageSize is the number of keys read from the backend per Range call
+const exportPageSize = 1000
+
+// exportMaxSize bounds keys and values in a record, a larger size is taken as
+// corruption. exportChunkSize is how much a value buffer grows per read, so a
+// corrupt size in a short stream isn't allocated at once
+const exportMaxSize = 256 * 1024 * 1024
+const exportChunkSize = 64 * 1024
+
+const (
+	recordItem byte = 'I'
+	recordEnd  byte = 'E'
+)
+
+var errExportTruncated = errors.New("export stream truncated")
+var errExportChecksum = errors.New("export record checksum mismatch")
+
+/*
+exportItem is a record of the export stream. beano doesn't keep flags,
+exptime and cas yet, they are exported as 0 so the format doesn't change
+when it does
+*/
+type exportItem struct {
+	key     []byte
+	value   []byte
+	flags   uint32
+	exptime int64
+	cas     uint64
+}
+
+/*
+exportWriter writes the backend neutral export stream:
+
+	BEANO-EXPORT <version>\n
+	'I' <uvarint key size> <key> <uvarint flags> <varint exptime> <uvarint cas> <uvarint value size> <value> <crc32>
+	...
+	'E' <uvarint item count> <crc32>
+
+every record ends with the crc32 (IEEE, big endian) of its bytes
+*/
+type exportWriter struct {
+	w       *bufio.Writer
+	buf     []byte
+	count   uint64
+	lastKey []byte
+}
+
+func newExportWriter(w io.Writer) (*exportWriter, error) {
+	ew := exportWriter{w: bufio.NewWriter(w)}
+	if _, err := fmt.Fprintf(ew.w, "BEANO-EXPORT %d\n", exportVersion); err != nil {
+		return nil, err
+	}
+	return &ew, nil
+}
+
+func (ew *exportWriter) record(b []byte) error {
+	b = append(b, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[len(b)-4:], crc32.ChecksumIEEE(b[:len(b)-4]))
+	_, err := ew.w.Write(b)
+	ew.buf = b[:0]
+	return err
+}
+
+func (ew *exportWriter) Write(item exportItem) error {
+	b := append(ew.buf[:0], recordItem)
+	b = binary.AppendUvarint(b, uint64(len(item.key)))
+	b = append(b, item.key...)
+	b = binary.AppendUvarint(b, uint64(item.flags))
+	b = binary.AppendVarint(b, item.exptime)
+	b = binary.AppendUvarint(b, item.cas)
+	b = binary.AppendUvarint(b, uint64(len(item.value)))
+	b = append(b, item.value...)
+	if err := ew.record(b); err != nil {
+		return err
+	}
+	ew.count++
+	ew.lastKey = append(ew.lastKey[:0], item.key...)
+	return nil
+}
+
+/*
+Close writes the end record and flushes. A stream without it was cut short
+*/
+func (ew *exportWriter) Close() error {
+	b := append(ew.buf[:0], recordEnd)
+	if err := ew.record(binary.AppendUvarint(b, ew.count)); err != nil {
+		return err
+	}
+	return ew.w.Flush()
+}
+
+/*
+exportReader reads and verifies the stream written by exportWriter
+*/
+type exportReader struct {
+	r     *bufio.Reader
+	rec   []byte
+	count uint64
+}
+
+func newExportReader(r io.Reader) (*exportReader, error) {
+	er := exportReader{r: bufio.NewReader(r)}
+	header, err := er.r.ReadString('\n')
+	if err != nil {
+		return nil, errExportTruncated
+	}
+	var version int
+	if n, _ := fmt.Sscanf(header, "BEANO-EXPORT %d\n", &version); n != 1 {
+		return nil, fmt.Errorf("Not an export stream")
+	}
+	if version != exportVersion {
+		return nil, fmt.Errorf("Unsupported export version %d", version)
+	}
+	return &er, nil
+}
+
+func (er *exportReader) readByte() (byte, error) {
+	c, err := er.r.ReadByte()
+	if err != nil {
+		return 0, errExportTruncated
+	}
+	er.rec = append(er.rec, c)
+	return c, nil
+}
+
+func (er *exportReader) uvarint() (uint64, error) {
+	return binary.ReadUvarint(byteReaderFunc(er.readByte))
+}
+
+func (er *exportReader) bytes(n uint64) ([]byte, error) {
+	if n > exportMaxSize {
+		return nil, errExportChecksum
+	}
+	start := len(er.rec)
+	for left := int(n); left > 0; {
+		chunk := left
+		if chunk > exportChunkSize {
+			chunk = exportChunkSize
+		}
+		er.rec = append(er.rec, make([]byte, chunk)...)
+		if _, err := io.ReadFull(er.r, er.rec[len(er.rec)-chunk:]); err != nil {
+			return nil, errExportTruncated
+		}
+		left -= chunk
+	}
+	return er.rec[start:], nil
+}
+
+func (er *exportReader) checksum() error {
+	sum := crc32.ChecksumIEEE(er.rec)
+	var b [4]byte
+	if _, err := io.ReadFull(er.r, b[:]); err != nil {
+		return errExportTruncated
+	}
+	if binary.BigEndian.Uint32(b[:]) != sum {
+		return errExportChecksum
+	}
+	return nil
+}
+
+/*
+Next returns the next item, io.EOF after a verified end record
+*/
+func (er *exportReader) Next() (exportItem, error) {
+	var item exportItem
+	er.rec = er.rec[:0]
+	kind, err := er.readByte()
+	if err != nil {
+		return item, err
+	}
+	switch kind {
+	case recordEnd:
+		count, err := er.uvarint()
+		if err != nil {
+			return item, errExportTruncated
+		}
+		if err := er.checksum(); err != nil {
+			return item, err
+		}
+		if count != er.count {
+			return item, fmt.Errorf("Export stream holds %d items, end record says %d", er.count, count)
+		}
+		return item, io.EOF
+	case recordItem:
+	default:
+		return item, fmt.Errorf("Unknown export record %q", kind)
+	}
+
+	n, err := er.uvarint()
+	if err != nil {
+		return item, errExportTruncated
+	}
+	key, err := er.bytes(n)
+	if err != nil {
+		return item, err
+	}
+	flags, err := er.uvarint()
+	if err != nil {
+		return item, errExportTruncated
+	}
+	exptime, err := binary.ReadVarint(byteReaderFunc(er.readByte))
+	if err != nil {
+		return item, errExportTruncated
+	}
+	cas, err := er.uvarint()
+	if err != nil {
+		return item, errExportTruncated
+	}
+	if n, err = er.uvarint(); err != nil {
+		return item, errExportTruncated
+	}
+	value, err := er.bytes(n)
+	if err != nil {
+		return item, err
+	}
+	if err := er.checksum(); err != nil {
+		return item, err
+	}
+	er.count++
+	return exportItem{
+		key:     append([]byte{}, key...),
+		value:   append([]byte{}, value...),
+		flags:   uint32(flags),
+		exptime: exptime,
+		cas:     cas,
+	}, nil
+}
+
+type byteReaderFunc func() (byte, error)
+
+func (f byteReaderFunc) ReadByte() (byte, error) {
+	return f()
+}
+
+/*
+exportDB writes all keys starting with prefix, in key order, after the key
+after (excluded, nil starts from the first one). Returns the number of items
+and the last key written: an interrupted export is resumed passing it as after
+*/
+func exportDB(vdb BackendDatabase, w io.Writer, prefix []byte, after []byte) (uint64, []byte, error) {
+	ew, err := newExportWriter(w)
+	if err != nil {
+		return 0, nil, err
+	}
+	from := after
+	if from != nil {
+		from = append(append([]byte{}, after...), 0)
+	}
+	for {
+		page, err := vdb.Range(prefix, exportPageSize, from, false)
+		if err != nil {
+			return ew.count, ew.lastKey, err
+		}
+		keys := sortedKeys(page, false)
+		for _, k := range keys {
+			if err := ew.Write(exportItem{key: []byte(k), value: page[k]}); err != nil {
+				return ew.count, ew.lastKey, err
+			}
+		}
+		if len(keys) < exportPageSize {
+			break
+		}
+		from = append([]byte(keys[len(keys)-1]), 0)
+	}
+	return ew.count, ew.lastKey, ew.Close()
+}
+
+/*
+importDB stores the items of an export stream, skipping the first skip ones
+(already imported by an interrupted run). Returns the number of items done,
+the value to pass as skip to resume. progress is called after each item
+*/
+func importDB(vdb BackendDatabase, r io.Reader, prefix []byte, skip uint64, progress func(uint64) error) (uint64, error) {
+	er, err := newExportReader(r)
+	if err != nil {
+		return 0, err
+	}
+	var done uint64
+	for {
+		item, err := er.Next()
+		if err == io.EOF {
+			return done, nil
+		} else if err != nil {
+			return done, fmt.Errorf("Item %d: %s", done+1, err)
+		}
+		if er.count > skip && strings.HasPrefix(string(item.key), string(prefix)) {
+			if err := vdb.Set(item.key, item.value); err != nil {
+				return done, fmt.Errorf("Storing %s: %s", item.key, err)
+			}
+		}
+		done = er.count
+		if progress != nil {
+			if err := progress(done); err != nil {
+				return done, err
+			}
+		}
+	}
+}
+
+/*
+importProgress keeps the number of items imported in a file so an
+interrupted import resumes where it stopped
+*/
+type importProgress struct {
+	filename string
+	every    uint64
+}
+
+func (p importProgress) load() (uint64, error) {
+	b, err := ioutil.ReadFile(p.filename)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
+
+func (p importProgress) save(n uint64) error {
+	if n%p.every != 0 {
+		return nil
+	}
+	return p.write(n)
+}
+
+func (p importProgress) write(n uint64) error {
+	tmp := p.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatUint(n, 10)+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.filename)
+}
+
+/*
+runExport implements beano export
+*/
+func runExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	filename := fs.String("f", "./memcached.db", "path and file for database. for badger it needs to be a directory")
+	backend := fs.String("b", "leveldb", "backend: leveldb, boltdb or badger")
+	shards := fs.Int("shards", 1, "Number of shards of the database")
+	prefix := fs.String("prefix", "", "Export only keys starting with prefix")
+	after := fs.String("after", "", "Resume an export after this key (the last key of the interrupted export)")
+	output := fs.String("o", "", "Output file, default stdout")
+	fs.Parse(args)
+
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Error("Export: %s", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	vdb := loadDB(*backend, *filename, dbOptions{shards: *shards})
+	if vdb == nil {
+		return 1
+	}
+	defer vdb.Close()
+
+	var from []byte
+	if *after != "" {
+		from = []byte(*after)
+	}
+	n, last, err := exportDB(vdb, w, []byte(*prefix), from)
+	if err != nil {
+		log.Error("Export: %s after %d items, resume with -after %q", err, n, last)
+		return 1
+	}
+	log.Info("Exported %d items from %s", n, *filename)
+	return 0
+}
+
+/*
+runImport implements beano import
+*/
+func runImport(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	filename := fs.String("f", "./memcached.db", "path and file for database. for badger it needs to be a directory")
+	backend := fs.String("b", "leveldb", "backend: leveldb, boltdb or badger")
+	shards := fs.Int("shards", 1, "Number of shards of the database")
+	prefix := fs.String("prefix", "", "Import only keys starting with prefix")
+	input := fs.String("i", "", "Export file to import")
+	resume := fs.Bool("resume", false, "Skip the items stored by a previous, interrupted import of the same file")
+	fs.Parse(args)
+
+	if *input == "" {
+		log.Error("Import: -i is required")
+		return 1
+	}
+	f, err := os.Open(*input)
+	if err != nil {
+		log.Error("Import: %s", err)
+		return 1
+	}
+	defer f.Close()
+
+	progress := importProgress{filename: *input + ".progress", every: 1000}
+	var skip uint64
+	if *resume {
+		if skip, err = progress.load(); err != nil {
+			log.Error("Import: %s", err)
+			return 1
+		}
+		log.Info("Resuming import after %d items", skip)
+	}
+	vdb := loadDB(*backend, *filename, dbOptions{shards: *shards})
+	if vdb == nil {
+		return 1
+	}
+	defer vdb.Close()
+
+	n, err := importDB(vdb, f, []byte(*prefix), skip, progress.save)
+	if err != nil {
+		progress.write(n)
+		log.Error("Import: %s, rerun with -resume to continue", err)
+		return 1
+	}
+	os.Remove(progress.filename)
+	log.Info("Imported %d items into %s", n, *filename)
+	return 0
+}
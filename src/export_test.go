@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beano-export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, err := openBackend("leveldb", filepath.Join(dir, "src"), dbOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	for i := 0; i < 2500; i++ {
+		src.Set([]byte(fmt.Sprintf("export%04d", i)), []byte(fmt.Sprintf("clapton%d", i)))
+	}
+	src.Set([]byte("other"), []byte("hendrix"))
+
+	var buf bytes.Buffer
+	n, last, err := exportDB(src, &buf, []byte("export"), nil)
+	if err != nil || n != 2500 || string(last) != "export2499" {
+		t.Fatal(errUnexpected(fmt.Sprintf("%d %s %s", n, last, err)))
+	}
+
+	for _, backend := range []string{"boltdb", "badger"} {
+		dst, err := openBackend(backend, filepath.Join(dir, backend), dbOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := importDB(dst, bytes.NewReader(buf.Bytes()), nil, 0, nil); err != nil || n != 2500 {
+			t.Fatal(errUnexpected(fmt.Sprintf("%s: %d %s", backend, n, err)))
+		}
+		if v, _ := dst.Get([]byte("export1234")); string(v) != "clapton1234" {
+			t.Error(errUnexpected(v))
+		}
+		if v, _ := dst.Get([]byte("other")); v != nil {
+			t.Error(errUnexpected(v))
+		}
+		dst.Close()
+	}
+
+	var resumed bytes.Buffer
+	if n, _, err := exportDB(src, &resumed, []byte("export"), []byte("export2490")); err != nil || n != 9 {
+		t.Error(errUnexpected(fmt.Sprintf("%d %s", n, err)))
+	}
+}
+
+func TestImportTruncatedAndResume(t *testing.T) {
+	var buf bytes.Buffer
+	ew, _ := newExportWriter(&buf)
+	for i := 0; i < 10; i++ {
+		ew.Write(exportItem{key: []byte(fmt.Sprintf("import%d", i)), value: []byte("clapton")})
+	}
+	ew.Close()
+	stream := buf.Bytes()
+
+	// cut in the middle of the sixth record
+	cut := bytes.Index(stream, []byte("import5")) + 3
+	n, err := importDB(vleveldb, bytes.NewReader(stream[:cut]), nil, 0, nil)
+	if err == nil || n != 5 {
+		t.Fatal(errUnexpected(fmt.Sprintf("%d %s", n, err)))
+	}
+	vleveldb.Delete([]byte("import0"), false)
+	if n, err = importDB(vleveldb, bytes.NewReader(stream), nil, n, nil); err != nil || n != 10 {
+		t.Error(errUnexpected(fmt.Sprintf("%d %s", n, err)))
+	}
+	if v, _ := vleveldb.Get([]byte("import0")); v != nil {
+		t.Error(errUnexpected("skipped item imported again"))
+	}
+	if v, _ := vleveldb.Get([]byte("import9")); string(v) != "clapton" {
+		t.Error(errUnexpected(v))
+	}
+
+	corrupt := append([]byte{}, stream...)
+	corrupt[bytes.Index(corrupt, []byte("clapton"))]++
+	if _, err := importDB(vleveldb, bytes.NewReader(corrupt), nil, 0, nil); err == nil {
+		t.Error(errUnexpected("checksum not verified"))
+	}
+	for i := 0; i < 10; i++ {
+		vleveldb.Delete([]byte(fmt.Sprintf("import%d", i)), false)
+	}
+}
+
+func TestImportCorruptSizes(t *testing.T) {
+	header := fmt.Sprintf("BEANO-EXPORT %d\n", exportVersion)
+	// a key size over the limit, and a value size past the end of the stream
+	huge := append([]byte(header+"I"), binary.AppendUvarint(nil, 1<<62)...)
+	short := append([]byte(header+"I\x01k\x00\x00\x00"), binary.AppendUvarint(nil, exportMaxSize)...)
+	for _, stream := range [][]byte{huge, short} {
+		er, err := newExportReader(bytes.NewReader(stream))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := er.Next(); err != errExportChecksum && err != errExportTruncated {
+			t.Error(errUnexpected(err))
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// hashFieldSeparator ends the hash name in the keys of its fields. It's a
+// control character, the protocol refuses it in client keys
+const hashFieldSeparator = "\x01"
+
+var errHashNotInteger = errors.New("not an integer")
+
+// hashLocks serializes hincrby on the same field
+var hashLocks = newStripedLock()
+
+/*
+hashFieldKey is where field of hash key is stored: the fields of a hash
+share the key and separator as prefix, so they sort together and one range
+scan reads them all
+*/
+func hashFieldKey(key string, field string) []byte {
+	return []byte(key + hashFieldSeparator + field)
+}
+
+/*
+hashFields returns the fields of hash key and their values
+*/
+func hashFields(vdb BackendDatabase, key string) (map[string][]byte, error) {
+	prefix := key + hashFieldSeparator
+	stored, err := vdb.Range([]byte(prefix), -1, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string][]byte, len(stored))
+	for k, v := range stored {
+		fields[k[len(prefix):]] = v
+	}
+	return fields, nil
+}
+
+/*
+hashIncrBy adds delta to the integer in field of hash key, a missing field counts as 0
+*/
+func hashIncrBy(vdb BackendDatabase, key string, field string, delta int64) (int64, error) {
+	fk := hashFieldKey(key, field)
+	hashLocks.Lock(fk)
+	defer hashLocks.Unlock(fk)
+	v, err := vdb.Get(fk)
+	if err != nil {
+		return 0, err
+	}
+	var i int64
+	if v != nil {
+		if i, err = strconv.ParseInt(string(v), 10, 64); err != nil {
+			return 0, errHashNotInteger
+		}
+	}
+	i += delta
+	return i, vdb.Set(fk, []byte(strconv.FormatInt(i, 10)))
+}
+
+/*
+hashCommand runs the hash commands, each field is a key of its own so
+updates don't rewrite the whole hash:
+
+	hset <key> <field> <bytes>\r\n<data>      STORED
+	hget <key> <field...>                     VALUE <field> 0 <bytes>\r\n<data> ... END
+	hdel <key> <field>                        DELETED | NOT_FOUND
+	hgetall <key>                             VALUE <field> 0 <bytes>\r\n<data> ... END
+	hkeys <key>                               FIELD <field> ... END
+	hincrby <key> <field> <delta>             <value>
+*/
+func (ms MemcachedProtocolServer) hashCommand(c *memcachedConn, vdb BackendDatabase, cmd string, args []string) {
+	if ms.noHashes {
+		c.discardBody(cmd, args)
+		c.writeLine("SERVER_ERROR hashes are not available in this mode")
+		return
+	}
+	if !hashArgsValid(cmd, args) {
+		c.writeLine("ERROR")
+		protocolErrors.Inc(1)
+		return
+	}
+	key := args[1]
+	switch cmd {
+	case "hset":
+		n, err := strconv.Atoi(args[3])
+		if err != nil || n < 0 {
+			c.writeLine("CLIENT_ERROR bad data chunk")
+			return
+		}
+		data, err := c.readData(n)
+		if err == errTooLarge {
+			oversizedRequests.Inc(1)
+			c.writeLine("SERVER_ERROR object too large for cache")
+			return
+		} else if err != nil {
+			protocolErrors.Inc(1)
+			c.writeLine("CLIENT_ERROR bad data chunk")
+			return
+		}
+		if err := vdb.Set(hashFieldKey(key, args[2]), data); err != nil {
+			log.Error("HSET: %s", err)
+			c.writeLine("SERVER_ERROR " + err.Error())
+			return
+		}
+		cmdSet.Inc(1)
+		c.writeLine("STORED")
+
+	case "hget":
+		cmdGet.Inc(1)
+		// read all the fields first, an error replaces the whole reply
+		values := make([][]byte, len(args)-2)
+		for i, field := range args[2:] {
+			v, err := vdb.Get(hashFieldKey(key, field))
+			if err != nil {
+				log.Error("HGET: %s", err)
+				c.writeLine("SERVER_ERROR " + err.Error())
+				return
+			}
+			values[i] = v
+		}
+		for i, field := range args[2:] {
+			if values[i] == nil {
+				getMisses.Inc(1)
+				continue
+			}
+			getHits.Inc(1)
+			c.writeValue(field, values[i])
+		}
+		c.writeLine("END")
+
+	case "hdel":
+		deleted, err := vdb.Delete(hashFieldKey(key, args[2]), true)
+		if err != nil {
+			log.Error("HDEL: %s", err)
+			c.writeLine("SERVER_ERROR " + err.Error())
+			return
+		}
+		if !deleted {
+			c.writeLine("NOT_FOUND")
+			return
+		}
+		c.writeLine("DELETED")
+
+	case "hgetall", "hkeys":
+		cmdGet.Inc(1)
+		fields, err := hashFields(vdb, key)
+		if err != nil {
+			log.Error("%s: %s", strings.ToUpper(cmd), err)
+			c.writeLine("SERVER_ERROR " + err.Error())
+			return
+		}
+		for _, field := range sortedKeys(fields, false) {
+			if cmd == "hkeys" {
+				c.writeLine("FIELD " + field)
+			} else {
+				c.writeValue(field, fields[field])
+			}
+		}
+		c.writeLine("END")
+
+	case "hincrby":
+		// the read and write of a field are only serialized on this member
+		if ms.cluster != nil {
+			c.writeLine("SERVER_ERROR hincrby is not available in cluster mode")
+			return
+		}
+		delta, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil {
+			c.writeLine("CLIENT_ERROR invalid numeric delta argument")
+			return
+		}
+		i, err := hashIncrBy(vdb, key, args[2], delta)
+		if err == errHashNotInteger {
+			c.writeLine("CLIENT_ERROR field " + args[2] + " of " + key + " is not an integer")
+			return
+		} else if err != nil {
+			log.Error("HINCRBY: %s", err)
+			c.writeLine("SERVER_ERROR " + err.Error())
+			return
+		}
+		c.writeLine(strconv.FormatInt(i, 10))
+	}
+}
+
+func hashArgsValid(cmd string, args []string) bool {
+	switch cmd {
+	case "hset", "hincrby":
+		return len(args) == 4
+	case "hget":
+		return len(args) >= 3
+	case "hdel":
+		return len(args) == 3
+	default:
+		return len(args) == 2
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beano-hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	vdb := loadDB("leveldb", filepath.Join(dir, "hash.db"), dbOptions{})
+	defer vdb.Close()
+	ms := NewMemcachedProtocolServer(false, nil)
+	addr, stop := startTestServer(t, ms, vdb)
+	defer stop()
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+
+	// a plain key sharing the hash name isn't one of its fields
+	vdb.Set([]byte("user:1"), []byte("blob"))
+	vdb.Set([]byte("user:10"), []byte("other"))
+	fmt.Fprintf(conn, "hset user:1 name 7\r\nclapton\r\nhset user:1 city 6\r\nlondon\r\nhincrby user:1 visits 2\r\nhincrby user:1 visits -1\r\nhincrby user:1 name 1\r\n")
+	want := []string{"STORED", "STORED", "2", "1", "CLIENT_ERROR field name of user:1 is not an integer"}
+	for i, reply := range readReplies(t, r, len(want)) {
+		if reply != want[i] {
+			t.Error(errUnexpected(fmt.Sprintf("%q, want %q", reply, want[i])))
+		}
+	}
+
+	fmt.Fprintf(conn, "hget user:1 name missing city\r\nhgetall user:1\r\nhkeys user:1\r\n")
+	want = []string{"VALUE name 0 7", "clapton", "VALUE city 0 6", "london", "END",
+		"VALUE city 0 6", "london", "VALUE name 0 7", "clapton", "VALUE visits 0 1", "1", "END",
+		"FIELD city", "FIELD name", "FIELD visits", "END"}
+	for i, reply := range readReplies(t, r, len(want)) {
+		if reply != want[i] {
+			t.Error(errUnexpected(fmt.Sprintf("%q, want %q", reply, want[i])))
+		}
+	}
+
+	fmt.Fprintf(conn, "hdel user:1 city\r\nhdel user:1 city\r\nhkeys user:1\r\nhgetall user:2\r\nhget user:1\r\n")
+	want = []string{"DELETED", "NOT_FOUND", "FIELD name", "FIELD visits", "END", "END", "ERROR"}
+	for i, reply := range readReplies(t, r, len(want)) {
+		if reply != want[i] {
+			t.Error(errUnexpected(fmt.Sprintf("%q, want %q", reply, want[i])))
+		}
+	}
+	if v, _ := vdb.Get([]byte("user:1")); string(v) != "blob" {
+		t.Error(errUnexpected(fmt.Sprintf("plain key changed: %q", v)))
+	}
+
+	// plain keys can't name a field
+	fmt.Fprintf(conn, "set user:1\x01name 0 0 4\r\nslow\r\nget user:1\x01visits\r\nhget user:1 name\r\n")
+	want = []string{"CLIENT_ERROR bad command line format", "CLIENT_ERROR bad command line format", "VALUE name 0 7", "clapton", "END"}
+	for i, reply := range readReplies(t, r, len(want)) {
+		if reply != want[i] {
+			t.Error(errUnexpected(fmt.Sprintf("%q, want %q", reply, want[i])))
+		}
+	}
+}
+
+func TestHashRefused(t *testing.T) {
+	vdb := loadDB("inmem", "", dbOptions{})
+	defer vdb.Close()
+	ms := NewMemcachedProtocolServer(false, nil)
+	ms.noHashes = true
+	addr, stop := startTestServer(t, ms, vdb)
+	defer stop()
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+
+	// the data block of a refused hset is dropped, the next command still runs
+	fmt.Fprintf(conn, "hset user:1 name 7\r\nclapton\r\nhgetall user:1\r\nset user:1 0 0 4\r\nblob\r\n")
+	want := []string{"SERVER_ERROR hashes are not available in this mode", "SERVER_ERROR hashes are not available in this mode", "STORED"}
+	for i, reply := range readReplies(t, r, len(want)) {
+		if reply != want[i] {
+			t.Error(errUnexpected(fmt.Sprintf("%q, want %q", reply, want[i])))
+		}
+	}
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+var errKeyFilterClosed = errors.New("key filter closed")
+var errKeyFilterCorrupt = errors.New("key filter file corrupt")
+
+// keyFilterMagic heads persisted filters, bump it when the layout changes
+var keyFilterMagic = [8]byte{'B', 'E', 'A', 'N', 'O', 'K', 'F', '1'}
+
+// keyFilterMinSamples is the number of misses observed before the false positive rate is trusted
+const keyFilterMinSamples = 1000
+
+/*
+countingFilter is a counting bloom filter. Each slot is a saturating 8 bit
+counter so keys can be removed; a saturated counter is never decremented
+*/
+type countingFilter struct {
+	m        uint32
+	k        uint32
+	keys     int64
+	counters []uint8
+}
+
+/*
+newCountingFilter sizes a filter for n keys at false positive rate p
+*/
+func newCountingFilter(n int, p float64) *countingFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	k := math.Round(m / float64(n) * math.Ln2)
+	if k < 1 {
+		k = 1
+	}
+	return &countingFilter{m: uint32(m), k: uint32(k), counters: make([]uint8, uint32(m))}
+}
+
+/*
+slots calls fn with the k counter positions for key (double hashing over fnv-1a 64)
+*/
+func (f *countingFilter) slots(key []byte, fn func(i uint32)) {
+	h := uint64(14695981039346656037)
+	for _, c := range key {
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+	h1, h2 := uint32(h), uint32(h>>32)|1
+	for i := uint32(0); i < f.k; i++ {
+		fn((h1 + i*h2) % f.m)
+	}
+}
+
+func (f *countingFilter) Add(key []byte) {
+	f.slots(key, func(i uint32) {
+		if f.counters[i] < math.MaxUint8 {
+			f.counters[i]++
+		}
+	})
+	f.keys++
+}
+
+/*
+Remove must only be called for keys known to be in the filter
+*/
+func (f *countingFilter) Remove(key []byte) {
+	f.slots(key, func(i uint32) {
+		if c := f.counters[i]; c > 0 && c < math.MaxUint8 {
+			f.counters[i]--
+		}
+	})
+	f.keys--
+}
+
+func (f *countingFilter) Test(key []byte) bool {
+	found := true
+	f.slots(key, func(i uint32) {
+		if f.counters[i] == 0 {
+			found = false
+		}
+	})
+	return found
+}
+
+/*
+WriteTo stores the filter as magic, m, k, keys, counters and a crc32 of the counters
+*/
+func (f *countingFilter) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	header := struct {
+		Magic [8]byte
+		M     uint32
+		K     uint32
+		Keys  int64
+	}{keyFilterMagic, f.m, f.k, f.keys}
+	if err := binary.Write(bw, binary.BigEndian, &header); err != nil {
+		return 0, err
+	}
+	if _, err := bw.Write(f.counters); err != nil {
+		return 0, err
+	}
+	if err := binary.Write(bw, binary.BigEndian, crc32.ChecksumIEEE(f.counters)); err != nil {
+		return 0, err
+	}
+	return int64(binary.Size(header) + len(f.counters) + 4), bw.Flush()
+}
+
+/*
+readCountingFilter loads a filter written by WriteTo
+*/
+func readCountingFilter(r io.Reader) (*countingFilter, error) {
+	var header struct {
+		Magic [8]byte
+		M     uint32
+		K     uint32
+		Keys  int64
+	}
+	br := bufio.NewReader(r)
+	if err := binary.Read(br, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	if header.Magic != keyFilterMagic || header.M == 0 || header.K == 0 {
+		return nil, errKeyFilterCorrupt
+	}
+	f := countingFilter{m: header.M, k: header.K, keys: header.Keys, counters: make([]uint8, header.M)}
+	if _, err := io.ReadFull(br, f.counters); err != nil {
+		return nil, err
+	}
+	var sum uint32
+	if err := binary.Read(br, binary.BigEndian, &sum); err != nil {
+		return nil, err
+	}
+	if sum != crc32.ChecksumIEEE(f.counters) {
+		return nil, errKeyFilterCorrupt
+	}
+	return &f, nil
+}
+
+/*
+filteredBackend answers lookups for missing keys from a counting bloom filter
+instead of the backend. The filter is saved next to the database on close and
+the file is removed once loaded, so after a crash it is rebuilt from a key scan.
+When the observed false positive rate goes over maxFalsePositives the filter
+is rebuilt in the background, sized for twice the current key count.
+
+Overwrites add the key again, drifting counters up. That only costs false
+positives, which the rebuild takes care of
+*/
+type filteredBackend struct {
+	BackendDatabase
+	scanner           KeyScanner
+	filename          string
+	capacity          int
+	falsePositiveRate float64
+	maxFalsePositives float64
+	filter            *countingFilter
+	pending           *countingFilter
+	filterLock        *sync.RWMutex
+	keyLocks          *stripedLock
+	negatives         int64
+	falsePositives    int64
+	rebuilds          int64
+	rebuilding        int32
+	rebuildDone       *sync.WaitGroup
+	quit              chan bool
+}
+
+/*
+NewFilteredBackend wraps vdb with a key filter sized for capacity keys at
+falsePositiveRate, rebuilt when the observed rate exceeds maxFalsePositives.
+vdb, or a backend it wraps, must be a KeyScanner
+*/
+func NewFilteredBackend(vdb BackendDatabase, capacity int, falsePositiveRate float64, maxFalsePositives float64) (*filteredBackend, error) {
+	scanner, ok := findKeyScanner(vdb)
+	if !ok {
+		return nil, fmt.Errorf("Key filter: backend can't scan its keys")
+	}
+	fb := filteredBackend{
+		BackendDatabase:   vdb,
+		scanner:           scanner,
+		filename:          vdb.GetDbPath() + ".keyfilter",
+		capacity:          capacity,
+		falsePositiveRate: falsePositiveRate,
+		maxFalsePositives: maxFalsePositives,
+		filterLock:        &sync.RWMutex{},
+		keyLocks:          newStripedLock(),
+		rebuildDone:       &sync.WaitGroup{},
+		quit:              make(chan bool),
+	}
+	if f, err := fb.load(); err == nil {
+		fb.filter = f
+		if f.keys > int64(fb.capacity) {
+			fb.capacity = int(f.keys)
+		}
+		log.Info("Key filter loaded from %s", fb.filename)
+	} else {
+		if !os.IsNotExist(err) {
+			log.Error("Key filter: %s, rebuilding", err)
+		}
+		fb.startRebuild()
+	}
+	return &fb, nil
+}
+
+/*
+Unwrap returns the filtered backend
+*/
+func (fb *filteredBackend) Unwrap() BackendDatabase {
+	return fb.BackendDatabase
+}
+
+/*
+load reads the saved filter and removes the file, it is only valid until the next write
+*/
+func (fb *filteredBackend) load() (*countingFilter, error) {
+	file, err := os.Open(fb.filename)
+	if err != nil {
+		return nil, err
+	}
+	f, err := readCountingFilter(file)
+	file.Close()
+	if rmErr := os.Remove(fb.filename); err == nil && rmErr != nil {
+		return nil, rmErr
+	}
+	return f, err
+}
+
+func (fb *filteredBackend) save() error {
+	fb.filterLock.RLock()
+	defer fb.filterLock.RUnlock()
+	if fb.filter == nil {
+		return nil
+	}
+	tmp := fb.filename + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = fb.filter.WriteTo(file); err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, fb.filename)
+}
+
+/*
+startRebuild scans the backend into a new filter unless a rebuild is already running.
+Keys written during the scan are added to both filters
+*/
+func (fb *filteredBackend) startRebuild() {
+	if !atomic.CompareAndSwapInt32(&fb.rebuilding, 0, 1) {
+		return
+	}
+	fb.filterLock.Lock()
+	n := fb.capacity
+	if fb.filter != nil && int(2*fb.filter.keys) > n {
+		n = int(2 * fb.filter.keys)
+	}
+	fb.pending = newCountingFilter(n, fb.falsePositiveRate)
+	fb.filterLock.Unlock()
+
+	fb.rebuildDone.Add(1)
+	go func() {
+		defer fb.rebuildDone.Done()
+		defer atomic.StoreInt32(&fb.rebuilding, 0)
+		err := fb.scanner.ScanKeys(func(key []byte) error {
+			select {
+			case <-fb.quit:
+				return errKeyFilterClosed
+			default:
+			}
+			fb.filterLock.Lock()
+			fb.pending.Add(key)
+			fb.filterLock.Unlock()
+			return nil
+		})
+		fb.filterLock.Lock()
+		defer fb.filterLock.Unlock()
+		if err != nil {
+			if err != errKeyFilterClosed {
+				log.Error("Key filter rebuild: %s", err)
+			}
+			fb.pending = nil
+			return
+		}
+		fb.filter, fb.pending = fb.pending, nil
+		fb.capacity = n
+		atomic.StoreInt64(&fb.negatives, 0)
+		atomic.StoreInt64(&fb.falsePositives, 0)
+		atomic.AddInt64(&fb.rebuilds, 1)
+		keyFilterRebuilds.Inc(1)
+		log.Info("Key filter rebuilt: %d keys", fb.filter.keys)
+	}()
+}
+
+/*
+mayContain is true when the key may be stored. Without a filter (first build
+running) every key may be stored
+*/
+func (fb *filteredBackend) mayContain(key []byte) bool {
+	fb.filterLock.RLock()
+	defer fb.filterLock.RUnlock()
+	return fb.filter == nil || fb.filter.Test(key)
+}
+
+func (fb *filteredBackend) add(key []byte) {
+	fb.filterLock.Lock()
+	if fb.filter != nil {
+		fb.filter.Add(key)
+	}
+	if fb.pending != nil {
+		fb.pending.Add(key)
+	}
+	fb.filterLock.Unlock()
+}
+
+/*
+remove only touches the live filter: the pending one may not have seen the key yet
+*/
+func (fb *filteredBackend) remove(key []byte) {
+	fb.filterLock.Lock()
+	if fb.filter != nil {
+		fb.filter.Remove(key)
+	}
+	fb.filterLock.Unlock()
+}
+
+/*
+observedFalsePositives returns the share of lookups for missing keys that went to the backend
+*/
+func (fb *filteredBackend) observedFalsePositives() (float64, int64) {
+	fp := atomic.LoadInt64(&fb.falsePositives)
+	samples := fp + atomic.LoadInt64(&fb.negatives)
+	if samples == 0 {
+		return 0, 0
+	}
+	return float64(fp) / float64(samples), samples
+}
+
+/*
+Set the value for key
+*/
+func (fb *filteredBackend) Set(key []byte, value []byte) error {
+	return fb.Put(key, value, false, true)
+}
+
+/*
+Add value to key, store data only if the server doesnt holds it yet
+*/
+func (fb *filteredBackend) Add(key []byte, value []byte) error {
+	return fb.Put(key, value, false, false)
+}
+
+/*
+Replace value for key, store data only if the server already holds this key
+*/
+func (fb *filteredBackend) Replace(key []byte, value []byte) error {
+	return fb.Put(key, value, true, false)
+}
+
+/*
+Incr data, yields error if the represented value doesnt maps to int
+*/
+func (fb *filteredBackend) Incr(key []byte, value uint) (int, error) {
+	return fb.Increment(key, int(value), false)
+}
+
+/*
+Decr data, yields error if the represented value doesnt maps to int
+*/
+func (fb *filteredBackend) Decr(key []byte, value uint) (int, error) {
+	return fb.Increment(key, int(value)*-1, false)
+}
+
+/*
+Increment runs on the backend and adds the key when it may have been created
+*/
+func (fb *filteredBackend) Increment(key []byte, value int, createIfNotExists bool) (int, error) {
+	fb.keyLocks.Lock(key)
+	defer fb.keyLocks.Unlock(key)
+	i, err := fb.BackendDatabase.Increment(key, value, createIfNotExists)
+	if err == nil && createIfNotExists {
+		fb.add(key)
+	}
+	return i, err
+}
+
+/*
+Put stores the value and adds the key to the filter
+*/
+func (fb *filteredBackend) Put(key []byte, value []byte, replace bool, passthru bool) error {
+	fb.keyLocks.Lock(key)
+	defer fb.keyLocks.Unlock(key)
+	if err := fb.BackendDatabase.Put(key, value, replace, passthru); err != nil {
+		return err
+	}
+	fb.add(key)
+	return nil
+}
+
+/*
+Get skips the backend for keys the filter rules out
+*/
+func (fb *filteredBackend) Get(key []byte) ([]byte, error) {
+	if !fb.mayContain(key) {
+		atomic.AddInt64(&fb.negatives, 1)
+		keyFilterNegatives.Inc(1)
+		return nil, nil
+	}
+	v, err := fb.BackendDatabase.Get(key)
+	if err == nil && v == nil {
+		atomic.AddInt64(&fb.falsePositives, 1)
+		keyFilterFalsePositives.Inc(1)
+		if rate, samples := fb.observedFalsePositives(); samples >= keyFilterMinSamples && rate > fb.maxFalsePositives {
+			fb.startRebuild()
+		}
+	}
+	return v, err
+}
+
+/*
+Delete removes the key from the filter once the backend confirms it existed
+*/
+func (fb *filteredBackend) Delete(key []byte, onlyIfExists bool) (bool, error) {
+	fb.keyLocks.Lock(key)
+	defer fb.keyLocks.Unlock(key)
+	if !fb.mayContain(key) {
+		if onlyIfExists {
+			return false, nil
+		}
+		return fb.BackendDatabase.Delete(key, onlyIfExists)
+	}
+	v, err := fb.BackendDatabase.Get(key)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := fb.BackendDatabase.Delete(key, onlyIfExists)
+	if err == nil && v != nil {
+		fb.remove(key)
+	}
+	return deleted, err
+}
+
+/*
+Flush the backend and start over with an empty filter
+*/
+func (fb *filteredBackend) Flush() error {
+	err := fb.BackendDatabase.Flush()
+	if err == nil {
+		fb.startRebuild()
+	}
+	return err
+}
+
+/*
+Sync forwards to the backend when it supports it
+*/
+func (fb *filteredBackend) Sync() error {
+	if s, ok := findSyncer(fb.BackendDatabase); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+/*
+Close stops a running rebuild, closes the backend and saves the filter
+*/
+func (fb *filteredBackend) Close() {
+	close(fb.quit)
+	fb.rebuildDone.Wait()
+	fb.BackendDatabase.Close()
+	if err := fb.save(); err != nil {
+		log.Error("Key filter: saving %s: %s", fb.filename, err)
+	}
+}
+
+/*
+Stats adds the filter size and observed false positive rate to the backend stats
+*/
+func (fb *filteredBackend) Stats() string {
+	rate, _ := fb.observedFalsePositives()
+	fb.filterLock.RLock()
+	defer fb.filterLock.RUnlock()
+	if fb.filter == nil {
+		return fmt.Sprintf("%s\nkeyfilter: building", fb.BackendDatabase.Stats())
+	}
+	return fmt.Sprintf("%s\nkeyfilter: %d keys, %d counters, %d hashes, false positive rate %.4f, %d rebuilds",
+		fb.BackendDatabase.Stats(), fb.filter.keys, fb.filter.m, fb.filter.k, rate, atomic.LoadInt64(&fb.rebuilds))
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestFilteredBackend(t *testing.T, dir string, capacity int) *filteredBackend {
+	l, err := NewLevelDBBackend(filepath.Join(dir, "filtered.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb, err := NewFilteredBackend(l, capacity, 0.01, 0.05)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb.rebuildDone.Wait()
+	return fb
+}
+
+func TestCountingFilter(t *testing.T) {
+	f := newCountingFilter(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		f.Add([]byte(fmt.Sprintf("key%d", i)))
+	}
+	fp := 0
+	for i := 0; i < 1000; i++ {
+		if !f.Test([]byte(fmt.Sprintf("key%d", i))) {
+			t.Fatal(errUnexpected(i))
+		}
+		if f.Test([]byte(fmt.Sprintf("missing%d", i))) {
+			fp++
+		}
+	}
+	if fp > 50 {
+		t.Error(errUnexpected(fp))
+	}
+	f.Remove([]byte("key1"))
+	if f.keys != 999 {
+		t.Error(errUnexpected(f.keys))
+	}
+
+	var buf bytes.Buffer
+	if _, err := f.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	g, err := readCountingFilter(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.m != f.m || g.k != f.k || g.keys != f.keys || !bytes.Equal(g.counters, f.counters) {
+		t.Error(errUnexpected("filter changed after reload"))
+	}
+	corrupt := buf.Bytes()
+	corrupt[30]++
+	if _, err := readCountingFilter(bytes.NewReader(corrupt)); err != errKeyFilterCorrupt {
+		t.Error(errUnexpected(err))
+	}
+}
+
+func TestFilteredBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beano-keyfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fb := newTestFilteredBackend(t, dir, 100)
+
+	fb.Set([]byte("beano"), []byte("clapton"))
+	if v, err := fb.Get([]byte("beano")); err != nil || string(v) != "clapton" {
+		t.Error(errUnexpected(v))
+	}
+	negatives := keyFilterNegatives.Count()
+	if v, err := fb.Get([]byte("missing")); err != nil || v != nil {
+		t.Error(errUnexpected(v))
+	}
+	if keyFilterNegatives.Count() != negatives+1 {
+		t.Error(errUnexpected(keyFilterNegatives.Count()))
+	}
+	if deleted, _ := fb.Delete([]byte("missing"), true); deleted {
+		t.Error(errUnexpected(deleted))
+	}
+
+	// the filter survives a restart and the file is consumed on load
+	fb.Close()
+	fb = newTestFilteredBackend(t, dir, 100)
+	if _, err := os.Stat(fb.filename); !os.IsNotExist(err) {
+		t.Error(errUnexpected(err))
+	}
+	if fb.rebuilds != 0 {
+		t.Error(errUnexpected(fb.rebuilds))
+	}
+	if v, _ := fb.Get([]byte("beano")); string(v) != "clapton" {
+		t.Error(errUnexpected(v))
+	}
+	if deleted, _ := fb.Delete([]byte("beano"), true); !deleted {
+		t.Error(errUnexpected(deleted))
+	}
+	if fb.mayContain([]byte("beano")) {
+		t.Error(errUnexpected("deleted key still in filter"))
+	}
+	fb.Close()
+}
+
+func TestFilteredBackendRebuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beano-keyfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fb := newTestFilteredBackend(t, dir, 10)
+	defer fb.Close()
+
+	// way over capacity, most misses become false positives
+	for i := 0; i < 2000; i++ {
+		fb.Set([]byte(fmt.Sprintf("key%d", i)), []byte("clapton"))
+	}
+	for i := 0; i < 2*keyFilterMinSamples; i++ {
+		fb.Get([]byte(fmt.Sprintf("missing%d", i)))
+	}
+	fb.rebuildDone.Wait()
+	if fb.rebuilds == 0 || fb.capacity < 2000 {
+		t.Fatal(errUnexpected(fb.Stats()))
+	}
+	for i := 0; i < 2000; i++ {
+		if !fb.mayContain([]byte(fmt.Sprintf("key%d", i))) {
+			t.Fatal(errUnexpected(i))
+		}
+	}
+}
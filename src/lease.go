@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// leases and the last fencing token are stored under keys with control
+// characters, which the protocol refuses in client keys
+const leaseKeyPrefix = "\x00lease\x00"
+const leaseTokenKey = "\x00lease_token"
+
+var errLeaseNotHeld = errors.New("lease not held")
+
+/*
+lease is a granted lock. expires is read from the monotonic clock, wall
+clock changes don't move it
+*/
+type lease struct {
+	token   uint64
+	owner   string
+	ttl     time.Duration
+	expires time.Time
+}
+
+func (l *lease) held(now time.Time) bool {
+	return l != nil && now.Before(l.expires)
+}
+
+/*
+leaseManager grants named locks as leases with fencing tokens. Every grant
+gets a token greater than all the ones before, so a resource can refuse
+writes from a holder whose lease was taken over. Leases and the last token are
+persisted in the backend: after a restart a lease is held for its full ttl
+again, as the time it had left isn't known
+*/
+type leaseManager struct {
+	lock   sync.Mutex
+	leases map[string]*lease
+	last   uint64
+}
+
+func newLeaseManager() *leaseManager {
+	return &leaseManager{leases: make(map[string]*lease)}
+}
+
+func leaseKey(name string) []byte {
+	return []byte(leaseKeyPrefix + name)
+}
+
+/*
+get returns the lease on name, loading it from the backend, with lm locked
+*/
+func (lm *leaseManager) get(vdb BackendDatabase, name string) (*lease, error) {
+	if l, ok := lm.leases[name]; ok {
+		return l, nil
+	}
+	v, err := vdb.Get(leaseKey(name))
+	if err != nil || v == nil {
+		return nil, err
+	}
+	// <token> <ttl ms> <owner>
+	fields := strings.SplitN(string(v), " ", 3)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("bad lease %q for %s", v, name)
+	}
+	token, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad lease token %q for %s", fields[0], name)
+	}
+	ms, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad lease ttl %q for %s", fields[1], name)
+	}
+	ttl := time.Duration(ms) * time.Millisecond
+	l := &lease{token: token, owner: fields[2], ttl: ttl, expires: time.Now().Add(ttl)}
+	lm.leases[name] = l
+	return l, nil
+}
+
+func (lm *leaseManager) store(vdb BackendDatabase, name string, l *lease) error {
+	return vdb.Set(leaseKey(name), []byte(fmt.Sprintf("%d %d %s", l.token, l.ttl/time.Millisecond, l.owner)))
+}
+
+/*
+loadToken raises the last token given to the one persisted, with lm locked
+*/
+func (lm *leaseManager) loadToken(vdb BackendDatabase) error {
+	v, err := vdb.Get([]byte(leaseTokenKey))
+	if err != nil || v == nil {
+		return err
+	}
+	stored, err := strconv.ParseUint(string(v), 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad fencing token %q", v)
+	}
+	if stored > lm.last {
+		lm.last = stored
+	}
+	return nil
+}
+
+/*
+Load reads the last fencing token at start, so tokens keep increasing even
+if the backend is flushed before the next grant
+*/
+func (lm *leaseManager) Load(vdb BackendDatabase) error {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	return lm.loadToken(vdb)
+}
+
+/*
+nextToken persists and returns a fencing token greater than any given before,
+with lm locked. The one in memory covers a flushed backend
+*/
+func (lm *leaseManager) nextToken(vdb BackendDatabase) (uint64, error) {
+	if err := lm.loadToken(vdb); err != nil {
+		return 0, err
+	}
+	token := lm.last + 1
+	if err := vdb.Set([]byte(leaseTokenKey), []byte(strconv.FormatUint(token, 10))); err != nil {
+		return 0, err
+	}
+	lm.last = token
+	return token, nil
+}
+
+/*
+Flush empties the backend and releases all leases, keeping the last fencing
+token so tokens never go back, even across a restart. A nil manager only
+flushes
+*/
+func (lm *leaseManager) Flush(vdb BackendDatabase) error {
+	if lm == nil {
+		return vdb.Flush()
+	}
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	if err := lm.loadToken(vdb); err != nil {
+		return err
+	}
+	if err := vdb.Flush(); err != nil {
+		return err
+	}
+	lm.leases = make(map[string]*lease)
+	if lm.last == 0 {
+		return nil
+	}
+	return vdb.Set([]byte(leaseTokenKey), []byte(strconv.FormatUint(lm.last, 10)))
+}
+
+/*
+Lock grants name to owner for ttl if it's free or its lease expired,
+returning the fencing token. Otherwise returns the time left on the current lease
+*/
+func (lm *leaseManager) Lock(vdb BackendDatabase, name string, ttl time.Duration, owner string) (uint64, time.Duration, error) {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	l, err := lm.get(vdb, name)
+	if err != nil {
+		return 0, 0, err
+	}
+	now := time.Now()
+	if l.held(now) {
+		leaseBusy.Inc(1)
+		return 0, l.expires.Sub(now), nil
+	}
+	if l != nil {
+		leaseExpired.Inc(1)
+	}
+	token, err := lm.nextToken(vdb)
+	if err != nil {
+		return 0, 0, err
+	}
+	l = &lease{token: token, owner: owner, ttl: ttl, expires: now.Add(ttl)}
+	if err := lm.store(vdb, name, l); err != nil {
+		return 0, 0, err
+	}
+	lm.leases[name] = l
+	leaseGranted.Inc(1)
+	return token, 0, nil
+}
+
+/*
+held returns the live lease on name granted to owner with token, with lm locked
+*/
+func (lm *leaseManager) held(vdb BackendDatabase, name string, owner string, token uint64) (*lease, error) {
+	l, err := lm.get(vdb, name)
+	if err != nil {
+		return nil, err
+	}
+	if !l.held(time.Now()) || l.owner != owner || l.token != token {
+		return nil, errLeaseNotHeld
+	}
+	return l, nil
+}
+
+/*
+Renew extends the lease of owner on name to ttl from now, keeping its token
+*/
+func (lm *leaseManager) Renew(vdb BackendDatabase, name string, ttl time.Duration, owner string, token uint64) error {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	l, err := lm.held(vdb, name, owner, token)
+	if err != nil {
+		return err
+	}
+	renewed := &lease{token: token, owner: owner, ttl: ttl, expires: time.Now().Add(ttl)}
+	if err := lm.store(vdb, name, renewed); err != nil {
+		return err
+	}
+	*l = *renewed
+	leaseRenewed.Inc(1)
+	return nil
+}
+
+/*
+Unlock releases the lease of owner on name
+*/
+func (lm *leaseManager) Unlock(vdb BackendDatabase, name string, owner string, token uint64) error {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	if _, err := lm.held(vdb, name, owner, token); err != nil {
+		return err
+	}
+	if _, err := vdb.Delete(leaseKey(name), false); err != nil {
+		return err
+	}
+	delete(lm.leases, name)
+	return nil
+}
+
+/*
+leaseCommand runs lock, renew and unlock:
+
+	lock <name> <ttl ms> <owner>                  LOCKED <token> | BUSY <ms left>
+	renew <name> <ttl ms> <owner> <token>         RENEWED <token> | NOT_FOUND
+	unlock <name> <owner> <token>                 UNLOCKED | NOT_FOUND
+*/
+func (ms MemcachedProtocolServer) leaseCommand(c *memcachedConn, vdb BackendDatabase, cmd string, args []string) {
+	want := map[string]int{"lock": 4, "renew": 5, "unlock": 4}[cmd]
+	if len(args) != want {
+		c.writeLine("ERROR")
+		protocolErrors.Inc(1)
+		return
+	}
+	if ms.leases == nil {
+		c.writeLine("SERVER_ERROR locks are not available in this mode")
+		return
+	}
+	name := args[1]
+	var ttl time.Duration
+	if cmd != "unlock" {
+		ttlMs, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil || ttlMs <= 0 {
+			c.writeLine("CLIENT_ERROR bad ttl")
+			return
+		}
+		ttl = time.Duration(ttlMs) * time.Millisecond
+	}
+	var token uint64
+	if cmd != "lock" {
+		var err error
+		if token, err = strconv.ParseUint(args[len(args)-1], 10, 64); err != nil {
+			c.writeLine("CLIENT_ERROR bad token")
+			return
+		}
+	}
+	var err error
+	switch cmd {
+	case "lock":
+		var left time.Duration
+		token, left, err = ms.leases.Lock(vdb, name, ttl, args[3])
+		if err == nil && left > 0 {
+			c.writeLine(fmt.Sprintf("BUSY %d", left/time.Millisecond))
+		} else if err == nil {
+			c.writeLine(fmt.Sprintf("LOCKED %d", token))
+		}
+	case "renew":
+		if err = ms.leases.Renew(vdb, name, ttl, args[3], token); err == nil {
+			c.writeLine(fmt.Sprintf("RENEWED %d", token))
+		}
+	case "unlock":
+		if err = ms.leases.Unlock(vdb, name, args[2], token); err == nil {
+			c.writeLine("UNLOCKED")
+		}
+	}
+	if err == errLeaseNotHeld {
+		c.writeLine("NOT_FOUND")
+	} else if err != nil {
+		log.Error("LEASE: %s %s: %s", cmd, name, err)
+		c.writeLine("SERVER_ERROR " + err.Error())
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beano-lease")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	vdb := loadDB("leveldb", filepath.Join(dir, "lease.db"), dbOptions{})
+	ms := NewMemcachedProtocolServer(false, nil)
+	addr, stop := startTestServer(t, ms, vdb)
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "lock db:leader 60000 node1\r\nlock db:leader 60000 node2\r\nrenew db:leader 60000 node1 1\r\nrenew db:leader 60000 node2 1\r\nunlock db:leader node1 1\r\nlock db:leader 50 node2\r\n")
+	replies := readReplies(t, r, 6)
+	want := []string{"LOCKED 1", "BUSY", "RENEWED 1", "NOT_FOUND", "UNLOCKED", "LOCKED 2"}
+	for i, reply := range replies {
+		if !strings.HasPrefix(reply, want[i]) {
+			t.Error(errUnexpected(fmt.Sprintf("%q, want %q", reply, want[i])))
+		}
+	}
+	if left := strings.TrimPrefix(replies[1], "BUSY "); left != "59999" && left != "60000" {
+		t.Error(errUnexpected(replies[1]))
+	}
+
+	// an expired lease is taken over with a greater token, the old holder can't renew it
+	time.Sleep(100 * time.Millisecond)
+	fmt.Fprintf(conn, "renew db:leader 50 node2 2\r\nlock db:leader 60000 node3\r\nunlock db:leader node2 2\r\nlock other 60000 node1\r\n")
+	want = []string{"NOT_FOUND", "LOCKED 3", "NOT_FOUND", "LOCKED 4"}
+	for i, reply := range readReplies(t, r, len(want)) {
+		if reply != want[i] {
+			t.Error(errUnexpected(fmt.Sprintf("%q, want %q", reply, want[i])))
+		}
+	}
+	fmt.Fprintf(conn, "lock db:leader 0 node1\r\nunlock db:leader node3 three\r\nlock db:leader\r\n")
+	want = []string{"CLIENT_ERROR bad ttl", "CLIENT_ERROR bad token", "ERROR"}
+	for i, reply := range readReplies(t, r, len(want)) {
+		if reply != want[i] {
+			t.Error(errUnexpected(fmt.Sprintf("%q, want %q", reply, want[i])))
+		}
+	}
+	stop()
+	vdb.Close()
+
+	// leases and tokens survive a restart, flush_all doesn't reuse tokens
+	vdb = loadDB("leveldb", filepath.Join(dir, "lease.db"), dbOptions{})
+	lm := newLeaseManager()
+	if err := lm.Load(vdb); err != nil {
+		t.Fatal(err)
+	}
+	if _, left, err := lm.Lock(vdb, "db:leader", time.Minute, "node4"); err != nil || left <= 59*time.Second {
+		t.Error(errUnexpected(fmt.Sprintf("lease of node3 lost: %s left %v", left, err)))
+	}
+	if err := lm.Renew(vdb, "db:leader", time.Minute, "node3", 3); err != nil {
+		t.Error(errUnexpected(err))
+	}
+	if err := lm.Unlock(vdb, "other", "node1", 4); err != nil {
+		t.Error(errUnexpected(err))
+	}
+	if err := lm.Flush(vdb); err != nil {
+		t.Fatal(err)
+	}
+	if token, _, err := lm.Lock(vdb, "other", time.Minute, "node4"); err != nil || token != 5 {
+		t.Error(errUnexpected(fmt.Sprintf("token %d %v", token, err)))
+	}
+
+	// flush_all followed by a restart keeps the token too
+	if err := lm.Flush(vdb); err != nil {
+		t.Fatal(err)
+	}
+	vdb.Close()
+	vdb = loadDB("leveldb", filepath.Join(dir, "lease.db"), dbOptions{})
+	lm = newLeaseManager()
+	if err := lm.Load(vdb); err != nil {
+		t.Fatal(err)
+	}
+	if token, _, err := lm.Lock(vdb, "db:leader", time.Minute, "node4"); err != nil || token != 6 {
+		t.Error(errUnexpected(fmt.Sprintf("token %d %v", token, err)))
+	}
+	vdb.Close()
+}
+
+func TestLeaseKeysRefused(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beano-lease")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	vdb := loadDB("leveldb", filepath.Join(dir, "lease.db"), dbOptions{})
+	defer vdb.Close()
+	ms := NewMemcachedProtocolServer(false, nil)
+	ms.admin = true
+	addr, stop := startTestServer(t, ms, vdb)
+	defer stop()
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "lock db:leader 60000 node1\r\nset \x00lease_token 0 0 1\r\n0\r\ndelete \x00lease\x00db:leader\r\nflush_all\r\nlock db:leader 60000 node2\r\n")
+	want := []string{"LOCKED 1", "CLIENT_ERROR bad command line format", "CLIENT_ERROR bad command line format", "OK", "LOCKED 2"}
+	for i, reply := range readReplies(t, r, len(want)) {
+		if reply != want[i] {
+			t.Error(errUnexpected(fmt.Sprintf("%q, want %q", reply, want[i])))
+		}
+	}
+}
@@ -1,9 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"strconv"
-	"sync"
+	"time"
 
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/filter"
@@ -12,15 +13,17 @@ import (
 )
 
 /*
-KVDBBackend is the KeyValue DB abstraction. Contains a Mutex to coordinate
-file changes
+KVDBBackend is the KeyValue DB abstraction. Contains striped locks to coordinate
+read-modify-write operations on the same key
 */
 type LevelDBBackend struct {
-	filename string
-	db       *leveldb.DB
-	ro       *opt.ReadOptions
-	wo       *opt.WriteOptions
-	dbMutex  *sync.RWMutex
+	filename   string
+	db         *leveldb.DB
+	ro         *opt.ReadOptions
+	wo         *opt.WriteOptions
+	keyLocks   *stripedLock
+	coalescer  *writeCoalescer
+	durability *durability
 }
 
 /*
@@ -38,7 +41,8 @@ func NewLevelDBBackend(filename string) (*LevelDBBackend, error) {
 	b.db, err = leveldb.OpenFile(filename, &opts)
 	b.ro = new(opt.ReadOptions)
 	b.wo = new(opt.WriteOptions)
-	b.dbMutex = &sync.RWMutex{}
+	b.keyLocks = newStripedLock()
+	b.durability = newDurability(durabilityDefault, durabilityNone, 0)
 
 	if err != nil {
 		return nil, err
@@ -46,6 +50,49 @@ func NewLevelDBBackend(filename string) (*LevelDBBackend, error) {
 	return &b, nil
 }
 
+/*
+EnableGroupCommit batches plain sets and deletes issued within window into a
+single leveldb Batch of up to maxBatch writes
+*/
+func (be *LevelDBBackend) EnableGroupCommit(window time.Duration, maxBatch int) {
+	be.coalescer = newWriteCoalescer(window, maxBatch, be.commitBatch)
+}
+
+/*
+SetDurability maps the durability mode onto leveldb write options. interval
+mode syncs the journal in the background
+*/
+func (be *LevelDBBackend) SetDurability(mode durabilityMode, interval time.Duration) {
+	be.durability.stop()
+	be.durability = newDurability(mode, durabilityNone, interval)
+	be.wo.Sync = be.durability.mode == durabilitySync
+	be.durability.start(be)
+}
+
+// deleting a missing key is invisible but still goes through the journal
+var levelDBSyncMarker = []byte("\x00beano/fsync")
+
+/*
+Sync flushes the journal, making all previous writes durable
+*/
+func (be LevelDBBackend) Sync() error {
+	batch := new(leveldb.Batch)
+	batch.Delete(levelDBSyncMarker)
+	return be.db.Write(batch, &opt.WriteOptions{Sync: true})
+}
+
+func (be LevelDBBackend) commitBatch(ops []*writeOp) error {
+	batch := new(leveldb.Batch)
+	for _, op := range ops {
+		if op.delete {
+			batch.Delete(op.key)
+		} else {
+			batch.Put(op.key, op.value)
+		}
+	}
+	return be.db.Write(batch, be.wo)
+}
+
 func (be LevelDBBackend) NormalizedGet(key []byte, ro *opt.ReadOptions) ([]byte, error) {
 	v, err := be.db.Get(key, be.ro)
 	// impedance mismatch w/ levigo: v should be nil, err should be nil for key not found
@@ -97,43 +144,40 @@ func (be LevelDBBackend) Decr(key []byte, value uint) (int, error) {
 Increment - Generic get and set for incr/decr tx
 */
 func (be LevelDBBackend) Increment(key []byte, value int, createIfNotExists bool) (int, error) {
-	be.dbMutex.Lock()
+	be.keyLocks.Lock(key)
+	defer be.keyLocks.Unlock(key)
 	v, err := be.NormalizedGet(key, be.ro)
 	if createIfNotExists == false {
 		if v == nil || err != nil {
-			be.dbMutex.Unlock()
 			return -1, fmt.Errorf("Key %s do not exists, createIfNotExists set to false - %s", string(key), err)
 		}
 	}
 	if v == nil {
 		err = be.db.Put(key, []byte("0"), be.wo)
-		be.dbMutex.Unlock()
 		return 0, nil
 	}
 	i, err := strconv.Atoi(string(v))
 	if err != nil {
-		be.dbMutex.Unlock()
 		return -1, fmt.Errorf("Data cannot be incr/decr for key %s - %s", string(key), string(v))
 	}
 	i = i + value
 	s := fmt.Sprintf("%d", i)
 	err = be.db.Put(key, []byte(s), be.wo)
 	if err != nil {
-		be.dbMutex.Unlock()
 		return -1, fmt.Errorf("Error key %s - %s", string(key), err)
 	}
-	be.dbMutex.Unlock()
 	return i, nil
 
 }
 
 /*
-Put data checking if it should be replaced or exists. Generic method
+Put data checking if it should be replaced or exists. Generic method.
+Passthru writes skip the existence check and the key lock
 */
 func (be LevelDBBackend) Put(key []byte, value []byte, replace bool, passthru bool) error {
-	be.dbMutex.Lock()
-	defer be.dbMutex.Unlock()
 	if passthru == false {
+		be.keyLocks.Lock(key)
+		defer be.keyLocks.Unlock(key)
 		if replace == true {
 			v, err := be.NormalizedGet(key, be.ro)
 			if v == nil || err != nil {
@@ -145,6 +189,8 @@ func (be LevelDBBackend) Put(key []byte, value []byte, replace bool, passthru bo
 				return fmt.Errorf("Key %s exists, replace set to false - %s", string(key), err)
 			}
 		}
+	} else if be.coalescer != nil {
+		return be.coalescer.Put(key, value)
 	}
 
 	err := be.db.Put(key, value, be.wo)
@@ -155,8 +201,6 @@ func (be LevelDBBackend) Put(key []byte, value []byte, replace bool, passthru bo
 Get data for key
 */
 func (be LevelDBBackend) Get(key []byte) ([]byte, error) {
-	be.dbMutex.RLock()
-	defer be.dbMutex.RUnlock()
 	v, err := be.NormalizedGet(key, be.ro)
 	return v, err
 }
@@ -165,35 +209,39 @@ func (be LevelDBBackend) Get(key []byte) ([]byte, error) {
 Range query by key prefix. If limit == -1 no limit is applyed. Take care
 */
 func (be LevelDBBackend) Range(key []byte, limit int, from []byte, reverse bool) (map[string][]byte, error) {
-	be.dbMutex.RLock()
-	defer be.dbMutex.RUnlock()
-
-	var f func() bool
+	var ok bool
 	ret := make(map[string][]byte)
 
 	it := be.db.NewIterator(util.BytesPrefix(key), be.ro)
-
+	next := it.Next
 	if reverse == true {
-		it.Last()
-	}
-
-	if from != nil {
-		it.Seek(from)
+		next = it.Prev
 	}
 
-	if reverse == true {
-		f = it.Prev
-	} else {
-		f = it.Next
+	// position on the first key to return, from included
+	switch {
+	case from != nil && reverse == true:
+		if ok = it.Seek(from); !ok {
+			ok = it.Last()
+		} else if bytes.Compare(it.Key(), from) > 0 {
+			ok = it.Prev()
+		}
+	case from != nil:
+		ok = it.Seek(from)
+	case reverse == true:
+		ok = it.Last()
+	default:
+		ok = it.First()
 	}
 
-	for l := 1; f(); l++ {
+	for l := 1; ok; l++ {
 		k := string(it.Key())
 		ret[k] = make([]byte, len(it.Value()))
 		copy(ret[k], it.Value())
 		if limit >= 0 && limit == l {
 			break
 		}
+		ok = next()
 	}
 
 	it.Release()
@@ -204,15 +252,28 @@ func (be LevelDBBackend) Range(key []byte, limit int, from []byte, reverse bool)
 	return ret, nil
 }
 
+/*
+ScanKeys calls fn for every key in the database, stopping at the first error
+*/
+func (be LevelDBBackend) ScanKeys(fn func(key []byte) error) error {
+	it := be.db.NewIterator(nil, be.ro)
+	defer it.Release()
+	for it.Next() {
+		if err := fn(it.Key()); err != nil {
+			return err
+		}
+	}
+	return it.Error()
+}
+
 /*
 Delete key, optional check to see if it exists.
 Returns deleted boolean and error
 */
 func (be LevelDBBackend) Delete(key []byte, onlyIfExists bool) (bool, error) {
-	be.dbMutex.Lock()
-	defer be.dbMutex.Unlock()
-
 	if onlyIfExists == true {
+		be.keyLocks.Lock(key)
+		defer be.keyLocks.Unlock(key)
 		x, err := be.NormalizedGet(key, be.ro)
 		if err != nil {
 			return false, err
@@ -220,6 +281,8 @@ func (be LevelDBBackend) Delete(key []byte, onlyIfExists bool) (bool, error) {
 		if x == nil {
 			return false, nil
 		}
+	} else if be.coalescer != nil {
+		return true, be.coalescer.Delete(key)
 	}
 	err := be.db.Delete(key, be.wo)
 	return true, err
@@ -229,6 +292,10 @@ func (be LevelDBBackend) Delete(key []byte, onlyIfExists bool) (bool, error) {
 Close database
 */
 func (be LevelDBBackend) Close() {
+	be.durability.stop()
+	if be.coalescer != nil {
+		be.coalescer.Close()
+	}
 	be.db.Close()
 }
 
@@ -237,7 +304,7 @@ Stats returns db statuses
 */
 func (be LevelDBBackend) Stats() string {
 	s, _ := be.db.GetProperty("leveldb.stats")
-	return s
+	return fmt.Sprintf("%s\n%s", s, be.durability)
 }
 
 /*
@@ -248,9 +315,26 @@ func (be LevelDBBackend) GetDbPath() string {
 }
 
 /*
-Flush flushes all data from the database, not implemented
+Flush deletes all keys, in batches of 1000 from an iterator snapshot
 */
-func (be LevelDBBackend) Flush() error { return nil }
+func (be LevelDBBackend) Flush() error {
+	it := be.db.NewIterator(nil, be.ro)
+	defer it.Release()
+	batch := new(leveldb.Batch)
+	for it.Next() {
+		batch.Delete(it.Key())
+		if batch.Len() >= 1000 {
+			if err := be.db.Write(batch, be.wo); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	return be.db.Write(batch, be.wo)
+}
 
 /*
 BucketStats implement statuses for db that used the bucket idea (boltdb)
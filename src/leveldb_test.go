@@ -1,6 +1,9 @@
 package main
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestLevelDBDelete(t *testing.T) {
 	key := []byte("beano")
@@ -108,7 +111,7 @@ func TestLevelDBDecr(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	} else if v != 9 {
-		t.Error(errUnexpected(string(v)))
+		t.Error(errUnexpected(v))
 	}
 
 	if v, err := vleveldb.Get(key); err != nil {
@@ -118,3 +121,108 @@ func TestLevelDBDecr(t *testing.T) {
 	}
 	vleveldb.Delete(key, false)
 }
+
+func BenchmarkLevelDBParallelSet(b *testing.B) {
+	value := []byte("clapton")
+	b.RunParallel(func(pb *testing.PB) {
+		key := []byte(randomString(16))
+		for pb.Next() {
+			vleveldb.Set(key, value)
+		}
+	})
+}
+
+func BenchmarkLevelDBParallelIncr(b *testing.B) {
+	b.RunParallel(func(pb *testing.PB) {
+		key := []byte(randomString(16))
+		vleveldb.Set(key, []byte("0"))
+		for pb.Next() {
+			vleveldb.Incr(key, 1)
+		}
+	})
+}
+
+func TestLevelDBConcurrentIncr(t *testing.T) {
+	key := []byte("beano")
+	vleveldb.Set(key, []byte("0"))
+	done := make(chan bool)
+	for g := 0; g < 8; g++ {
+		go func() {
+			for i := 0; i < 100; i++ {
+				vleveldb.Incr(key, 1)
+			}
+			done <- true
+		}()
+	}
+	for g := 0; g < 8; g++ {
+		<-done
+	}
+	if v, err := vleveldb.Get(key); err != nil {
+		t.Error(err)
+	} else if string(v) != "800" {
+		t.Error(errUnexpected(string(v)))
+	}
+	vleveldb.Delete(key, false)
+}
+
+func TestLevelDBDurability(t *testing.T) {
+	vleveldb.SetDurability(durabilitySync, 0)
+	if !vleveldb.wo.Sync {
+		t.Error(errUnexpected(vleveldb.wo))
+	}
+	if !strings.HasSuffix(vleveldb.Stats(), "durability: sync") {
+		t.Error(errUnexpected(vleveldb.Stats()))
+	}
+	vleveldb.SetDurability(durabilityDefault, 0)
+	if vleveldb.wo.Sync {
+		t.Error(errUnexpected(vleveldb.wo))
+	}
+	if err := vleveldb.Sync(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLevelDBRange(t *testing.T) {
+	for _, k := range []string{"range1", "range2", "range3", "rangf"} {
+		vleveldb.Set([]byte(k), []byte("clapton"))
+	}
+	for _, c := range []struct {
+		limit    int
+		from     string
+		reverse  bool
+		expected string
+	}{
+		{-1, "", false, "range1 range2 range3"},
+		{2, "", false, "range1 range2"},
+		{2, "range2", false, "range2 range3"},
+		{2, "", true, "range3 range2"},
+		{-1, "range2", true, "range2 range1"},
+	} {
+		var from []byte
+		if c.from != "" {
+			from = []byte(c.from)
+		}
+		v, err := vleveldb.Range([]byte("range"), c.limit, from, c.reverse)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys := strings.Join(sortedKeys(v, c.reverse), " "); keys != c.expected {
+			t.Error(errUnexpected(keys))
+		}
+	}
+	for _, k := range []string{"range1", "range2", "range3", "rangf"} {
+		vleveldb.Delete([]byte(k), false)
+	}
+}
+
+func TestLevelDBFlush(t *testing.T) {
+	for _, k := range []string{"flush1", "flush2", "flush3"} {
+		vleveldb.Set([]byte(k), []byte("clapton"))
+	}
+	if err := vleveldb.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := vleveldb.Range(nil, -1, nil, false); err != nil || len(v) != 0 {
+		t.Error(errUnexpected(v))
+	}
+}
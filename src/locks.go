@@ -0,0 +1,46 @@
+package main
+
+import "sync"
+
+const lockStripes = 256
+
+/*
+stripedLock serializes read-modify-write operations (add, replace, incr, cas)
+on the same key while unrelated keys proceed in parallel. Plain sets don't
+need it, the stores are already safe for concurrent writes
+*/
+type stripedLock struct {
+	stripes [lockStripes]sync.Mutex
+}
+
+func newStripedLock() *stripedLock {
+	return &stripedLock{}
+}
+
+// fnv32a is fnv-1a, inlined to avoid allocating a hash.Hash per call
+func fnv32a(key []byte) uint32 {
+	h := uint32(2166136261)
+	for _, b := range key {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+	return h
+}
+
+func (sl *stripedLock) stripe(key []byte) *sync.Mutex {
+	return &sl.stripes[fnv32a(key)%lockStripes]
+}
+
+/*
+Lock the stripe owning key
+*/
+func (sl *stripedLock) Lock(key []byte) {
+	sl.stripe(key).Lock()
+}
+
+/*
+Unlock the stripe owning key
+*/
+func (sl *stripedLock) Unlock(key []byte) {
+	sl.stripe(key).Unlock()
+}
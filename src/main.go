@@ -1,9 +1,12 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	logging "github.com/op/go-logging"
 	"github.com/pkg/profile"
@@ -23,20 +26,80 @@ func setLogger() *logging.Logger {
 var log = setLogger()
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "export":
+			os.Exit(runExport(os.Args[2:]))
+		case "import":
+			os.Exit(runImport(os.Args[2:]))
+		}
+	}
+
 	address := flag.String("s", "127.0.0.1", "Bind Address")
 	port := flag.String("p", "11211", "Bind Port")
 	filename := flag.String("f", "./memcached.db", "path and file for database. for badger it needs to be a directory")
 	backend := flag.String("b", "leveldb", "backend: leveldb, boltdb, inmem or badger")
 	pf := flag.Bool("q", false, "Enable profiling")
 	dumpLogs := flag.Bool("m", false, "Enable metric dump each 60 seconds")
+	tlsCert := flag.String("tlscert", "", "TLS certificate file, enables TLS on all listeners")
+	tlsKey := flag.String("tlskey", "", "TLS private key file")
+	tlsCA := flag.String("tlsca", "", "CA bundle used to verify client certificates (mutual TLS)")
+	aclFile := flag.String("acl", "", "ACL file, enables authentication and per user access control")
+	adminPort := flag.String("adminport", "", "Port for a memcached protocol listener accepting admin commands")
+	adminOnData := flag.Bool("adminondata", false, "Allow admin commands (flush_all, switchdb, dbstats, backup) on the data port")
+	auditFile := flag.String("auditlog", "", "Audit log file for admin commands, default stdout")
+	idleTimeout := flag.Duration("idletimeout", defaultIdleTimeout, "Close client connections idle for this long, 0 disables")
+	maxConns := flag.Int("maxconns", 1024, "Max simultaneous client connections, 0 for unlimited")
+	maxLineSize := flag.Int("maxlinesize", defaultMaxLineSize, "Max command line size in bytes")
+	maxItemSize := flag.Int("maxitemsize", defaultMaxItemSize, "Max value size in bytes")
+	pubSubBuffer := flag.Int("pubsubbuffer", defaultPubSubBuffer, "Messages buffered per pub/sub subscriber, a subscriber that falls further behind is disconnected")
+	batchWindow := flag.Duration("batchwindow", 0, "Group commit window for leveldb/badger writes, 0 disables batching")
+	batchSize := flag.Int("batchsize", 128, "Max writes per group commit batch")
+	durabilityFlag := flag.String("durability", "", "sync (fsync every write), interval (fsync every -syncinterval) or none. Default is the backend native mode")
+	syncInterval := flag.Duration("syncinterval", time.Second, "fsync interval for -durability interval")
+	cacheSize := flag.Int("cache", 0, "Entries kept in an in memory LRU in front of the backend, 0 disables")
+	shards := flag.Int("shards", 1, "Spread keys over this many backend instances (<file>.shard0, <file>.shard1, ...)")
+	shardRulesFile := flag.String("shardrules", "", "Prefix rules file pinning key prefixes to shards")
+	compression := flag.String("compress", "", "Value compression: snappy, empty disables")
+	compressMin := flag.Int("compressmin", 1024, "Compress values of at least this many bytes")
+	encryptKeyFile := flag.String("encryptkeyfile", "", "AES key file, enables encryption of stored values")
+	encryptKeys := flag.Bool("encryptkeys", false, "Encrypt keys too, leaving their namespace (up to -keyseparator) in clear")
+	keySeparator := flag.String("keyseparator", ":", "Separator ending the cleartext namespace of encrypted keys")
+	restore := flag.String("restore", "", "Restore this backup file into -f before starting, -f must not exist")
+	keyFilter := flag.Int("keyfilter", 0, "Expected keys for the bloom filter answering misses, 0 disables")
+	keyFilterFP := flag.Float64("keyfilterfp", 0.01, "Key filter target false positive rate")
+	changeLogPrefix := flag.String("changelog", "", "Change log path prefix, enables the change log replicas stream from")
+	changeLogSize := flag.Int64("changelogsize", 64, "Change log segment size in MB")
+	changeLogKeep := flag.Int("changelogkeep", 4, "Change log segments kept, older changes are only available through a snapshot")
+	replicaOf := flag.String("replicaof", "", "host:port of the primary to replicate, makes this server a read only replica")
+	replicaAuth := flag.String("replicaauth", "", "\"<user> <token>\" the replica authenticates with on the primary")
+	clusterAddr := flag.String("cluster", "", "host:port of this node raft listener, enables cluster mode")
+	clusterPeers := flag.String("clusterpeers", "", "Comma separated raft addresses of the initial members, this node alone if empty")
+	clusterDir := flag.String("clusterdir", "", "Raft state directory, default <db file>.raft")
+	clusterSnapshot := flag.Uint64("clustersnapshot", 10000, "Applied raft entries kept in the log before compacting it")
+	clusterToken := flag.String("clustertoken", "", "Shared secret raft peers must present, the same on every member")
+	proxyRing := flag.String("proxy", "", "Ring file of <host:port> [weight] lines, makes this server a proxy to those nodes")
+	proxyVnodes := flag.Int("proxyvnodes", 160, "Ring points per node weight unit")
+	proxyHealth := flag.Duration("proxyhealth", time.Second, "Node health check and ring file reload interval")
+	upstream := flag.String("upstream", "", "host:port of a memcached server local misses are read from")
+	upstreamPopulate := flag.Bool("upstreampopulate", false, "Store values read from -upstream locally")
+	upstreamMirror := flag.Bool("upstreammirror", false, "Mirror writes to -upstream")
+	upstreamFlush := flag.Bool("upstreamflush", false, "Mirror flush_all to -upstream too, with -upstreammirror")
+	upstreamTimeout := flag.Duration("upstreamtimeout", 500*time.Millisecond, "Timeout of -upstream requests")
+	queues := flag.String("queues", "", "Key prefix of queues: set enqueues and get dequeues on keys starting with it")
+	keyFilterRebuild := flag.Float64("keyfilterrebuild", 0.05, "Rebuild the key filter when the observed false positive rate goes over this")
 
 	flag.Usage = func() {
 		fmt.Println("Usage: beano [-s ip] [-p port] [-f /path/to/db/file -q -b leveldb|boltdb|inmem|badger]")
+		fmt.Println("       beano export|import -h for export and import of a stopped database")
 		fmt.Println("default ip: 127.0.0.1")
 		fmt.Println("default port: 11211")
 		fmt.Println("default backend: leveldb")
 		fmt.Println("default file: ./memcached.db")
 		fmt.Println("-q enables profiling to /tmp/*.prof")
+		fmt.Println("-tlscert/-tlskey enable TLS, -tlsca requires client certificates")
+		fmt.Println("-acl /path/to/acl enables authentication")
+		fmt.Println("-adminport port enables the admin listener, -adminondata allows admin commands on the data port")
 		os.Exit(1)
 	}
 	flag.Parse()
@@ -47,8 +110,164 @@ func main() {
 
 	log.Info("Beano backend: %s | db file: %s", *backend, *filename)
 
+	var tlsConfig *tls.Config
+	if *tlsCert != "" || *tlsKey != "" {
+		var err error
+		tlsConfig, err = newTLSConfig(*tlsCert, *tlsKey, *tlsCA)
+		if err != nil {
+			log.Fatalf("TLS: %s", err)
+		}
+		log.Info("TLS enabled, client certificates required: %t", *tlsCA != "")
+	}
+
+	var acl *ACL
+	if *aclFile != "" {
+		var err error
+		acl, err = loadACL(*aclFile)
+		if err != nil {
+			log.Fatalf("ACL: %s", err)
+		}
+		log.Info("ACL enabled: %d users", len(acl.users))
+	}
+
+	durabilityMode, err := parseDurability(*durabilityFlag)
+	if err != nil {
+		log.Fatalf("Durability: %s", err)
+	}
+
+	if *keyFilterFP <= 0 || *keyFilterFP >= 1 {
+		log.Fatalf("Key filter: false positive rate must be between 0 and 1")
+	}
+
+	if *compression != "" && *compression != "snappy" {
+		log.Fatalf("Compression: unknown codec %s, use snappy", *compression)
+	}
+
+	var ring *keyRing
+	if *encryptKeyFile != "" {
+		// the change log and the raft log aren't sealed yet
+		if *changeLogPrefix != "" || *clusterAddr != "" {
+			log.Fatalf("Encryption: the change log and the raft log keep keys and values in clear, -changelog and -cluster can't be used with -encryptkeyfile")
+		}
+		ring, err = loadKeyRing(*encryptKeyFile)
+		if err != nil {
+			log.Fatalf("Encryption: %s", err)
+		}
+		log.Info("Encryption enabled: active key %d, keys encrypted: %t", ring.active.id, *encryptKeys)
+	}
+
+	var shardRules []shardRule
+	if *shardRulesFile != "" {
+		if *shards < 2 {
+			log.Fatalf("Shards: -shardrules needs -shards 2 or more")
+		}
+		shardRules, err = loadShardRules(*shardRulesFile, *shards)
+		if err != nil {
+			log.Fatalf("Shards: %s", err)
+		}
+	}
+
+	if *proxyRing != "" && (*clusterAddr != "" || *replicaOf != "" || *changeLogPrefix != "") {
+		log.Fatalf("Proxy: -cluster, -replicaof and -changelog can't be used in proxy mode")
+	}
+
+	if *queues != "" {
+		switch {
+		case *proxyRing != "" || *clusterAddr != "":
+			log.Fatalf("Queues: not available in proxy and cluster modes")
+		case *backend == "inmem" || *encryptKeys:
+			log.Fatalf("Queues: items are kept in key order, use leveldb, boltdb or badger without -encryptkeys")
+		}
+	}
+
+	if *clusterAddr != "" {
+		switch {
+		case *backend == "inmem":
+			log.Fatalf("Cluster: inmem can't be snapshotted, use a persistent backend")
+		case *replicaOf != "" || *changeLogPrefix != "":
+			log.Fatalf("Cluster: -replicaof and -changelog can't be used in cluster mode")
+		case len(*clusterToken) > raftMaxTokenSize || strings.ContainsAny(*clusterToken, "\r\n"):
+			log.Fatalf("Cluster: -clustertoken must be a single line of at most %d bytes", raftMaxTokenSize)
+		case *clusterDir == "":
+			*clusterDir = *filename + ".raft"
+		}
+	}
+
+	if *restore != "" {
+		if err := restoreBackup(*backend, *restore, *filename, *shards); err != nil {
+			log.Fatalf("Restore: %s", err)
+		}
+	}
+
+	audit, err := newAuditLog(*auditFile)
+	if err != nil {
+		log.Fatalf("Audit log: %s", err)
+	}
+
 	initializeMetrics(*filename, *dumpLogs)
 
-	serve(*address, *port, *filename, *backend)
+	serve(serverConfig{
+		address:     *address,
+		port:        *port,
+		adminPort:   *adminPort,
+		adminOnData: *adminOnData,
+		filename:    *filename,
+		backend:     *backend,
+		dbOptions: dbOptions{
+			batchWindow:  *batchWindow,
+			batchSize:    *batchSize,
+			durability:   durabilityMode,
+			syncInterval: *syncInterval,
+			cacheSize:    *cacheSize,
+			keyFilter: keyFilterOptions{
+				capacity:          *keyFilter,
+				falsePositiveRate: *keyFilterFP,
+				maxFalsePositives: *keyFilterRebuild,
+			},
+			shards:       *shards,
+			shardRules:   shardRules,
+			compression:  *compression,
+			compressMin:  *compressMin,
+			encryption:   ring,
+			encryptKeys:  *encryptKeys,
+			keySeparator: *keySeparator,
+			upstream: upstreamOptions{
+				addr:     *upstream,
+				populate: *upstreamPopulate,
+				mirror:   *upstreamMirror,
+				flush:    *upstreamFlush,
+				timeout:  *upstreamTimeout,
+			},
+		},
+		tls:         tlsConfig,
+		acl:         acl,
+		audit:       audit,
+		idleTimeout: *idleTimeout,
+		maxConns:    *maxConns,
+		maxLineSize: *maxLineSize,
+		maxItemSize: *maxItemSize,
+		pubsub:      *pubSubBuffer,
+		queues:      *queues,
+		replication: replicationOptions{
+			changeLog:   *changeLogPrefix,
+			segmentSize: *changeLogSize * 1024 * 1024,
+			keep:        *changeLogKeep,
+			replicaOf:   *replicaOf,
+			auth:        *replicaAuth,
+		},
+		cluster: clusterOptions{
+			addr:            *clusterAddr,
+			peers:           splitMembers(*clusterPeers),
+			dir:             *clusterDir,
+			snapshotEntries: *clusterSnapshot,
+			token:           *clusterToken,
+			tls:             tlsConfig,
+		},
+		proxy: proxyOptions{
+			ring:           *proxyRing,
+			vnodes:         *proxyVnodes,
+			healthInterval: *proxyHealth,
+		},
+	})
 
 }
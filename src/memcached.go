@@ -2,26 +2,55 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"strconv"
 	"strings"
 	"time"
 )
 
+var errBadDataChunk = errors.New("bad data chunk")
+var errTooLarge = errors.New("object too large for cache")
+var errLineTooLong = errors.New("line too long")
+
 /*
 MemcachedProtocolServer a protocol abstraction with db switching and ro mode
 */
 type MemcachedProtocolServer struct {
-	readonly bool
+	readonly    bool
+	acl         *ACL
+	admin       bool
+	audit       *auditLog
+	listener    string
+	idleTimeout time.Duration
+	maxLineSize int
+	maxItemSize int
+	migrate     func(backend string, filename string) error
+	changes     *changeLog
+	cluster     *raftBackend
+	pubsub      *pubSub
+	queues      *queueManager
+	leases      *leaseManager
+	noHashes    bool
 }
 
 /*
-NewMemcachedProtocolServer creates a new protocol parser
+NewMemcachedProtocolServer creates a new protocol parser. A nil acl disables authentication
 */
-func NewMemcachedProtocolServer(readonly bool) *MemcachedProtocolServer {
-	ms := MemcachedProtocolServer{readonly: readonly}
+func NewMemcachedProtocolServer(readonly bool, acl *ACL) *MemcachedProtocolServer {
+	ms := MemcachedProtocolServer{
+		readonly:    readonly,
+		acl:         acl,
+		idleTimeout: defaultIdleTimeout,
+		maxLineSize: defaultMaxLineSize,
+		maxItemSize: defaultMaxItemSize,
+		pubsub:      newPubSub(defaultPubSubBuffer),
+		leases:      newLeaseManager(),
+	}
 	return &ms
 }
 
@@ -39,29 +68,390 @@ func (ms MemcachedProtocolServer) SwitchDB(newDB string) error {
 	return nil
 }
 
-func (ms MemcachedProtocolServer) readLine(conn net.Conn, buf *bufio.ReadWriter) ([]byte, error) {
-	conn.SetReadDeadline(time.Now().Add(time.Second * 10))
-	d, _, err := buf.ReadLine()
-	return d, err
+const defaultIdleTimeout = 10 * time.Second
+const defaultMaxLineSize = 64 * 1024
+const defaultMaxItemSize = 1024 * 1024
+const bufferSize = 16 * 1024
+
+/*
+memcachedConn holds per connection state: buffers reused across commands and the authenticated user
+*/
+type memcachedConn struct {
+	conn        net.Conn
+	buf         *bufio.ReadWriter
+	args        []string
+	scratch     []byte
+	user        *aclUser
+	queueReads  map[string]uint64
+	idleTimeout time.Duration
+	maxLineSize int
+	maxItemSize int
 }
 
-func (ms MemcachedProtocolServer) writeLine(buf *bufio.ReadWriter, s string) error {
-	_, err := buf.WriteString(fmt.Sprintf("%s\r\n", s))
+func newMemcachedConn(conn net.Conn, ms MemcachedProtocolServer) *memcachedConn {
+	return &memcachedConn{
+		conn:        conn,
+		buf:         bufio.NewReadWriter(bufio.NewReaderSize(conn, bufferSize), bufio.NewWriterSize(conn, bufferSize)),
+		args:        make([]string, 0, 16),
+		queueReads:  make(map[string]uint64),
+		scratch:     make([]byte, 0, 64),
+		idleTimeout: ms.idleTimeout,
+		maxLineSize: ms.maxLineSize,
+		maxItemSize: ms.maxItemSize,
+	}
+}
+
+/*
+setDeadline arms the idle timeout before a blocking read. Zero disables it
+*/
+func (c *memcachedConn) setDeadline() {
+	if c.idleTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.idleTimeout))
+	}
+}
+
+/*
+flushBeforeRead flushes pending replies only when the next read would block on
+the network, so a pipelined batch is answered with a single write
+*/
+func (c *memcachedConn) flushBeforeRead(complete func([]byte) bool) {
+	buffered, _ := c.buf.Reader.Peek(c.buf.Reader.Buffered())
+	if !complete(buffered) {
+		c.buf.Flush()
+	}
+}
+
+func hasLine(b []byte) bool {
+	return bytes.IndexByte(b, '\n') >= 0
+}
+
+func (c *memcachedConn) readLine() (string, error) {
+	return c.readLineLimit(c.maxLineSize)
+}
+
+/*
+readLineLimit reads a line without its \r\n, zero max is no limit. A line
+longer than max is read to its end without keeping it, so the connection stays
+in sync, and fails with errLineTooLong
+*/
+func (c *memcachedConn) readLineLimit(max int) (string, error) {
+	c.flushBeforeRead(hasLine)
+	c.setDeadline()
+	line, err := c.buf.ReadSlice('\n')
+	tooLong := false
+	if err == bufio.ErrBufferFull {
+		long := append([]byte(nil), line...)
+		for err == bufio.ErrBufferFull {
+			if max > 0 && len(long) > max {
+				tooLong = true
+				long = long[:0]
+			}
+			line, err = c.buf.ReadSlice('\n')
+			long = append(long, line...)
+		}
+		line = long
+	}
 	if err != nil {
-		return err
+		return "", err
+	}
+	line = bytes.TrimRight(line, "\r\n")
+	if tooLong || max > 0 && len(line) > max {
+		return "", errLineTooLong
+	}
+	return string(line), nil
+}
+
+/*
+readBody reads the data block of a storage command. Clients that don't send
+<bytes> on the command line get the next line as data
+*/
+func (c *memcachedConn) readBody(args []string) ([]byte, error) {
+	if len(args) < 5 {
+		line, err := c.readLineLimit(c.maxItemSize)
+		if err == errLineTooLong {
+			return nil, errTooLarge
+		}
+		return []byte(line), err
 	}
-	err = buf.Flush()
-	return err
+	n, err := strconv.Atoi(args[4])
+	if err != nil || n < 0 {
+		return nil, errBadDataChunk
+	}
+	return c.readData(n)
 }
 
-func (ms MemcachedProtocolServer) checkRO(buf *bufio.ReadWriter) bool {
+/*
+readData reads a data block of n bytes followed by \r\n
+*/
+func (c *memcachedConn) readData(n int) ([]byte, error) {
+	c.flushBeforeRead(func(b []byte) bool { return len(b) >= n+2 })
+	c.setDeadline()
+	if c.maxItemSize > 0 && n > c.maxItemSize {
+		// swallow the data block so the connection stays in sync
+		if _, err := io.CopyN(ioutil.Discard, c.buf, int64(n)+2); err != nil {
+			return nil, err
+		}
+		return nil, errTooLarge
+	}
+	body := make([]byte, n+2)
+	if _, err := io.ReadFull(c.buf, body); err != nil {
+		return nil, err
+	}
+	if body[n] != '\r' || body[n+1] != '\n' {
+		// resync on the next line
+		if !bytes.HasSuffix(body, []byte("\n")) {
+			c.readLine()
+		}
+		return nil, errBadDataChunk
+	}
+	return body[:n], nil
+}
+
+/*
+discardBody reads and drops the data block of a refused command, so the
+connection stays in sync
+*/
+func (c *memcachedConn) discardBody(cmd string, args []string) {
+	var size string
+	switch {
+	case cmd == "set" || cmd == "add" || cmd == "replace":
+		c.readBody(args)
+		return
+	case cmd == "hset" && len(args) == 4:
+		size = args[3]
+	case cmd == "publish" && len(args) == 3:
+		size = args[2]
+	default:
+		return
+	}
+	if n, err := strconv.Atoi(size); err == nil && n >= 0 {
+		c.readData(n)
+	}
+}
+
+/*
+validArgs refuses control characters in a command line. Clients can't name
+the internal keys of queues, leases and hashes, which use them as separators
+*/
+func validArgs(args []string) bool {
+	for _, arg := range args {
+		for i := 0; i < len(arg); i++ {
+			if arg[i] < ' ' || arg[i] == 0x7f {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (c *memcachedConn) writeLine(s string) {
+	c.buf.WriteString(s)
+	c.buf.WriteString("\r\n")
+}
+
+func (c *memcachedConn) writeValue(key string, value []byte) {
+	c.buf.WriteString("VALUE ")
+	c.buf.WriteString(key)
+	c.buf.WriteString(" 0 ")
+	c.scratch = strconv.AppendInt(c.scratch[:0], int64(len(value)), 10)
+	c.buf.Write(c.scratch)
+	c.buf.WriteString("\r\n")
+	c.buf.Write(value)
+	c.buf.WriteString("\r\n")
+}
+
+/*
+splitArgs splits a command line on spaces reusing the args slice
+*/
+func splitArgs(line string, args []string) []string {
+	args = args[:0]
+	for len(line) > 0 {
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			args = append(args, line)
+			break
+		}
+		if i > 0 {
+			args = append(args, line[:i])
+		}
+		line = line[i+1:]
+	}
+	return args
+}
+
+func (ms MemcachedProtocolServer) checkRO(c *memcachedConn) bool {
 	if ms.readonly {
-		ms.writeLine(buf, "ERROR")
+		c.writeLine("ERROR")
 		readonlyErrors.Inc(1)
 	}
 	return ms.readonly
 }
 
+/*
+hasOption reports if one of the two trailing tokens is opt, as in "set k 0 0 1 sync noreply"
+*/
+func hasOption(args []string, opt string) bool {
+	for i := len(args) - 1; i >= 2 && i >= len(args)-2; i-- {
+		if args[i] == opt {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+syncRequested fsyncs the backend after a write carrying the "sync" option.
+Replies with an error and returns false if the sync failed
+*/
+func (ms MemcachedProtocolServer) syncRequested(c *memcachedConn, vdb BackendDatabase, args []string) bool {
+	if !hasOption(args, "sync") {
+		return true
+	}
+	s, ok := findSyncer(vdb)
+	if !ok {
+		return true
+	}
+	if err := s.Sync(); err != nil {
+		log.Error("SYNC: %s", err)
+		c.writeLine("SERVER_ERROR sync failed")
+		return false
+	}
+	return true
+}
+
+/*
+commandKeys returns the keys a command operates on, for access control
+*/
+func commandKeys(cmd string, args []string) []string {
+	switch cmd {
+	case "get":
+		keys := args[1:]
+		if len(keys) > 0 && keys[len(keys)-1] == "noreply" {
+			keys = keys[:len(keys)-1]
+		}
+		return keys
+	case "subscribe", "psubscribe":
+		return args[1:]
+	// gets is the range alias, its second argument is the limit
+	case "set", "add", "replace", "delete", "range", "gets", "watch", "publish", "lock", "renew", "unlock",
+		"hset", "hget", "hdel", "hgetall", "hkeys", "hincrby":
+		if len(args) > 1 {
+			return args[1:2]
+		}
+	}
+	return nil
+}
+
+/*
+checkAdmin refuses admin commands on listeners without admin enabled and audits the allowed ones
+*/
+func (ms MemcachedProtocolServer) checkAdmin(c *memcachedConn, cmd string, args []string) bool {
+	if commandClasses[cmd] != classAdmin {
+		return true
+	}
+	if !ms.admin {
+		adminDenials.Inc(1)
+		c.writeLine("CLIENT_ERROR admin commands are disabled on this listener")
+		return false
+	}
+	name := ""
+	if c.user != nil {
+		name = c.user.name
+	}
+	ms.audit.Record(c.conn.RemoteAddr().String(), name, ms.listener, args...)
+	return true
+}
+
+/*
+authorize checks the command against the connection user acl and replies with an error if denied
+*/
+func (ms MemcachedProtocolServer) authorize(c *memcachedConn, cmd string, args []string) bool {
+	class := commandClasses[cmd]
+	if ms.acl == nil || class == classNone {
+		return true
+	}
+	allowed := c.user.Allowed(class, commandKeys(cmd, args))
+	if allowed {
+		return true
+	}
+	c.discardBody(cmd, args)
+	if c.user == nil {
+		authFailures.Inc(1)
+		c.writeLine("CLIENT_ERROR unauthenticated")
+	} else {
+		aclDenials.Inc(1)
+		log.Error("ACL: user %s denied %s from %s", c.user.name, cmd, c.conn.RemoteAddr())
+		c.writeLine("CLIENT_ERROR access denied")
+	}
+	return false
+}
+
+/*
+queueGet runs a get on a queue, replying with the item taken if any. Reads
+that take items need write access, queues are only served in read write mode
+*/
+func (ms MemcachedProtocolServer) queueGet(c *memcachedConn, vdb BackendDatabase, key string, noreply bool) {
+	r, err := parseQueueRead(key)
+	if err != nil {
+		protocolErrors.Inc(1)
+		log.Error("QUEUE: %s", err)
+		return
+	}
+	if ms.readonly {
+		readonlyErrors.Inc(1)
+		return
+	}
+	if ms.acl != nil && !r.peek && !c.user.Allowed(classWrite, []string{r.name}) {
+		aclDenials.Inc(1)
+		return
+	}
+	if r.timeout > 0 {
+		// don't hold earlier replies while waiting
+		c.buf.Flush()
+	}
+	v, err := ms.queues.Read(vdb, c.queueReads, r)
+	if err != nil {
+		log.Error("QUEUE: %s: %s", r.name, err)
+		return
+	}
+	if v == nil {
+		getMisses.Inc(1)
+		return
+	}
+	getHits.Inc(1)
+	if noreply == false {
+		c.writeValue(key, v)
+	}
+}
+
+/*
+getMulti fetches all keys of a get in one call, replying in the order asked
+*/
+func (ms MemcachedProtocolServer) getMulti(c *memcachedConn, mg MultiGetter, args []string, noreply bool) {
+	keys := make([][]byte, len(args))
+	for i, arg := range args {
+		keys[i] = []byte(arg)
+	}
+	values, err := mg.GetMulti(keys)
+	if err != nil {
+		log.Error("GET: %s", err)
+	}
+	for _, arg := range args {
+		v, ok := values[arg]
+		if !ok {
+			getMisses.Inc(1)
+			continue
+		}
+		if noreply == false {
+			c.writeValue(arg, v)
+			getHits.Inc(1)
+		}
+	}
+	if noreply == false {
+		c.writeLine("END")
+	}
+}
+
 /*
 Parse memcachedprotocol and bind it with a DB Backend ops
 */
@@ -69,42 +459,56 @@ func (ms MemcachedProtocolServer) Parse(conn net.Conn, vdb BackendDatabase) {
 	totalThreads.Inc(1)
 	currThreads.Inc(1)
 	defer currThreads.Dec(1)
-	conn.SetReadDeadline(time.Now().Add(time.Second * 10))
 	defer conn.Close()
-	startTime := time.Now()
+	identity, err := connIdentity(conn)
+	if err != nil {
+		tlsErrors.Inc(1)
+		log.Error("TLS handshake with %s failed: %s", conn.RemoteAddr(), err)
+		return
+	}
+	c := newMemcachedConn(conn, ms)
+	defer c.buf.Flush()
+	defer ms.queues.AbortAll(c.queueReads)
+	if ms.acl != nil {
+		c.user = ms.acl.UserByIdentity(identity)
+	}
+	if c.user != nil {
+		log.Debug("Client %s authenticated by certificate as %s", conn.RemoteAddr(), identity)
+	}
 	for {
-		buf := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
 		noreply := false
-		line, err := ms.readLine(conn, buf)
+		line, err := c.readLine()
 		if err != nil {
-			if err != io.EOF {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				log.Info("Closing idle connection from %s after %s", conn.RemoteAddr(), c.idleTimeout)
+			} else if err == errLineTooLong {
+				oversizedRequests.Inc(1)
+				c.writeLine("CLIENT_ERROR line too long")
+			} else if err != io.EOF {
 				networkErrors.Inc(1)
 				log.Error("Connection closed: error %s\n", err)
 			}
 			return
 		}
+		startTime := time.Now()
 
-		if line == nil {
-			if time.Now().Sub(startTime) > time.Second*3 {
-				conn.Close()
-				networkErrors.Inc(1)
-				log.Info("Closing idle connection after timeout")
-				return
-			}
+		if len(line) < 3 {
+			protocolErrors.Inc(1)
+			c.writeLine("ERROR")
 			continue
-
-		} else {
-			startTime = time.Now()
 		}
 
-		if len(line) < 3 || err != nil {
+		c.args = splitArgs(line, c.args)
+		args := c.args
+		if len(args) == 0 {
 			protocolErrors.Inc(1)
-			ms.writeLine(buf, "ERROR")
+			c.writeLine("ERROR")
 			continue
 		}
-
-		args := strings.Split(string(line), " ")
-		cmd := strings.ToLower(args[0])
+		cmd := args[0]
+		if !isLower(cmd) {
+			cmd = strings.ToLower(cmd)
+		}
 
 		if args[len(args)-1] == "noreply" {
 			noreply = true
@@ -112,17 +516,55 @@ func (ms MemcachedProtocolServer) Parse(conn net.Conn, vdb BackendDatabase) {
 			noreply = false
 		}
 
+		if !validArgs(args) {
+			protocolErrors.Inc(1)
+			c.discardBody(cmd, args)
+			c.writeLine("CLIENT_ERROR bad command line format")
+			continue
+		}
+
+		if !ms.authorize(c, cmd, args) || !ms.checkAdmin(c, cmd, args) {
+			continue
+		}
+
 		switch true {
+		case cmd == "auth":
+			if ms.acl == nil || len(args) != 3 {
+				c.writeLine("ERROR")
+				protocolErrors.Inc(1)
+				break
+			}
+			c.user = ms.acl.Authenticate(args[1], args[2])
+			if c.user == nil {
+				authFailures.Inc(1)
+				log.Error("AUTH: failed for %s from %s", args[1], conn.RemoteAddr())
+				c.writeLine("CLIENT_ERROR authentication failed")
+				break
+			}
+			c.writeLine("OK")
+
 		case cmd == "get":
 			if len(args) < 2 {
-				ms.writeLine(buf, "ERROR")
+				c.writeLine("ERROR")
+				protocolErrors.Inc(1)
+				break
+			}
+			// a trailing noreply isn't a key
+			keys := commandKeys(cmd, args)
+			if len(keys) == 0 {
+				c.writeLine("ERROR")
 				protocolErrors.Inc(1)
 				break
 			}
 			cmdGet.Inc(1)
-			for _, arg := range args[1:] {
-				if arg == " " || arg == "" {
-					break
+			if mg, ok := findMultiGetter(vdb); ok && len(keys) > 1 {
+				ms.getMulti(c, mg, keys, noreply)
+				break
+			}
+			for _, arg := range keys {
+				if ms.queues.IsQueue(arg) {
+					ms.queueGet(c, vdb, arg, noreply)
+					continue
 				}
 				v, err := vdb.Get([]byte(arg))
 				if v == nil {
@@ -135,165 +577,178 @@ func (ms MemcachedProtocolServer) Parse(conn net.Conn, vdb BackendDatabase) {
 				}
 
 				if noreply == false {
-					ms.writeLine(buf, fmt.Sprintf("VALUE %s 0 %d", arg, len(v)))
-					ms.writeLine(buf, string(v))
+					c.writeValue(arg, v)
 					getHits.Inc(1)
 				}
 			}
 			if noreply == false {
-				ms.writeLine(buf, "END")
+				c.writeLine("END")
 			}
 
 		case cmd == "set":
-			if ms.checkRO(buf) {
+			if ms.checkRO(c) {
 				break
 			}
 			if len(args) < 2 {
-				ms.writeLine(buf, "ERROR")
+				c.writeLine("ERROR")
 				protocolErrors.Inc(1)
 				break
 			}
-			// retrieve body
-			body, err := ms.readLine(conn, buf)
-			if len(body) == 0 || err != nil {
-				ms.writeLine(buf, "ERROR")
+			body, err := c.readBody(args)
+			if err == errBadDataChunk {
+				c.writeLine("CLIENT_ERROR bad data chunk")
+				protocolErrors.Inc(1)
+			} else if err == errTooLarge {
+				c.writeLine("SERVER_ERROR object too large for cache")
+				oversizedRequests.Inc(1)
+			} else if len(body) == 0 || err != nil {
+				c.writeLine("ERROR")
 				protocolErrors.Inc(1)
 			} else {
-				err = vdb.Set([]byte(args[1]), []byte(body))
+				if ms.queues.IsQueue(args[1]) {
+					err = ms.queues.Enqueue(vdb, args[1], body)
+				} else {
+					err = vdb.Set([]byte(args[1]), body)
+				}
 				if err != nil {
 					log.Error("SET: %s", err)
-					ms.writeLine(buf, "ERROR")
+					c.writeLine("ERROR")
 					protocolErrors.Inc(1)
 					break
 				}
 				cmdSet.Inc(1)
 				totalItems.Inc(1)
 				currItems.Inc(1)
+				if !ms.syncRequested(c, vdb, args) {
+					break
+				}
 				if noreply == false {
-					ms.writeLine(buf, "STORED")
+					c.writeLine("STORED")
 				}
 			}
-			break
 
 		case cmd == "replace":
-			if ms.checkRO(buf) {
+			if ms.checkRO(c) {
 				break
 			}
 			if len(args) < 2 {
-				ms.writeLine(buf, "ERROR")
+				c.writeLine("ERROR")
 				protocolErrors.Inc(1)
 				break
 			}
-			// retrieve body
-			body, err := ms.readLine(conn, buf)
-			if len(body) == 0 || err != nil {
-				ms.writeLine(buf, "ERROR")
+			body, err := c.readBody(args)
+			if err == errBadDataChunk {
+				c.writeLine("CLIENT_ERROR bad data chunk")
+				protocolErrors.Inc(1)
+			} else if err == errTooLarge {
+				c.writeLine("SERVER_ERROR object too large for cache")
+				oversizedRequests.Inc(1)
+			} else if len(body) == 0 || err != nil {
+				c.writeLine("ERROR")
 				protocolErrors.Inc(1)
-				break
 			} else {
-				err := vdb.Replace([]byte(args[1]), []byte(body))
+				err := vdb.Replace([]byte(args[1]), body)
 				if err != nil {
 					log.Error("REPLACE: %s", err)
-					ms.writeLine(buf, "NOT_STORED")
-				} else {
-					ms.writeLine(buf, "STORED")
+					c.writeLine("NOT_STORED")
+				} else if ms.syncRequested(c, vdb, args) {
+					c.writeLine("STORED")
 				}
 			}
-			break
 
 		case cmd == "add":
-			if ms.checkRO(buf) {
+			if ms.checkRO(c) {
 				break
 			}
 			if len(args) < 2 {
-				ms.writeLine(buf, "ERROR")
+				c.writeLine("ERROR")
 				protocolErrors.Inc(1)
 				break
 			}
-
-			// retrieve body
-			body, err := ms.readLine(conn, buf)
-			if len(body) == 0 || err != nil {
-				ms.writeLine(buf, "ERROR")
+			body, err := c.readBody(args)
+			if err == errBadDataChunk {
+				c.writeLine("CLIENT_ERROR bad data chunk")
+				protocolErrors.Inc(1)
+			} else if err == errTooLarge {
+				c.writeLine("SERVER_ERROR object too large for cache")
+				oversizedRequests.Inc(1)
+			} else if len(body) == 0 || err != nil {
+				c.writeLine("ERROR")
 				protocolErrors.Inc(1)
-				break
 			} else {
-				err := vdb.Add([]byte(args[1]), []byte(body))
+				err := vdb.Add([]byte(args[1]), body)
 				if err != nil {
 					log.Error("ADD: %s", err)
-					ms.writeLine(buf, "NOT_STORED")
-				} else {
-					ms.writeLine(buf, "STORED")
+					c.writeLine("NOT_STORED")
+				} else if ms.syncRequested(c, vdb, args) {
+					c.writeLine("STORED")
 				}
 			}
-			break
 
 		case cmd == "quit":
 			if len(args) > 1 {
-				ms.writeLine(buf, "ERROR")
+				c.writeLine("ERROR")
 				protocolErrors.Inc(1)
 				break
-			} else {
-				conn.Close()
-				return
 			}
+			return
 
 		case cmd == "version":
 			if len(args) > 1 {
-				ms.writeLine(buf, "ERROR")
+				c.writeLine("ERROR")
 				protocolErrors.Inc(1)
 			} else {
-				ms.writeLine(buf, "VERSION BEANO")
+				c.writeLine("VERSION BEANO")
 			}
-			break
 
 		case cmd == "flush_all":
-			if ms.checkRO(buf) {
+			if ms.checkRO(c) {
 				break
 			}
-			vdb.Flush()
-			ms.writeLine(buf, "OK")
-			break
+			if err := ms.leases.Flush(vdb); err != nil {
+				log.Error("FLUSH: %s", err)
+				c.writeLine("SERVER_ERROR " + err.Error())
+				break
+			}
+			c.writeLine("OK")
 
 		case cmd == "verbosity":
 			if len(args) < 2 || len(args) > 3 {
-				ms.writeLine(buf, "ERROR")
+				c.writeLine("ERROR")
 				protocolErrors.Inc(1)
 			} else {
-				ms.writeLine(buf, "OK")
+				c.writeLine("OK")
 			}
-			break
 
 		case cmd == "switchdb":
-			if ms.checkRO(buf) {
+			if ms.checkRO(c) {
 				break
 			}
 			if len(args) < 2 || len(args) > 3 {
-				ms.writeLine(buf, "ERROR")
+				c.writeLine("ERROR")
 				protocolErrors.Inc(1)
 			} else {
 				err := ms.SwitchDB(args[1])
 				if err != nil {
-					ms.writeLine(buf, "ERROR")
+					c.writeLine("ERROR")
 					protocolErrors.Inc(1)
 					log.Error("SWITCHDB: %s", err)
 				}
-				s := fmt.Sprintf("%s\nOK", args[1])
-				ms.writeLine(buf, s)
+				c.writeLine(args[1])
+				c.writeLine("OK")
 			}
-			break
 
 		case cmd == "delete":
-			if ms.checkRO(buf) {
+			if ms.checkRO(c) {
 				break
 			}
 			if len(args) < 2 {
-				ms.writeLine(buf, "ERROR")
+				c.writeLine("ERROR")
 				protocolErrors.Inc(1)
 				break
 			}
-			if len(args) > 3 {
-				ms.writeLine(buf, "ERROR")
+			if len(args) > 4 {
+				c.writeLine("ERROR")
 				protocolErrors.Inc(1)
 				break
 			}
@@ -303,27 +758,170 @@ func (ms MemcachedProtocolServer) Parse(conn net.Conn, vdb BackendDatabase) {
 				log.Error("DELETE: %s", err)
 			}
 			if deleted == true {
-				ms.writeLine(buf, "DELETED")
+				if !ms.syncRequested(c, vdb, args) {
+					break
+				}
+				c.writeLine("DELETED")
 				currItems.Dec(1)
 			} else if deleted == false {
-				ms.writeLine(buf, "NOT_FOUND")
+				c.writeLine("NOT_FOUND")
 			}
-			break
 
 		case cmd == "dbstats":
 			if len(args) > 1 {
-				ms.writeLine(buf, "ERROR")
+				c.writeLine("ERROR")
 				protocolErrors.Inc(1)
 			} else {
-				ms.writeLine(buf, "VERSION BEANO")
+				c.writeLine("VERSION BEANO")
 			}
-			s := vdb.Stats()
-			ms.writeLine(buf, s)
-			ms.writeLine(buf, "OK")
-			break
+			c.writeLine(vdb.Stats())
+			c.writeLine("OK")
+
+		case cmd == "backup":
+			if len(args) != 2 {
+				c.writeLine("ERROR")
+				protocolErrors.Inc(1)
+				break
+			}
+			files, err := backupToDir(vdb, args[1])
+			if err != nil {
+				log.Error("BACKUP: %s", err)
+				c.writeLine("SERVER_ERROR backup failed")
+				break
+			}
+			for _, f := range files {
+				c.writeLine(f)
+			}
+			c.writeLine("OK")
+
+		case cmd == "migrate":
+			if len(args) != 3 {
+				c.writeLine("ERROR")
+				protocolErrors.Inc(1)
+				break
+			}
+			if ms.migrate == nil {
+				c.writeLine("SERVER_ERROR migration not available")
+				break
+			}
+			if err := ms.migrate(args[1], args[2]); err != nil {
+				log.Error("MIGRATE: %s", err)
+				c.writeLine("SERVER_ERROR " + err.Error())
+				break
+			}
+			c.writeLine("OK")
+
+		case cmd == "replicate":
+			if len(args) != 2 {
+				c.writeLine("ERROR")
+				protocolErrors.Inc(1)
+				break
+			}
+			from, err := strconv.ParseUint(args[1], 10, 64)
+			if err != nil {
+				c.writeLine("CLIENT_ERROR bad sequence")
+				break
+			}
+			if ms.changes == nil {
+				c.writeLine("SERVER_ERROR change log not enabled")
+				break
+			}
+			// the connection belongs to the replica stream from now on
+			serveReplica(c, vdb, ms.changes, from)
+			return
+
+		case cmd == "watch":
+			if len(args) < 2 || len(args) > 3 {
+				c.writeLine("ERROR")
+				protocolErrors.Inc(1)
+				break
+			}
+			var from uint64
+			if len(args) == 3 {
+				if from, err = strconv.ParseUint(args[2], 10, 64); err != nil || from == 0 {
+					c.writeLine("CLIENT_ERROR bad sequence")
+					break
+				}
+			}
+			if ms.changes == nil {
+				c.writeLine("SERVER_ERROR change log not enabled")
+				break
+			}
+			// the connection belongs to the event stream from now on
+			serveWatch(c, ms.changes, args[1], from)
+			return
+
+		case cmd == "subscribe" || cmd == "psubscribe":
+			if len(args) < 2 {
+				c.writeLine("ERROR")
+				protocolErrors.Inc(1)
+				break
+			}
+			// the connection is a subscriber until it quits
+			ms.serveSubscriber(c, args)
+			return
+
+		case cmd == "publish":
+			if len(args) != 3 {
+				c.writeLine("ERROR")
+				protocolErrors.Inc(1)
+				break
+			}
+			n, err := strconv.Atoi(args[2])
+			if err != nil || n < 0 {
+				c.writeLine("CLIENT_ERROR bad data chunk")
+				break
+			}
+			data, err := c.readData(n)
+			if err == errTooLarge {
+				oversizedRequests.Inc(1)
+				c.writeLine("SERVER_ERROR object too large for cache")
+				break
+			} else if err != nil {
+				c.writeLine("CLIENT_ERROR bad data chunk")
+				break
+			}
+			c.writeLine(fmt.Sprintf("PUBLISHED %d", ms.pubsub.Publish(args[1], data)))
+
+		case cmd == "lock" || cmd == "renew" || cmd == "unlock":
+			if ms.checkRO(c) {
+				break
+			}
+			ms.leaseCommand(c, vdb, cmd, args)
+
+		case cmd == "hset" || cmd == "hdel" || cmd == "hincrby":
+			if ms.checkRO(c) {
+				break
+			}
+			ms.hashCommand(c, vdb, cmd, args)
+
+		case cmd == "hget" || cmd == "hgetall" || cmd == "hkeys":
+			ms.hashCommand(c, vdb, cmd, args)
+
+		case cmd == "cluster":
+			if ms.cluster == nil {
+				c.writeLine("SERVER_ERROR cluster mode not enabled")
+				break
+			}
+			switch {
+			case len(args) == 2 && args[1] == "status":
+				c.writeLine(ms.cluster.Status())
+				c.writeLine("OK")
+			case len(args) == 3 && (args[1] == "add" || args[1] == "remove"):
+				if err := ms.cluster.ChangeMembership(args[1], args[2]); err != nil {
+					log.Error("CLUSTER: %s", err)
+					c.writeLine("SERVER_ERROR " + err.Error())
+					break
+				}
+				c.writeLine("OK")
+			default:
+				c.writeLine("ERROR")
+				protocolErrors.Inc(1)
+			}
+
 		case cmd == "range" || cmd == "gets":
 			if len(args) < 2 || len(args) > 3 {
-				ms.writeLine(buf, "ERROR")
+				c.writeLine("ERROR")
 				protocolErrors.Inc(1)
 				break
 			}
@@ -338,31 +936,37 @@ func (ms MemcachedProtocolServer) Parse(conn net.Conn, vdb BackendDatabase) {
 			v, err := vdb.Range([]byte(args[1]), limit, nil, false)
 			if err != nil {
 				log.Error("RANGE: %s", err)
+				c.writeLine("SERVER_ERROR range failed")
 				break
 			}
 			if v == nil {
 				getMisses.Inc(1)
-				continue
 			}
 			cmdGet.Inc(1)
-			for key, value := range v {
+			for _, key := range sortedKeys(v, false) {
 				if noreply == false {
-					ms.writeLine(buf, fmt.Sprintf("VALUE %s 0 %d", key, len(value)))
-					ms.writeLine(buf, string(value))
+					c.writeValue(key, v[key])
 					getHits.Inc(1)
 				}
 			}
 			if noreply == false {
-				ms.writeLine(buf, "END")
+				c.writeLine("END")
 			}
 
 		default:
 			log.Error("NOT IMPLEMENTED: %s", args[0])
-			ms.writeLine(buf, "ERROR")
+			c.writeLine("ERROR")
 			protocolErrors.Inc(1)
-			break
-
 		}
 		responseTiming.Update(time.Since(startTime))
 	}
 }
+
+func isLower(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 'A' && s[i] <= 'Z' {
+			return false
+		}
+	}
+	return true
+}
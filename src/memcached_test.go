@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startTestServer serves the memcached protocol for vdb on a random local port
+func startTestServer(tb testing.TB, ms *MemcachedProtocolServer, vdb BackendDatabase) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go ms.Parse(conn, vdb)
+		}
+	}()
+	return listener.Addr().String(), func() { listener.Close() }
+}
+
+func dialTestServer(tb testing.TB, addr string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return conn, bufio.NewReader(conn)
+}
+
+func readReplies(tb testing.TB, r *bufio.Reader, n int) []string {
+	replies := make([]string, n)
+	for i := 0; i < n; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			tb.Fatal(err)
+		}
+		replies[i] = strings.TrimRight(line, "\r\n")
+	}
+	return replies
+}
+
+func TestParsePipelined(t *testing.T) {
+	addr, stop := startTestServer(t, NewMemcachedProtocolServer(false, nil), vleveldb)
+	defer stop()
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+
+	var cmds string
+	for i := 0; i < 100; i++ {
+		cmds += fmt.Sprintf("set pipeline%d 0 0 7\r\nclapton\r\n", i)
+	}
+	cmds += "get pipeline0 pipeline99\r\n"
+	conn.Write([]byte(cmds))
+
+	for i, reply := range readReplies(t, r, 100) {
+		if reply != "STORED" {
+			t.Fatal(errUnexpected(fmt.Sprintf("%d: %s", i, reply)))
+		}
+	}
+	expected := []string{"VALUE pipeline0 0 7", "clapton", "VALUE pipeline99 0 7", "clapton", "END"}
+	for i, reply := range readReplies(t, r, len(expected)) {
+		if reply != expected[i] {
+			t.Error(errUnexpected(reply))
+		}
+	}
+	for i := 0; i < 100; i++ {
+		vleveldb.Delete([]byte(fmt.Sprintf("pipeline%d", i)), false)
+	}
+}
+
+/*
+recordingMultiGetter fetches keys one by one, keeping the keys asked for in batches
+*/
+type recordingMultiGetter struct {
+	BackendDatabase
+	lock sync.Mutex
+	keys []string
+}
+
+func (rg *recordingMultiGetter) GetMulti(keys [][]byte) (map[string][]byte, error) {
+	rg.lock.Lock()
+	defer rg.lock.Unlock()
+	values := make(map[string][]byte)
+	for _, k := range keys {
+		rg.keys = append(rg.keys, string(k))
+		if v, _ := rg.Get(k); v != nil {
+			values[string(k)] = v
+		}
+	}
+	return values, nil
+}
+
+func TestParseMultiGetNoreply(t *testing.T) {
+	rg := &recordingMultiGetter{BackendDatabase: vleveldb}
+	addr, stop := startTestServer(t, NewMemcachedProtocolServer(false, nil), rg)
+	defer stop()
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+
+	conn.Write([]byte("get beano1 beano2 noreply\r\nget beano1 noreply\r\nversion\r\n"))
+	if reply := readReplies(t, r, 1)[0]; reply != "VERSION BEANO" {
+		t.Error(errUnexpected(reply))
+	}
+	rg.lock.Lock()
+	defer rg.lock.Unlock()
+	if strings.Join(rg.keys, " ") != "beano1 beano2" {
+		t.Error(errUnexpected(rg.keys))
+	}
+}
+
+func TestParseDataBlock(t *testing.T) {
+	addr, stop := startTestServer(t, NewMemcachedProtocolServer(false, nil), vleveldb)
+	defer stop()
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+
+	conn.Write([]byte("set beano 0 0 13\r\neric\r\nclapton\r\nget beano\r\n"))
+	expected := []string{"STORED", "VALUE beano 0 13", "eric", "clapton", "END"}
+	for i, reply := range readReplies(t, r, len(expected)) {
+		if reply != expected[i] {
+			t.Error(errUnexpected(reply))
+		}
+	}
+	conn.Write([]byte("set beano 0 0 2\r\nclapton\r\n"))
+	if reply := readReplies(t, r, 1)[0]; reply != "CLIENT_ERROR bad data chunk" {
+		t.Error(errUnexpected(reply))
+	}
+	vleveldb.Delete([]byte("beano"), false)
+}
+
+func BenchmarkParseSet(b *testing.B) {
+	addr, stop := startTestServer(b, NewMemcachedProtocolServer(false, nil), vleveldb)
+	defer stop()
+	conn, r := dialTestServer(b, addr)
+	defer conn.Close()
+
+	cmd := []byte("set benchmark 0 0 7\r\nclapton\r\n")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn.Write(cmd)
+		if _, err := r.ReadString('\n'); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParsePipelinedSet(b *testing.B) {
+	addr, stop := startTestServer(b, NewMemcachedProtocolServer(false, nil), vleveldb)
+	defer stop()
+	conn, r := dialTestServer(b, addr)
+	defer conn.Close()
+
+	batch := 100
+	cmds := []byte(strings.Repeat("set benchmark 0 0 7\r\nclapton\r\n", batch))
+	b.ResetTimer()
+	for i := 0; i < b.N; i += batch {
+		conn.Write(cmds)
+		for j := 0; j < batch; j++ {
+			if _, err := r.ReadString('\n'); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkParseMultiGet(b *testing.B) {
+	addr, stop := startTestServer(b, NewMemcachedProtocolServer(false, nil), vleveldb)
+	defer stop()
+	conn, r := dialTestServer(b, addr)
+	defer conn.Close()
+
+	keys := make([]string, 10)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("benchmark%d", i)
+		vleveldb.Set([]byte(keys[i]), []byte("clapton"))
+	}
+	cmd := []byte("get " + strings.Join(keys, " ") + "\r\n")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn.Write(cmd)
+		for j := 0; j < 2*len(keys)+1; j++ {
+			if _, err := r.ReadString('\n'); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestParseMaxItemSize(t *testing.T) {
+	ms := NewMemcachedProtocolServer(false, nil)
+	ms.maxItemSize = 4
+	addr, stop := startTestServer(t, ms, vleveldb)
+	defer stop()
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+
+	// the short form without <bytes> is limited too
+	conn.Write([]byte("set beano 0 0 7\r\nclapton\r\nset beano 0 0\r\nclapton\r\nset beano 0 0 4\r\neric\r\nset beano 0 0\r\neric\r\n"))
+	expected := []string{"SERVER_ERROR object too large for cache", "SERVER_ERROR object too large for cache", "STORED", "STORED"}
+	for i, reply := range readReplies(t, r, len(expected)) {
+		if reply != expected[i] {
+			t.Error(errUnexpected(reply))
+		}
+	}
+	vleveldb.Delete([]byte("beano"), false)
+}
+
+func TestParseMaxLineSize(t *testing.T) {
+	ms := NewMemcachedProtocolServer(false, nil)
+	ms.maxLineSize = 16
+	addr, stop := startTestServer(t, ms, vleveldb)
+	defer stop()
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+
+	conn.Write([]byte("get beano\r\nget beano beano beano\r\n"))
+	expected := []string{"END", "CLIENT_ERROR line too long"}
+	for i, reply := range readReplies(t, r, len(expected)) {
+		if reply != expected[i] {
+			t.Error(errUnexpected(reply))
+		}
+	}
+	if _, err := r.ReadString('\n'); err != io.EOF {
+		t.Error(errUnexpected(fmt.Sprintf("connection not closed: %v", err)))
+	}
+}
+
+func TestParseIdleTimeout(t *testing.T) {
+	ms := NewMemcachedProtocolServer(false, nil)
+	ms.idleTimeout = 50 * time.Millisecond
+	addr, stop := startTestServer(t, ms, vleveldb)
+	defer stop()
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	if _, err := r.ReadString('\n'); err != io.EOF {
+		t.Error(errUnexpected(fmt.Sprintf("idle connection not closed: %v", err)))
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Error(errUnexpected(fmt.Sprintf("closed after %s", waited)))
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	db := newCurrentDB(vleveldb, "leveldb")
+	go acceptLoop(listener, NewMemcachedProtocolServer(false, nil), db, newConnLimiter(1))
+
+	first, r := dialTestServer(t, listener.Addr().String())
+	defer first.Close()
+	first.Write([]byte("version\r\n"))
+	if reply := readReplies(t, r, 1)[0]; reply != "VERSION BEANO" {
+		t.Error(errUnexpected(reply))
+	}
+
+	second, r := dialTestServer(t, listener.Addr().String())
+	defer second.Close()
+	if reply := readReplies(t, r, 1)[0]; reply != "SERVER_ERROR too many open connections" {
+		t.Error(errUnexpected(reply))
+	}
+}
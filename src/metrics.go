@@ -27,8 +27,70 @@ var getMisses = metrics.NewCounter()        //"get_misses"
 var protocolErrors = metrics.NewCounter()   //"protocol_errors"
 var networkErrors = metrics.NewCounter()    //"network_errors"
 var readonlyErrors = metrics.NewCounter()   //"readonly_errors"
+var tlsErrors = metrics.NewCounter()        //"tls_errors"
+var authFailures = metrics.NewCounter()     //"auth_failures"
+var aclDenials = metrics.NewCounter()       //"acl_denials"
+var adminDenials = metrics.NewCounter()     //"admin_denials"
 var responseTiming = metrics.NewTimer()     // response_timing
 
+var rejectedConnections = metrics.NewCounter() //"rejected_connections"
+var oversizedRequests = metrics.NewCounter()   //"oversized_requests"
+
+var batchSizes = metrics.NewHistogram(metrics.NewUniformSample(1028)) // write_batch_size
+var batchLatency = metrics.NewTimer()                                 // write_batch_latency
+
+var cacheHits = metrics.NewCounter()                              //"cache_hits"
+var cacheMisses = metrics.NewCounter()                            //"cache_misses"
+var cacheRatio = metrics.NewFunctionalGaugeFloat64(cacheHitRatio) // cache_hit_ratio
+
+var keyFilterNegatives = metrics.NewCounter()      //"keyfilter_negatives"
+var keyFilterFalsePositives = metrics.NewCounter() //"keyfilter_false_positives"
+var keyFilterRebuilds = metrics.NewCounter()       //"keyfilter_rebuilds"
+
+var compressionBytesIn = metrics.NewCounter()                                   //"compression_bytes_in"
+var compressionBytesOut = metrics.NewCounter()                                  //"compression_bytes_out"
+var compressionRatioGauge = metrics.NewFunctionalGaugeFloat64(compressionRatio) // compression_ratio
+
+var encryptionRotations = metrics.NewCounter() //"encryption_rotations"
+
+var changeLogRecords = metrics.NewCounter()     //"changelog_records"
+var changeLogErrors = metrics.NewCounter()      //"changelog_errors"
+var replicationApplied = metrics.NewCounter()   //"replication_applied"
+var replicationSnapshots = metrics.NewCounter() //"replication_snapshots"
+var replicationLag = metrics.NewGauge()         //"replication_lag"
+
+var clusterElections = metrics.NewCounter() //"cluster_elections"
+var clusterSnapshots = metrics.NewCounter() //"cluster_snapshots"
+
+var proxyRequests = metrics.NewCounter()  //"proxy_requests"
+var proxyErrors = metrics.NewCounter()    //"proxy_errors"
+var proxyNodesDown = metrics.NewCounter() //"proxy_nodes_down"
+var proxyReloads = metrics.NewCounter()   //"proxy_ring_reloads"
+
+var upstreamHits = metrics.NewCounter()      //"upstream_hits"
+var upstreamMisses = metrics.NewCounter()    //"upstream_misses"
+var upstreamErrors = metrics.NewCounter()    //"upstream_errors"
+var upstreamPopulated = metrics.NewCounter() //"upstream_populated"
+var upstreamMirrored = metrics.NewCounter()  //"upstream_mirrored"
+
+var watchStreams = metrics.NewCounter() //"watch_streams"
+var watchEvents = metrics.NewCounter()  //"watch_events"
+
+var pubSubSubscribers = metrics.NewCounter()   //"pubsub_subscribers"
+var pubSubPublished = metrics.NewCounter()     //"pubsub_published"
+var pubSubDelivered = metrics.NewCounter()     //"pubsub_delivered"
+var pubSubSlowConsumers = metrics.NewCounter() //"pubsub_slow_consumers"
+
+var queueEnqueued = metrics.NewCounter()  //"queue_enqueued"
+var queueDequeued = metrics.NewCounter()  //"queue_dequeued"
+var queueOpenReads = metrics.NewCounter() //"queue_open_reads"
+var queueAborted = metrics.NewCounter()   //"queue_aborted"
+
+var leaseGranted = metrics.NewCounter() //"lease_granted"
+var leaseBusy = metrics.NewCounter()    //"lease_busy"
+var leaseExpired = metrics.NewCounter() //"lease_expired"
+var leaseRenewed = metrics.NewCounter() //"lease_renewed"
+
 func initializeMetrics(dbp string, dumpLogs bool) {
 	pid.Set(int64(os.Getpid()))
 	version.Set("BEANO Server")
@@ -47,7 +109,55 @@ func initializeMetrics(dbp string, dumpLogs bool) {
 	metrics.Register("protocol_errors", protocolErrors)
 	metrics.Register("network_errors", networkErrors)
 	metrics.Register("readonly_errors", readonlyErrors)
+	metrics.Register("tls_errors", tlsErrors)
+	metrics.Register("auth_failures", authFailures)
+	metrics.Register("acl_denials", aclDenials)
+	metrics.Register("admin_denials", adminDenials)
+	metrics.Register("rejected_connections", rejectedConnections)
+	metrics.Register("oversized_requests", oversizedRequests)
 	metrics.Register("response_timing", responseTiming)
+	metrics.Register("write_batch_size", batchSizes)
+	metrics.Register("write_batch_latency", batchLatency)
+	metrics.Register("cache_hits", cacheHits)
+	metrics.Register("cache_misses", cacheMisses)
+	metrics.Register("cache_hit_ratio", cacheRatio)
+	metrics.Register("keyfilter_negatives", keyFilterNegatives)
+	metrics.Register("keyfilter_false_positives", keyFilterFalsePositives)
+	metrics.Register("keyfilter_rebuilds", keyFilterRebuilds)
+	metrics.Register("compression_bytes_in", compressionBytesIn)
+	metrics.Register("compression_bytes_out", compressionBytesOut)
+	metrics.Register("compression_ratio", compressionRatioGauge)
+	metrics.Register("encryption_rotations", encryptionRotations)
+	metrics.Register("changelog_records", changeLogRecords)
+	metrics.Register("changelog_errors", changeLogErrors)
+	metrics.Register("replication_applied", replicationApplied)
+	metrics.Register("replication_snapshots", replicationSnapshots)
+	metrics.Register("replication_lag", replicationLag)
+	metrics.Register("cluster_elections", clusterElections)
+	metrics.Register("cluster_snapshots", clusterSnapshots)
+	metrics.Register("proxy_requests", proxyRequests)
+	metrics.Register("proxy_errors", proxyErrors)
+	metrics.Register("proxy_nodes_down", proxyNodesDown)
+	metrics.Register("proxy_ring_reloads", proxyReloads)
+	metrics.Register("upstream_hits", upstreamHits)
+	metrics.Register("upstream_misses", upstreamMisses)
+	metrics.Register("upstream_errors", upstreamErrors)
+	metrics.Register("upstream_populated", upstreamPopulated)
+	metrics.Register("upstream_mirrored", upstreamMirrored)
+	metrics.Register("watch_streams", watchStreams)
+	metrics.Register("watch_events", watchEvents)
+	metrics.Register("pubsub_subscribers", pubSubSubscribers)
+	metrics.Register("pubsub_published", pubSubPublished)
+	metrics.Register("pubsub_delivered", pubSubDelivered)
+	metrics.Register("pubsub_slow_consumers", pubSubSlowConsumers)
+	metrics.Register("queue_enqueued", queueEnqueued)
+	metrics.Register("queue_dequeued", queueDequeued)
+	metrics.Register("queue_open_reads", queueOpenReads)
+	metrics.Register("queue_aborted", queueAborted)
+	metrics.Register("lease_granted", leaseGranted)
+	metrics.Register("lease_busy", leaseBusy)
+	metrics.Register("lease_expired", leaseExpired)
+	metrics.Register("lease_renewed", leaseRenewed)
 	if dumpLogs {
 		go metrics.Log(metrics.DefaultRegistry, time.Duration(60*time.Second), logging.NewLogBackend(os.Stdout, "", 0).Logger)
 	}
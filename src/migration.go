@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// migrationPageSize is the number of keys read from the source per Range call
+const migrationPageSize = 1000
+
+const (
+	migrationCopying int32 = iota
+	migrationVerifying
+	migrationDone
+	migrationFailed
+	migrationStopped
+)
+
+var migrationStates = []string{"copying", "verifying", "done", "failed", "stopped"}
+
+var errMigrationRunning = errors.New("a migration is already running")
+
+// migrateLock serializes migration starts
+var migrateLock sync.Mutex
+
+/*
+migratingBackend copies a backend into another one, of any type, while it
+keeps serving. Reads go to the source until cutover. Writes go to the source
+and are mirrored to the target, under a key lock shared with the copy so a
+stale copied value never overwrites a newer write. Once copied both sides are
+compared a page at a time, each with writes paused, and if they match all
+calls are sent to the target
+*/
+type migratingBackend struct {
+	BackendDatabase
+	target        BackendDatabase
+	targetBackend string
+	gate          *sync.RWMutex
+	keyLocks      *stripedLock
+	cutover       bool
+	targetClosed  bool
+	state         int32
+	copied        int64
+	err           atomic.Value
+	onCutover     func()
+	quit          chan bool
+	stopped       chan bool
+}
+
+func newMigratingBackend(source BackendDatabase, target BackendDatabase, targetBackend string) *migratingBackend {
+	return &migratingBackend{
+		BackendDatabase: source,
+		target:          target,
+		targetBackend:   targetBackend,
+		gate:            &sync.RWMutex{},
+		keyLocks:        newStripedLock(),
+		quit:            make(chan bool),
+		stopped:         make(chan bool),
+	}
+}
+
+/*
+Migrate starts copying the active backend into a new backend of type backend
+at filename, swapping it in once verified
+*/
+func (c *currentDB) Migrate(backend string, filename string, opts dbOptions) error {
+	if c.pinned != nil {
+		return c.pinned
+	}
+	migrateLock.Lock()
+	defer migrateLock.Unlock()
+	source := c.Active()
+	if mb, ok := source.(*migratingBackend); ok {
+		if s := atomic.LoadInt32(&mb.state); s == migrationCopying || s == migrationVerifying {
+			return errMigrationRunning
+		}
+		source = mb.BackendDatabase
+	}
+	if _, ok := source.(*raftBackend); ok {
+		return errors.New("migration isn't supported in cluster mode")
+	}
+	if _, ok := source.(*proxyBackend); ok {
+		return errors.New("migration isn't supported in proxy mode")
+	}
+	switch {
+	case c.Backend() == "inmem":
+		return errors.New("inmem can't be migrated, its keys can't be listed")
+	case backend != "leveldb" && backend != "boltdb" && backend != "badger":
+		return fmt.Errorf("unknown migration target backend %s", backend)
+	case source.GetDbPath() == filename:
+		return fmt.Errorf("%s is the active database", filename)
+	}
+	target := loadDB(backend, filename, opts)
+	if target == nil {
+		return fmt.Errorf("can't open %s %s", backend, filename)
+	}
+	mb := newMigratingBackend(source, target, backend)
+	mb.onCutover = func() { c.Swap(target, backend) }
+	c.Swap(mb, c.Backend())
+	log.Info("Migration from %s to %s %s started", source.GetDbPath(), backend, filename)
+	go mb.run()
+	return nil
+}
+
+/*
+Unwrap returns the backend serving reads
+*/
+func (mb *migratingBackend) Unwrap() BackendDatabase {
+	return mb.active()
+}
+
+func (mb *migratingBackend) active() BackendDatabase {
+	mb.gate.RLock()
+	defer mb.gate.RUnlock()
+	if mb.cutover {
+		return mb.target
+	}
+	return mb.BackendDatabase
+}
+
+func (mb *migratingBackend) mirroring() bool {
+	s := atomic.LoadInt32(&mb.state)
+	return s == migrationCopying || s == migrationVerifying
+}
+
+/*
+fail stops mirroring, the source keeps serving and the target is left as it is
+*/
+func (mb *migratingBackend) fail(err error) {
+	if atomic.CompareAndSwapInt32(&mb.state, migrationCopying, migrationFailed) ||
+		atomic.CompareAndSwapInt32(&mb.state, migrationVerifying, migrationFailed) {
+		mb.err.Store(err.Error())
+		log.Error("Migration to %s failed: %s", mb.target.GetDbPath(), err)
+	}
+}
+
+/*
+mirror applies fn to the target. Caller holds the gate and key lock
+*/
+func (mb *migratingBackend) mirror(fn func(BackendDatabase) error) {
+	if !mb.mirroring() {
+		return
+	}
+	if err := fn(mb.target); err != nil {
+		mb.fail(err)
+	}
+}
+
+/*
+Set the value for key
+*/
+func (mb *migratingBackend) Set(key []byte, value []byte) error {
+	return mb.Put(key, value, false, true)
+}
+
+/*
+Add value to key, store data only if the server doesnt holds it yet
+*/
+func (mb *migratingBackend) Add(key []byte, value []byte) error {
+	return mb.Put(key, value, false, false)
+}
+
+/*
+Replace value for key, store data only if the server already holds this key
+*/
+func (mb *migratingBackend) Replace(key []byte, value []byte) error {
+	return mb.Put(key, value, true, false)
+}
+
+/*
+Incr data, yields error if the represented value doesnt maps to int
+*/
+func (mb *migratingBackend) Incr(key []byte, value uint) (int, error) {
+	return mb.Increment(key, int(value), false)
+}
+
+/*
+Decr data, yields error if the represented value doesnt maps to int
+*/
+func (mb *migratingBackend) Decr(key []byte, value uint) (int, error) {
+	return mb.Increment(key, int(value)*-1, false)
+}
+
+/*
+Increment runs on the source, the resulting value is mirrored
+*/
+func (mb *migratingBackend) Increment(key []byte, value int, createIfNotExists bool) (int, error) {
+	mb.gate.RLock()
+	defer mb.gate.RUnlock()
+	if mb.cutover {
+		return mb.target.Increment(key, value, createIfNotExists)
+	}
+	mb.keyLocks.Lock(key)
+	defer mb.keyLocks.Unlock(key)
+	i, err := mb.BackendDatabase.Increment(key, value, createIfNotExists)
+	if err == nil {
+		mb.mirror(func(target BackendDatabase) error {
+			return target.Set(key, []byte(fmt.Sprintf("%d", i)))
+		})
+	}
+	return i, err
+}
+
+/*
+Put on the source, mirrored when the source accepted it
+*/
+func (mb *migratingBackend) Put(key []byte, value []byte, replace bool, passthru bool) error {
+	mb.gate.RLock()
+	defer mb.gate.RUnlock()
+	if mb.cutover {
+		return mb.target.Put(key, value, replace, passthru)
+	}
+	mb.keyLocks.Lock(key)
+	defer mb.keyLocks.Unlock(key)
+	if err := mb.BackendDatabase.Put(key, value, replace, passthru); err != nil {
+		return err
+	}
+	mb.mirror(func(target BackendDatabase) error {
+		return target.Set(key, value)
+	})
+	return nil
+}
+
+/*
+Get from the backend serving reads
+*/
+func (mb *migratingBackend) Get(key []byte) ([]byte, error) {
+	return mb.active().Get(key)
+}
+
+/*
+Range on the backend serving reads
+*/
+func (mb *migratingBackend) Range(key []byte, limit int, from []byte, reverse bool) (map[string][]byte, error) {
+	return mb.active().Range(key, limit, from, reverse)
+}
+
+/*
+Delete from the source, mirrored
+*/
+func (mb *migratingBackend) Delete(key []byte, onlyIfExists bool) (bool, error) {
+	mb.gate.RLock()
+	defer mb.gate.RUnlock()
+	if mb.cutover {
+		return mb.target.Delete(key, onlyIfExists)
+	}
+	mb.keyLocks.Lock(key)
+	defer mb.keyLocks.Unlock(key)
+	deleted, err := mb.BackendDatabase.Delete(key, onlyIfExists)
+	if err == nil {
+		mb.mirror(func(target BackendDatabase) error {
+			_, err := target.Delete(key, false)
+			return err
+		})
+	}
+	return deleted, err
+}
+
+/*
+Flush both sides
+*/
+func (mb *migratingBackend) Flush() error {
+	mb.gate.RLock()
+	defer mb.gate.RUnlock()
+	if mb.cutover {
+		return mb.target.Flush()
+	}
+	err := mb.BackendDatabase.Flush()
+	if err == nil {
+		mb.mirror(func(target BackendDatabase) error { return target.Flush() })
+	}
+	return err
+}
+
+/*
+GetDbPath of the backend serving reads
+*/
+func (mb *migratingBackend) GetDbPath() string {
+	return mb.active().GetDbPath()
+}
+
+/*
+BucketStats of the backend serving reads
+*/
+func (mb *migratingBackend) BucketStats() error {
+	return mb.active().BucketStats()
+}
+
+/*
+Stats adds the migration progress to the stats of the backend serving reads
+*/
+func (mb *migratingBackend) Stats() string {
+	state := atomic.LoadInt32(&mb.state)
+	line := fmt.Sprintf("migration: %s to %s %s, %d keys copied", migrationStates[state],
+		mb.targetBackend, mb.target.GetDbPath(), atomic.LoadInt64(&mb.copied))
+	if err, ok := mb.err.Load().(string); ok {
+		line += ", " + err
+	}
+	return fmt.Sprintf("%s\n%s", mb.active().Stats(), line)
+}
+
+/*
+Close stops a running copy and closes both backends. After cutover only the target is left
+*/
+func (mb *migratingBackend) Close() {
+	mb.gate.RLock()
+	cutover := mb.cutover
+	mb.gate.RUnlock()
+	if cutover {
+		mb.target.Close()
+		return
+	}
+	close(mb.quit)
+	<-mb.stopped
+	atomic.CompareAndSwapInt32(&mb.state, migrationCopying, migrationStopped)
+	if !mb.targetClosed {
+		mb.target.Close()
+	}
+	mb.BackendDatabase.Close()
+}
+
+func (mb *migratingBackend) run() {
+	defer close(mb.stopped)
+	defer mb.closeFailedTarget()
+	var from []byte
+	for mb.mirroring() {
+		page, err := mb.BackendDatabase.Range(nil, migrationPageSize, from, false)
+		if err != nil {
+			mb.fail(err)
+			return
+		}
+		keys := sortedKeys(page, false)
+		for _, k := range keys {
+			select {
+			case <-mb.quit:
+				return
+			default:
+			}
+			if !mb.mirroring() {
+				return
+			}
+			if err := mb.copyKey([]byte(k)); err != nil {
+				mb.fail(err)
+				return
+			}
+		}
+		if len(keys) < migrationPageSize {
+			break
+		}
+		from = append([]byte(keys[len(keys)-1]), 0)
+	}
+	if !atomic.CompareAndSwapInt32(&mb.state, migrationCopying, migrationVerifying) {
+		return
+	}
+	if mb.verify() {
+		log.Info("Migration to %s %s done", mb.targetBackend, mb.target.GetDbPath())
+		mb.onCutover()
+		mb.BackendDatabase.Close()
+	}
+}
+
+/*
+closeFailedTarget closes the target once mirroring stopped, the gate waits for writes still on it
+*/
+func (mb *migratingBackend) closeFailedTarget() {
+	if atomic.LoadInt32(&mb.state) != migrationFailed {
+		return
+	}
+	mb.gate.Lock()
+	defer mb.gate.Unlock()
+	mb.target.Close()
+	mb.targetClosed = true
+}
+
+/*
+copyKey copies the current value of key, the page read may be stale by now
+*/
+func (mb *migratingBackend) copyKey(key []byte) error {
+	mb.gate.RLock()
+	defer mb.gate.RUnlock()
+	mb.keyLocks.Lock(key)
+	defer mb.keyLocks.Unlock(key)
+	v, err := mb.BackendDatabase.Get(key)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		_, err = mb.target.Delete(key, false)
+	} else {
+		err = mb.target.Set(key, v)
+	}
+	atomic.AddInt64(&mb.copied, 1)
+	return err
+}
+
+/*
+verify compares both sides a page at a time and cuts over if they match.
+Writes are only paused for the page being compared, the ones to pages
+already compared are mirrored to both sides
+*/
+func (mb *migratingBackend) verify() bool {
+	var count uint64
+	var from []byte
+	for {
+		keys, err := mb.comparePage(from)
+		if err != nil {
+			mb.fail(err)
+			return false
+		}
+		count += uint64(len(keys))
+		if len(keys) < migrationPageSize {
+			break
+		}
+		from = append([]byte(keys[len(keys)-1]), 0)
+	}
+	mb.gate.Lock()
+	defer mb.gate.Unlock()
+	if !mb.mirroring() {
+		return false
+	}
+	log.Info("Migration verified: %d keys", count)
+	mb.cutover = true
+	atomic.StoreInt32(&mb.state, migrationDone)
+	return true
+}
+
+/*
+comparePage compares the page of keys starting at from on both sides with
+writes paused, returning its keys
+*/
+func (mb *migratingBackend) comparePage(from []byte) ([]string, error) {
+	mb.gate.Lock()
+	defer mb.gate.Unlock()
+	if !mb.mirroring() {
+		return nil, errors.New("mirroring stopped")
+	}
+	source, err := mb.BackendDatabase.Range(nil, migrationPageSize, from, false)
+	if err != nil {
+		return nil, err
+	}
+	target, err := mb.target.Range(nil, migrationPageSize, from, false)
+	if err != nil {
+		return nil, err
+	}
+	keys := sortedKeys(source, false)
+	if len(source) != len(target) {
+		return nil, fmt.Errorf("verification failed: %d keys in source, %d in target from %q", len(source), len(target), from)
+	}
+	for _, k := range keys {
+		if v, ok := target[k]; !ok || !bytes.Equal(v, source[k]) {
+			return nil, fmt.Errorf("verification failed: key %q differs", k)
+		}
+	}
+	return keys, nil
+}
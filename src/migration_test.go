@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beano-migration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source := loadDB("leveldb", filepath.Join(dir, "source.db"), dbOptions{})
+	for i := 0; i < 2500; i++ {
+		source.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("clapton"))
+	}
+	db := newCurrentDB(source, "leveldb")
+
+	// queues keep positions for the active database
+	db.pinned = errQueuesPinned
+	if err := db.Migrate("boltdb", filepath.Join(dir, "target.db"), dbOptions{}); err != errQueuesPinned {
+		t.Error(errUnexpected(err))
+	}
+	db.pinned = nil
+	if err := db.Migrate("nosuchdb", filepath.Join(dir, "target.db"), dbOptions{}); err == nil {
+		t.Error(errUnexpected("unknown backend accepted"))
+	}
+	target := filepath.Join(dir, "target.db")
+	if err := db.Migrate("boltdb", target, dbOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrate("badger", filepath.Join(dir, "other.db"), dbOptions{}); err != errMigrationRunning {
+		t.Error(errUnexpected(err))
+	}
+
+	// writes during the copy are mirrored
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < 2500; i += 4 {
+				key := []byte(fmt.Sprintf("key%04d", i))
+				switch i % 3 {
+				case 0:
+					db.Set(key, []byte("eric"))
+				case 1:
+					db.Delete(key, false)
+				}
+			}
+			db.Set([]byte(fmt.Sprintf("new%d", w)), []byte("cream"))
+		}(w)
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for db.Backend() != "boltdb" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if db.Backend() != "boltdb" || db.GetDbPath() != target {
+		t.Fatal(errUnexpected(db.Stats()))
+	}
+	if _, ok := db.Active().(*migratingBackend); ok {
+		t.Error(errUnexpected("migration wrapper still active"))
+	}
+	for i := 0; i < 2500; i++ {
+		v, _ := db.Get([]byte(fmt.Sprintf("key%04d", i)))
+		expected := []string{"eric", "", "clapton"}[i%3]
+		if string(v) != expected {
+			t.Fatal(errUnexpected(fmt.Sprintf("key%04d: %q", i, v)))
+		}
+	}
+	if v, _ := db.Get([]byte("new3")); string(v) != "cream" {
+		t.Error(errUnexpected(v))
+	}
+	db.Close()
+}
+
+func TestMigrationDeletesToBolt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beano-migration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source := loadDB("leveldb", filepath.Join(dir, "source.db"), dbOptions{})
+	for i := 0; i < 1000; i++ {
+		source.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("clapton"))
+	}
+	db := newCurrentDB(source, "leveldb")
+	defer db.Close()
+
+	// deletes mirrored before the copy created the bolt bucket
+	target := filepath.Join(dir, "target.db")
+	if err := db.Migrate("boltdb", target, dbOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i += 2 {
+		if _, err := db.Delete([]byte(fmt.Sprintf("key%04d", i)), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for db.Backend() != "boltdb" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if db.Backend() != "boltdb" {
+		t.Fatal(errUnexpected(db.Stats()))
+	}
+	for i := 0; i < 1000; i++ {
+		v, _ := db.Get([]byte(fmt.Sprintf("key%04d", i)))
+		if expected := []string{"", "clapton"}[i%2]; string(v) != expected {
+			t.Fatal(errUnexpected(fmt.Sprintf("key%04d: %q", i, v)))
+		}
+	}
+}
+
+func TestMigrationVerifyFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beano-migration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source := loadDB("leveldb", filepath.Join(dir, "source.db"), dbOptions{})
+	source.Set([]byte("key"), []byte("clapton"))
+	target := loadDB("leveldb", filepath.Join(dir, "target.db"), dbOptions{})
+	// a key only in the target makes the verification fail
+	target.Set([]byte("stale"), []byte("eric"))
+
+	mb := newMigratingBackend(source, target, "leveldb")
+	mb.onCutover = func() { t.Error(errUnexpected("cut over")) }
+	mb.run()
+	if atomic.LoadInt32(&mb.state) != migrationFailed || !mb.targetClosed {
+		t.Error(errUnexpected(mb.Stats()))
+	}
+	if stats := mb.Stats(); !strings.Contains(stats, "migration: failed") {
+		t.Error(errUnexpected(stats))
+	}
+	mb.Set([]byte("key"), []byte("cream"))
+	if v, _ := mb.Get([]byte("key")); string(v) != "cream" {
+		t.Error(errUnexpected(v))
+	}
+	mb.Close()
+}
@@ -1,72 +1,595 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
 var messages chan string
 
-func loadDB(backend string, filename string) BackendDatabase {
+/*
+dbOptions tunes the persistent backends
+*/
+type dbOptions struct {
+	batchWindow  time.Duration
+	batchSize    int
+	durability   durabilityMode
+	syncInterval time.Duration
+	cacheSize    int
+	keyFilter    keyFilterOptions
+	shards       int
+	shardRules   []shardRule
+	compression  string
+	compressMin  int
+	encryption   *keyRing
+	encryptKeys  bool
+	keySeparator string
+	upstream     upstreamOptions
+}
+
+/*
+keyFilterOptions sizes the key filter, capacity 0 disables it
+*/
+type keyFilterOptions struct {
+	capacity          int
+	falsePositiveRate float64
+	maxFalsePositives float64
+}
+
+func loadDB(backend string, filename string, opts dbOptions) BackendDatabase {
 	var vdb BackendDatabase
 	var err error
+	if opts.shards > 1 {
+		vdb, err = openShards(backend, filename, opts)
+	} else {
+		vdb, err = openBackend(backend, filename, opts)
+	}
+	if err != nil {
+		log.Error("Error opening db %s", err)
+		return nil
+	}
+	if opts.encryption != nil {
+		vdb = NewEncryptedBackend(vdb, opts.encryption, opts.encryptKeys, opts.keySeparator)
+	}
+	if opts.compression == "snappy" {
+		vdb = NewCompressedBackend(vdb, opts.compressMin)
+	}
+	if opts.keyFilter.capacity > 0 && backend != "inmem" {
+		kf := opts.keyFilter
+		fb, err := NewFilteredBackend(vdb, kf.capacity, kf.falsePositiveRate, kf.maxFalsePositives)
+		if err != nil {
+			log.Error("%s", err)
+		} else {
+			vdb = fb
+		}
+	}
+	if opts.upstream.addr != "" {
+		// above the key filter, a local miss must reach upstream
+		vdb = NewUpstreamBackend(vdb, opts.upstream)
+	}
+	if opts.cacheSize > 0 && backend != "inmem" {
+		vdb = NewCachedBackend(vdb, opts.cacheSize)
+	}
+	return vdb
+
+}
+
+/*
+openBackend opens a single backend instance
+*/
+func openBackend(backend string, filename string, opts dbOptions) (BackendDatabase, error) {
 	switch backend {
 	case "boltdb":
-		vdb, err = NewKVBoltDBBackend(filename, "memcached", 1000000)
+		b, err := NewKVBoltDBBackend(filename, "memcached", 1000000)
+		if err != nil {
+			return nil, err
+		}
+		b.SetDurability(opts.durability, opts.syncInterval)
+		return b, nil
 	case "badger":
-		vdb, err = NewBadgerBackend(filename)
+		b, err := NewBadgerBackend(filename, opts.durability, opts.syncInterval)
+		if err != nil {
+			return nil, err
+		}
+		if opts.batchWindow > 0 {
+			b.EnableGroupCommit(opts.batchWindow, opts.batchSize)
+		}
+		return b, nil
 	case "inmem":
-		vdb, err = NewInmemBackend(1000000)
+		return NewInmemBackend(1000000)
 	default:
 		fallthrough
 	case "leveldb":
-		vdb, err = NewLevelDBBackend(filename)
+		l, err := NewLevelDBBackend(filename)
+		if err != nil {
+			return nil, err
+		}
+		l.SetDurability(opts.durability, opts.syncInterval)
+		if opts.batchWindow > 0 {
+			l.EnableGroupCommit(opts.batchWindow, opts.batchSize)
+		}
+		return l, nil
+	}
+}
+
+func switchDBHandler(db *currentDB, audit *auditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, "405 Method not allowed", 405)
+			return
+		}
+		filename := req.FormValue("filename")
+		if filename == "" {
+			http.Error(w, "500 Internal error", 500)
+			return
+		}
+		audit.Record(req.RemoteAddr, requestUser(req), "http", "switchdb", filename)
+		if db.pinned != nil {
+			http.Error(w, "409 "+db.pinned.Error(), 409)
+			return
+		}
+		messages <- filename
+		w.Write([]byte("OK"))
+	}
+}
+
+func flushHandler(db *currentDB, leases *leaseManager, audit *auditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, "405 Method not allowed", 405)
+			return
+		}
+		audit.Record(req.RemoteAddr, requestUser(req), "http", "flush_all")
+		if err := leases.Flush(db); err != nil {
+			log.Error("FLUSH: %s", err)
+			http.Error(w, "500 Internal error", 500)
+			return
+		}
+		w.Write([]byte("OK"))
+	}
+}
+
+func rotateKeysHandler(db *currentDB, audit *auditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, "405 Method not allowed", 405)
+			return
+		}
+		audit.Record(req.RemoteAddr, requestUser(req), "http", "rotatekeys")
+		eb, ok := findEncryptedBackend(db.Active())
+		if !ok {
+			http.Error(w, "400 Encryption not enabled", 400)
+			return
+		}
+		if err := eb.Rotate(); err == errRotationRunning {
+			http.Error(w, "409 Key rotation already running", 409)
+			return
+		} else if err != nil {
+			log.Error("ROTATEKEYS: %s", err)
+			http.Error(w, "500 Internal error", 500)
+			return
+		}
+		w.Write([]byte("OK"))
+	}
+}
+
+/*
+backupHandler writes a snapshot to the server directory given in dir, or
+streams it in the response when dir is empty
+*/
+func backupHandler(db *currentDB, audit *auditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, "405 Method not allowed", 405)
+			return
+		}
+		dir := req.FormValue("dir")
+		audit.Record(req.RemoteAddr, requestUser(req), "http", "backup", dir)
+		if dir != "" {
+			files, err := backupToDir(db.Active(), dir)
+			if err != nil {
+				log.Error("BACKUP: %s", err)
+				http.Error(w, "500 Internal error", 500)
+				return
+			}
+			w.Write([]byte(strings.Join(files, "\n") + "\nOK"))
+			return
+		}
+		b, ok := findBackuper(db.Active())
+		if !ok {
+			http.Error(w, "400 Backup can't be streamed for this backend, use dir", 400)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=beano-%s.backup", time.Now().UTC().Format("20060102T150405.000Z")))
+		if err := writeBackup(b, w); err != nil {
+			// headers are gone, a truncated body is all the client gets
+			log.Error("BACKUP: %s", err)
+		}
+	}
+}
+
+/*
+migrateHandler starts copying the database to a new backend, see stats for progress
+*/
+func migrateHandler(db *currentDB, opts dbOptions, audit *auditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, "405 Method not allowed", 405)
+			return
+		}
+		backend, filename := req.FormValue("backend"), req.FormValue("filename")
+		if backend == "" || filename == "" {
+			http.Error(w, "400 backend and filename are required", 400)
+			return
+		}
+		audit.Record(req.RemoteAddr, requestUser(req), "http", "migrate", backend, filename)
+		if err := db.Migrate(backend, filename, opts); err == errMigrationRunning {
+			http.Error(w, "409 Migration already running", 409)
+			return
+		} else if err != nil {
+			log.Error("MIGRATE: %s", err)
+			http.Error(w, "400 "+err.Error(), 400)
+			return
+		}
+		w.Write([]byte("OK"))
+	}
+}
+
+/*
+exportHandler streams the keys starting with prefix, resuming after the key after
+*/
+func exportHandler(db *currentDB, audit *auditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		prefix, after := req.FormValue("prefix"), req.FormValue("after")
+		audit.Record(req.RemoteAddr, requestUser(req), "http", "export", prefix, after)
+		var from []byte
+		if after != "" {
+			from = []byte(after)
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if n, last, err := exportDB(db.Active(), w, []byte(prefix), from); err != nil {
+			// the stream has no end record, the client sees it as truncated
+			log.Error("EXPORT: %s after %d items, last key %q", err, n, last)
+		}
+	}
+}
+
+/*
+importHandler stores the export stream in the body. skip resumes an
+interrupted import, the reply tells how many items were done
+*/
+func importHandler(db *currentDB, audit *auditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, "405 Method not allowed", 405)
+			return
+		}
+		prefix := req.URL.Query().Get("prefix")
+		skip, _ := strconv.ParseUint(req.URL.Query().Get("skip"), 10, 64)
+		audit.Record(req.RemoteAddr, requestUser(req), "http", "import", prefix)
+		n, err := importDB(db, req.Body, []byte(prefix), skip, nil)
+		if err != nil {
+			log.Error("IMPORT: %s", err)
+			http.Error(w, fmt.Sprintf("500 %s, %d items done, resume with skip=%d", err, n, n), 500)
+			return
+		}
+		w.Write([]byte(fmt.Sprintf("OK %d", n)))
+	}
+}
+
+/*
+clusterHandler shows the raft node status, a POST with action=add|remove and
+peer=<raft address> changes the membership
+*/
+func clusterHandler(cluster *raftBackend, audit *auditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			audit.Record(req.RemoteAddr, requestUser(req), "http", "cluster", "status")
+			w.Write([]byte(cluster.Status()))
+			return
+		}
+		action, peer := req.FormValue("action"), req.FormValue("peer")
+		if peer == "" {
+			http.Error(w, "400 peer is required", 400)
+			return
+		}
+		audit.Record(req.RemoteAddr, requestUser(req), "http", "cluster", action, peer)
+		if err := cluster.ChangeMembership(action, peer); err != nil {
+			log.Error("CLUSTER: %s", err)
+			http.Error(w, "500 "+err.Error(), 500)
+			return
+		}
+		w.Write([]byte("OK"))
+	}
+}
+
+func dbStatsHandler(db *currentDB, audit *auditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		audit.Record(req.RemoteAddr, requestUser(req), "http", "dbstats")
+		w.Write([]byte(db.Active().Stats()))
 	}
+}
+
+/*
+serverConfig holds the listener, backend and security settings given on the command line
+*/
+type serverConfig struct {
+	address     string
+	port        string
+	adminPort   string
+	adminOnData bool
+	filename    string
+	backend     string
+	dbOptions   dbOptions
+	tls         *tls.Config
+	acl         *ACL
+	audit       *auditLog
+	idleTimeout time.Duration
+	maxConns    int
+	maxLineSize int
+	maxItemSize int
+	pubsub      int
+	queues      string
+	replication replicationOptions
+	cluster     clusterOptions
+	proxy       proxyOptions
+}
+
+/*
+proxyOptions makes this server a proxy to the nodes of a hash ring
+*/
+type proxyOptions struct {
+	ring           string
+	vnodes         int
+	healthInterval time.Duration
+}
+
+/*
+replicationOptions enables the change log on a primary, or makes this server a replica
+*/
+type replicationOptions struct {
+	changeLog   string
+	segmentSize int64
+	keep        int
+	replicaOf   string
+	auth        string
+}
+
+func newProtocolServer(cfg serverConfig, listener string, admin bool) *MemcachedProtocolServer {
+	ms := NewMemcachedProtocolServer(false, cfg.acl)
+	ms.admin = admin
+	ms.audit = cfg.audit
+	ms.listener = listener
+	ms.idleTimeout = cfg.idleTimeout
+	ms.maxLineSize = cfg.maxLineSize
+	ms.maxItemSize = cfg.maxItemSize
+	return ms
+}
+
+/*
+listen opens a memcached protocol listener, TLS enabled if configured
+*/
+func listen(cfg serverConfig, port string) (net.Listener, error) {
+	addr := fmt.Sprintf("%s:%s", cfg.address, port)
+	listener, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Error("Error opening db %s", err)
+		return nil, err
+	}
+	if cfg.tls != nil {
+		listener = tls.NewListener(listener, cfg.tls)
+	}
+	return listener, nil
+}
+
+/*
+connLimiter caps open client connections of a listener. A nil limiter allows everything
+*/
+type connLimiter struct {
+	slots chan struct{}
+}
+
+func newConnLimiter(max int) *connLimiter {
+	if max <= 0 {
 		return nil
 	}
-	return vdb
+	return &connLimiter{slots: make(chan struct{}, max)}
+}
 
+func (l *connLimiter) Acquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
 }
 
-func switchDBHandler(w http.ResponseWriter, req *http.Request) {
-	if req.Method != "POST" {
-		http.Error(w, "405 Method not allowed", 405)
-		return
+func (l *connLimiter) Release() {
+	if l != nil {
+		<-l.slots
 	}
-	filename := req.FormValue("filename")
-	if filename == "" {
-		http.Error(w, "500 Internal error", 500)
-		return
+}
+
+func rejectConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte("SERVER_ERROR too many open connections\r\n"))
+}
+
+func acceptLoop(listener net.Listener, ms *MemcachedProtocolServer, db *currentDB, limiter *connLimiter) {
+	for {
+		if conn, err := listener.Accept(); err == nil {
+			totalConnections.Inc(1)
+			if !limiter.Acquire() {
+				rejectedConnections.Inc(1)
+				go rejectConn(conn)
+				continue
+			}
+			go func() {
+				defer limiter.Release()
+				ms.Parse(conn, db)
+			}()
+		} else if errors.Is(err, net.ErrClosed) {
+			return
+		} else {
+			networkErrors.Inc(1)
+			log.Error(err.Error())
+		}
 	}
-	messages <- filename
-	w.Write([]byte("OK"))
 }
 
-func serve(ip string, port string, filename string, backend string) {
-	var err error
+func serve(cfg serverConfig) {
 	messages = make(chan string)
+	backend := cfg.backend
+
+	var vdb BackendDatabase
+	if cfg.proxy.ring != "" {
+		pb, err := NewProxyBackend(cfg.proxy.ring, cfg.proxy.vnodes, cfg.proxy.healthInterval)
+		if err != nil {
+			log.Fatalf("Proxy: %s", err)
+		}
+		log.Info("Proxy mode: %s", pb.Stats())
+		vdb, backend = pb, "proxy"
+	} else {
+		vdb = loadDB(backend, cfg.filename, cfg.dbOptions)
+	}
+	var cluster *raftBackend
+	if cfg.cluster.addr != "" {
+		if vdb == nil {
+			log.Fatalf("Cluster: can't open %s", cfg.filename)
+		}
+		var err error
+		if cluster, err = startCluster(cfg.cluster, vdb); err != nil {
+			log.Fatalf("Cluster: %s", err)
+		}
+		vdb = cluster
+	}
+	db := newCurrentDB(vdb, backend)
+	defer func() { db.Active().Close() }()
+	if cfg.queues != "" {
+		db.pinned = errQueuesPinned
+	}
+
+	repl := cfg.replication
+	if repl.changeLog != "" {
+		cl, err := openChangeLog(repl.changeLog, repl.segmentSize, repl.keep)
+		if err != nil {
+			log.Fatalf("Change log: %s", err)
+		}
+		cl.SetDurability(cfg.dbOptions.durability, cfg.dbOptions.syncInterval)
+		defer cl.Close()
+		db.changes = cl
+		log.Info("Change log %s at sequence %d", repl.changeLog, cl.Last())
+	}
+	if repl.replicaOf != "" {
+		r, err := newReplica(repl.replicaOf, repl.auth, clientTLSConfig(cfg.tls), db, cfg.filename)
+		if err != nil {
+			log.Fatalf("Replica: %s", err)
+		}
+		log.Info("Replica of %s, last applied change %d", repl.replicaOf, r.applied)
+		defer r.Close()
+		go r.run()
+	}
+
+	var leases *leaseManager
+	// lease state is local, it would differ between cluster and proxy nodes
+	if cluster == nil && backend != "proxy" {
+		leases = newLeaseManager()
+		if err := leases.Load(db); err != nil {
+			log.Fatalf("Leases: %s", err)
+		}
+	}
 
 	go func() {
-		http.HandleFunc("/api/v1/switchdb", switchDBHandler)
-		http.ListenAndServe(":8080", nil)
+		http.HandleFunc("/api/v1/switchdb", authorizeHTTP(cfg.acl, classAdmin, switchDBHandler(db, cfg.audit)))
+		http.HandleFunc("/api/v1/flush", authorizeHTTP(cfg.acl, classAdmin, flushHandler(db, leases, cfg.audit)))
+		http.HandleFunc("/api/v1/dbstats", authorizeHTTP(cfg.acl, classAdmin, dbStatsHandler(db, cfg.audit)))
+		http.HandleFunc("/api/v1/backup", authorizeHTTP(cfg.acl, classAdmin, backupHandler(db, cfg.audit)))
+		http.HandleFunc("/api/v1/export", authorizeHTTP(cfg.acl, classAdmin, exportHandler(db, cfg.audit)))
+		http.HandleFunc("/api/v1/import", authorizeHTTP(cfg.acl, classAdmin, importHandler(db, cfg.audit)))
+		http.HandleFunc("/api/v1/migrate", authorizeHTTP(cfg.acl, classAdmin, migrateHandler(db, cfg.dbOptions, cfg.audit)))
+		if db.changes != nil {
+			http.HandleFunc("/api/v1/watch", authorizeHTTP(cfg.acl, classRead, watchHandler(db.changes, cfg.audit)))
+		}
+		if cluster != nil {
+			http.HandleFunc("/api/v1/cluster", authorizeHTTP(cfg.acl, classAdmin, clusterHandler(cluster, cfg.audit)))
+		}
+		http.HandleFunc("/api/v1/rotatekeys", authorizeHTTP(cfg.acl, classAdmin, rotateKeysHandler(db, cfg.audit)))
+		// the API listens on the -s address, like the memcached listener
+		addr := fmt.Sprintf("%s:8080", cfg.address)
+		if cfg.tls != nil {
+			srv := &http.Server{Addr: addr, TLSConfig: cfg.tls}
+			log.Error("HTTP: %s", srv.ListenAndServeTLS("", ""))
+			return
+		}
+		log.Error("HTTP: %s", http.ListenAndServe(addr, nil))
 	}()
-	addr := fmt.Sprintf("%s:%s", ip, port)
-	listener, err := net.Listen("tcp", addr)
+
+	listener, err := listen(cfg, cfg.port)
+	if err != nil {
+		networkErrors.Inc(1)
+		log.Fatal(err.Error())
+	}
 	defer listener.Close()
 
-	vdb := loadDB(backend, filename)
-	defer vdb.Close()
+	migrate := func(backend string, filename string) error {
+		return db.Migrate(backend, filename, cfg.dbOptions)
+	}
+	ms := newProtocolServer(cfg, "data", cfg.adminOnData)
+	ms.migrate = migrate
+	ms.changes = db.changes
+	ms.readonly = repl.replicaOf != ""
+	ms.cluster = cluster
+	ms.pubsub = newPubSub(cfg.pubsub)
+	if cfg.queues != "" {
+		ms.queues = newQueueManager(cfg.queues)
+	}
+	ms.leases = leases
+	// inmem can't range over keys, hgetall and hkeys would miss the fields.
+	// Proxied field keys carry a control byte, the nodes refuse them
+	ms.noHashes = backend == "inmem" || backend == "proxy"
+	limiter := newConnLimiter(cfg.maxConns)
 
-	ms := NewMemcachedProtocolServer(false)
+	if cfg.adminPort != "" {
+		adminListener, err := listen(cfg, cfg.adminPort)
+		if err != nil {
+			networkErrors.Inc(1)
+			log.Fatal(err.Error())
+		}
+		defer adminListener.Close()
+		adminMs := newProtocolServer(cfg, "admin", true)
+		adminMs.migrate = migrate
+		adminMs.changes = db.changes
+		adminMs.readonly = repl.replicaOf != ""
+		adminMs.cluster = cluster
+		adminMs.pubsub = ms.pubsub
+		adminMs.queues = ms.queues
+		adminMs.leases = ms.leases
+		adminMs.noHashes = ms.noHashes
+		log.Info("Admin listener on %s:%s", cfg.address, cfg.adminPort)
+		// a limiter of its own, so admins and replicas get in while data clients fill theirs
+		go acceptLoop(adminListener, adminMs, db, newConnLimiter(cfg.maxConns))
+	}
 
 	go func() {
 		for {
 			filename := <-messages
 			if filename != "" {
+				vdb := db.Active()
+				if cluster != nil || backend == "proxy" {
+					log.Error("DB Switch to %s - Aborted, not supported in cluster and proxy modes", filename)
+					continue
+				}
 				if vdb.GetDbPath() == filename {
 					log.Error("DB Switch from %s to %s - Aborted, db already open", vdb.GetDbPath(), filename)
 					continue
@@ -75,27 +598,20 @@ func serve(ip string, port string, filename string, backend string) {
 				log.Info("DB Switch from %s to %s", vdb.GetDbPath(), filename)
 				currentVdb := vdb
 				time.Sleep(2 * time.Second)
-				vdb = loadDB(backend, filename)
+				newVdb := loadDB(db.Backend(), filename, cfg.dbOptions)
+				if newVdb == nil {
+					log.Error("DB Switch from %s to %s - Aborted, can't open %s", vdb.GetDbPath(), filename, filename)
+					ms.ReadOnly(false)
+					continue
+				}
+				db.Swap(newVdb, db.Backend())
 				time.Sleep(2 * time.Second)
 				currentVdb.Close()
-				log.Info("DB Switch from %s to %s done", vdb.GetDbPath(), filename)
+				log.Info("DB Switch from %s to %s done", db.Active().GetDbPath(), filename)
 				ms.ReadOnly(false)
 			}
 		}
 	}()
 
-	if err == nil {
-		for {
-			if conn, err := listener.Accept(); err == nil {
-				totalConnections.Inc(1)
-				go ms.Parse(conn, vdb)
-			} else {
-				networkErrors.Inc(1)
-				log.Error(err.Error())
-			}
-		}
-	} else {
-		networkErrors.Inc(1)
-		log.Fatal(err.Error())
-	}
+	acceptLoop(listener, ms, db, limiter)
 }
@@ -0,0 +1,753 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// proxyTimeout bounds a request to a node, dial included
+const proxyTimeout = 2 * time.Second
+
+// proxyMaxIdle is the number of idle connections kept per node
+const proxyMaxIdle = 16
+
+// proxyMaxFailures is the number of failed health checks taking a node out of the ring
+const proxyMaxFailures = 3
+
+var errNoProxyNode = errors.New("no node available for key")
+
+/*
+MultiGetter is implemented by backends fetching several keys in one go
+*/
+type MultiGetter interface {
+	GetMulti(keys [][]byte) (map[string][]byte, error)
+}
+
+/*
+findMultiGetter walks down the wrapper chain looking for a backend able to fetch keys in batches
+*/
+func findMultiGetter(vdb BackendDatabase) (MultiGetter, bool) {
+	for vdb != nil {
+		if mg, ok := vdb.(MultiGetter); ok {
+			return mg, true
+		}
+		w, ok := vdb.(backendWrapper)
+		if !ok {
+			break
+		}
+		vdb = w.Unwrap()
+	}
+	return nil, false
+}
+
+/*
+ringNode is a line of the ring configuration: <host:port> [weight]
+*/
+type ringNode struct {
+	addr   string
+	weight int
+}
+
+/*
+loadRingConfig reads one node per line, weight defaults to 1. Blank lines and
+lines starting with # are skipped
+*/
+func loadRingConfig(filename string) ([]ringNode, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []ringNode
+	seen := make(map[string]bool)
+	for i, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("%s:%d: expected <host:port> [weight]", filename, i+1)
+		}
+		n := ringNode{addr: fields[0], weight: 1}
+		if _, _, err := net.SplitHostPort(n.addr); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", filename, i+1, err)
+		}
+		if len(fields) == 2 {
+			if n.weight, err = strconv.Atoi(fields[1]); err != nil || n.weight < 1 {
+				return nil, fmt.Errorf("%s:%d: bad weight %s", filename, i+1, fields[1])
+			}
+		}
+		if seen[n.addr] {
+			return nil, fmt.Errorf("%s:%d: %s listed twice", filename, i+1, n.addr)
+		}
+		seen[n.addr] = true
+		nodes = append(nodes, n)
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("%s: no nodes", filename)
+	}
+	return nodes, nil
+}
+
+/*
+hashRing places vnodes points per weight unit of every node on a 32 bit
+circle, ketama style: a key belongs to the first point at or after its hash.
+Adding or removing a node only moves the keys of its own points
+*/
+type hashRing struct {
+	points []uint32
+	owners []string
+}
+
+func ringHash(b []byte) uint32 {
+	sum := md5.Sum(b)
+	return binary.LittleEndian.Uint32(sum[:4])
+}
+
+func newHashRing(nodes []ringNode, vnodes int) *hashRing {
+	type point struct {
+		hash  uint32
+		owner string
+	}
+	var points []point
+	for _, n := range nodes {
+		// each md5 gives 4 points
+		for i := 0; i < (n.weight*vnodes+3)/4; i++ {
+			sum := md5.Sum([]byte(fmt.Sprintf("%s-%d", n.addr, i)))
+			for j := 0; j < 4; j++ {
+				points = append(points, point{binary.LittleEndian.Uint32(sum[j*4:]), n.addr})
+			}
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash == points[j].hash {
+			return points[i].owner < points[j].owner
+		}
+		return points[i].hash < points[j].hash
+	})
+	r := hashRing{points: make([]uint32, len(points)), owners: make([]string, len(points))}
+	for i, p := range points {
+		r.points[i], r.owners[i] = p.hash, p.owner
+	}
+	return &r
+}
+
+/*
+lookup returns the node owning key, skipping nodes up reports as down: their
+keys go to the next node on the circle. Empty if no node is up
+*/
+func (r *hashRing) lookup(key []byte, up func(addr string) bool) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	for n := 0; n < len(r.points); n++ {
+		owner := r.owners[(i+n)%len(r.points)]
+		if up(owner) {
+			return owner
+		}
+	}
+	return ""
+}
+
+/*
+proxyConn is a memcached protocol connection to a node
+*/
+type proxyConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+func (pc *proxyConn) readLine() (string, error) {
+	line, err := pc.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+/*
+command sends a command line, and the data block when body isn't nil, and returns the reply line
+*/
+func (pc *proxyConn) command(line string, body []byte) (string, error) {
+	pc.w.WriteString(line)
+	pc.w.WriteString("\r\n")
+	if body != nil {
+		pc.w.Write(body)
+		pc.w.WriteString("\r\n")
+	}
+	if err := pc.w.Flush(); err != nil {
+		return "", err
+	}
+	return pc.readLine()
+}
+
+/*
+values sends a retrieval command and reads the VALUE blocks up to END
+*/
+func (pc *proxyConn) values(line string, ret map[string][]byte) error {
+	reply, err := pc.command(line, nil)
+	for ; err == nil; reply, err = pc.readLine() {
+		if reply == "END" {
+			return nil
+		}
+		// VALUE <key> <flags> <bytes> [<cas>]
+		fields := strings.Fields(reply)
+		if len(fields) < 4 || fields[0] != "VALUE" {
+			return fmt.Errorf("unexpected reply %q to %s", reply, line)
+		}
+		size, err := strconv.Atoi(fields[3])
+		if err != nil || size < 0 {
+			return fmt.Errorf("bad value size in %q", reply)
+		}
+		v := make([]byte, size+2)
+		if _, err := io.ReadFull(pc.r, v); err != nil {
+			return err
+		}
+		ret[fields[1]] = v[:size]
+	}
+	return err
+}
+
+/*
+proxyNode is a memcached protocol server with its idle connections and
+health. Failed requests are counted in errs
+*/
+type proxyNode struct {
+	addr     string
+	timeout  time.Duration
+	errs     metrics.Counter
+	idle     chan *proxyConn
+	lock     sync.Mutex
+	up       bool
+	failures int
+}
+
+func newProxyNode(addr string, timeout time.Duration, errs metrics.Counter) *proxyNode {
+	return &proxyNode{addr: addr, timeout: timeout, errs: errs, idle: make(chan *proxyConn, proxyMaxIdle), up: true}
+}
+
+func (pn *proxyNode) isUp() bool {
+	pn.lock.Lock()
+	defer pn.lock.Unlock()
+	return pn.up
+}
+
+/*
+do runs fn on a connection to the node. A connection that failed is dropped,
+its protocol state is unknown
+*/
+func (pn *proxyNode) do(fn func(pc *proxyConn) error) error {
+	var pc *proxyConn
+	select {
+	case pc = <-pn.idle:
+	default:
+		conn, err := net.DialTimeout("tcp", pn.addr, pn.timeout)
+		if err != nil {
+			pn.errs.Inc(1)
+			return err
+		}
+		pc = &proxyConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	}
+	pc.conn.SetDeadline(time.Now().Add(pn.timeout))
+	if err := fn(pc); err != nil {
+		pn.errs.Inc(1)
+		pc.conn.Close()
+		return fmt.Errorf("%s: %s", pn.addr, err)
+	}
+	select {
+	case pn.idle <- pc:
+	default:
+		pc.conn.Close()
+	}
+	return nil
+}
+
+/*
+check sends version to the node, proxyMaxFailures failures in a row take it
+down and one success brings it back
+*/
+func (pn *proxyNode) check() {
+	err := pn.do(func(pc *proxyConn) error {
+		reply, err := pc.command("version", nil)
+		if err == nil && !strings.HasPrefix(reply, "VERSION") {
+			err = fmt.Errorf("unexpected reply %q to version", reply)
+		}
+		return err
+	})
+	pn.lock.Lock()
+	defer pn.lock.Unlock()
+	if err == nil {
+		if !pn.up {
+			log.Info("Proxy: node %s is up", pn.addr)
+			proxyNodesDown.Dec(1)
+		}
+		pn.up, pn.failures = true, 0
+		return
+	}
+	if pn.failures++; pn.failures >= proxyMaxFailures && pn.up {
+		log.Error("Proxy: node %s is down: %s", pn.addr, err)
+		proxyNodesDown.Inc(1)
+		pn.up = false
+	}
+}
+
+func (pn *proxyNode) Close() {
+	pn.lock.Lock()
+	if !pn.up {
+		proxyNodesDown.Dec(1)
+	}
+	pn.lock.Unlock()
+	for {
+		select {
+		case pc := <-pn.idle:
+			pc.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+/*
+proxyBackend routes each key to a beano or memcached node of a consistent hash
+ring read from filename. Nodes failing health checks are skipped, their keys
+go to the next node on the ring until they are back. The ring is rebuilt when
+the file changes
+*/
+type proxyBackend struct {
+	filename string
+	vnodes   int
+	lock     *sync.RWMutex
+	ring     *hashRing
+	config   []ringNode
+	nodes    map[string]*proxyNode
+	modTime  time.Time
+	quit     chan bool
+	stopped  chan bool
+}
+
+/*
+NewProxyBackend loads the ring from filename and health checks its nodes every interval
+*/
+func NewProxyBackend(filename string, vnodes int, interval time.Duration) (*proxyBackend, error) {
+	pb := proxyBackend{
+		filename: filename,
+		vnodes:   vnodes,
+		lock:     &sync.RWMutex{},
+		nodes:    make(map[string]*proxyNode),
+		quit:     make(chan bool),
+		stopped:  make(chan bool),
+	}
+	if err := pb.reload(); err != nil {
+		return nil, err
+	}
+	go pb.watch(interval)
+	return &pb, nil
+}
+
+/*
+reload rebuilds the ring from the configuration file. Nodes still in the ring
+keep their connections and health
+*/
+func (pb *proxyBackend) reload() error {
+	fi, err := os.Stat(pb.filename)
+	if err != nil {
+		return err
+	}
+	config, err := loadRingConfig(pb.filename)
+	if err != nil {
+		return err
+	}
+	ring := newHashRing(config, pb.vnodes)
+	pb.lock.Lock()
+	defer pb.lock.Unlock()
+	nodes := make(map[string]*proxyNode)
+	for _, n := range config {
+		if pn, ok := pb.nodes[n.addr]; ok {
+			nodes[n.addr] = pn
+		} else {
+			nodes[n.addr] = newProxyNode(n.addr, proxyTimeout, proxyErrors)
+		}
+	}
+	for addr, pn := range pb.nodes {
+		if _, ok := nodes[addr]; !ok {
+			pn.Close()
+		}
+	}
+	pb.ring, pb.config, pb.nodes, pb.modTime = ring, config, nodes, fi.ModTime()
+	return nil
+}
+
+func (pb *proxyBackend) changed() bool {
+	fi, err := os.Stat(pb.filename)
+	if err != nil {
+		return false
+	}
+	pb.lock.RLock()
+	defer pb.lock.RUnlock()
+	return !fi.ModTime().Equal(pb.modTime)
+}
+
+/*
+watch health checks the nodes and reloads the ring when its file changes
+*/
+func (pb *proxyBackend) watch(interval time.Duration) {
+	defer close(pb.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pb.quit:
+			return
+		case <-ticker.C:
+		}
+		if pb.changed() {
+			if err := pb.reload(); err != nil {
+				log.Error("Proxy: error reloading %s, keeping the current ring: %s", pb.filename, err)
+			} else {
+				proxyReloads.Inc(1)
+				log.Info("Proxy: ring reloaded from %s", pb.filename)
+			}
+		}
+		var wg sync.WaitGroup
+		for _, pn := range pb.allNodes() {
+			wg.Add(1)
+			go func(pn *proxyNode) {
+				defer wg.Done()
+				pn.check()
+			}(pn)
+		}
+		wg.Wait()
+	}
+}
+
+func (pb *proxyBackend) allNodes() []*proxyNode {
+	pb.lock.RLock()
+	defer pb.lock.RUnlock()
+	var ret []*proxyNode
+	for _, n := range pb.config {
+		ret = append(ret, pb.nodes[n.addr])
+	}
+	return ret
+}
+
+func (pb *proxyBackend) upNodes() []*proxyNode {
+	var ret []*proxyNode
+	for _, pn := range pb.allNodes() {
+		if pn.isUp() {
+			ret = append(ret, pn)
+		}
+	}
+	return ret
+}
+
+/*
+route returns the node for key
+*/
+func (pb *proxyBackend) route(key []byte) (*proxyNode, error) {
+	pb.lock.RLock()
+	defer pb.lock.RUnlock()
+	addr := pb.ring.lookup(key, func(addr string) bool { return pb.nodes[addr].isUp() })
+	if addr == "" {
+		return nil, errNoProxyNode
+	}
+	proxyRequests.Inc(1)
+	return pb.nodes[addr], nil
+}
+
+/*
+store runs a storage command for key
+*/
+func (pb *proxyBackend) store(cmd string, key []byte, value []byte) error {
+	pn, err := pb.route(key)
+	if err != nil {
+		return err
+	}
+	var reply string
+	if err := pn.do(func(pc *proxyConn) error {
+		reply, err = pc.command(fmt.Sprintf("%s %s 0 0 %d", cmd, key, len(value)), value)
+		return err
+	}); err != nil {
+		return err
+	}
+	if reply != "STORED" {
+		return fmt.Errorf("%s %s on %s: %s", cmd, key, pn.addr, reply)
+	}
+	return nil
+}
+
+/*
+Set the value for key
+*/
+func (pb *proxyBackend) Set(key []byte, value []byte) error {
+	return pb.store("set", key, value)
+}
+
+/*
+Add value to key, store data only if the server doesnt holds it yet
+*/
+func (pb *proxyBackend) Add(key []byte, value []byte) error {
+	return pb.store("add", key, value)
+}
+
+/*
+Replace value for key, store data only if the server already holds this key
+*/
+func (pb *proxyBackend) Replace(key []byte, value []byte) error {
+	return pb.store("replace", key, value)
+}
+
+/*
+Put data checking if it should be replaced or exists
+*/
+func (pb *proxyBackend) Put(key []byte, value []byte, replace bool, passthru bool) error {
+	switch {
+	case passthru:
+		return pb.Set(key, value)
+	case replace:
+		return pb.Replace(key, value)
+	default:
+		return pb.Add(key, value)
+	}
+}
+
+/*
+Incr data, yields error if the represented value doesnt maps to int
+*/
+func (pb *proxyBackend) Incr(key []byte, value uint) (int, error) {
+	return pb.Increment(key, int(value), false)
+}
+
+/*
+Decr data, yields error if the represented value doesnt maps to int
+*/
+func (pb *proxyBackend) Decr(key []byte, value uint) (int, error) {
+	return pb.Increment(key, int(value)*-1, false)
+}
+
+/*
+Increment sends incr or decr to the node. A missing key is created with 0
+when createIfNotExists is set
+*/
+func (pb *proxyBackend) Increment(key []byte, value int, createIfNotExists bool) (int, error) {
+	pn, err := pb.route(key)
+	if err != nil {
+		return -1, err
+	}
+	line := fmt.Sprintf("incr %s %d", key, value)
+	if value < 0 {
+		line = fmt.Sprintf("decr %s %d", key, -value)
+	}
+	var reply string
+	if err := pn.do(func(pc *proxyConn) error {
+		reply, err = pc.command(line, nil)
+		if err == nil && reply == "NOT_FOUND" && createIfNotExists {
+			if reply, err = pc.command(fmt.Sprintf("add %s 0 0 1", key), []byte("0")); reply == "STORED" {
+				reply = "0"
+			}
+		}
+		return err
+	}); err != nil {
+		return -1, err
+	}
+	i, err := strconv.Atoi(reply)
+	if err != nil {
+		return -1, fmt.Errorf("%s on %s: %s", line, pn.addr, reply)
+	}
+	return i, nil
+}
+
+/*
+Get data for key
+*/
+func (pb *proxyBackend) Get(key []byte) ([]byte, error) {
+	ret, err := pb.GetMulti([][]byte{key})
+	return ret[string(key)], err
+}
+
+/*
+GetMulti sends one get per node for its keys, in parallel, and merges the
+replies. Keys of a failing node are missing from the result, with the error
+*/
+func (pb *proxyBackend) GetMulti(keys [][]byte) (map[string][]byte, error) {
+	byNode := make(map[*proxyNode][]string)
+	var firstErr error
+	for _, key := range keys {
+		pn, err := pb.route(key)
+		if err != nil {
+			firstErr = err
+			continue
+		}
+		byNode[pn] = append(byNode[pn], string(key))
+	}
+	ret := make(map[string][]byte)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for pn, keys := range byNode {
+		wg.Add(1)
+		go func(pn *proxyNode, keys []string) {
+			defer wg.Done()
+			values := make(map[string][]byte)
+			err := pn.do(func(pc *proxyConn) error {
+				return pc.values("get "+strings.Join(keys, " "), values)
+			})
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			for k, v := range values {
+				ret[k] = v
+			}
+		}(pn, keys)
+	}
+	wg.Wait()
+	return ret, firstErr
+}
+
+/*
+Range sends range to every node up and merges the replies, only beano nodes
+implement it. The limit is applied again on the merged keys
+*/
+func (pb *proxyBackend) Range(key []byte, limit int, from []byte, reverse bool) (map[string][]byte, error) {
+	line := fmt.Sprintf("range %s", key)
+	if limit >= 0 && from == nil && !reverse {
+		line = fmt.Sprintf("range %s %d", key, limit)
+	}
+	merged := make(map[string][]byte)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+	for _, pn := range pb.upNodes() {
+		wg.Add(1)
+		go func(pn *proxyNode) {
+			defer wg.Done()
+			values := make(map[string][]byte)
+			err := pn.do(func(pc *proxyConn) error { return pc.values(line, values) })
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			for k, v := range values {
+				merged[k] = v
+			}
+		}(pn)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	ret := make(map[string][]byte)
+	for _, k := range sortedKeys(merged, reverse) {
+		if from != nil && ((!reverse && k < string(from)) || (reverse && k > string(from))) {
+			continue
+		}
+		if limit >= 0 && len(ret) == limit {
+			break
+		}
+		ret[k] = merged[k]
+	}
+	return ret, nil
+}
+
+/*
+Delete key. Nodes don't tell a missing key from a deleted one unless
+onlyIfExists is set, as for the local backends
+*/
+func (pb *proxyBackend) Delete(key []byte, onlyIfExists bool) (bool, error) {
+	pn, err := pb.route(key)
+	if err != nil {
+		return false, err
+	}
+	var reply string
+	if err := pn.do(func(pc *proxyConn) error {
+		reply, err = pc.command(fmt.Sprintf("delete %s", key), nil)
+		return err
+	}); err != nil {
+		return false, err
+	}
+	switch reply {
+	case "DELETED":
+		return true, nil
+	case "NOT_FOUND":
+		return !onlyIfExists, nil
+	}
+	return false, fmt.Errorf("delete %s on %s: %s", key, pn.addr, reply)
+}
+
+/*
+Flush sends flush_all to every node up
+*/
+func (pb *proxyBackend) Flush() error {
+	for _, pn := range pb.upNodes() {
+		var reply string
+		if err := pn.do(func(pc *proxyConn) (err error) {
+			reply, err = pc.command("flush_all", nil)
+			return err
+		}); err != nil {
+			return err
+		}
+		if reply != "OK" {
+			return fmt.Errorf("flush_all on %s: %s", pn.addr, reply)
+		}
+	}
+	return nil
+}
+
+/*
+Close stops the health checks and closes the idle connections
+*/
+func (pb *proxyBackend) Close() {
+	close(pb.quit)
+	<-pb.stopped
+	for _, pn := range pb.allNodes() {
+		pn.Close()
+	}
+}
+
+/*
+Stats returns the ring nodes and their health
+*/
+func (pb *proxyBackend) Stats() string {
+	pb.lock.RLock()
+	defer pb.lock.RUnlock()
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "proxy: ring %s, %d nodes, %d points", pb.filename, len(pb.config), len(pb.ring.points))
+	for _, n := range pb.config {
+		state := "up"
+		if !pb.nodes[n.addr].isUp() {
+			state = "down"
+		}
+		fmt.Fprintf(&b, "\nproxy: node %s weight %d %s", n.addr, n.weight, state)
+	}
+	return b.String()
+}
+
+/*
+GetDbPath returns the ring configuration file
+*/
+func (pb *proxyBackend) GetDbPath() string {
+	return pb.filename
+}
+
+/*
+BucketStats implement statuses for db that used the bucket idea (boltdb)
+*/
+func (pb *proxyBackend) BucketStats() error { return nil }
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashRing(t *testing.T) {
+	nodes := []ringNode{{"10.0.0.1:11211", 1}, {"10.0.0.2:11211", 1}, {"10.0.0.3:11211", 2}}
+	ring := newHashRing(nodes, 160)
+	all := func(string) bool { return true }
+	owners := make(map[string]string)
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		owners[key] = ring.lookup([]byte(key), all)
+		counts[owners[key]]++
+	}
+	// the weight 2 node holds about half the keys
+	if c := counts["10.0.0.3:11211"]; c < 4000 || c > 6000 {
+		t.Error(errUnexpected(fmt.Sprintf("weighted node got %d keys of 10000: %v", c, counts)))
+	}
+
+	// a node going down only moves its own keys
+	up := func(addr string) bool { return addr != "10.0.0.1:11211" }
+	for key, owner := range owners {
+		got := ring.lookup([]byte(key), up)
+		if owner != "10.0.0.1:11211" && got != owner {
+			t.Fatal(errUnexpected(fmt.Sprintf("%s moved from %s to %s", key, owner, got)))
+		}
+		if got == "10.0.0.1:11211" {
+			t.Fatal(errUnexpected(fmt.Sprintf("%s on a down node", key)))
+		}
+	}
+	// as does a node added to the ring
+	grown := newHashRing(append(nodes, ringNode{"10.0.0.4:11211", 1}), 160)
+	for key, owner := range owners {
+		if got := grown.lookup([]byte(key), all); got != owner && got != "10.0.0.4:11211" {
+			t.Fatal(errUnexpected(fmt.Sprintf("%s moved from %s to %s", key, owner, got)))
+		}
+	}
+	if ring.lookup([]byte("key"), func(string) bool { return false }) != "" {
+		t.Error(errUnexpected("lookup with every node down"))
+	}
+}
+
+func TestLoadRingConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beano-ring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "ring")
+	ioutil.WriteFile(name, []byte("# nodes\n127.0.0.1:11211\n\n127.0.0.1:11212 3\n"), 0644)
+	nodes, err := loadRingConfig(name)
+	if err != nil || len(nodes) != 2 || nodes[0].weight != 1 || nodes[1].weight != 3 {
+		t.Error(errUnexpected(fmt.Sprintf("%v %v", nodes, err)))
+	}
+	for _, bad := range []string{"", "127.0.0.1\n", "127.0.0.1:1 0\n", "127.0.0.1:1\n127.0.0.1:1\n", "127.0.0.1:1 1 1\n"} {
+		ioutil.WriteFile(name, []byte(bad), 0644)
+		if _, err := loadRingConfig(name); err == nil {
+			t.Error(errUnexpected(fmt.Sprintf("config %q accepted", bad)))
+		}
+	}
+}
+
+func TestProxy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beano-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// three beano nodes and an address nothing listens on
+	var addrs []string
+	dbs := make(map[string]BackendDatabase)
+	for i := 0; i < 3; i++ {
+		vdb := loadDB("leveldb", filepath.Join(dir, fmt.Sprintf("node%d.db", i)), dbOptions{})
+		defer vdb.Close()
+		ms := NewMemcachedProtocolServer(false, nil)
+		ms.admin = true
+		addr, stop := startTestServer(t, ms, vdb)
+		defer stop()
+		addrs = append(addrs, addr)
+		dbs[addr] = vdb
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := l.Addr().String()
+	l.Close()
+
+	ringFile := filepath.Join(dir, "ring")
+	ioutil.WriteFile(ringFile, []byte(strings.Join(addrs, "\n")+"\n"), 0644)
+	pb, err := NewProxyBackend(ringFile, 160, 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pb.Close()
+
+	ms := NewMemcachedProtocolServer(false, nil)
+	ms.admin = true
+	addr, stop := startTestServer(t, ms, newCurrentDB(pb, "proxy"))
+	defer stop()
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+
+	var keys []string
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		keys = append(keys, key)
+		fmt.Fprintf(conn, "set %s 0 0 %d\r\n%s\r\n", key, len(key), key)
+	}
+	for i, reply := range readReplies(t, r, 30) {
+		if reply != "STORED" {
+			t.Fatal(errUnexpected(fmt.Sprintf("set %s: %s", keys[i], reply)))
+		}
+	}
+	// each key is on the node the ring picks, and only there
+	used := make(map[string]bool)
+	for _, key := range keys {
+		owner, _ := pb.route([]byte(key))
+		used[owner.addr] = true
+		for a, vdb := range dbs {
+			if v, _ := vdb.Get([]byte(key)); (v != nil) != (a == owner.addr) {
+				t.Error(errUnexpected(fmt.Sprintf("%s on %s: %q, owner %s", key, a, v, owner.addr)))
+			}
+		}
+	}
+	if len(used) != 3 {
+		t.Error(errUnexpected(fmt.Sprintf("keys spread on %d nodes", len(used))))
+	}
+
+	// a multi-get spanning the nodes comes back merged, in order
+	fmt.Fprintf(conn, "get key00 missing key01 key02 key03\r\n")
+	replies := readReplies(t, r, 9)
+	want := []string{"VALUE key00 0 5", "key00", "VALUE key01 0 5", "key01", "VALUE key02 0 5", "key02", "VALUE key03 0 5", "key03", "END"}
+	for i := range want {
+		if replies[i] != want[i] {
+			t.Error(errUnexpected(fmt.Sprintf("multi-get reply %d: %q, want %q", i, replies[i], want[i])))
+		}
+	}
+
+	fmt.Fprintf(conn, "add key00 0 0 1\r\nx\r\nreplace key00 0 0 1\r\ny\r\ndelete key01\r\ndelete key01\r\n")
+	for i, want := range []string{"NOT_STORED", "STORED", "DELETED", "NOT_FOUND"} {
+		if reply := readReplies(t, r, 1)[0]; reply != want {
+			t.Error(errUnexpected(fmt.Sprintf("command %d: %q, want %q", i, reply, want)))
+		}
+	}
+	if v, err := pb.Range([]byte("key1"), 3, nil, false); err != nil || len(v) != 3 || string(v["key10"]) != "key10" || v["key13"] != nil {
+		t.Error(errUnexpected(fmt.Sprintf("range %v %v", v, err)))
+	}
+	if v, err := pb.Range([]byte("key"), 2, []byte("key05"), true); err != nil || len(v) != 2 || v["key05"] == nil || v["key04"] == nil {
+		t.Error(errUnexpected(fmt.Sprintf("reverse range %v %v", v, err)))
+	}
+
+	// a dead node is taken out of the ring by the health checks, its keys go elsewhere
+	ioutil.WriteFile(ringFile, []byte(strings.Join(append(addrs, dead), "\n")+"\n"), 0644)
+	os.Chtimes(ringFile, time.Now().Add(time.Second), time.Now().Add(time.Second))
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(pb.Stats(), dead+" weight 1 down") {
+		if time.Now().After(deadline) {
+			t.Fatal(errUnexpected(pb.Stats()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 30; i++ {
+		if err := pb.Set([]byte(fmt.Sprintf("more%02d", i)), []byte("v")); err != nil {
+			t.Error(errUnexpected(err))
+		}
+	}
+
+	// a node removed from the ring file gets no more keys
+	ioutil.WriteFile(ringFile, []byte(strings.Join(addrs[1:], "\n")+"\n"), 0644)
+	os.Chtimes(ringFile, time.Now().Add(2*time.Second), time.Now().Add(2*time.Second))
+	deadline = time.Now().Add(5 * time.Second)
+	for strings.Contains(pb.Stats(), addrs[0]) {
+		if time.Now().After(deadline) {
+			t.Fatal(errUnexpected(pb.Stats()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, key := range keys {
+		if owner, _ := pb.route([]byte(key)); owner.addr == addrs[0] {
+			t.Error(errUnexpected(fmt.Sprintf("%s still routed to the removed node", key)))
+		}
+	}
+
+	if err := pb.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for a, vdb := range dbs {
+		if v, _ := vdb.Get([]byte("key02")); v != nil && a != addrs[0] {
+			t.Error(errUnexpected(fmt.Sprintf("key02 left on %s after flush", a)))
+		}
+	}
+}
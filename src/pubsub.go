@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultPubSubBuffer = 1024
+
+// pubSubWriteTimeout bounds a write to a subscriber that stopped reading
+const pubSubWriteTimeout = 5 * time.Second
+
+/*
+pubSubMessage is a published message, pattern is the prefix it matched for psubscribe
+*/
+type pubSubMessage struct {
+	pattern string
+	channel string
+	data    []byte
+}
+
+/*
+subscriber is a connection in subscriber mode. Messages wait in a bounded
+buffer, a subscriber that lets it fill up is dropped: removed from the hub and
+dropped closed
+*/
+type subscriber struct {
+	messages chan pubSubMessage
+	dropped  chan struct{}
+	channels map[string]bool
+	patterns map[string]bool
+	closed   bool
+}
+
+/*
+pubSub delivers published messages to the subscribers of a channel and of
+the prefixes matching it. It's local to this server
+*/
+type pubSub struct {
+	lock     sync.Mutex
+	buffer   int
+	channels map[string]map[*subscriber]bool
+	patterns map[string]map[*subscriber]bool
+}
+
+/*
+newPubSub creates a hub buffering up to buffer messages per subscriber
+*/
+func newPubSub(buffer int) *pubSub {
+	if buffer < 1 {
+		buffer = 1
+	}
+	return &pubSub{
+		buffer:   buffer,
+		channels: make(map[string]map[*subscriber]bool),
+		patterns: make(map[string]map[*subscriber]bool),
+	}
+}
+
+func (ps *pubSub) newSubscriber() *subscriber {
+	pubSubSubscribers.Inc(1)
+	return &subscriber{
+		messages: make(chan pubSubMessage, ps.buffer),
+		dropped:  make(chan struct{}),
+		channels: make(map[string]bool),
+		patterns: make(map[string]bool),
+	}
+}
+
+func (s *subscriber) count() int {
+	return len(s.channels) + len(s.patterns)
+}
+
+func addSubscriber(set map[string]map[*subscriber]bool, name string, s *subscriber) {
+	if set[name] == nil {
+		set[name] = make(map[*subscriber]bool)
+	}
+	set[name][s] = true
+}
+
+func removeSubscriber(set map[string]map[*subscriber]bool, name string, s *subscriber) {
+	delete(set[name], s)
+	if len(set[name]) == 0 {
+		delete(set, name)
+	}
+}
+
+/*
+Subscribe s to channel, returns its subscription count
+*/
+func (ps *pubSub) Subscribe(s *subscriber, channel string) int {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	if !s.closed {
+		s.channels[channel] = true
+		addSubscriber(ps.channels, channel, s)
+	}
+	return s.count()
+}
+
+/*
+PSubscribe s to the channels starting with prefix, returns its subscription count
+*/
+func (ps *pubSub) PSubscribe(s *subscriber, prefix string) int {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	if !s.closed {
+		s.patterns[prefix] = true
+		addSubscriber(ps.patterns, prefix, s)
+	}
+	return s.count()
+}
+
+/*
+Unsubscribe s from channel, returns its subscription count
+*/
+func (ps *pubSub) Unsubscribe(s *subscriber, channel string) int {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	delete(s.channels, channel)
+	removeSubscriber(ps.channels, channel, s)
+	return s.count()
+}
+
+/*
+PUnsubscribe s from prefix, returns its subscription count
+*/
+func (ps *pubSub) PUnsubscribe(s *subscriber, prefix string) int {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	delete(s.patterns, prefix)
+	removeSubscriber(ps.patterns, prefix, s)
+	return s.count()
+}
+
+/*
+drop removes s from the hub, with the lock held
+*/
+func (ps *pubSub) drop(s *subscriber) {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	for channel := range s.channels {
+		removeSubscriber(ps.channels, channel, s)
+	}
+	for prefix := range s.patterns {
+		removeSubscriber(ps.patterns, prefix, s)
+	}
+	pubSubSubscribers.Dec(1)
+}
+
+/*
+Close removes s from the hub once its connection is gone
+*/
+func (ps *pubSub) Close(s *subscriber) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	ps.drop(s)
+}
+
+/*
+deliver queues m for s, dropping it if its buffer is full
+*/
+func (ps *pubSub) deliver(s *subscriber, m pubSubMessage) bool {
+	select {
+	case s.messages <- m:
+		pubSubDelivered.Inc(1)
+		return true
+	default:
+		pubSubSlowConsumers.Inc(1)
+		ps.drop(s)
+		close(s.dropped)
+		return false
+	}
+}
+
+/*
+Publish data on channel, returns how many subscribers got it
+*/
+func (ps *pubSub) Publish(channel string, data []byte) int {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	pubSubPublished.Inc(1)
+	receivers := 0
+	for s := range ps.channels[channel] {
+		if ps.deliver(s, pubSubMessage{channel: channel, data: data}) {
+			receivers++
+		}
+	}
+	for prefix, subs := range ps.patterns {
+		if !strings.HasPrefix(channel, prefix) {
+			continue
+		}
+		for s := range subs {
+			if ps.deliver(s, pubSubMessage{pattern: prefix, channel: channel, data: data}) {
+				receivers++
+			}
+		}
+	}
+	return receivers
+}
+
+/*
+readSubscriberCommands reads command lines for serveSubscriber until the
+connection fails or done is closed. It doesn't write to the connection
+*/
+func readSubscriberCommands(c *memcachedConn, commands chan<- []string, errs chan<- error, done <-chan struct{}) {
+	for {
+		line, err := c.buf.Reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			err = errLineTooLong
+		}
+		if err != nil {
+			select {
+			case errs <- err:
+			case <-done:
+			}
+			return
+		}
+		args := splitArgs(strings.TrimRight(string(line), "\r\n"), nil)
+		select {
+		case commands <- args:
+		case <-done:
+			return
+		}
+	}
+}
+
+/*
+writeMessage writes m to a subscriber connection
+*/
+func writeMessage(c *memcachedConn, m pubSubMessage) {
+	if m.pattern != "" {
+		c.writeLine(fmt.Sprintf("PMESSAGE %s %s %d", m.pattern, m.channel, len(m.data)))
+	} else {
+		c.writeLine(fmt.Sprintf("MESSAGE %s %d", m.channel, len(m.data)))
+	}
+	c.buf.Write(m.data)
+	c.writeLine("")
+}
+
+/*
+serveSubscriber puts the connection in subscriber mode after a subscribe or
+psubscribe, until it quits. Only subscribe, psubscribe, unsubscribe,
+punsubscribe, ping and quit are accepted, messages are sent as
+
+	MESSAGE <channel> <bytes>\r\n<data>
+	PMESSAGE <prefix> <channel> <bytes>\r\n<data>
+
+A subscriber that doesn't keep up with its buffer is disconnected
+*/
+func (ms MemcachedProtocolServer) serveSubscriber(c *memcachedConn, args []string) {
+	c.conn.SetReadDeadline(time.Time{})
+	s := ms.pubsub.newSubscriber()
+	defer ms.pubsub.Close(s)
+	ms.subscriberCommand(c, s, args)
+	commands := make(chan []string)
+	errs := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go readSubscriberCommands(c, commands, errs, done)
+	for {
+		c.conn.SetWriteDeadline(time.Now().Add(pubSubWriteTimeout))
+		if err := c.buf.Flush(); err != nil {
+			log.Info("Subscriber %s closed: %s", c.conn.RemoteAddr(), err)
+			return
+		}
+		select {
+		case m := <-s.messages:
+			writeMessage(c, m)
+			for len(s.messages) > 0 && c.buf.Writer.Buffered() < bufferSize {
+				writeMessage(c, <-s.messages)
+			}
+		case args := <-commands:
+			if !ms.subscriberCommand(c, s, args) {
+				return
+			}
+		case <-s.dropped:
+			log.Error("PUBSUB: disconnecting slow subscriber %s", c.conn.RemoteAddr())
+			c.writeLine("SERVER_ERROR slow consumer, disconnected")
+			c.buf.Flush()
+			return
+		case err := <-errs:
+			if err == errLineTooLong {
+				oversizedRequests.Inc(1)
+			}
+			return
+		}
+	}
+}
+
+/*
+subscriberCommand runs a command in subscriber mode, false once the connection quits
+*/
+func (ms MemcachedProtocolServer) subscriberCommand(c *memcachedConn, s *subscriber, args []string) bool {
+	if len(args) == 0 {
+		protocolErrors.Inc(1)
+		c.writeLine("ERROR")
+		return true
+	}
+	cmd := strings.ToLower(args[0])
+	if !ms.authorize(c, cmd, args) {
+		return true
+	}
+	switch {
+	case cmd == "quit":
+		return false
+	case cmd == "ping":
+		c.writeLine("PONG")
+	case len(args) < 2 && (cmd == "subscribe" || cmd == "psubscribe" || cmd == "unsubscribe" || cmd == "punsubscribe"):
+		protocolErrors.Inc(1)
+		c.writeLine("ERROR")
+	case cmd == "subscribe":
+		for _, channel := range args[1:] {
+			c.writeLine(fmt.Sprintf("SUBSCRIBED %s %d", channel, ms.pubsub.Subscribe(s, channel)))
+		}
+	case cmd == "psubscribe":
+		for _, prefix := range args[1:] {
+			c.writeLine(fmt.Sprintf("PSUBSCRIBED %s %d", prefix, ms.pubsub.PSubscribe(s, prefix)))
+		}
+	case cmd == "unsubscribe":
+		for _, channel := range args[1:] {
+			c.writeLine(fmt.Sprintf("UNSUBSCRIBED %s %d", channel, ms.pubsub.Unsubscribe(s, channel)))
+		}
+	case cmd == "punsubscribe":
+		for _, prefix := range args[1:] {
+			c.writeLine(fmt.Sprintf("PUNSUBSCRIBED %s %d", prefix, ms.pubsub.PUnsubscribe(s, prefix)))
+		}
+	default:
+		protocolErrors.Inc(1)
+		c.writeLine("CLIENT_ERROR only subscribe, psubscribe, unsubscribe, punsubscribe, ping and quit in subscriber mode")
+	}
+	return true
+}
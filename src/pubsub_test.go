@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPubSub(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beano-pubsub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	vdb := loadDB("leveldb", filepath.Join(dir, "pubsub.db"), dbOptions{})
+	defer vdb.Close()
+	ms := NewMemcachedProtocolServer(false, nil)
+	addr, stop := startTestServer(t, ms, vdb)
+	defer stop()
+
+	sub, rsub := dialTestServer(t, addr)
+	defer sub.Close()
+	fmt.Fprintf(sub, "subscribe news sports\r\n")
+	if replies := readReplies(t, rsub, 2); replies[0] != "SUBSCRIBED news 1" || replies[1] != "SUBSCRIBED sports 2" {
+		t.Fatal(errUnexpected(replies))
+	}
+	psub, rpsub := dialTestServer(t, addr)
+	defer psub.Close()
+	fmt.Fprintf(psub, "psubscribe app:\r\n")
+	if reply := readReplies(t, rpsub, 1)[0]; reply != "PSUBSCRIBED app: 1" {
+		t.Fatal(errUnexpected(reply))
+	}
+
+	pub, rpub := dialTestServer(t, addr)
+	defer pub.Close()
+	fmt.Fprintf(pub, "publish news 5\r\nhello\r\npublish app:orders 3\r\nnew\r\npublish nobody 1\r\nx\r\n")
+	want := []string{"PUBLISHED 1", "PUBLISHED 1", "PUBLISHED 0"}
+	for i, reply := range readReplies(t, rpub, len(want)) {
+		if reply != want[i] {
+			t.Error(errUnexpected(fmt.Sprintf("%q, want %q", reply, want[i])))
+		}
+	}
+	if replies := readReplies(t, rsub, 2); replies[0] != "MESSAGE news 5" || replies[1] != "hello" {
+		t.Error(errUnexpected(replies))
+	}
+	if replies := readReplies(t, rpsub, 2); replies[0] != "PMESSAGE app: app:orders 3" || replies[1] != "new" {
+		t.Error(errUnexpected(replies))
+	}
+
+	// subscriber mode only takes subscription commands
+	fmt.Fprintf(sub, "unsubscribe news\r\nping\r\nget news\r\n")
+	want = []string{"UNSUBSCRIBED news 1", "PONG", "CLIENT_ERROR only subscribe, psubscribe, unsubscribe, punsubscribe, ping and quit in subscriber mode"}
+	for i, reply := range readReplies(t, rsub, len(want)) {
+		if reply != want[i] {
+			t.Error(errUnexpected(fmt.Sprintf("%q, want %q", reply, want[i])))
+		}
+	}
+	fmt.Fprintf(pub, "publish news 4\r\nlost\r\npublish sports 4\r\ngoal\r\n")
+	readReplies(t, rpub, 2)
+	if replies := readReplies(t, rsub, 2); replies[0] != "MESSAGE sports 4" || replies[1] != "goal" {
+		t.Error(errUnexpected(replies))
+	}
+}
+
+func TestPubSubSlowConsumer(t *testing.T) {
+	ps := newPubSub(2)
+	slow, fast := ps.newSubscriber(), ps.newSubscriber()
+	ps.Subscribe(slow, "news")
+	ps.PSubscribe(fast, "ne")
+	dropped := pubSubSlowConsumers.Count()
+	for i := 0; i < 2; i++ {
+		if n := ps.Publish("news", []byte("hello")); n != 2 {
+			t.Error(errUnexpected(fmt.Sprintf("%d receivers", n)))
+		}
+		<-fast.messages
+	}
+	if n := ps.Publish("news", []byte("hello")); n != 1 {
+		t.Error(errUnexpected(fmt.Sprintf("%d receivers with a full buffer", n)))
+	}
+	select {
+	case <-slow.dropped:
+	default:
+		t.Error(errUnexpected("slow subscriber not dropped"))
+	}
+	if pubSubSlowConsumers.Count() != dropped+1 {
+		t.Error(errUnexpected(pubSubSlowConsumers.Count() - dropped))
+	}
+	if ps.Subscribe(slow, "sports"); len(ps.channels["sports"]) != 0 {
+		t.Error(errUnexpected("dropped subscriber resubscribed"))
+	}
+	ps.Close(slow)
+	ps.Close(fast)
+	if len(ps.channels) != 0 || len(ps.patterns) != 0 {
+		t.Error(errUnexpected(fmt.Sprintf("%d channels %d patterns left", len(ps.channels), len(ps.patterns))))
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errQueueReadOpen = errors.New("a read is already open on this queue")
+
+// queue heads and tails are kept in memory for the active database, it can't be replaced
+var errQueuesPinned = errors.New("switchdb and migrate aren't available with -queues")
+
+/*
+queueItemKey is where item seq of queue is stored: the queue name, a NUL and
+the sequence in fixed width hex, so items sort in order after the name
+*/
+func queueItemKey(name string, seq uint64) []byte {
+	return []byte(fmt.Sprintf("%s\x00%016x", name, seq))
+}
+
+func queueItemPrefix(name string) []byte {
+	return []byte(name + "\x00")
+}
+
+/*
+queue is the in memory state of a persisted queue: items from head to tail
+are in the backend unless consumed out of order, aborted holds the sequences
+of reads returned to the queue, served first. Sequences of open reads aren't
+in either until they are closed or aborted
+*/
+type queue struct {
+	name    string
+	lock    sync.Mutex
+	loaded  bool
+	head    uint64
+	tail    uint64
+	aborted []uint64
+	wait    chan struct{}
+}
+
+/*
+queueManager turns set and get on keys starting with prefix into enqueue and
+dequeue, kestrel style
+*/
+type queueManager struct {
+	prefix string
+	lock   sync.Mutex
+	queues map[string]*queue
+}
+
+func newQueueManager(prefix string) *queueManager {
+	return &queueManager{prefix: prefix, queues: make(map[string]*queue)}
+}
+
+/*
+IsQueue tells if key, with its /options, names a queue. False on a nil manager
+*/
+func (qm *queueManager) IsQueue(key string) bool {
+	return qm != nil && strings.HasPrefix(key, qm.prefix)
+}
+
+func (qm *queueManager) queue(name string) *queue {
+	qm.lock.Lock()
+	defer qm.lock.Unlock()
+	q, ok := qm.queues[name]
+	if !ok {
+		q = &queue{name: name, wait: make(chan struct{})}
+		qm.queues[name] = q
+	}
+	return q
+}
+
+/*
+load finds the first and last items of q in the backend, with q locked
+*/
+func (q *queue) load(vdb BackendDatabase) error {
+	if q.loaded {
+		return nil
+	}
+	for _, reverse := range []bool{false, true} {
+		items, err := vdb.Range(queueItemPrefix(q.name), 1, nil, reverse)
+		if err != nil {
+			return err
+		}
+		for key := range items {
+			seq, err := strconv.ParseUint(key[len(q.name)+1:], 16, 64)
+			if err != nil {
+				return fmt.Errorf("bad item key %q in queue %s", key, q.name)
+			}
+			if reverse {
+				q.tail = seq + 1
+			} else {
+				q.head = seq
+			}
+		}
+	}
+	q.loaded = true
+	return nil
+}
+
+/*
+next returns the sequence and value of the next item, without consuming it
+when peek is set. ok is false when the queue is empty
+*/
+func (q *queue) next(vdb BackendDatabase, peek bool) (seq uint64, value []byte, ok bool, err error) {
+	for len(q.aborted) > 0 {
+		seq = q.aborted[0]
+		if value, err = vdb.Get(queueItemKey(q.name, seq)); err != nil {
+			return 0, nil, false, err
+		}
+		if value == nil || !peek {
+			q.aborted = q.aborted[1:]
+		}
+		if value != nil {
+			return seq, value, true, nil
+		}
+	}
+	for q.head < q.tail {
+		seq = q.head
+		if value, err = vdb.Get(queueItemKey(q.name, seq)); err != nil {
+			return 0, nil, false, err
+		}
+		// missing items were consumed out of order or flushed
+		if value == nil || !peek {
+			q.head++
+		}
+		if value != nil {
+			return seq, value, true, nil
+		}
+	}
+	return 0, nil, false, nil
+}
+
+/*
+Enqueue stores value at the tail of queue name
+*/
+func (qm *queueManager) Enqueue(vdb BackendDatabase, name string, value []byte) error {
+	q := qm.queue(name)
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if err := q.load(vdb); err != nil {
+		return err
+	}
+	if err := vdb.Set(queueItemKey(name, q.tail), value); err != nil {
+		return err
+	}
+	q.tail++
+	queueEnqueued.Inc(1)
+	close(q.wait)
+	q.wait = make(chan struct{})
+	return nil
+}
+
+/*
+queueRead is a parsed queue get: <name>[/open][/close][/abort][/peek][/t=<ms>]
+*/
+type queueRead struct {
+	name    string
+	open    bool
+	close   bool
+	abort   bool
+	peek    bool
+	timeout time.Duration
+}
+
+func parseQueueRead(key string) (queueRead, error) {
+	parts := strings.Split(key, "/")
+	r := queueRead{name: parts[0]}
+	for _, opt := range parts[1:] {
+		switch {
+		case opt == "open":
+			r.open = true
+		case opt == "close":
+			r.close = true
+		case opt == "abort":
+			r.abort = true
+		case opt == "peek":
+			r.peek = true
+		case strings.HasPrefix(opt, "t="):
+			ms, err := strconv.Atoi(opt[2:])
+			if err != nil || ms < 0 {
+				return r, fmt.Errorf("bad timeout %q", opt)
+			}
+			r.timeout = time.Duration(ms) * time.Millisecond
+		default:
+			return r, fmt.Errorf("unknown queue option %q", opt)
+		}
+	}
+	if r.name == "" {
+		return r, errors.New("missing queue name")
+	}
+	return r, nil
+}
+
+/*
+Read runs a queue get for the connection reads, the open reads by queue
+name. Close confirms the open read, deleting its item, abort returns it to
+the queue. Then, unless only closing or aborting, the next item is taken,
+waiting up to timeout for one: removed, reserved as an open read or only
+peeked at. The value is nil when there is nothing to return
+*/
+func (qm *queueManager) Read(vdb BackendDatabase, reads map[string]uint64, r queueRead) ([]byte, error) {
+	q := qm.queue(r.name)
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if err := q.load(vdb); err != nil {
+		return nil, err
+	}
+	if seq, ok := reads[r.name]; ok && (r.close || r.abort) {
+		delete(reads, r.name)
+		queueOpenReads.Dec(1)
+		if r.close {
+			if _, err := vdb.Delete(queueItemKey(r.name, seq), false); err != nil {
+				return nil, err
+			}
+			queueDequeued.Inc(1)
+		} else {
+			q.returnItem(seq)
+			queueAborted.Inc(1)
+		}
+	}
+	if (r.close || r.abort) && !r.open && !r.peek {
+		return nil, nil
+	}
+	if _, ok := reads[r.name]; ok && r.open {
+		return nil, errQueueReadOpen
+	}
+	deadline := time.Now().Add(r.timeout)
+	for {
+		seq, value, ok, err := q.next(vdb, r.peek)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			switch {
+			case r.peek:
+			case r.open:
+				reads[r.name] = seq
+				queueOpenReads.Inc(1)
+			default:
+				if _, err := vdb.Delete(queueItemKey(r.name, seq), false); err != nil {
+					return nil, err
+				}
+				queueDequeued.Inc(1)
+			}
+			return value, nil
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return nil, nil
+		}
+		// wait for an enqueue with the queue unlocked
+		ch := q.wait
+		q.lock.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-ch:
+		case <-timer.C:
+		}
+		timer.Stop()
+		q.lock.Lock()
+	}
+}
+
+/*
+returnItem puts back an aborted read, with q locked
+*/
+func (q *queue) returnItem(seq uint64) {
+	i := sort.Search(len(q.aborted), func(i int) bool { return q.aborted[i] >= seq })
+	q.aborted = append(q.aborted, 0)
+	copy(q.aborted[i+1:], q.aborted[i:])
+	q.aborted[i] = seq
+	close(q.wait)
+	q.wait = make(chan struct{})
+}
+
+/*
+AbortAll returns the open reads of a closed connection to their queues
+*/
+func (qm *queueManager) AbortAll(reads map[string]uint64) {
+	if qm == nil {
+		return
+	}
+	for name, seq := range reads {
+		q := qm.queue(name)
+		q.lock.Lock()
+		q.returnItem(seq)
+		q.lock.Unlock()
+		queueOpenReads.Dec(1)
+		queueAborted.Inc(1)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseQueueRead(t *testing.T) {
+	r, err := parseQueueRead("q:jobs/close/open/t=250")
+	if err != nil || r.name != "q:jobs" || !r.close || !r.open || r.abort || r.peek || r.timeout != 250*time.Millisecond {
+		t.Error(errUnexpected(fmt.Sprintf("%+v %v", r, err)))
+	}
+	for _, bad := range []string{"q:jobs/later", "q:jobs/t=soon", "/open"} {
+		if _, err := parseQueueRead(bad); err == nil {
+			t.Error(errUnexpected(bad))
+		}
+	}
+}
+
+func TestQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beano-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	vdb := loadDB("leveldb", filepath.Join(dir, "queue.db"), dbOptions{})
+	ms := NewMemcachedProtocolServer(false, nil)
+	ms.queues = newQueueManager("q:")
+	addr, stop := startTestServer(t, ms, vdb)
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "set q:jobs 0 0 3\r\none\r\nset q:jobs 0 0 3\r\ntwo\r\nset q:jobs 0 0 5\r\nthree\r\nset q:jobs 0 0 4\r\nfour\r\n")
+	readReplies(t, r, 4)
+	fmt.Fprintf(conn, "get q:jobs\r\nget q:jobs/open\r\n")
+	want := []string{"VALUE q:jobs 0 3", "one", "END", "VALUE q:jobs/open 0 3", "two", "END"}
+	for i, reply := range readReplies(t, r, len(want)) {
+		if reply != want[i] {
+			t.Error(errUnexpected(fmt.Sprintf("%q, want %q", reply, want[i])))
+		}
+	}
+
+	// another reader skips the open read, an abort puts it back first
+	other, ro := dialTestServer(t, addr)
+	fmt.Fprintf(other, "get q:jobs/peek\r\nget q:jobs/open\r\n")
+	want = []string{"VALUE q:jobs/peek 0 5", "three", "END", "VALUE q:jobs/open 0 5", "three", "END"}
+	for i, reply := range readReplies(t, ro, len(want)) {
+		if reply != want[i] {
+			t.Error(errUnexpected(fmt.Sprintf("%q, want %q", reply, want[i])))
+		}
+	}
+	fmt.Fprintf(conn, "get q:jobs/abort\r\nget q:jobs/open\r\nget q:jobs/open\r\nget q:jobs/close\r\n")
+	want = []string{"END", "VALUE q:jobs/open 0 3", "two", "END", "END", "END"}
+	for i, reply := range readReplies(t, r, len(want)) {
+		if reply != want[i] {
+			t.Error(errUnexpected(fmt.Sprintf("%q, want %q", reply, want[i])))
+		}
+	}
+	// a closed connection aborts its open reads
+	aborted := queueAborted.Count()
+	other.Close()
+	for deadline := time.Now().Add(time.Second); queueAborted.Count() == aborted && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	fmt.Fprintf(conn, "get q:jobs\r\n")
+	want = []string{"VALUE q:jobs 0 5", "three", "END"}
+	for i, reply := range readReplies(t, r, len(want)) {
+		if reply != want[i] {
+			t.Error(errUnexpected(fmt.Sprintf("%q, want %q", reply, want[i])))
+		}
+	}
+
+	// a timeout waits for the next item
+	start := time.Now()
+	fmt.Fprintf(conn, "get q:jobs/close/open\r\nget q:jobs/t=1000\r\n")
+	if reply := readReplies(t, r, 3); reply[1] != "four" {
+		t.Error(errUnexpected(reply))
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		ms.queues.Enqueue(vdb, "q:jobs", []byte("five"))
+	}()
+	if reply := readReplies(t, r, 3); reply[1] != "five" || time.Since(start) < 100*time.Millisecond {
+		t.Error(errUnexpected(fmt.Sprintf("%q after %s", reply, time.Since(start))))
+	}
+	fmt.Fprintf(conn, "get q:jobs/t=50\r\n")
+	if reply := readReplies(t, r, 1)[0]; reply != "END" {
+		t.Error(errUnexpected(reply))
+	}
+
+	// items survive a restart in order, including the read of four left open
+	fmt.Fprintf(conn, "set q:jobs 0 0 3\r\nsix\r\n")
+	readReplies(t, r, 1)
+	stop()
+	conn.Close()
+	vdb.Close()
+	vdb = loadDB("leveldb", filepath.Join(dir, "queue.db"), dbOptions{})
+	defer vdb.Close()
+	qm := newQueueManager("q:")
+	reads := make(map[string]uint64)
+	for _, w := range []string{"four", "six"} {
+		if v, err := qm.Read(vdb, reads, queueRead{name: "q:jobs"}); err != nil || string(v) != w {
+			t.Error(errUnexpected(fmt.Sprintf("%q %v, want %q", v, err, w)))
+		}
+	}
+	if v, err := qm.Read(vdb, reads, queueRead{name: "q:jobs"}); err != nil || v != nil {
+		t.Error(errUnexpected(fmt.Sprintf("%q %v from an empty queue", v, err)))
+	}
+}
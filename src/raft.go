@@ -0,0 +1,1614 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	opAdd     byte = 'A'
+	opReplace byte = 'R'
+	opConfig  byte = 'C'
+	opNoop    byte = 'N'
+	// opIncrement is forwarded to the leader, which logs the result as a set
+	opIncrement byte = 'I'
+)
+
+const (
+	raftFollower = iota
+	raftCandidate
+	raftLeader
+)
+
+var raftStates = []string{"follower", "candidate", "leader"}
+
+// raftBatchSize is the max number of entries per AppendEntries
+const raftBatchSize = 256
+
+// raftSnapshotChunk is the InstallSnapshot chunk size
+const raftSnapshotChunk = 1024 * 1024
+
+// raftRequestTimeout bounds client requests waiting for a commit
+const raftRequestTimeout = 5 * time.Second
+
+// raftAuthTimeout bounds the token line opening a raft connection
+const raftAuthTimeout = 5 * time.Second
+
+// raftMaxTokenSize bounds the token line, -clustertoken is checked against it
+const raftMaxTokenSize = 256
+
+var errNotLeader = errors.New("not the cluster leader")
+var errNoLeader = errors.New("no cluster leader")
+var errRaftTimeout = errors.New("cluster request timed out, outcome unknown")
+var errLeaderChanged = errors.New("cluster leader changed, write lost")
+var errConfigPending = errors.New("a membership change is in progress")
+var errRaftClosed = errors.New("cluster node closed")
+var errRaftAuth = errors.New("bad cluster token")
+
+/*
+raftOptions configures a cluster node. addr is the raft listener and the node
+id. peers is the initial membership, used only when dir holds no state yet.
+Every raft connection starts with the token line, tls is used to dial peers
+*/
+type raftOptions struct {
+	addr            string
+	peers           []string
+	dir             string
+	snapshotEntries uint64
+	heartbeat       time.Duration
+	electionTimeout time.Duration
+	token           string
+	tls             *tls.Config
+}
+
+/*
+RequestVoteArgs is the raft RequestVote request
+*/
+type RequestVoteArgs struct {
+	Term         uint64
+	Candidate    string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+/*
+RequestVoteReply is the raft RequestVote reply
+*/
+type RequestVoteReply struct {
+	Term    uint64
+	Granted bool
+}
+
+/*
+AppendEntriesArgs is the raft AppendEntries request, empty as a heartbeat
+*/
+type AppendEntriesArgs struct {
+	Term         uint64
+	Leader       string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []raftEntry
+	LeaderCommit uint64
+}
+
+/*
+AppendEntriesReply is the raft AppendEntries reply. On a mismatch
+ConflictIndex is where the leader should retry from
+*/
+type AppendEntriesReply struct {
+	Term          uint64
+	Success       bool
+	ConflictIndex uint64
+}
+
+/*
+InstallSnapshotArgs carries a chunk of an export stream of the leader backend
+*/
+type InstallSnapshotArgs struct {
+	Term      uint64
+	Leader    string
+	LastIndex uint64
+	LastTerm  uint64
+	Members   []string
+	Offset    int64
+	Data      []byte
+	Done      bool
+}
+
+/*
+InstallSnapshotReply is the raft InstallSnapshot reply
+*/
+type InstallSnapshotReply struct {
+	Term uint64
+}
+
+/*
+ForwardArgs is a client write forwarded by a follower to the leader
+*/
+type ForwardArgs struct {
+	Op           byte
+	Key          []byte
+	Value        []byte
+	Delta        int
+	Create       bool
+	OnlyIfExists bool
+}
+
+/*
+ForwardReply is the outcome of a forwarded write
+*/
+type ForwardReply struct {
+	Int     int
+	Deleted bool
+	Err     string
+}
+
+/*
+ReadIndexArgs asks the leader for a commit index safe to read at
+*/
+type ReadIndexArgs struct{}
+
+/*
+ReadIndexReply is the leader commit index, confirmed by a majority
+*/
+type ReadIndexReply struct {
+	Index uint64
+	Err   string
+}
+
+type raftResult struct {
+	deleted bool
+	err     error
+}
+
+type raftWaiter struct {
+	term uint64
+	ch   chan raftResult
+}
+
+/*
+raftNode is a member of a raft cluster. The replicated state machine is the
+local backend: committed entries are applied to it in log order, and it is
+the snapshot too, its export is what slow or new followers get. Increments
+are resolved by the leader and logged as sets, so every entry can be applied
+again after a crash
+*/
+type raftNode struct {
+	id          string
+	opts        raftOptions
+	vdb         BackendDatabase
+	storage     *raftStorage
+	lock        sync.Mutex
+	state       int
+	term        uint64
+	votedFor    string
+	leader      string
+	members     []string
+	entries     []raftEntry
+	snapIndex   uint64
+	snapTerm    uint64
+	snapMembers []string
+	commitIndex uint64
+	lastApplied uint64
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	acked       map[string]time.Time
+	ackCh       chan struct{}
+	triggers    map[string]chan struct{}
+	lastContact time.Time
+	timeout     time.Duration
+	waiters     map[uint64]raftWaiter
+	appliedCh   chan struct{}
+	commitCh    chan struct{}
+	applyLock   sync.Mutex
+	keyLocks    *stripedLock
+	flushLock   sync.RWMutex
+	clients     map[string]*rpc.Client
+	clientsLock sync.Mutex
+	listener    net.Listener
+	conns       map[net.Conn]bool
+	connsLock   sync.Mutex
+	recv        *os.File
+	quit        chan struct{}
+	done        sync.WaitGroup
+}
+
+/*
+startRaftNode opens the node state in opts.dir and starts serving raft on listener
+*/
+func startRaftNode(opts raftOptions, vdb BackendDatabase, listener net.Listener) (*raftNode, error) {
+	storage, err := openRaftStorage(opts.dir)
+	if err != nil {
+		return nil, err
+	}
+	n := raftNode{
+		id:        opts.addr,
+		opts:      opts,
+		vdb:       vdb,
+		storage:   storage,
+		acked:     make(map[string]time.Time),
+		ackCh:     make(chan struct{}),
+		triggers:  make(map[string]chan struct{}),
+		waiters:   make(map[uint64]raftWaiter),
+		appliedCh: make(chan struct{}),
+		commitCh:  make(chan struct{}, 1),
+		keyLocks:  newStripedLock(),
+		clients:   make(map[string]*rpc.Client),
+		listener:  listener,
+		conns:     make(map[net.Conn]bool),
+		quit:      make(chan struct{}),
+	}
+	if err := n.load(); err != nil {
+		storage.Close()
+		return nil, err
+	}
+	n.resetElectionTimer()
+
+	server := rpc.NewServer()
+	if err := server.RegisterName("Raft", &raftRPC{node: &n}); err != nil {
+		storage.Close()
+		return nil, err
+	}
+	n.done.Add(3)
+	go n.serve(server)
+	go n.run()
+	go n.applyLoop()
+	log.Info("Cluster node %s: term %d, members %s, applied %d", n.id, n.term, joinMembers(n.members), n.lastApplied)
+	return &n, nil
+}
+
+func (n *raftNode) load() error {
+	var err error
+	if n.term, n.votedFor, err = n.storage.loadState(); err != nil {
+		return err
+	}
+	index, term, members, ok, err := n.storage.loadSnapshot()
+	if err != nil {
+		return err
+	}
+	if ok {
+		n.snapIndex, n.snapTerm, n.snapMembers = index, term, members
+	} else {
+		n.snapMembers = n.opts.peers
+	}
+	installing := filepath.Join(n.opts.dir, "raft.installing")
+	if _, err := os.Stat(installing); err == nil {
+		// a snapshot install was cut short, the backend is neither the old nor the new state
+		log.Error("Cluster node %s: incomplete snapshot install, starting empty", n.id)
+		if err := n.vdb.Flush(); err != nil {
+			return err
+		}
+		n.snapIndex, n.snapTerm = 0, 0
+		if err := n.storage.saveSnapshot(0, 0, n.snapMembers); err != nil {
+			return err
+		}
+		if err := n.storage.rewriteLog(nil); err != nil {
+			return err
+		}
+		if err := n.storage.saveApplied(0); err != nil {
+			return err
+		}
+		os.Remove(installing)
+	}
+	if n.entries, err = n.storage.loadLog(n.snapIndex); err != nil {
+		return err
+	}
+	if n.lastApplied, err = n.storage.loadApplied(); err != nil {
+		return err
+	}
+	if n.lastApplied < n.snapIndex {
+		n.lastApplied = n.snapIndex
+	}
+	if last := n.lastIndex(); n.lastApplied > last {
+		n.lastApplied = last
+	}
+	n.commitIndex = n.lastApplied
+	n.members = n.configAt(n.lastIndex())
+	return nil
+}
+
+/*
+serve accepts raft connections until Close
+*/
+func (n *raftNode) serve(server *rpc.Server) {
+	defer n.done.Done()
+	for {
+		conn, err := n.listener.Accept()
+		if err != nil {
+			return
+		}
+		n.connsLock.Lock()
+		n.conns[conn] = true
+		n.connsLock.Unlock()
+		go func() {
+			if err := n.authenticatePeer(conn); err != nil {
+				authFailures.Inc(1)
+				log.Error("Cluster node %s: refused %s: %s", n.id, conn.RemoteAddr(), err)
+				conn.Close()
+			} else {
+				server.ServeConn(conn)
+			}
+			n.connsLock.Lock()
+			delete(n.conns, conn)
+			n.connsLock.Unlock()
+		}()
+	}
+}
+
+/*
+authenticatePeer reads the token line a peer sends first and checks it
+against the cluster token. It reads a byte at a time, so nothing meant for
+the rpc server is buffered away
+*/
+func (n *raftNode) authenticatePeer(conn net.Conn) error {
+	conn.SetReadDeadline(time.Now().Add(raftAuthTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	var token []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		if len(token) >= raftMaxTokenSize {
+			return errRaftAuth
+		}
+		token = append(token, b[0])
+	}
+	if subtle.ConstantTimeCompare(token, []byte(n.opts.token)) != 1 {
+		return errRaftAuth
+	}
+	return nil
+}
+
+/*
+dial connects to peer, over TLS if configured, and sends the token line
+*/
+func (n *raftNode) dial(peer string, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if n.opts.tls != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", peer, n.opts.tls)
+	} else {
+		conn, err = dialer.Dial("tcp", peer)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write([]byte(n.opts.token + "\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetWriteDeadline(time.Time{})
+	return conn, nil
+}
+
+/*
+Close stops the node, the backend is left to the caller
+*/
+func (n *raftNode) Close() {
+	close(n.quit)
+	n.listener.Close()
+	n.connsLock.Lock()
+	for conn := range n.conns {
+		conn.Close()
+	}
+	n.connsLock.Unlock()
+	n.clientsLock.Lock()
+	for peer, c := range n.clients {
+		c.Close()
+		delete(n.clients, peer)
+	}
+	n.clientsLock.Unlock()
+	n.done.Wait()
+	n.applyLock.Lock()
+	n.storage.Close()
+	n.applyLock.Unlock()
+}
+
+func (n *raftNode) closed() bool {
+	select {
+	case <-n.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+lastIndex returns the index of the last entry. Caller holds lock
+*/
+func (n *raftNode) lastIndex() uint64 {
+	if len(n.entries) > 0 {
+		return n.entries[len(n.entries)-1].Index
+	}
+	return n.snapIndex
+}
+
+/*
+termAt returns the term of the entry at index, 0 if it's not in the log. Caller holds lock
+*/
+func (n *raftNode) termAt(index uint64) uint64 {
+	if index == n.snapIndex {
+		return n.snapTerm
+	}
+	if index < n.snapIndex || index > n.lastIndex() {
+		return 0
+	}
+	return n.entries[index-n.snapIndex-1].Term
+}
+
+/*
+configAt returns the membership in effect at index: a configuration takes
+effect as soon as it's in the log. Caller holds lock
+*/
+func (n *raftNode) configAt(index uint64) []string {
+	for i := len(n.entries) - 1; i >= 0; i-- {
+		if n.entries[i].Index <= index && n.entries[i].Op == opConfig {
+			return splitMembers(string(n.entries[i].Value))
+		}
+	}
+	return n.snapMembers
+}
+
+func (n *raftNode) lastConfigIndex() uint64 {
+	for i := len(n.entries) - 1; i >= 0; i-- {
+		if n.entries[i].Op == opConfig {
+			return n.entries[i].Index
+		}
+	}
+	return n.snapIndex
+}
+
+func isMember(members []string, id string) bool {
+	for _, m := range members {
+		if m == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *raftNode) quorum() int {
+	return len(n.members)/2 + 1
+}
+
+/*
+resetElectionTimer picks a new random timeout between electionTimeout and twice that. Caller holds lock
+*/
+func (n *raftNode) resetElectionTimer() {
+	n.lastContact = time.Now()
+	n.timeout = n.opts.electionTimeout + time.Duration(rand.Int63n(int64(n.opts.electionTimeout)))
+}
+
+func (n *raftNode) persistState() {
+	if err := n.storage.saveState(n.term, n.votedFor); err != nil {
+		log.Fatalf("Cluster node %s: can't save raft state: %s", n.id, err)
+	}
+}
+
+/*
+stepDown makes the node a follower, in term if it's newer. Caller holds lock
+*/
+func (n *raftNode) stepDown(term uint64) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		n.leader = ""
+		n.persistState()
+	}
+	if n.state != raftFollower {
+		log.Info("Cluster node %s: follower in term %d", n.id, n.term)
+		n.state = raftFollower
+	}
+}
+
+/*
+run starts elections when the leader is silent for too long
+*/
+func (n *raftNode) run() {
+	defer n.done.Done()
+	ticker := time.NewTicker(n.opts.heartbeat / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.quit:
+			return
+		case <-ticker.C:
+		}
+		n.lock.Lock()
+		if n.state != raftLeader && isMember(n.members, n.id) && time.Since(n.lastContact) > n.timeout {
+			n.startElection()
+		}
+		n.lock.Unlock()
+	}
+}
+
+/*
+startElection votes for itself and asks the other members. Caller holds lock
+*/
+func (n *raftNode) startElection() {
+	n.state = raftCandidate
+	n.term++
+	n.votedFor = n.id
+	n.leader = ""
+	n.persistState()
+	n.resetElectionTimer()
+	clusterElections.Inc(1)
+	log.Info("Cluster node %s: election for term %d", n.id, n.term)
+
+	term := n.term
+	args := RequestVoteArgs{Term: term, Candidate: n.id, LastLogIndex: n.lastIndex(), LastLogTerm: n.termAt(n.lastIndex())}
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	for _, peer := range n.members {
+		if peer == n.id {
+			continue
+		}
+		go func(peer string) {
+			var reply RequestVoteReply
+			if err := n.call(peer, "Raft.RequestVote", &args, &reply, n.opts.electionTimeout); err != nil {
+				return
+			}
+			n.lock.Lock()
+			defer n.lock.Unlock()
+			if reply.Term > n.term {
+				n.stepDown(reply.Term)
+				return
+			}
+			if n.state != raftCandidate || n.term != term || !reply.Granted {
+				return
+			}
+			if votes++; votes >= n.quorum() {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+/*
+becomeLeader starts replicating to the members, beginning with an empty
+entry: once it's committed the leader knows the commit index. Caller holds lock
+*/
+func (n *raftNode) becomeLeader() {
+	log.Info("Cluster node %s: leader for term %d", n.id, n.term)
+	n.state = raftLeader
+	n.leader = n.id
+	n.nextIndex = make(map[string]uint64)
+	n.matchIndex = make(map[string]uint64)
+	n.triggers = make(map[string]chan struct{})
+	if _, err := n.appendLocal(opNoop, nil, nil); err != nil {
+		log.Error("Cluster node %s: %s", n.id, err)
+		n.stepDown(n.term)
+	}
+}
+
+/*
+appendLocal appends an entry to the leader log and triggers replication. Caller holds lock
+*/
+func (n *raftNode) appendLocal(op byte, key []byte, value []byte) (uint64, error) {
+	e := raftEntry{Index: n.lastIndex() + 1, Term: n.term, Op: op, Key: key, Value: value}
+	if err := n.storage.appendEntries([]raftEntry{e}); err != nil {
+		return 0, err
+	}
+	n.entries = append(n.entries, e)
+	if op == opConfig {
+		n.members = splitMembers(string(value))
+		log.Info("Cluster node %s: members %s", n.id, value)
+	}
+	n.startPeerLoops()
+	for _, t := range n.triggers {
+		select {
+		case t <- struct{}{}:
+		default:
+		}
+	}
+	n.advanceCommit()
+	return e.Index, nil
+}
+
+/*
+startPeerLoops starts replication to members without one. Caller holds lock
+*/
+func (n *raftNode) startPeerLoops() {
+	for _, peer := range n.members {
+		if _, ok := n.triggers[peer]; ok || peer == n.id {
+			continue
+		}
+		if _, ok := n.nextIndex[peer]; !ok {
+			n.nextIndex[peer] = n.lastIndex() + 1
+		}
+		trigger := make(chan struct{}, 1)
+		n.triggers[peer] = trigger
+		go n.peerLoop(peer, n.term, trigger)
+	}
+}
+
+/*
+peerLoop replicates to peer while this node leads term, at least every heartbeat.
+A removed peer is followed until its removal is committed, so it learns about it
+*/
+func (n *raftNode) peerLoop(peer string, term uint64, trigger chan struct{}) {
+	ticker := time.NewTicker(n.opts.heartbeat)
+	defer ticker.Stop()
+	for {
+		more := n.replicate(peer, term)
+		n.lock.Lock()
+		active := n.state == raftLeader && n.term == term && !n.closed() &&
+			(isMember(n.members, peer) || isMember(n.configAt(n.commitIndex), peer))
+		if !active {
+			if n.triggers[peer] == trigger {
+				delete(n.triggers, peer)
+			}
+			n.lock.Unlock()
+			return
+		}
+		n.lock.Unlock()
+		if more {
+			continue
+		}
+		select {
+		case <-n.quit:
+		case <-trigger:
+		case <-ticker.C:
+		}
+	}
+}
+
+/*
+replicate sends peer the entries it misses, or a snapshot when they were
+compacted away. Returns true if there is more to send right away
+*/
+func (n *raftNode) replicate(peer string, term uint64) bool {
+	n.lock.Lock()
+	if n.state != raftLeader || n.term != term {
+		n.lock.Unlock()
+		return false
+	}
+	next := n.nextIndex[peer]
+	if next <= n.snapIndex {
+		n.lock.Unlock()
+		return n.sendSnapshot(peer, term)
+	}
+	args := AppendEntriesArgs{
+		Term:         term,
+		Leader:       n.id,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  n.termAt(next - 1),
+		LeaderCommit: n.commitIndex,
+	}
+	if last := n.lastIndex(); next <= last {
+		end := last
+		if end-next+1 > raftBatchSize {
+			end = next + raftBatchSize - 1
+		}
+		args.Entries = append([]raftEntry{}, n.entries[next-n.snapIndex-1:end-n.snapIndex]...)
+	}
+	n.lock.Unlock()
+
+	sent := time.Now()
+	var reply AppendEntriesReply
+	if err := n.call(peer, "Raft.AppendEntries", &args, &reply, n.opts.electionTimeout); err != nil {
+		return false
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if reply.Term > n.term {
+		n.stepDown(reply.Term)
+		return false
+	}
+	if n.state != raftLeader || n.term != term {
+		return false
+	}
+	n.ack(peer, sent)
+	if !reply.Success {
+		next := reply.ConflictIndex
+		if next < 1 {
+			next = 1
+		}
+		if next >= n.nextIndex[peer] {
+			next = n.nextIndex[peer] - 1
+		}
+		n.nextIndex[peer] = next
+		return true
+	}
+	match := args.PrevLogIndex + uint64(len(args.Entries))
+	if match > n.matchIndex[peer] {
+		n.matchIndex[peer] = match
+	}
+	n.nextIndex[peer] = match + 1
+	n.advanceCommit()
+	return n.nextIndex[peer] <= n.lastIndex()
+}
+
+/*
+ack records that peer accepted this node as leader for a request sent at sent. Caller holds lock
+*/
+func (n *raftNode) ack(peer string, sent time.Time) {
+	if sent.After(n.acked[peer]) {
+		n.acked[peer] = sent
+	}
+	close(n.ackCh)
+	n.ackCh = make(chan struct{})
+}
+
+/*
+advanceCommit commits the last entry of the current term stored on a
+majority. A leader removed from the cluster steps down once that's committed.
+Caller holds lock
+*/
+func (n *raftNode) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex; index-- {
+		if n.termAt(index) != n.term {
+			break
+		}
+		count := 0
+		for _, m := range n.members {
+			if m == n.id || n.matchIndex[m] >= index {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitIndex = index
+			n.notifyCommit()
+			break
+		}
+	}
+	if n.state == raftLeader && !isMember(n.configAt(n.commitIndex), n.id) {
+		log.Info("Cluster node %s: removed from the cluster", n.id)
+		n.state = raftFollower
+		n.leader = ""
+	}
+}
+
+func (n *raftNode) notifyCommit() {
+	select {
+	case n.commitCh <- struct{}{}:
+	default:
+	}
+}
+
+/*
+sendSnapshot streams an export of the backend to peer. The export is taken
+with the apply loop paused so it matches the last applied index exactly
+*/
+func (n *raftNode) sendSnapshot(peer string, term uint64) bool {
+	f, err := ioutil.TempFile(n.opts.dir, "snapshot.send")
+	if err != nil {
+		log.Error("Cluster node %s: snapshot for %s: %s", n.id, peer, err)
+		return false
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	n.applyLock.Lock()
+	n.lock.Lock()
+	index, lastTerm, members := n.lastApplied, n.termAt(n.lastApplied), n.configAt(n.lastApplied)
+	n.lock.Unlock()
+	_, _, err = exportDB(n.vdb, f, nil, nil)
+	n.applyLock.Unlock()
+	if err != nil {
+		log.Error("Cluster node %s: snapshot for %s: %s", n.id, peer, err)
+		return false
+	}
+	log.Info("Cluster node %s: sending a snapshot at %d to %s", n.id, index, peer)
+	clusterSnapshots.Inc(1)
+
+	buf := make([]byte, raftSnapshotChunk)
+	var offset int64
+	for {
+		size, err := f.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			log.Error("Cluster node %s: snapshot for %s: %s", n.id, peer, err)
+			return false
+		}
+		args := InstallSnapshotArgs{
+			Term:      term,
+			Leader:    n.id,
+			LastIndex: index,
+			LastTerm:  lastTerm,
+			Members:   members,
+			Offset:    offset,
+			Data:      buf[:size],
+			Done:      err == io.EOF,
+		}
+		var reply InstallSnapshotReply
+		if err := n.call(peer, "Raft.InstallSnapshot", &args, &reply, raftRequestTimeout); err != nil {
+			return false
+		}
+		n.lock.Lock()
+		if reply.Term > n.term {
+			n.stepDown(reply.Term)
+		}
+		leading := n.state == raftLeader && n.term == term
+		n.lock.Unlock()
+		if !leading {
+			return false
+		}
+		if args.Done {
+			break
+		}
+		offset += int64(size)
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if index > n.matchIndex[peer] {
+		n.matchIndex[peer] = index
+	}
+	n.nextIndex[peer] = index + 1
+	n.advanceCommit()
+	return true
+}
+
+/*
+call runs an RPC on peer, dropping the connection on errors
+*/
+func (n *raftNode) call(peer string, method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	n.clientsLock.Lock()
+	client, ok := n.clients[peer]
+	n.clientsLock.Unlock()
+	if !ok {
+		conn, err := n.dial(peer, timeout)
+		if err != nil {
+			return err
+		}
+		client = rpc.NewClient(conn)
+		n.clientsLock.Lock()
+		if n.closed() {
+			n.clientsLock.Unlock()
+			client.Close()
+			return errRaftClosed
+		}
+		if c, ok := n.clients[peer]; ok {
+			client.Close()
+			client = c
+		} else {
+			n.clients[peer] = client
+		}
+		n.clientsLock.Unlock()
+	}
+	drop := func() {
+		n.clientsLock.Lock()
+		if n.clients[peer] == client {
+			delete(n.clients, peer)
+		}
+		n.clientsLock.Unlock()
+		client.Close()
+	}
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			drop()
+		}
+		return call.Error
+	case <-time.After(timeout):
+		drop()
+		return errRaftTimeout
+	case <-n.quit:
+		return errRaftClosed
+	}
+}
+
+/*
+applyLoop applies committed entries to the backend
+*/
+func (n *raftNode) applyLoop() {
+	defer n.done.Done()
+	for {
+		select {
+		case <-n.quit:
+			return
+		case <-n.commitCh:
+		}
+		for n.applyCommitted() {
+		}
+	}
+}
+
+/*
+applyCommitted applies a batch of committed entries, returns true if there are more
+*/
+func (n *raftNode) applyCommitted() bool {
+	n.applyLock.Lock()
+	defer n.applyLock.Unlock()
+	n.lock.Lock()
+	if n.lastApplied >= n.commitIndex || n.closed() {
+		n.lock.Unlock()
+		return false
+	}
+	end := n.commitIndex
+	if end-n.lastApplied > 1000 {
+		end = n.lastApplied + 1000
+	}
+	batch := append([]raftEntry{}, n.entries[n.lastApplied-n.snapIndex:end-n.snapIndex]...)
+	n.lock.Unlock()
+
+	for _, e := range batch {
+		res := n.applyEntry(e)
+		n.lock.Lock()
+		n.lastApplied = e.Index
+		if w, ok := n.waiters[e.Index]; ok {
+			delete(n.waiters, e.Index)
+			if w.term != e.Term {
+				res = raftResult{err: errLeaderChanged}
+			}
+			w.ch <- res
+		}
+		n.lock.Unlock()
+	}
+	if err := n.storage.saveApplied(batch[len(batch)-1].Index); err != nil {
+		log.Error("Cluster node %s: %s", n.id, err)
+	}
+	n.lock.Lock()
+	close(n.appliedCh)
+	n.appliedCh = make(chan struct{})
+	more := n.lastApplied < n.commitIndex
+	n.lock.Unlock()
+	n.compact()
+	return more
+}
+
+func (n *raftNode) applyEntry(e raftEntry) raftResult {
+	var res raftResult
+	switch e.Op {
+	case opSet:
+		res.err = n.vdb.Set(e.Key, e.Value)
+	case opAdd:
+		res.err = n.vdb.Add(e.Key, e.Value)
+	case opReplace:
+		res.err = n.vdb.Replace(e.Key, e.Value)
+	case opDelete:
+		res.deleted, res.err = n.vdb.Delete(e.Key, len(e.Value) > 0)
+	case opFlush:
+		res.err = n.vdb.Flush()
+	}
+	return res
+}
+
+/*
+compact drops the applied entries from the log once there are more than
+opts.snapshotEntries of them, the backend holds their result. Caller holds applyLock
+*/
+func (n *raftNode) compact() {
+	n.lock.Lock()
+	if n.opts.snapshotEntries == 0 || n.lastApplied-n.snapIndex < n.opts.snapshotEntries {
+		n.lock.Unlock()
+		return
+	}
+	index := n.lastApplied
+	n.lock.Unlock()
+
+	// what the entries did must be on disk before they go
+	if s, ok := findSyncer(n.vdb); ok {
+		if err := s.Sync(); err != nil {
+			log.Error("Cluster node %s: compaction: %s", n.id, err)
+			return
+		}
+	}
+	if err := n.storage.syncApplied(); err != nil {
+		log.Error("Cluster node %s: compaction: %s", n.id, err)
+		return
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	term, members := n.termAt(index), n.configAt(index)
+	if err := n.storage.saveSnapshot(index, term, members); err != nil {
+		log.Error("Cluster node %s: compaction: %s", n.id, err)
+		return
+	}
+	n.entries = append([]raftEntry{}, n.entries[index-n.snapIndex:]...)
+	n.snapIndex, n.snapTerm, n.snapMembers = index, term, members
+	if err := n.storage.rewriteLog(n.entries); err != nil {
+		log.Fatalf("Cluster node %s: compaction: %s", n.id, err)
+	}
+	log.Info("Cluster node %s: log compacted up to %d", n.id, index)
+}
+
+/*
+propose appends an entry as leader and waits for it to be applied
+*/
+func (n *raftNode) propose(op byte, key []byte, value []byte) raftResult {
+	n.lock.Lock()
+	if n.state != raftLeader {
+		n.lock.Unlock()
+		return raftResult{err: errNotLeader}
+	}
+	index, err := n.appendLocal(op, key, value)
+	if err != nil {
+		n.lock.Unlock()
+		return raftResult{err: err}
+	}
+	ch := make(chan raftResult, 1)
+	n.waiters[index] = raftWaiter{term: n.term, ch: ch}
+	n.lock.Unlock()
+	return n.wait(index, ch)
+}
+
+func (n *raftNode) wait(index uint64, ch chan raftResult) raftResult {
+	select {
+	case res := <-ch:
+		return res
+	case <-time.After(raftRequestTimeout):
+	case <-n.quit:
+	}
+	n.lock.Lock()
+	delete(n.waiters, index)
+	n.lock.Unlock()
+	return raftResult{err: errRaftTimeout}
+}
+
+/*
+readIndex returns an index such that reading once it's applied is
+linearizable: the leader commit index, after a majority confirmed the
+leadership. Followers ask the leader
+*/
+func (n *raftNode) readIndex() (uint64, error) {
+	deadline := time.Now().Add(raftRequestTimeout)
+	for {
+		n.lock.Lock()
+		state, leader := n.state, n.leader
+		// the commit index is only known once an entry of this term is committed
+		ready := n.termAt(n.commitIndex) == n.term
+		n.lock.Unlock()
+		if time.Now().After(deadline) {
+			return 0, errRaftTimeout
+		}
+		switch {
+		case state == raftLeader && ready:
+			return n.confirmLeadership(deadline)
+		case state == raftLeader || leader == "":
+			if err := n.sleep(n.opts.heartbeat); err != nil {
+				return 0, err
+			}
+		default:
+			var reply ReadIndexReply
+			if err := n.call(leader, "Raft.ReadIndex", &ReadIndexArgs{}, &reply, raftRequestTimeout); err != nil {
+				return 0, err
+			}
+			if reply.Err == errNotLeader.Error() {
+				if err := n.sleep(n.opts.heartbeat); err != nil {
+					return 0, err
+				}
+				continue
+			} else if reply.Err != "" {
+				return 0, errors.New(reply.Err)
+			}
+			return reply.Index, nil
+		}
+	}
+}
+
+func (n *raftNode) sleep(d time.Duration) error {
+	select {
+	case <-n.quit:
+		return errRaftClosed
+	case <-time.After(d):
+		return nil
+	}
+}
+
+/*
+confirmLeadership triggers a heartbeat round and returns the commit index
+once a majority answered requests sent after it was read
+*/
+func (n *raftNode) confirmLeadership(deadline time.Time) (uint64, error) {
+	n.lock.Lock()
+	start := time.Now()
+	index := n.commitIndex
+	term := n.term
+	for _, t := range n.triggers {
+		select {
+		case t <- struct{}{}:
+		default:
+		}
+	}
+	for {
+		if n.state != raftLeader || n.term != term {
+			n.lock.Unlock()
+			return 0, errNotLeader
+		}
+		count := 0
+		for _, m := range n.members {
+			if m == n.id || !n.acked[m].Before(start) {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.lock.Unlock()
+			return index, nil
+		}
+		ackCh := n.ackCh
+		n.lock.Unlock()
+		select {
+		case <-ackCh:
+		case <-n.quit:
+			return 0, errRaftClosed
+		case <-time.After(time.Until(deadline)):
+			return 0, errRaftTimeout
+		}
+		n.lock.Lock()
+	}
+}
+
+/*
+waitApplied waits until the entry at index is applied
+*/
+func (n *raftNode) waitApplied(index uint64) error {
+	timeout := time.After(raftRequestTimeout)
+	for {
+		n.lock.Lock()
+		applied, ch := n.lastApplied, n.appliedCh
+		n.lock.Unlock()
+		if applied >= index {
+			return nil
+		}
+		select {
+		case <-ch:
+		case <-n.quit:
+			return errRaftClosed
+		case <-timeout:
+			return errRaftTimeout
+		}
+	}
+}
+
+/*
+linearizableRead waits until reading the local backend is linearizable
+*/
+func (n *raftNode) linearizableRead() error {
+	index, err := n.readIndex()
+	if err != nil {
+		return err
+	}
+	return n.waitApplied(index)
+}
+
+/*
+execute runs a client write as leader. Writes to a key hold its lock until
+applied, so an increment reads a value no write in flight can change
+*/
+func (n *raftNode) execute(args ForwardArgs) ForwardReply {
+	var reply ForwardReply
+	var err error
+	switch args.Op {
+	case opFlush:
+		n.flushLock.Lock()
+		err = n.propose(opFlush, nil, nil).err
+		n.flushLock.Unlock()
+	case opConfig:
+		err = n.changeMembership(string(args.Key), string(args.Value))
+	case opSet, opAdd, opReplace, opDelete, opIncrement:
+		n.flushLock.RLock()
+		n.keyLocks.Lock(args.Key)
+		switch args.Op {
+		case opIncrement:
+			reply.Int, err = n.increment(args.Key, args.Delta, args.Create)
+		case opDelete:
+			var flag []byte
+			if args.OnlyIfExists {
+				flag = []byte{1}
+			}
+			res := n.propose(opDelete, args.Key, flag)
+			reply.Deleted, err = res.deleted, res.err
+		default:
+			err = n.propose(args.Op, args.Key, args.Value).err
+		}
+		n.keyLocks.Unlock(args.Key)
+		n.flushLock.RUnlock()
+	default:
+		err = fmt.Errorf("unknown cluster operation %q", args.Op)
+	}
+	if err != nil {
+		reply.Err = err.Error()
+	}
+	return reply
+}
+
+/*
+increment reads the applied value and logs the result as a set, with the
+semantics of the backends Increment. Caller holds the key lock
+*/
+func (n *raftNode) increment(key []byte, delta int, create bool) (int, error) {
+	if err := n.linearizableRead(); err != nil {
+		return -1, err
+	}
+	v, err := n.vdb.Get(key)
+	if err != nil {
+		return -1, err
+	}
+	i := 0
+	if v == nil {
+		if !create {
+			return -1, fmt.Errorf("Key %s do not exists, createIfNotExists set to false", key)
+		}
+	} else {
+		if i, err = strconv.Atoi(string(v)); err != nil {
+			return -1, fmt.Errorf("Data cannot be incr/decr for key %s - %s", key, v)
+		}
+		i += delta
+	}
+	return i, n.propose(opSet, key, []byte(strconv.Itoa(i))).err
+}
+
+/*
+changeMembership adds or removes one member. Changes go one at a time: the
+previous one must be committed first
+*/
+func (n *raftNode) changeMembership(action string, peer string) error {
+	n.lock.Lock()
+	if n.state != raftLeader {
+		n.lock.Unlock()
+		return errNotLeader
+	}
+	if n.lastConfigIndex() > n.commitIndex || n.termAt(n.commitIndex) != n.term {
+		n.lock.Unlock()
+		return errConfigPending
+	}
+	members := append([]string{}, n.members...)
+	switch action {
+	case "add":
+		if isMember(members, peer) {
+			n.lock.Unlock()
+			return fmt.Errorf("%s is already a member", peer)
+		}
+		members = append(members, peer)
+	case "remove":
+		if !isMember(members, peer) {
+			n.lock.Unlock()
+			return fmt.Errorf("%s is not a member", peer)
+		}
+		if len(members) == 1 {
+			n.lock.Unlock()
+			return errors.New("can't remove the last member")
+		}
+		for i, m := range members {
+			if m == peer {
+				members = append(members[:i], members[i+1:]...)
+				break
+			}
+		}
+	default:
+		n.lock.Unlock()
+		return fmt.Errorf("unknown membership change %s", action)
+	}
+	index, err := n.appendLocal(opConfig, nil, []byte(strings.Join(members, ",")))
+	if err != nil {
+		n.lock.Unlock()
+		return err
+	}
+	ch := make(chan raftResult, 1)
+	n.waiters[index] = raftWaiter{term: n.term, ch: ch}
+	n.lock.Unlock()
+	return n.wait(index, ch).err
+}
+
+/*
+Do runs a client write on the leader, forwarding it when this node follows
+*/
+func (n *raftNode) Do(args ForwardArgs) ForwardReply {
+	deadline := time.Now().Add(raftRequestTimeout)
+	for {
+		n.lock.Lock()
+		state, leader := n.state, n.leader
+		n.lock.Unlock()
+		var reply ForwardReply
+		switch {
+		case state == raftLeader:
+			reply = n.execute(args)
+		case leader == "":
+			reply.Err = errNoLeader.Error()
+		default:
+			// a lost reply leaves the outcome unknown, the write isn't retried
+			if err := n.call(leader, "Raft.Forward", &args, &reply, raftRequestTimeout); err != nil {
+				return ForwardReply{Err: err.Error()}
+			}
+		}
+		if reply.Err != errNotLeader.Error() && reply.Err != errNoLeader.Error() {
+			return reply
+		}
+		if time.Now().After(deadline) {
+			return reply
+		}
+		if err := n.sleep(n.opts.heartbeat); err != nil {
+			return ForwardReply{Err: err.Error()}
+		}
+	}
+}
+
+/*
+Status describes the node for dbstats and the cluster command
+*/
+func (n *raftNode) Status() string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return fmt.Sprintf("cluster: %s %s, term %d, leader %s, members %s, commit %d, applied %d, log %d entries after %d",
+		n.id, raftStates[n.state], n.term, n.leader, joinMembers(n.members), n.commitIndex, n.lastApplied, len(n.entries), n.snapIndex)
+}
+
+/*
+raftRPC exposes the node over net/rpc
+*/
+type raftRPC struct {
+	node *raftNode
+}
+
+/*
+RequestVote grants the vote to an up to date candidate. Members that heard
+from a leader recently ignore it, so a removed member can't disrupt the cluster
+*/
+func (r *raftRPC) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	n := r.node
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if args.Term > n.term {
+		if n.state == raftFollower && n.leader != "" && time.Since(n.lastContact) < n.opts.electionTimeout {
+			reply.Term = n.term
+			return nil
+		}
+		n.stepDown(args.Term)
+	}
+	reply.Term = n.term
+	if args.Term < n.term {
+		return nil
+	}
+	lastIndex := n.lastIndex()
+	lastTerm := n.termAt(lastIndex)
+	upToDate := args.LastLogTerm > lastTerm || (args.LastLogTerm == lastTerm && args.LastLogIndex >= lastIndex)
+	if (n.votedFor == "" || n.votedFor == args.Candidate) && upToDate {
+		n.votedFor = args.Candidate
+		n.persistState()
+		n.resetElectionTimer()
+		reply.Granted = true
+	}
+	return nil
+}
+
+/*
+AppendEntries stores the leader entries after checking the log matches up to PrevLogIndex
+*/
+func (r *raftRPC) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	n := r.node
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if args.Term < n.term {
+		reply.Term = n.term
+		return nil
+	}
+	n.stepDown(args.Term)
+	if n.leader != args.Leader {
+		log.Info("Cluster node %s: leader %s for term %d", n.id, args.Leader, args.Term)
+	}
+	n.leader = args.Leader
+	n.resetElectionTimer()
+	reply.Term = n.term
+
+	prev, prevTerm := args.PrevLogIndex, args.PrevLogTerm
+	entries := args.Entries
+	if prev < n.snapIndex {
+		// compacted entries are committed, they match
+		for len(entries) > 0 && entries[0].Index <= n.snapIndex {
+			entries = entries[1:]
+		}
+		prev, prevTerm = n.snapIndex, n.snapTerm
+	}
+	if prev > n.lastIndex() {
+		reply.ConflictIndex = n.lastIndex() + 1
+		return nil
+	}
+	if t := n.termAt(prev); t != prevTerm {
+		i := prev
+		for i > n.snapIndex+1 && n.termAt(i-1) == t {
+			i--
+		}
+		reply.ConflictIndex = i
+		return nil
+	}
+
+	var appended []raftEntry
+	config := false
+	for _, e := range entries {
+		if e.Index <= n.lastIndex() {
+			if n.termAt(e.Index) == e.Term {
+				continue
+			}
+			n.truncate(e.Index)
+			config = true
+		}
+		appended = append(appended, e)
+		n.entries = append(n.entries, e)
+		config = config || e.Op == opConfig
+	}
+	if len(appended) > 0 {
+		if err := n.storage.appendEntries(appended); err != nil {
+			return err
+		}
+	}
+	if config {
+		n.members = n.configAt(n.lastIndex())
+	}
+	if last := args.PrevLogIndex + uint64(len(args.Entries)); args.LeaderCommit > n.commitIndex {
+		commit := args.LeaderCommit
+		if last < commit {
+			commit = last
+		}
+		if commit > n.commitIndex {
+			n.commitIndex = commit
+			n.notifyCommit()
+		}
+	}
+	reply.Success = true
+	return nil
+}
+
+/*
+truncate drops the entries from index on, they conflict with the leader log. Caller holds lock
+*/
+func (n *raftNode) truncate(index uint64) {
+	for i := index; i <= n.lastIndex(); i++ {
+		if w, ok := n.waiters[i]; ok {
+			delete(n.waiters, i)
+			w.ch <- raftResult{err: errLeaderChanged}
+		}
+	}
+	n.entries = n.entries[:index-n.snapIndex-1]
+	if err := n.storage.rewriteLog(n.entries); err != nil {
+		log.Fatalf("Cluster node %s: can't truncate the raft log: %s", n.id, err)
+	}
+}
+
+/*
+InstallSnapshot receives an export of the leader backend, chunk by chunk, and
+replaces the local data with it once complete
+*/
+func (r *raftRPC) InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	n := r.node
+	n.lock.Lock()
+	if args.Term < n.term {
+		reply.Term = n.term
+		n.lock.Unlock()
+		return nil
+	}
+	n.stepDown(args.Term)
+	n.leader = args.Leader
+	n.resetElectionTimer()
+	reply.Term = n.term
+	if args.Offset == 0 {
+		if n.recv != nil {
+			n.recv.Close()
+		}
+		f, err := os.Create(filepath.Join(n.opts.dir, "snapshot.recv"))
+		if err != nil {
+			n.lock.Unlock()
+			return err
+		}
+		n.recv = f
+	}
+	f := n.recv
+	n.lock.Unlock()
+	if f == nil {
+		return errors.New("snapshot chunk out of order")
+	}
+	if _, err := f.WriteAt(args.Data, args.Offset); err != nil {
+		return err
+	}
+	if !args.Done {
+		return nil
+	}
+	n.lock.Lock()
+	n.recv = nil
+	n.lock.Unlock()
+	defer os.Remove(f.Name())
+	defer f.Close()
+	return n.installSnapshot(args, f)
+}
+
+func (n *raftNode) installSnapshot(args *InstallSnapshotArgs, f *os.File) error {
+	n.applyLock.Lock()
+	defer n.applyLock.Unlock()
+	n.lock.Lock()
+	applied := n.lastApplied
+	n.lock.Unlock()
+	if args.LastIndex <= applied {
+		return nil
+	}
+	log.Info("Cluster node %s: installing a snapshot at %d from %s", n.id, args.LastIndex, args.Leader)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	installing := filepath.Join(n.opts.dir, "raft.installing")
+	if err := writeFileSync(installing, nil); err != nil {
+		return err
+	}
+	if err := n.vdb.Flush(); err != nil {
+		return err
+	}
+	if _, err := importDB(n.vdb, f, nil, 0, nil); err != nil {
+		return err
+	}
+	if s, ok := findSyncer(n.vdb); ok {
+		if err := s.Sync(); err != nil {
+			return err
+		}
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if args.LastIndex < n.lastIndex() && n.termAt(args.LastIndex) == args.LastTerm {
+		n.entries = append([]raftEntry{}, n.entries[args.LastIndex-n.snapIndex:]...)
+	} else {
+		n.entries = nil
+	}
+	n.snapIndex, n.snapTerm, n.snapMembers = args.LastIndex, args.LastTerm, args.Members
+	n.lastApplied = args.LastIndex
+	if n.commitIndex < args.LastIndex {
+		n.commitIndex = args.LastIndex
+	}
+	n.members = n.configAt(n.lastIndex())
+	if err := n.storage.saveApplied(args.LastIndex); err != nil {
+		return err
+	}
+	if err := n.storage.syncApplied(); err != nil {
+		return err
+	}
+	if err := n.storage.saveSnapshot(n.snapIndex, n.snapTerm, n.snapMembers); err != nil {
+		return err
+	}
+	if err := n.storage.rewriteLog(n.entries); err != nil {
+		return err
+	}
+	os.Remove(installing)
+	close(n.appliedCh)
+	n.appliedCh = make(chan struct{})
+	n.notifyCommit()
+	return nil
+}
+
+/*
+Forward runs a write forwarded by a follower
+*/
+func (r *raftRPC) Forward(args *ForwardArgs, reply *ForwardReply) error {
+	*reply = r.node.execute(*args)
+	return nil
+}
+
+/*
+ReadIndex answers a follower linearizable read
+*/
+func (r *raftRPC) ReadIndex(args *ReadIndexArgs, reply *ReadIndexReply) error {
+	n := r.node
+	n.lock.Lock()
+	leading := n.state == raftLeader
+	n.lock.Unlock()
+	if !leading {
+		reply.Err = errNotLeader.Error()
+		return nil
+	}
+	index, err := n.readIndex()
+	if err != nil {
+		reply.Err = err.Error()
+	}
+	reply.Index = index
+	return nil
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func startTestRaftNode(t *testing.T, dir string, addr string, peers []string) *raftBackend {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr = listener.Addr().String()
+	if peers == nil {
+		peers = []string{addr}
+	}
+	name := filepath.Join(dir, addr)
+	vdb := loadDB("leveldb", name+".db", dbOptions{})
+	node, err := startRaftNode(raftOptions{
+		addr:            addr,
+		peers:           peers,
+		dir:             name + ".raft",
+		snapshotEntries: 50,
+		heartbeat:       20 * time.Millisecond,
+		electionTimeout: 200 * time.Millisecond,
+		token:           "s3cret",
+	}, vdb, listener)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &raftBackend{BackendDatabase: vdb, node: node}
+}
+
+func startTestCluster(t *testing.T, dir string, size int) []*raftBackend {
+	var listeners []net.Listener
+	var peers []string
+	for i := 0; i < size; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, l)
+		peers = append(peers, l.Addr().String())
+	}
+	for _, l := range listeners {
+		l.Close()
+	}
+	var nodes []*raftBackend
+	for _, addr := range peers {
+		nodes = append(nodes, startTestRaftNode(t, dir, addr, peers))
+	}
+	return nodes
+}
+
+func waitLeader(t *testing.T, nodes []*raftBackend) *raftBackend {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, rb := range nodes {
+			if rb == nil {
+				continue
+			}
+			rb.node.lock.Lock()
+			leading := rb.node.state == raftLeader && rb.node.termAt(rb.node.commitIndex) == rb.node.term
+			rb.node.lock.Unlock()
+			if leading {
+				return rb
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal(errUnexpected("no leader elected"))
+	return nil
+}
+
+func followers(nodes []*raftBackend, leader *raftBackend) []*raftBackend {
+	var ret []*raftBackend
+	for _, rb := range nodes {
+		if rb != nil && rb != leader {
+			ret = append(ret, rb)
+		}
+	}
+	return ret
+}
+
+func waitLocal(t *testing.T, rb *raftBackend, key string, value string) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if v, _ := rb.BackendDatabase.Get([]byte(key)); string(v) == value {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	v, _ := rb.BackendDatabase.Get([]byte(key))
+	t.Fatal(errUnexpected(fmt.Sprintf("%s on %s: %q, want %q", key, rb.node.id, v, value)))
+}
+
+func TestRaftStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beano-raftstorage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := openRaftStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.saveState(3, "127.0.0.1:7001"); err != nil {
+		t.Fatal(err)
+	}
+	entries := []raftEntry{
+		{Index: 1, Term: 1, Op: opNoop},
+		{Index: 2, Term: 1, Op: opSet, Key: []byte("key"), Value: []byte("value")},
+		{Index: 3, Term: 2, Op: opConfig, Value: []byte("a,b,c")},
+	}
+	if err := s.appendEntries(entries); err != nil {
+		t.Fatal(err)
+	}
+	// a torn entry at the end is cut on load
+	s.log.Write(appendRaftEntry(nil, raftEntry{Index: 4, Term: 2, Op: opSet, Key: []byte("torn")})[:8])
+	s.saveApplied(2)
+	s.Close()
+
+	if s, err = openRaftStorage(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if term, vote, err := s.loadState(); err != nil || term != 3 || vote != "127.0.0.1:7001" {
+		t.Error(errUnexpected(fmt.Sprintf("state %d %q %v", term, vote, err)))
+	}
+	got, err := s.loadLog(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Index != 2 || string(got[0].Value) != "value" || string(got[1].Value) != "a,b,c" {
+		t.Error(errUnexpected(fmt.Sprintf("log %+v", got)))
+	}
+	if applied, err := s.loadApplied(); err != nil || applied != 2 {
+		t.Error(errUnexpected(fmt.Sprintf("applied %d %v", applied, err)))
+	}
+	if _, _, _, ok, _ := s.loadSnapshot(); ok {
+		t.Error(errUnexpected("snapshot before any compaction"))
+	}
+	s.saveSnapshot(3, 2, []string{"a", "b"})
+	if index, term, members, ok, err := s.loadSnapshot(); err != nil || !ok || index != 3 || term != 2 || len(members) != 2 {
+		t.Error(errUnexpected(fmt.Sprintf("snapshot %d %d %v %v", index, term, members, err)))
+	}
+	if err := s.rewriteLog(got[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.loadLog(0); len(got) != 1 || got[0].Index != 3 {
+		t.Error(errUnexpected(fmt.Sprintf("rewritten log %+v", got)))
+	}
+
+	// an entry with a corrupt key size is cut too, without allocating it
+	corrupt := append([]byte{4, 2, opSet}, binary.AppendUvarint(nil, 1<<62)...)
+	s.log.Write(corrupt)
+	if got, err := s.loadLog(0); err != nil || len(got) != 1 || got[0].Index != 3 {
+		t.Error(errUnexpected(fmt.Sprintf("log %+v %v", got, err)))
+	}
+}
+
+func TestRaftPeerAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beano-raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(t, dir, "node")
+	config, err := newTLSConfig(certFile, keyFile, certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	rb, err := startCluster(clusterOptions{
+		addr:            addr,
+		dir:             filepath.Join(dir, "raft"),
+		snapshotEntries: 50,
+		token:           "s3cret",
+		tls:             config,
+	}, loadDB("leveldb", filepath.Join(dir, "db"), dbOptions{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rb.Close()
+	waitLeader(t, []*raftBackend{rb})
+	if err := rb.Set([]byte("key"), []byte("clapton")); err != nil {
+		t.Fatal(err)
+	}
+
+	forward := func(conn net.Conn, token string) error {
+		defer conn.Close()
+		conn.Write([]byte(token + "\n"))
+		client := rpc.NewClient(conn)
+		var reply ForwardReply
+		call := client.Go("Raft.Forward", &ForwardArgs{Op: opFlush}, &reply, make(chan *rpc.Call, 1))
+		select {
+		case <-call.Done:
+			return call.Error
+		case <-time.After(5 * time.Second):
+			return errRaftTimeout
+		}
+	}
+	// plain connections and bad tokens can't reach the rpc server
+	plain, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := forward(plain, "s3cret"); err == nil {
+		t.Error(errUnexpected("plain connection served"))
+	}
+	secure, err := tls.Dial("tcp", addr, clientTLSConfig(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := forward(secure, "guess"); err == nil {
+		t.Error(errUnexpected("bad token served"))
+	}
+	if v, _ := rb.Get([]byte("key")); string(v) != "clapton" {
+		t.Error(errUnexpected(fmt.Sprintf("flushed: %q", v)))
+	}
+	if secure, err = tls.Dial("tcp", addr, clientTLSConfig(config)); err != nil {
+		t.Fatal(err)
+	}
+	if err := forward(secure, "s3cret"); err != nil {
+		t.Error(errUnexpected(err))
+	}
+}
+
+func TestRaftCluster(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beano-raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	nodes := startTestCluster(t, dir, 3)
+	defer func() {
+		for _, rb := range nodes {
+			rb.Close()
+		}
+	}()
+	leader := waitLeader(t, nodes)
+	f := followers(nodes, leader)
+
+	// writes on a follower are forwarded, reads anywhere see them right away
+	if err := f[0].Set([]byte("key"), []byte("clapton")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := f[1].Get([]byte("key")); err != nil || string(v) != "clapton" {
+		t.Error(errUnexpected(fmt.Sprintf("get on a follower: %q %v", v, err)))
+	}
+	if err := f[1].Add([]byte("key"), []byte("hendrix")); err == nil {
+		t.Error(errUnexpected("add of an existing key"))
+	}
+	if err := f[1].Replace([]byte("missing"), []byte("hendrix")); err == nil {
+		t.Error(errUnexpected("replace of a missing key"))
+	}
+	if err := leader.Add([]byte("counter"), []byte("10")); err != nil {
+		t.Fatal(err)
+	}
+	if i, err := f[0].Incr([]byte("counter"), 5); err != nil || i != 15 {
+		t.Error(errUnexpected(fmt.Sprintf("incr %d %v", i, err)))
+	}
+	if i, err := f[1].Decr([]byte("counter"), 3); err != nil || i != 12 {
+		t.Error(errUnexpected(fmt.Sprintf("decr %d %v", i, err)))
+	}
+	if _, err := f[1].Incr([]byte("key"), 1); err == nil {
+		t.Error(errUnexpected("incr of a string"))
+	}
+	if deleted, err := f[0].Delete([]byte("missing"), true); err != nil || deleted {
+		t.Error(errUnexpected(fmt.Sprintf("delete of a missing key %t %v", deleted, err)))
+	}
+	if deleted, err := f[0].Delete([]byte("key"), true); err != nil || !deleted {
+		t.Error(errUnexpected(fmt.Sprintf("delete %t %v", deleted, err)))
+	}
+	if r, err := f[1].Range([]byte(""), -1, nil, false); err != nil || len(r) != 1 || string(r["counter"]) != "12" {
+		t.Error(errUnexpected(fmt.Sprintf("range %v %v", r, err)))
+	}
+	// every member applies the same writes
+	for _, rb := range nodes {
+		waitLocal(t, rb, "counter", "12")
+		waitLocal(t, rb, "key", "")
+	}
+
+	if err := f[0].Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for _, rb := range nodes {
+		waitLocal(t, rb, "counter", "")
+	}
+
+	// the cluster command
+	ms := NewMemcachedProtocolServer(false, nil)
+	ms.admin = true
+	ms.cluster = f[0]
+	addr, stop := startTestServer(t, ms, newCurrentDB(f[0], "leveldb"))
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "set key 0 0 7\r\nclapton\r\ncluster status\r\ncluster join x\r\nhincrby user:1 visits 1\r\n")
+	for _, want := range []string{"STORED", "cluster: " + f[0].node.id + " follower", "OK", "ERROR", "SERVER_ERROR hincrby is not available in cluster mode"} {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(line) < len(want) || line[:len(want)] != want {
+			t.Error(errUnexpected(fmt.Sprintf("%q, want %q", line, want)))
+		}
+	}
+	waitLocal(t, leader, "key", "clapton")
+}
+
+func TestRaftFailover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beano-raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	nodes := startTestCluster(t, dir, 3)
+	defer func() {
+		for _, rb := range nodes {
+			if rb != nil {
+				rb.Close()
+			}
+		}
+	}()
+	leader := waitLeader(t, nodes)
+	if err := leader.Set([]byte("before"), []byte("failover")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the leader goes down, the other two elect a new one
+	stopped := -1
+	for i, rb := range nodes {
+		if rb == leader {
+			stopped = i
+		}
+	}
+	addr := leader.node.id
+	leader.Close()
+	nodes[stopped] = nil
+	leader = waitLeader(t, nodes)
+	if v, err := leader.Get([]byte("before")); err != nil || string(v) != "failover" {
+		t.Error(errUnexpected(fmt.Sprintf("committed write lost: %q %v", v, err)))
+	}
+	// enough writes for the log to be compacted past what the stopped node has
+	for i := 0; i < 200; i++ {
+		if err := followers(nodes, leader)[0].Set([]byte(fmt.Sprintf("key%03d", i)), []byte("after")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	leader.node.lock.Lock()
+	compacted := leader.node.snapIndex
+	leader.node.lock.Unlock()
+	if compacted == 0 {
+		t.Error(errUnexpected("log not compacted"))
+	}
+
+	// restarted, it gets a snapshot then the log
+	snapshots := clusterSnapshots.Count()
+	peers := append([]string{}, leader.node.members...)
+	nodes[stopped] = startTestRaftNode(t, dir, addr, peers)
+	if err := leader.Set([]byte("last"), []byte("write")); err != nil {
+		t.Fatal(err)
+	}
+	waitLocal(t, nodes[stopped], "last", "write")
+	waitLocal(t, nodes[stopped], "key000", "after")
+	waitLocal(t, nodes[stopped], "before", "failover")
+	if clusterSnapshots.Count() == snapshots {
+		t.Error(errUnexpected("no snapshot sent to the restarted node"))
+	}
+}
+
+func TestRaftMembership(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beano-raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// a single node bootstraps the cluster
+	first := startTestRaftNode(t, dir, "127.0.0.1:0", nil)
+	nodes := []*raftBackend{first}
+	defer func() {
+		for _, rb := range nodes {
+			rb.Close()
+		}
+	}()
+	waitLeader(t, nodes)
+	if err := first.Set([]byte("key"), []byte("clapton")); err != nil {
+		t.Fatal(err)
+	}
+
+	// new nodes know the members but aren't one of them until added
+	for i := 0; i < 2; i++ {
+		rb := startTestRaftNode(t, dir, "127.0.0.1:0", []string{first.node.id})
+		nodes = append(nodes, rb)
+		if err := nodes[0].ChangeMembership("add", rb.node.id); err != nil {
+			t.Fatal(err)
+		}
+		waitLocal(t, rb, "key", "clapton")
+	}
+	if err := first.ChangeMembership("add", nodes[1].node.id); err == nil {
+		t.Error(errUnexpected("member added twice"))
+	}
+
+	// the leader removes itself and steps down
+	if err := first.ChangeMembership("remove", first.node.id); err != nil {
+		t.Fatal(err)
+	}
+	leader := waitLeader(t, nodes[1:])
+	if len(leader.node.members) != 2 {
+		t.Error(errUnexpected(fmt.Sprintf("members %v", leader.node.members)))
+	}
+	if err := nodes[1].Set([]byte("key"), []byte("hendrix")); err != nil {
+		t.Fatal(err)
+	}
+	waitLocal(t, nodes[2], "key", "hendrix")
+	first.node.lock.Lock()
+	state := first.node.state
+	first.node.lock.Unlock()
+	if state == raftLeader {
+		t.Error(errUnexpected("removed node still leads"))
+	}
+}
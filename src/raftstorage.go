@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+raftEntry is a raft log entry, fields are exported for net/rpc
+*/
+type raftEntry struct {
+	Index uint64
+	Term  uint64
+	Op    byte
+	Key   []byte
+	Value []byte
+}
+
+/*
+appendRaftEntry encodes e as
+<uvarint index> <uvarint term> <op> <uvarint key size> <key> <uvarint value size> <value> <crc32>
+*/
+func appendRaftEntry(b []byte, e raftEntry) []byte {
+	start := len(b)
+	b = binary.AppendUvarint(b, e.Index)
+	b = binary.AppendUvarint(b, e.Term)
+	b = append(b, e.Op)
+	b = binary.AppendUvarint(b, uint64(len(e.Key)))
+	b = append(b, e.Key...)
+	b = binary.AppendUvarint(b, uint64(len(e.Value)))
+	b = append(b, e.Value...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b[start:]))
+}
+
+/*
+readRaftEntry decodes an entry and returns its encoded size. io.EOF means r
+ended on an entry boundary. Key and value sizes are bounded like change log
+records, a corrupt size fails with errChangeRecordCorrupt
+*/
+func readRaftEntry(rr *recordReader) (raftEntry, int, error) {
+	var e raftEntry
+	if err := rr.begin(); err != nil {
+		return e, 0, err
+	}
+	var err error
+	if e.Index, err = rr.uvarint(); err != nil {
+		return e, 0, err
+	}
+	if e.Term, err = rr.uvarint(); err != nil {
+		return e, 0, err
+	}
+	if e.Op, err = rr.ReadByte(); err != nil {
+		return e, 0, err
+	}
+	if e.Key, err = rr.bytes(); err != nil {
+		return e, 0, err
+	}
+	if e.Value, err = rr.bytes(); err != nil {
+		return e, 0, err
+	}
+	return e, len(rr.raw) + 4, rr.checksum()
+}
+
+/*
+raftStorage keeps a node raft state in dir:
+
+	raft.state     current term and vote
+	raft.snapshot  index, term and members of the last compaction, the data is the backend itself
+	raft.log       entries after the snapshot index
+	raft.applied   last entry applied to the backend
+
+the state and log are fsynced before the node answers, as raft requires
+*/
+type raftStorage struct {
+	dir     string
+	log     *os.File
+	applied *os.File
+	buf     []byte
+}
+
+func openRaftStorage(dir string) (*raftStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := raftStorage{dir: dir}
+	var err error
+	if s.log, err = os.OpenFile(filepath.Join(dir, "raft.log"), os.O_CREATE|os.O_RDWR, 0644); err != nil {
+		return nil, err
+	}
+	if s.applied, err = os.OpenFile(filepath.Join(dir, "raft.applied"), os.O_CREATE|os.O_RDWR, 0644); err != nil {
+		s.log.Close()
+		return nil, err
+	}
+	return &s, nil
+}
+
+/*
+writeFileSync replaces name with data, durably
+*/
+func writeFileSync(name string, data []byte) error {
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+func (s *raftStorage) loadState() (uint64, string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(s.dir, "raft.state"))
+	if os.IsNotExist(err) {
+		return 0, "", nil
+	} else if err != nil {
+		return 0, "", err
+	}
+	var term uint64
+	var votedFor string
+	if n, _ := fmt.Sscanf(string(b), "%d %s", &term, &votedFor); n != 2 {
+		return 0, "", fmt.Errorf("bad raft.state %q", b)
+	}
+	if votedFor == "-" {
+		votedFor = ""
+	}
+	return term, votedFor, nil
+}
+
+func (s *raftStorage) saveState(term uint64, votedFor string) error {
+	if votedFor == "" {
+		votedFor = "-"
+	}
+	return writeFileSync(filepath.Join(s.dir, "raft.state"), []byte(fmt.Sprintf("%d %s\n", term, votedFor)))
+}
+
+/*
+loadSnapshot returns the last compaction point, ok is false if there was none
+*/
+func (s *raftStorage) loadSnapshot() (index uint64, term uint64, members []string, ok bool, err error) {
+	b, err := ioutil.ReadFile(filepath.Join(s.dir, "raft.snapshot"))
+	if os.IsNotExist(err) {
+		return 0, 0, nil, false, nil
+	} else if err != nil {
+		return 0, 0, nil, false, err
+	}
+	var list string
+	if n, _ := fmt.Sscanf(string(b), "%d %d %s", &index, &term, &list); n != 3 {
+		return 0, 0, nil, false, fmt.Errorf("bad raft.snapshot %q", b)
+	}
+	return index, term, splitMembers(list), true, nil
+}
+
+func (s *raftStorage) saveSnapshot(index uint64, term uint64, members []string) error {
+	return writeFileSync(filepath.Join(s.dir, "raft.snapshot"), []byte(fmt.Sprintf("%d %d %s\n", index, term, joinMembers(members))))
+}
+
+/*
+loadLog reads the entries after index after, cutting a torn entry at the end
+*/
+func (s *raftStorage) loadLog(after uint64) ([]raftEntry, error) {
+	if _, err := s.log.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var entries []raftEntry
+	var size int64
+	rr := recordReader{r: bufio.NewReader(s.log)}
+	for {
+		e, n, err := readRaftEntry(&rr)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Error("Raft log %s: cutting a torn entry after %d bytes", s.dir, size)
+			break
+		}
+		size += int64(n)
+		if e.Index > after {
+			entries = append(entries, e)
+		}
+	}
+	if err := s.log.Truncate(size); err != nil {
+		return nil, err
+	}
+	_, err := s.log.Seek(size, io.SeekStart)
+	return entries, err
+}
+
+func (s *raftStorage) appendEntries(entries []raftEntry) error {
+	s.buf = s.buf[:0]
+	for _, e := range entries {
+		s.buf = appendRaftEntry(s.buf, e)
+	}
+	if _, err := s.log.Write(s.buf); err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
+
+/*
+rewriteLog replaces the log with entries, after a conflict or a compaction
+*/
+func (s *raftStorage) rewriteLog(entries []raftEntry) error {
+	s.buf = s.buf[:0]
+	for _, e := range entries {
+		s.buf = appendRaftEntry(s.buf, e)
+	}
+	name := filepath.Join(s.dir, "raft.log")
+	if err := writeFileSync(name, s.buf); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return err
+	}
+	s.log.Close()
+	s.log = f
+	return nil
+}
+
+func (s *raftStorage) loadApplied() (uint64, error) {
+	b := make([]byte, 20)
+	n, err := s.applied.ReadAt(b, 0)
+	if n == 0 && err == io.EOF {
+		return 0, nil
+	} else if n < len(b) {
+		return 0, fmt.Errorf("bad raft.applied: %v", err)
+	}
+	return strconv.ParseUint(string(b), 10, 64)
+}
+
+/*
+saveApplied records the last applied index in place. It's only synced
+before a compaction: after a crash entries are applied again, which ends
+in the same state as increments are logged as sets of their result
+*/
+func (s *raftStorage) saveApplied(index uint64) error {
+	_, err := s.applied.WriteAt([]byte(fmt.Sprintf("%020d\n", index)), 0)
+	return err
+}
+
+func (s *raftStorage) syncApplied() error {
+	return s.applied.Sync()
+}
+
+func (s *raftStorage) Close() {
+	s.log.Close()
+	s.applied.Close()
+}
+
+func splitMembers(list string) []string {
+	if list == "" || list == "-" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
+
+func joinMembers(members []string) string {
+	if len(members) == 0 {
+		return "-"
+	}
+	return strings.Join(members, ",")
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// replicationHeartbeat is how often an idle primary pings its replicas
+const replicationHeartbeat = time.Second
+
+// replicationTimeout is how long a replica waits for the primary before reconnecting
+const replicationTimeout = 5 * replicationHeartbeat
+
+const replicationMaxBackoff = 30 * time.Second
+
+/*
+serveReplica streams the change log from sequence from to a replica which sent
+replicate <from>. The reply is LOG <from> followed by the records, or, when the
+log doesn't go back to from, SNAPSHOT <seq> followed by an export stream of the
+database and the records after seq. The snapshot isn't point in time, replaying
+the records written while it was taken makes it consistent
+*/
+func serveReplica(c *memcachedConn, vdb BackendDatabase, cl *changeLog, from uint64) {
+	c.conn.SetReadDeadline(time.Time{})
+	lr, err := cl.NewReader(from)
+	if err == errChangeLogTruncated {
+		seq := cl.Last()
+		// open the reader first so the records after the snapshot can't be dropped while it's taken
+		if lr, err = cl.NewReader(seq + 1); err != nil {
+			log.Error("REPLICATE: %s", err)
+			c.writeLine("SERVER_ERROR " + err.Error())
+			return
+		}
+		defer lr.Close()
+		log.Info("Replica %s asked for %d, sending a snapshot at %d", c.conn.RemoteAddr(), from, seq)
+		replicationSnapshots.Inc(1)
+		c.writeLine(fmt.Sprintf("SNAPSHOT %d", seq))
+		if n, _, err := exportDB(vdb, c.buf.Writer, nil, nil); err != nil {
+			log.Error("REPLICATE: snapshot to %s failed after %d items: %s", c.conn.RemoteAddr(), n, err)
+			return
+		}
+	} else if err != nil {
+		log.Error("REPLICATE: %s", err)
+		c.writeLine("SERVER_ERROR " + err.Error())
+		return
+	} else {
+		defer lr.Close()
+		c.writeLine(fmt.Sprintf("LOG %d", from))
+	}
+	log.Info("Streaming changes from %d to replica %s", lr.next, c.conn.RemoteAddr())
+
+	var buf []byte
+	for {
+		rec, ok, err := lr.Next(replicationHeartbeat)
+		if err != nil {
+			// the replica reconnects and gets a snapshot if the log moved on
+			log.Error("REPLICATE: %s at %d, closing %s", err, lr.next, c.conn.RemoteAddr())
+			return
+		}
+		if !ok {
+			rec = changeRecord{op: opPing, seq: cl.Last()}
+		}
+		if _, err := c.buf.Write(appendChangeRecord(buf[:0], rec)); err != nil {
+			return
+		}
+		if !ok || lr.next > cl.Last() {
+			c.conn.SetWriteDeadline(time.Now().Add(replicationTimeout))
+			if err := c.buf.Flush(); err != nil {
+				log.Info("Replica %s gone: %s", c.conn.RemoteAddr(), err)
+				return
+			}
+		}
+	}
+}
+
+/*
+replica follows a primary, applying its changes to the local database. The
+last applied sequence is kept in <db>.replica so a restarted replica resumes
+where it stopped. Replaying changes already applied is harmless
+*/
+type replica struct {
+	primary string
+	auth    string
+	tls     *tls.Config
+	vdb     BackendDatabase
+	state   importProgress
+	applied uint64
+	lock    sync.Mutex
+	conn    net.Conn
+	closed  bool
+}
+
+func newReplica(primary string, auth string, tlsConfig *tls.Config, vdb BackendDatabase, filename string) (*replica, error) {
+	r := replica{
+		primary: primary,
+		auth:    auth,
+		tls:     tlsConfig,
+		vdb:     vdb,
+		state:   importProgress{filename: filename + ".replica", every: 1000},
+	}
+	applied, err := r.state.load()
+	if err != nil {
+		return nil, err
+	}
+	r.applied = applied
+	return &r, nil
+}
+
+/*
+Applied returns the sequence of the last change applied
+*/
+func (r *replica) Applied() uint64 {
+	return atomic.LoadUint64(&r.applied)
+}
+
+/*
+run follows the primary until Close, reconnecting with a backoff
+*/
+func (r *replica) run() {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := r.follow()
+		r.state.write(r.Applied())
+		if r.isClosed() {
+			return
+		}
+		log.Error("Replication from %s stopped at %d: %s", r.primary, r.Applied(), err)
+		if time.Since(start) > replicationMaxBackoff {
+			backoff = time.Second
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > replicationMaxBackoff {
+			backoff = replicationMaxBackoff
+		}
+	}
+}
+
+/*
+Close stops following the primary
+*/
+func (r *replica) Close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.closed = true
+	if r.conn != nil {
+		r.conn.Close()
+	}
+}
+
+func (r *replica) isClosed() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.closed
+}
+
+/*
+follow applies the primary changes until the connection breaks
+*/
+func (r *replica) follow() error {
+	dialer := &net.Dialer{Timeout: replicationTimeout}
+	var conn net.Conn
+	var err error
+	if r.tls != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", r.primary, r.tls)
+	} else {
+		conn, err = dialer.Dial("tcp", r.primary)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	r.lock.Lock()
+	r.conn = conn
+	closed := r.closed
+	r.lock.Unlock()
+	if closed {
+		return errors.New("replica closed")
+	}
+	// export and change records are read from this same buffer, newExportReader
+	// reuses a bufio.Reader this size instead of wrapping it
+	br := bufio.NewReaderSize(conn, 64*1024)
+	readLine := func() (string, error) {
+		conn.SetReadDeadline(time.Now().Add(replicationTimeout))
+		line, err := br.ReadString('\n')
+		return strings.TrimSpace(line), err
+	}
+	if r.auth != "" {
+		fmt.Fprintf(conn, "auth %s\r\n", r.auth)
+		if line, err := readLine(); err != nil {
+			return err
+		} else if line != "OK" {
+			return fmt.Errorf("authentication: %s", line)
+		}
+	}
+	fmt.Fprintf(conn, "replicate %d\r\n", r.applied+1)
+	line, err := readLine()
+	if err != nil {
+		return err
+	}
+	var seq uint64
+	if n, _ := fmt.Sscanf(line, "SNAPSHOT %d", &seq); n == 1 {
+		if err := r.loadSnapshot(br, conn, seq); err != nil {
+			return err
+		}
+	} else if n, _ := fmt.Sscanf(line, "LOG %d", &seq); n != 1 || seq != r.applied+1 {
+		return fmt.Errorf("unexpected reply %q", line)
+	}
+	log.Info("Replicating from %s at %d", r.primary, r.applied+1)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(replicationTimeout))
+		rec, err := readChangeRecord(br)
+		if err == io.EOF {
+			return errors.New("connection closed")
+		} else if err != nil {
+			return err
+		}
+		if rec.op == opPing {
+			if rec.seq >= r.applied {
+				replicationLag.Update(int64(rec.seq - r.applied))
+			}
+			r.state.write(r.applied)
+			continue
+		}
+		if rec.seq != r.applied+1 {
+			return fmt.Errorf("got change %d after %d", rec.seq, r.applied)
+		}
+		if err := r.apply(rec); err != nil {
+			return fmt.Errorf("applying change %d: %s", rec.seq, err)
+		}
+		atomic.StoreUint64(&r.applied, rec.seq)
+		replicationApplied.Inc(1)
+		if err := r.state.save(rec.seq); err != nil {
+			return err
+		}
+	}
+}
+
+/*
+loadSnapshot replaces the local data with the snapshot at seq
+*/
+func (r *replica) loadSnapshot(br *bufio.Reader, conn net.Conn, seq uint64) error {
+	log.Info("Loading a snapshot at %d from %s", seq, r.primary)
+	// the snapshot can't be told from a partial one until its end, don't resume from here after a crash
+	atomic.StoreUint64(&r.applied, 0)
+	if err := r.state.write(0); err != nil {
+		return err
+	}
+	if err := r.vdb.Flush(); err != nil {
+		return err
+	}
+	n, err := importDB(r.vdb, br, nil, 0, func(uint64) error {
+		return conn.SetReadDeadline(time.Now().Add(replicationTimeout))
+	})
+	if err != nil {
+		return fmt.Errorf("snapshot: %s", err)
+	}
+	replicationSnapshots.Inc(1)
+	atomic.StoreUint64(&r.applied, seq)
+	log.Info("Snapshot at %d loaded, %d items", seq, n)
+	return r.state.write(seq)
+}
+
+func (r *replica) apply(rec changeRecord) error {
+	switch rec.op {
+	case opSet:
+		return r.vdb.Set(rec.key, rec.value)
+	case opDelete:
+		_, err := r.vdb.Delete(rec.key, false)
+		return err
+	case opFlush:
+		return r.vdb.Flush()
+	}
+	return errChangeRecordCorrupt
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func waitApplied(t *testing.T, r *replica, cl *changeLog) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if r.Applied() >= cl.Last() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal(errUnexpected(fmt.Sprintf("replica at %d, primary at %d", r.Applied(), cl.Last())))
+}
+
+func TestReplication(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beano-replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	primary := newCurrentDB(loadDB("leveldb", filepath.Join(dir, "primary.db"), dbOptions{}), "leveldb")
+	defer primary.Close()
+	// small segments, only two kept: the first changes are gone before the replica connects
+	primary.changes, err = openChangeLog(filepath.Join(dir, "changes"), 512, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.changes.Close()
+	for i := 0; i < 100; i++ {
+		primary.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("clapton"))
+	}
+
+	ms := NewMemcachedProtocolServer(false, nil)
+	ms.admin = true
+	ms.changes = primary.changes
+	addr, stop := startTestServer(t, ms, primary)
+	defer stop()
+
+	replicaFile := filepath.Join(dir, "replica.db")
+	replicaDB := loadDB("leveldb", replicaFile, dbOptions{})
+	defer replicaDB.Close()
+	r, err := newReplica(addr, "", nil, replicaDB, replicaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replicaDB.Set([]byte("stale"), []byte("dropped by the snapshot"))
+
+	// first sync is a snapshot, then changes are streamed
+	done := make(chan error)
+	go func() { done <- r.follow() }()
+	primary.Delete([]byte("key000"), false)
+	primary.Set([]byte("key001"), []byte("eric"))
+	waitApplied(t, r, primary.changes)
+	if v, _ := replicaDB.Get([]byte("key000")); v != nil {
+		t.Error(errUnexpected(v))
+	}
+	if v, _ := replicaDB.Get([]byte("key001")); string(v) != "eric" {
+		t.Error(errUnexpected(v))
+	}
+	if v, _ := replicaDB.Get([]byte("key099")); string(v) != "clapton" {
+		t.Error(errUnexpected(v))
+	}
+	if v, _ := replicaDB.Get([]byte("stale")); v != nil {
+		t.Error(errUnexpected(v))
+	}
+	if replicationSnapshots.Count() == 0 {
+		t.Error(errUnexpected("no snapshot"))
+	}
+
+	// a restarted replica resumes from its last applied change, here from a TLS listener
+	r.Close()
+	if err := <-done; err == nil {
+		t.Error(errUnexpected("follow returned without error"))
+	}
+	r.state.write(r.Applied())
+	primary.Set([]byte("key002"), []byte("cream"))
+	certFile, keyFile := writeTestCert(t, dir, "primary")
+	config, err := newTLSConfig(certFile, keyFile, certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go ms.Parse(conn, primary)
+		}
+	}()
+	r, err = newReplica(listener.Addr().String(), "", clientTLSConfig(config), replicaDB, replicaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshots := replicationSnapshots.Count()
+	go r.follow()
+	defer r.Close()
+	waitApplied(t, r, primary.changes)
+	if v, _ := replicaDB.Get([]byte("key002")); string(v) != "cream" {
+		t.Error(errUnexpected(v))
+	}
+	if replicationSnapshots.Count() != snapshots {
+		t.Error(errUnexpected("resumed with a snapshot"))
+	}
+}
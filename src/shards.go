@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+shardRule sends keys starting with prefix to a fixed shard
+*/
+type shardRule struct {
+	prefix string
+	shard  int
+}
+
+/*
+loadShardRules reads a prefix rules file. One rule per line:
+
+	<prefix> <shard number>
+
+the longest matching prefix wins, keys matching no rule are hashed.
+Empty lines and lines starting with # are ignored
+*/
+func loadShardRules(filename string, shards int) ([]shardRule, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []shardRule
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected prefix and shard", filename, n)
+		}
+		shard, err := strconv.Atoi(fields[1])
+		if err != nil || shard < 0 || shard >= shards {
+			return nil, fmt.Errorf("%s:%d: shard must be between 0 and %d", filename, n, shards-1)
+		}
+		rules = append(rules, shardRule{prefix: fields[0], shard: shard})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	// longest prefixes first so the first match wins
+	sort.SliceStable(rules, func(i, j int) bool { return len(rules[i].prefix) > len(rules[j].prefix) })
+	return rules, nil
+}
+
+/*
+shardPath is the database path of shard i
+*/
+func shardPath(filename string, i int) string {
+	return fmt.Sprintf("%s.shard%d", filename, i)
+}
+
+/*
+rulesDigest identifies a set of prefix rules, whatever their order in the rules file
+*/
+func rulesDigest(rules []shardRule) string {
+	lines := make([]string, len(rules))
+	for i, r := range rules {
+		lines[i] = fmt.Sprintf("%s %d", r.prefix, r.shard)
+	}
+	sort.Strings(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+openShards opens opts.shards backends next to filename. The shard count and
+a digest of the prefix rules are recorded in <filename>.shards, opening with
+a different count or other rules fails, as keys would be routed to the wrong
+shards. A manifest without rules, from before they were recorded, gets the
+current ones
+*/
+func openShards(backend string, filename string, opts dbOptions) (BackendDatabase, error) {
+	manifest := filename + ".shards"
+	digest := rulesDigest(opts.shardRules)
+	record := fmt.Sprintf("%d\nrules %s\n", opts.shards, digest)
+	if b, err := ioutil.ReadFile(manifest); err == nil {
+		lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+		if n, _ := strconv.Atoi(strings.TrimSpace(lines[0])); n != opts.shards {
+			return nil, fmt.Errorf("%s was created with %d shards, not %d", filename, n, opts.shards)
+		}
+		if len(lines) < 2 {
+			if err := ioutil.WriteFile(manifest, []byte(record), 0644); err != nil {
+				return nil, err
+			}
+		} else if strings.TrimSpace(lines[1]) != "rules "+digest {
+			return nil, fmt.Errorf("%s was created with other shard rules", filename)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	} else if err := ioutil.WriteFile(manifest, []byte(record), 0644); err != nil {
+		return nil, err
+	}
+
+	shards := make([]BackendDatabase, opts.shards)
+	for i := range shards {
+		vdb, err := openBackend(backend, shardPath(filename, i), opts)
+		if err != nil {
+			for _, opened := range shards[:i] {
+				opened.Close()
+			}
+			return nil, err
+		}
+		shards[i] = vdb
+	}
+	return NewShardedBackend(filename, shards, opts.shardRules), nil
+}
+
+/*
+shardedBackend spreads keys over independent backends, each with its own
+files, so writes and compactions run in parallel. Keys are routed by prefix
+rules, falling back to a hash of the key. Changing the number of shards or
+the rules of an existing database moves keys to other shards: export and
+import the data instead
+*/
+type shardedBackend struct {
+	filename string
+	shards   []BackendDatabase
+	rules    []shardRule
+}
+
+/*
+NewShardedBackend routes keys over shards, filename is the base path the shards were opened from
+*/
+func NewShardedBackend(filename string, shards []BackendDatabase, rules []shardRule) *shardedBackend {
+	return &shardedBackend{filename: filename, shards: shards, rules: rules}
+}
+
+func (sb *shardedBackend) shard(key []byte) BackendDatabase {
+	for _, r := range sb.rules {
+		if len(key) >= len(r.prefix) && string(key[:len(r.prefix)]) == r.prefix {
+			return sb.shards[r.shard]
+		}
+	}
+	return sb.shards[fnv32a(key)%uint32(len(sb.shards))]
+}
+
+/*
+each runs fn on all shards in parallel and returns the first error
+*/
+func (sb *shardedBackend) each(fn func(i int, vdb BackendDatabase) error) error {
+	errs := make([]error, len(sb.shards))
+	var wg sync.WaitGroup
+	for i, vdb := range sb.shards {
+		wg.Add(1)
+		go func(i int, vdb BackendDatabase) {
+			defer wg.Done()
+			errs[i] = fn(i, vdb)
+		}(i, vdb)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Set the value for key
+*/
+func (sb *shardedBackend) Set(key []byte, value []byte) error {
+	return sb.shard(key).Set(key, value)
+}
+
+/*
+Add value to key, store data only if the server doesnt holds it yet
+*/
+func (sb *shardedBackend) Add(key []byte, value []byte) error {
+	return sb.shard(key).Add(key, value)
+}
+
+/*
+Replace value for key, store data only if the server already holds this key
+*/
+func (sb *shardedBackend) Replace(key []byte, value []byte) error {
+	return sb.shard(key).Replace(key, value)
+}
+
+/*
+Incr data, yields error if the represented value doesnt maps to int
+*/
+func (sb *shardedBackend) Incr(key []byte, value uint) (int, error) {
+	return sb.shard(key).Incr(key, value)
+}
+
+/*
+Decr data, yields error if the represented value doesnt maps to int
+*/
+func (sb *shardedBackend) Decr(key []byte, value uint) (int, error) {
+	return sb.shard(key).Decr(key, value)
+}
+
+/*
+Increment runs on the shard owning key
+*/
+func (sb *shardedBackend) Increment(key []byte, value int, createIfNotExists bool) (int, error) {
+	return sb.shard(key).Increment(key, value, createIfNotExists)
+}
+
+/*
+Put on the shard owning key
+*/
+func (sb *shardedBackend) Put(key []byte, value []byte, replace bool, passthru bool) error {
+	return sb.shard(key).Put(key, value, replace, passthru)
+}
+
+/*
+Get from the shard owning key
+*/
+func (sb *shardedBackend) Get(key []byte) ([]byte, error) {
+	return sb.shard(key).Get(key)
+}
+
+/*
+Range queries all shards in parallel and keeps the first limit keys in key
+order (reverse order when reverse is set)
+*/
+func (sb *shardedBackend) Range(key []byte, limit int, from []byte, reverse bool) (map[string][]byte, error) {
+	results := make([]map[string][]byte, len(sb.shards))
+	err := sb.each(func(i int, vdb BackendDatabase) error {
+		var err error
+		results[i], err = vdb.Range(key, limit, from, reverse)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string][]byte)
+	for _, r := range results {
+		for k, v := range r {
+			ret[k] = v
+		}
+	}
+	if limit >= 0 && len(ret) > limit {
+		for _, k := range sortedKeys(ret, reverse)[limit:] {
+			delete(ret, k)
+		}
+	}
+	return ret, nil
+}
+
+/*
+Delete key from the shard owning it
+*/
+func (sb *shardedBackend) Delete(key []byte, onlyIfExists bool) (bool, error) {
+	return sb.shard(key).Delete(key, onlyIfExists)
+}
+
+/*
+ScanKeys walks the keys of every shard, one shard after the other
+*/
+func (sb *shardedBackend) ScanKeys(fn func(key []byte) error) error {
+	for i, vdb := range sb.shards {
+		scanner, ok := vdb.(KeyScanner)
+		if !ok {
+			return fmt.Errorf("shard %d can't scan its keys", i)
+		}
+		if err := scanner.ScanKeys(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Sync fsyncs all shards that support it
+*/
+func (sb *shardedBackend) Sync() error {
+	return sb.each(func(i int, vdb BackendDatabase) error {
+		if s, ok := findSyncer(vdb); ok {
+			return s.Sync()
+		}
+		return nil
+	})
+}
+
+/*
+Close all shards
+*/
+func (sb *shardedBackend) Close() {
+	sb.each(func(i int, vdb BackendDatabase) error {
+		vdb.Close()
+		return nil
+	})
+}
+
+/*
+Stats lists the stats of each shard
+*/
+func (sb *shardedBackend) Stats() string {
+	stats := []string{fmt.Sprintf("shards: %d, prefix rules: %d", len(sb.shards), len(sb.rules))}
+	for i, vdb := range sb.shards {
+		stats = append(stats, fmt.Sprintf("shard %d (%s):\n%s", i, vdb.GetDbPath(), vdb.Stats()))
+	}
+	return strings.Join(stats, "\n")
+}
+
+/*
+GetDbPath returns the base path of the shards
+*/
+func (sb *shardedBackend) GetDbPath() string {
+	return sb.filename
+}
+
+/*
+Flush all shards
+*/
+func (sb *shardedBackend) Flush() error {
+	return sb.each(func(i int, vdb BackendDatabase) error {
+		return vdb.Flush()
+	})
+}
+
+/*
+BucketStats of all shards
+*/
+func (sb *shardedBackend) BucketStats() error {
+	for _, vdb := range sb.shards {
+		if err := vdb.BucketStats(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+sortedKeys returns the keys of a Range result in key order
+*/
+func sortedKeys(m map[string][]byte, reverse bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	if reverse {
+		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	} else {
+		sort.Strings(keys)
+	}
+	return keys
+}
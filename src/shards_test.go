@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestShardedBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beano-shards")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "sharded.db")
+	rules := []shardRule{{prefix: "user:", shard: 2}}
+	vdb, err := openShards("leveldb", filename, dbOptions{shards: 3, shardRules: rules})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb := vdb.(*shardedBackend)
+
+	for i := 0; i < 30; i++ {
+		sb.Set([]byte(fmt.Sprintf("key%02d", i)), []byte("clapton"))
+		sb.Set([]byte(fmt.Sprintf("user:%02d", i)), []byte("eric"))
+	}
+	for i, shard := range sb.shards {
+		v, _ := shard.Range([]byte("key"), -1, nil, false)
+		if len(v) == 0 || len(v) == 30 {
+			t.Error(errUnexpected(fmt.Sprintf("shard %d holds %d keys", i, len(v))))
+		}
+	}
+	if v, _ := sb.shards[2].Range([]byte("user:"), -1, nil, false); len(v) != 30 {
+		t.Error(errUnexpected(len(v)))
+	}
+	if v, _ := sb.Get([]byte("key07")); string(v) != "clapton" {
+		t.Error(errUnexpected(v))
+	}
+
+	v, err := sb.Range([]byte("key"), 3, []byte("key10"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := strings.Join(sortedKeys(v, false), " "); keys != "key10 key11 key12" {
+		t.Error(errUnexpected(keys))
+	}
+	v, _ = sb.Range([]byte("key"), 2, nil, true)
+	if keys := strings.Join(sortedKeys(v, true), " "); keys != "key29 key28" {
+		t.Error(errUnexpected(keys))
+	}
+	if stats := sb.Stats(); !strings.HasPrefix(stats, "shards: 3, prefix rules: 1") {
+		t.Error(errUnexpected(stats))
+	}
+	sb.Close()
+
+	if _, err := openShards("leveldb", filename, dbOptions{shards: 4}); err == nil {
+		t.Error(errUnexpected("opened with a different shard count"))
+	}
+	if _, err := openShards("leveldb", filename, dbOptions{shards: 3}); err == nil {
+		t.Error(errUnexpected("opened without the shard rules"))
+	}
+	if _, err := openShards("leveldb", filename, dbOptions{shards: 3, shardRules: []shardRule{{prefix: "user:", shard: 1}}}); err == nil {
+		t.Error(errUnexpected("opened with other shard rules"))
+	}
+	vdb, err = openShards("leveldb", filename, dbOptions{shards: 3, shardRules: rules})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vdb.Close()
+}
+
+func TestLoadShardRules(t *testing.T) {
+	f, err := ioutil.TempFile("", "beano-shardrules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# sessions on their own shard\nsession: 1\nsession:long: 0\n")
+	f.Close()
+
+	rules, err := loadShardRules(f.Name(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb := NewShardedBackend("", []BackendDatabase{vleveldb, vboltdb}, rules)
+	if sb.shard([]byte("session:long:1")) != vleveldb || sb.shard([]byte("session:1")) != vboltdb {
+		t.Error(errUnexpected(rules))
+	}
+	if _, err := loadShardRules(f.Name(), 1); err == nil {
+		t.Error(errUnexpected("shard out of range"))
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const certReloadInterval = 10 * time.Second
+const tlsHandshakeTimeout = 10 * time.Second
+
+/*
+certReloader keeps the server certificate in memory and reloads it from disk
+whenever the certificate or key files change
+*/
+type certReloader struct {
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modTime  time.Time
+	certLock *sync.RWMutex
+}
+
+/*
+newCertReloader loads the key pair and returns a reloader ready to be plugged into tls.Config
+*/
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	cr := certReloader{certFile: certFile, keyFile: keyFile, certLock: &sync.RWMutex{}}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return &cr, nil
+}
+
+func (cr *certReloader) lastModified() (time.Time, error) {
+	var last time.Time
+	for _, f := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return last, err
+		}
+		if fi.ModTime().After(last) {
+			last = fi.ModTime()
+		}
+	}
+	return last, nil
+}
+
+/*
+reload reads the key pair from disk. The current certificate is kept if the new one is invalid
+*/
+func (cr *certReloader) reload() error {
+	modTime, err := cr.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.certLock.Lock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	cr.certLock.Unlock()
+	return nil
+}
+
+/*
+changed reports if the files on disk are newer than the loaded certificate
+*/
+func (cr *certReloader) changed() bool {
+	modTime, err := cr.lastModified()
+	if err != nil {
+		return false
+	}
+	cr.certLock.RLock()
+	defer cr.certLock.RUnlock()
+	return modTime.After(cr.modTime)
+}
+
+/*
+watch polls the certificate files and reloads them when they change
+*/
+func (cr *certReloader) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if !cr.changed() {
+			continue
+		}
+		if err := cr.reload(); err != nil {
+			log.Error("TLS: error reloading %s: %s", cr.certFile, err)
+			continue
+		}
+		log.Info("TLS: certificate %s reloaded", cr.certFile)
+	}
+}
+
+/*
+GetCertificate implements tls.Config.GetCertificate
+*/
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.certLock.RLock()
+	defer cr.certLock.RUnlock()
+	return cr.cert, nil
+}
+
+/*
+newTLSConfig builds the server side TLS configuration shared by all listeners.
+If caFile is set clients must present a certificate signed by it (mutual TLS)
+*/
+func newTLSConfig(certFile string, keyFile string, caFile string) (*tls.Config, error) {
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	go cr.watch(certReloadInterval)
+
+	config := &tls.Config{
+		GetCertificate: cr.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+/*
+clientTLSConfig is used by beano dialing other beano nodes (raft peers, a
+replication primary): it presents the server certificate and verifies the
+peer against the -tlsca bundle, the system roots without it
+*/
+func clientTLSConfig(server *tls.Config) *tls.Config {
+	if server == nil {
+		return nil
+	}
+	return &tls.Config{
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return server.GetCertificate(nil)
+		},
+		RootCAs:    server.ClientCAs,
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+/*
+connIdentity completes the TLS handshake and returns the common name of the
+verified client certificate. Plaintext connections have no identity
+*/
+func connIdentity(conn net.Conn) (string, error) {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+	tc.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	defer tc.SetDeadline(time.Time{})
+	if err := tc.Handshake(); err != nil {
+		return "", err
+	}
+	return stateIdentity(tc.ConnectionState()), nil
+}
+
+/*
+requestIdentity returns the client certificate common name for an HTTP request
+*/
+func requestIdentity(req *http.Request) string {
+	if req.TLS == nil {
+		return ""
+	}
+	return stateIdentity(*req.TLS)
+}
+
+func stateIdentity(cs tls.ConnectionState) string {
+	if len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return cs.VerifiedChains[0][0].Subject.CommonName
+}
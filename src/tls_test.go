@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self signed certificate usable both as server, client and CA
+func writeTestCert(t *testing.T, dir string, cn string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, cn+".crt")
+	keyFile := filepath.Join(dir, cn+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func TestCertReload(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "beano_tls")
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCert(t, dir, "server")
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := cr.GetCertificate(nil)
+
+	newCert, newKey := writeTestCert(t, dir, "server2")
+	os.Rename(newCert, certFile)
+	os.Rename(newKey, keyFile)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+
+	if !cr.changed() {
+		t.Error(errUnexpected("certificate change not detected"))
+	}
+	if err := cr.reload(); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := cr.GetCertificate(nil)
+	if bytes.Equal(first.Certificate[0], second.Certificate[0]) {
+		t.Error(errUnexpected("certificate not reloaded"))
+	}
+}
+
+func TestConnIdentity(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "beano_tls")
+	defer os.RemoveAll(dir)
+
+	serverCert, serverKey := writeTestCert(t, dir, "server")
+	clientCert, clientKey := writeTestCert(t, dir, "clapton")
+	config, err := newTLSConfig(serverCert, serverKey, clientCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	identities := make(chan string)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			identities <- err.Error()
+			return
+		}
+		defer conn.Close()
+		id, err := connIdentity(conn)
+		if err != nil {
+			id = err.Error()
+		}
+		identities <- id
+	}()
+
+	pair, _ := tls.LoadX509KeyPair(clientCert, clientKey)
+	pem, _ := ioutil.ReadFile(serverCert)
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(pem)
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{Certificates: []tls.Certificate{pair}, RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if id := <-identities; id != "clapton" {
+		t.Error(errUnexpected(id))
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+/*
+upstreamOptions puts a memcached server behind the local backend, addr empty disables it
+*/
+type upstreamOptions struct {
+	addr     string
+	populate bool
+	mirror   bool
+	flush    bool
+	timeout  time.Duration
+}
+
+/*
+upstreamBackend falls back to an upstream memcached server on local misses,
+storing what it finds locally when populate is set, and mirrors successful
+local writes upstream when mirror is set, flush_all only when flush is set
+too. The local backend is the reference: an upstream failure is logged and
+counted, reads then miss and writes still succeed. The internal keys of
+queues, leases and hashes stay local
+*/
+type upstreamBackend struct {
+	BackendDatabase
+	node     *proxyNode
+	populate bool
+	mirror   bool
+	flush    bool
+}
+
+/*
+NewUpstreamBackend wraps vdb with the upstream server in opts
+*/
+func NewUpstreamBackend(vdb BackendDatabase, opts upstreamOptions) *upstreamBackend {
+	return &upstreamBackend{
+		BackendDatabase: vdb,
+		node:            newProxyNode(opts.addr, opts.timeout, upstreamErrors),
+		populate:        opts.populate,
+		mirror:          opts.mirror,
+		flush:           opts.flush,
+	}
+}
+
+/*
+Unwrap returns the local backend
+*/
+func (ub *upstreamBackend) Unwrap() BackendDatabase {
+	return ub.BackendDatabase
+}
+
+/*
+internalKey tells the keys beano builds with control characters as
+separators, upstream would refuse them and they only make sense here
+*/
+func internalKey(key []byte) bool {
+	return !validArgs([]string{string(key)})
+}
+
+/*
+fetch gets key upstream, nil if it's not there or upstream failed
+*/
+func (ub *upstreamBackend) fetch(key []byte) []byte {
+	values := make(map[string][]byte)
+	if err := ub.node.do(func(pc *proxyConn) error {
+		return pc.values(fmt.Sprintf("get %s", key), values)
+	}); err != nil {
+		log.Error("UPSTREAM: get %s: %s", key, err)
+		return nil
+	}
+	v, ok := values[string(key)]
+	if !ok {
+		upstreamMisses.Inc(1)
+		return nil
+	}
+	upstreamHits.Inc(1)
+	return v
+}
+
+/*
+send runs a command upstream expecting reply
+*/
+func (ub *upstreamBackend) send(line string, body []byte, reply ...string) {
+	if !ub.mirror {
+		return
+	}
+	var got string
+	err := ub.node.do(func(pc *proxyConn) (err error) {
+		got, err = pc.command(line, body)
+		return err
+	})
+	if err == nil {
+		for _, r := range reply {
+			if got == r {
+				upstreamMirrored.Inc(1)
+				return
+			}
+		}
+		upstreamErrors.Inc(1)
+		err = fmt.Errorf("unexpected reply %q", got)
+	}
+	log.Error("UPSTREAM: %s: %s", line, err)
+}
+
+func (ub *upstreamBackend) mirrorSet(key []byte, value []byte) {
+	if internalKey(key) {
+		return
+	}
+	ub.send(fmt.Sprintf("set %s 0 0 %d", key, len(value)), value, "STORED")
+}
+
+/*
+Get data for key, from upstream on a local miss
+*/
+func (ub *upstreamBackend) Get(key []byte) ([]byte, error) {
+	v, err := ub.BackendDatabase.Get(key)
+	if v != nil || err != nil || internalKey(key) {
+		return v, err
+	}
+	if v = ub.fetch(key); v != nil && ub.populate {
+		// a local write since the miss wins
+		if err := ub.BackendDatabase.Add(key, v); err == nil {
+			upstreamPopulated.Inc(1)
+		}
+	}
+	return v, nil
+}
+
+/*
+Set the value for key
+*/
+func (ub *upstreamBackend) Set(key []byte, value []byte) error {
+	return ub.Put(key, value, false, true)
+}
+
+/*
+Add value to key, store data only if the server doesnt holds it yet
+*/
+func (ub *upstreamBackend) Add(key []byte, value []byte) error {
+	return ub.Put(key, value, false, false)
+}
+
+/*
+Replace value for key, store data only if the server already holds this key
+*/
+func (ub *upstreamBackend) Replace(key []byte, value []byte) error {
+	return ub.Put(key, value, true, false)
+}
+
+/*
+Put stores locally then mirrors the value upstream as a set, upstream follows
+what the local backend decided
+*/
+func (ub *upstreamBackend) Put(key []byte, value []byte, replace bool, passthru bool) error {
+	if err := ub.BackendDatabase.Put(key, value, replace, passthru); err != nil {
+		return err
+	}
+	ub.mirrorSet(key, value)
+	return nil
+}
+
+/*
+Incr data, yields error if the represented value doesnt maps to int
+*/
+func (ub *upstreamBackend) Incr(key []byte, value uint) (int, error) {
+	return ub.Increment(key, int(value), false)
+}
+
+/*
+Decr data, yields error if the represented value doesnt maps to int
+*/
+func (ub *upstreamBackend) Decr(key []byte, value uint) (int, error) {
+	return ub.Increment(key, int(value)*-1, false)
+}
+
+/*
+Increment the local value, read through first so an upstream only counter
+keeps counting, and mirror the result
+*/
+func (ub *upstreamBackend) Increment(key []byte, value int, createIfNotExists bool) (int, error) {
+	if ub.populate {
+		ub.Get(key)
+	}
+	i, err := ub.BackendDatabase.Increment(key, value, createIfNotExists)
+	if err != nil {
+		return i, err
+	}
+	ub.mirrorSet(key, []byte(strconv.Itoa(i)))
+	return i, nil
+}
+
+/*
+Delete key locally and upstream
+*/
+func (ub *upstreamBackend) Delete(key []byte, onlyIfExists bool) (bool, error) {
+	deleted, err := ub.BackendDatabase.Delete(key, onlyIfExists)
+	if err != nil || internalKey(key) {
+		return deleted, err
+	}
+	ub.send(fmt.Sprintf("delete %s", key), nil, "DELETED", "NOT_FOUND")
+	return deleted, nil
+}
+
+/*
+Flush deletes all keys locally, and upstream when flush is set: the upstream
+fleet may hold more than this server ever mirrored
+*/
+func (ub *upstreamBackend) Flush() error {
+	if err := ub.BackendDatabase.Flush(); err != nil {
+		return err
+	}
+	if !ub.flush {
+		return nil
+	}
+	ub.send("flush_all", nil, "OK")
+	return nil
+}
+
+/*
+Stats returns the local backend statuses and the upstream settings
+*/
+func (ub *upstreamBackend) Stats() string {
+	return fmt.Sprintf("%s\nupstream: %s, timeout %s, populate %t, mirror %t, flush %t",
+		ub.BackendDatabase.Stats(), ub.node.addr, ub.node.timeout, ub.populate, ub.mirror, ub.flush)
+}
+
+/*
+Close the upstream connections and the local backend
+*/
+func (ub *upstreamBackend) Close() {
+	ub.node.Close()
+	ub.BackendDatabase.Close()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUpstream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beano-upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a beano stands in for the memcached fleet
+	remote := loadDB("leveldb", filepath.Join(dir, "remote.db"), dbOptions{})
+	defer remote.Close()
+	ms := NewMemcachedProtocolServer(false, nil)
+	ms.admin = true
+	addr, stop := startTestServer(t, ms, remote)
+	defer stop()
+	remote.Set([]byte("old"), []byte("from memcached"))
+	remote.Set([]byte("counter"), []byte("41"))
+
+	local := loadDB("leveldb", filepath.Join(dir, "local.db"), dbOptions{})
+	ub := NewUpstreamBackend(local, upstreamOptions{addr: addr, populate: true, mirror: true, timeout: time.Second})
+	defer ub.Close()
+
+	// read through, populating the local backend
+	if v, err := ub.Get([]byte("old")); err != nil || string(v) != "from memcached" {
+		t.Error(errUnexpected(fmt.Sprintf("read through %q %v", v, err)))
+	}
+	if v, _ := local.Get([]byte("old")); string(v) != "from memcached" {
+		t.Error(errUnexpected(fmt.Sprintf("not populated: %q", v)))
+	}
+	if v, err := ub.Get([]byte("missing")); err != nil || v != nil {
+		t.Error(errUnexpected(fmt.Sprintf("missing key %q %v", v, err)))
+	}
+
+	// writes are mirrored
+	if err := ub.Set([]byte("new"), []byte("from beano")); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := remote.Get([]byte("new")); string(v) != "from beano" {
+		t.Error(errUnexpected(fmt.Sprintf("set not mirrored: %q", v)))
+	}
+	if err := ub.Add([]byte("new"), []byte("again")); err == nil {
+		t.Error(errUnexpected("add of an existing key"))
+	}
+	if v, _ := remote.Get([]byte("new")); string(v) != "from beano" {
+		t.Error(errUnexpected(fmt.Sprintf("failed add mirrored: %q", v)))
+	}
+	if i, err := ub.Incr([]byte("counter"), 1); err != nil || i != 42 {
+		t.Error(errUnexpected(fmt.Sprintf("incr of an upstream counter %d %v", i, err)))
+	}
+	if v, _ := remote.Get([]byte("counter")); string(v) != "42" {
+		t.Error(errUnexpected(fmt.Sprintf("incr not mirrored: %q", v)))
+	}
+	if _, err := ub.Delete([]byte("old"), false); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := ub.Get([]byte("old")); v != nil {
+		t.Error(errUnexpected(fmt.Sprintf("deleted key read back: %q", v)))
+	}
+
+	// internal keys and flush_all stay local
+	remote.Set([]byte("user:1\x01name"), []byte("upstream"))
+	if v, _ := ub.Get([]byte("user:1\x01name")); v != nil {
+		t.Error(errUnexpected(fmt.Sprintf("internal key read upstream: %q", v)))
+	}
+	ub.Set([]byte("jobs\x00000001"), []byte("job"))
+	if v, _ := remote.Get([]byte("jobs\x00000001")); v != nil {
+		t.Error(errUnexpected(fmt.Sprintf("internal key mirrored: %q", v)))
+	}
+	if err := ub.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := remote.Get([]byte("new")); string(v) != "from beano" {
+		t.Error(errUnexpected(fmt.Sprintf("flush mirrored: %q", v)))
+	}
+
+	// upstream down: reads miss and writes succeed locally, after the timeout
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	hung := NewUpstreamBackend(local, upstreamOptions{addr: l.Addr().String(), mirror: true, timeout: 100 * time.Millisecond})
+	failures := upstreamErrors.Count()
+	start := time.Now()
+	if v, err := hung.Get([]byte("nowhere")); err != nil || v != nil {
+		t.Error(errUnexpected(fmt.Sprintf("get with upstream down %q %v", v, err)))
+	}
+	if err := hung.Set([]byte("local"), []byte("only")); err != nil {
+		t.Error(errUnexpected(err))
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Error(errUnexpected(fmt.Sprintf("timeouts not applied, took %s", d)))
+	}
+	if upstreamErrors.Count() != failures+2 {
+		t.Error(errUnexpected(fmt.Sprintf("%d upstream errors counted", upstreamErrors.Count()-failures)))
+	}
+	if v, _ := local.Get([]byte("local")); string(v) != "only" {
+		t.Error(errUnexpected(fmt.Sprintf("local write lost: %q", v)))
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// watchHeartbeat is how often a watch stream tells its position when it has no events to send
+const watchHeartbeat = 5 * time.Second
+
+/*
+watchChanges follows the change log with lr, calling emit for the changes to
+keys starting with prefix and for flushes, which affect them all. ping gets
+the last sequence read when nothing was sent for watchHeartbeat, a watcher
+resumes from there. flush is called once caught up. Returns on the first error
+*/
+func watchChanges(lr *changeLogReader, prefix []byte, emit func(rec changeRecord) error, ping func(seq uint64) error, flush func() error) error {
+	watchStreams.Inc(1)
+	defer watchStreams.Dec(1)
+	pending := false
+	lastWrite := time.Now()
+	for {
+		rec, ok, err := lr.Next(watchHeartbeat)
+		if err != nil {
+			return err
+		}
+		switch {
+		case ok && (rec.op == opFlush || bytes.HasPrefix(rec.key, prefix)):
+			watchEvents.Inc(1)
+			err = emit(rec)
+			pending, lastWrite = true, time.Now()
+		case !ok || time.Since(lastWrite) >= watchHeartbeat:
+			err = ping(lr.next - 1)
+			pending, lastWrite = true, time.Now()
+		}
+		if err != nil {
+			return err
+		}
+		if pending && lr.next > lr.cl.Last() {
+			if err := flush(); err != nil {
+				return err
+			}
+			pending = false
+		}
+	}
+}
+
+/*
+serveWatch streams events for prefix on a memcached connection, after a
+WATCHING <first sequence> line:
+
+	EVENT <seq> SET <key> <bytes>\r\n<value>
+	EVENT <seq> DELETE <key>
+	EVENT <seq> FLUSH
+	PING <last sequence read>
+
+A watcher reconnecting with the sequence after the last one it got misses nothing
+*/
+func serveWatch(c *memcachedConn, cl *changeLog, prefix string, from uint64) {
+	c.conn.SetReadDeadline(time.Time{})
+	if from == 0 {
+		from = cl.Last() + 1
+	}
+	lr, err := cl.NewReader(from)
+	if err == errChangeLogTruncated {
+		c.writeLine(fmt.Sprintf("SERVER_ERROR sequence %d is not in the change log, resync and watch from %d", from, cl.Last()+1))
+		return
+	} else if err != nil {
+		log.Error("WATCH: %s", err)
+		c.writeLine("SERVER_ERROR " + err.Error())
+		return
+	}
+	defer lr.Close()
+	c.writeLine(fmt.Sprintf("WATCHING %d", from))
+	c.buf.Flush()
+	err = watchChanges(lr, []byte(prefix), func(rec changeRecord) error {
+		switch rec.op {
+		case opSet:
+			c.writeLine(fmt.Sprintf("EVENT %d SET %s %d", rec.seq, rec.key, len(rec.value)))
+			c.buf.Write(rec.value)
+			c.writeLine("")
+		case opDelete:
+			c.writeLine(fmt.Sprintf("EVENT %d DELETE %s", rec.seq, rec.key))
+		case opFlush:
+			c.writeLine(fmt.Sprintf("EVENT %d FLUSH", rec.seq))
+		}
+		return nil
+	}, func(seq uint64) error {
+		c.writeLine(fmt.Sprintf("PING %d", seq))
+		return nil
+	}, func() error {
+		c.conn.SetWriteDeadline(time.Now().Add(watchHeartbeat))
+		return c.buf.Flush()
+	})
+	log.Info("Watch from %s closed: %s", c.conn.RemoteAddr(), err)
+}
+
+/*
+watchEvent is the data of a server-sent event, value is base64 in JSON
+*/
+type watchEvent struct {
+	Key   string `json:"key,omitempty"`
+	Value []byte `json:"value,omitempty"`
+}
+
+var watchEventNames = map[byte]string{opSet: "set", opDelete: "delete", opFlush: "flush"}
+
+/*
+watchHandler streams the changes to keys starting with prefix= as
+server-sent events, from the sequence from= or after the Last-Event-ID
+header of a reconnecting client
+*/
+func watchHandler(cl *changeLog, audit *auditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		prefix := req.FormValue("prefix")
+		if u, ok := req.Context().Value(aclContextKey{}).(*aclUser); ok && !u.Allowed(classRead, []string{prefix}) {
+			aclDenials.Inc(1)
+			http.Error(w, "403 Forbidden", 403)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "500 Streaming not supported", 500)
+			return
+		}
+		from := cl.Last() + 1
+		if id := req.Header.Get("Last-Event-ID"); id != "" {
+			last, err := strconv.ParseUint(id, 10, 64)
+			if err != nil {
+				http.Error(w, "400 bad Last-Event-ID", 400)
+				return
+			}
+			from = last + 1
+		} else if s := req.FormValue("from"); s != "" {
+			var err error
+			if from, err = strconv.ParseUint(s, 10, 64); err != nil {
+				http.Error(w, "400 bad from", 400)
+				return
+			}
+		}
+		audit.Record(req.RemoteAddr, requestUser(req), "http", "watch", prefix, strconv.FormatUint(from, 10))
+		lr, err := cl.NewReader(from)
+		if err == errChangeLogTruncated {
+			http.Error(w, fmt.Sprintf("410 sequence %d is not in the change log, resync and watch from %d", from, cl.Last()+1), 410)
+			return
+		} else if err != nil {
+			log.Error("WATCH: %s", err)
+			http.Error(w, "500 Internal error", 500)
+			return
+		}
+		defer lr.Close()
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(200)
+		flusher.Flush()
+		err = watchChanges(lr, []byte(prefix), func(rec changeRecord) error {
+			data, err := json.Marshal(watchEvent{Key: string(rec.key), Value: rec.value})
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", rec.seq, watchEventNames[rec.op], data)
+			return err
+		}, func(seq uint64) error {
+			if err := req.Context().Err(); err != nil {
+				return err
+			}
+			_, err := fmt.Fprintf(w, ": ping %d\n\n", seq)
+			return err
+		}, func() error {
+			flusher.Flush()
+			return req.Context().Err()
+		})
+		log.Info("Watch from %s closed: %s", req.RemoteAddr, err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beano-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db := newCurrentDB(loadDB("leveldb", filepath.Join(dir, "watch.db"), dbOptions{}), "leveldb")
+	defer db.Close()
+	if db.changes, err = openChangeLog(filepath.Join(dir, "changes"), 1024*1024, 2); err != nil {
+		t.Fatal(err)
+	}
+	defer db.changes.Close()
+
+	ms := NewMemcachedProtocolServer(false, nil)
+	ms.changes = db.changes
+	addr, stop := startTestServer(t, ms, db)
+	defer stop()
+	conn, r := dialTestServer(t, addr)
+	defer conn.Close()
+	fmt.Fprintf(conn, "watch app:\r\n")
+	if reply := readReplies(t, r, 1)[0]; reply != "WATCHING 1" {
+		t.Fatal(errUnexpected(reply))
+	}
+
+	db.Set([]byte("app:a"), []byte("clapton"))
+	db.Set([]byte("other:b"), []byte("hendrix"))
+	db.Delete([]byte("app:a"), false)
+	db.Flush()
+	want := []string{"EVENT 1 SET app:a 7", "clapton", "EVENT 3 DELETE app:a", "EVENT 4 FLUSH"}
+	for i, reply := range readReplies(t, r, len(want)) {
+		if reply != want[i] {
+			t.Error(errUnexpected(fmt.Sprintf("%q, want %q", reply, want[i])))
+		}
+	}
+
+	// a watcher resuming after the first event gets the rest
+	conn2, r2 := dialTestServer(t, addr)
+	defer conn2.Close()
+	fmt.Fprintf(conn2, "watch app: 2\r\n")
+	want = []string{"WATCHING 2", "EVENT 3 DELETE app:a", "EVENT 4 FLUSH"}
+	for i, reply := range readReplies(t, r2, len(want)) {
+		if reply != want[i] {
+			t.Error(errUnexpected(fmt.Sprintf("resumed %q, want %q", reply, want[i])))
+		}
+	}
+	conn3, r3 := dialTestServer(t, addr)
+	defer conn3.Close()
+	fmt.Fprintf(conn3, "watch app: 100\r\n")
+	if reply := readReplies(t, r3, 1)[0]; !strings.HasPrefix(reply, "SERVER_ERROR sequence 100 is not in the change log") {
+		t.Error(errUnexpected(reply))
+	}
+
+	// server-sent events, resumed with Last-Event-ID
+	srv := httptest.NewServer(watchHandler(db.changes, nil))
+	defer srv.Close()
+	req, _ := http.NewRequest("GET", srv.URL+"?prefix=app:", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Error(errUnexpected(ct))
+	}
+	db.Set([]byte("app:c"), []byte("king"))
+	br := bufio.NewReader(resp.Body)
+	want = []string{"id: 3", "event: delete", `data: {"key":"app:a"}`, "", "id: 4", "event: flush", "data: {}", "",
+		"id: 5", "event: set", `data: {"key":"app:c","value":"a2luZw=="}`, ""}
+	for _, w := range want {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line = strings.TrimRight(line, "\n"); line != w {
+			t.Error(errUnexpected(fmt.Sprintf("%q, want %q", line, w)))
+		}
+	}
+
+	resp, err = http.Get(srv.URL + "?prefix=app:&from=100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 410 {
+		t.Error(errUnexpected(resp.Status))
+	}
+}